@@ -0,0 +1,196 @@
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testRecord() *Record {
+	return &Record{
+		Time:          time.Date(2000, 10, 10, 13, 55, 36, 0, time.FixedZone("", -7*3600)),
+		Duration:      1500 * time.Microsecond,
+		ClientAddr:    "127.0.0.1:52012",
+		Username:      "frank",
+		Method:        "GET",
+		URL:           "http://a.com/a b?q=\"1\"",
+		Protocol:      "HTTP/1.1",
+		UserAgent:     "curl/7.58.0",
+		StatusCode:    200,
+		RequestBytes:  78,
+		ResponseBytes: 2326,
+		UpstreamAddr:  "1.1.1.1:80",
+		SuperProxy:    "2.2.2.2:3128",
+		SSLBump:       true,
+		Err:           errors.New("upstream \"closed\""),
+	}
+}
+
+func TestCommonLogEncoder(t *testing.T) {
+	line := string(CommonLogEncoder{}.Encode(nil, testRecord()))
+	expected := `127.0.0.1 - frank [10/Oct/2000:13:55:36 -0700] "GET http://a.com/a\x20b?q=\"1\" HTTP/1.1" 200 2326` + "\n"
+	if line != expected {
+		t.Fatalf("unexpected line %q, expected %q", line, expected)
+	}
+	line = string(CommonLogEncoder{}.Encode(nil, &Record{ClientAddr: "[::1]:1080", Method: "CONNECT"}))
+	if !strings.HasPrefix(line, "::1 - - [") || !strings.HasSuffix(line, `"CONNECT  " - -`+"\n") {
+		t.Fatalf("unexpected line %q", line)
+	}
+}
+
+func TestCombinedLogEncoder(t *testing.T) {
+	line := string(CombinedLogEncoder{}.Encode(nil, testRecord()))
+	if !strings.HasSuffix(line, `200 2326 "-" "curl/7.58.0"`+"\n") {
+		t.Fatalf("unexpected line %q", line)
+	}
+}
+
+func TestJSONEncoder(t *testing.T) {
+	r := testRecord()
+	r.UserAgent = "bad\xffagent\n"
+	line := JSONEncoder{}.Encode(nil, r)
+	if line[len(line)-1] != '\n' {
+		t.Fatalf("line should end with newline")
+	}
+	var v map[string]interface{}
+	if err := json.Unmarshal(line, &v); err != nil {
+		t.Fatalf("unexpected error: %s with line %s", err, line)
+	}
+	expected := map[string]interface{}{
+		"time":           "2000-10-10T13:55:36-07:00",
+		"duration_ms":    1.5,
+		"client_addr":    "127.0.0.1:52012",
+		"user":           "frank",
+		"url":            "http://a.com/a b?q=\"1\"",
+		"user_agent":     "bad�agent\n",
+		"status":         float64(200),
+		"request_bytes":  float64(78),
+		"response_bytes": float64(2326),
+		"super_proxy":    "2.2.2.2:3128",
+		"ssl_bump":       true,
+		"error":          "upstream \"closed\"",
+	}
+	for key, value := range expected {
+		if v[key] != value {
+			t.Fatalf("unexpected %s: %v, expected %v", key, v[key], value)
+		}
+	}
+	if _, ok := v["referer"]; ok {
+		t.Fatalf("empty referer should be omitted")
+	}
+	if _, ok := v["tunnel"]; ok {
+		t.Fatalf("false tunnel should be omitted")
+	}
+}
+
+type bufferSink struct {
+	sync.Mutex
+	bytes.Buffer
+	closed bool
+}
+
+func (s *bufferSink) Write(p []byte) (int, error) {
+	s.Lock()
+	defer s.Unlock()
+	return s.Buffer.Write(p)
+}
+
+func (s *bufferSink) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	s.closed = true
+	return nil
+}
+
+func (s *bufferSink) String() string {
+	s.Lock()
+	defer s.Unlock()
+	return s.Buffer.String()
+}
+
+func TestLogger(t *testing.T) {
+	sink := &bufferSink{}
+	l := &Logger{Sink: sink, Encoder: JSONEncoder{}, FlushInterval: 100 * time.Millisecond}
+	r := testRecord()
+	l.Log(r)
+	time.Sleep(300 * time.Millisecond)
+	if lines := strings.Count(sink.String(), "\n"); lines != 1 {
+		t.Fatalf("record should be flushed, got %d lines", lines)
+	}
+	for i := 0; i < 100; i++ {
+		l.Log(r)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !sink.closed {
+		t.Fatalf("sink should be closed")
+	}
+	if lines := strings.Count(sink.String(), "\n"); lines != 101 {
+		t.Fatalf("queued records should be written before closing, got %d lines", lines)
+	}
+	l.Log(r)
+	if lines := strings.Count(sink.String(), "\n"); lines != 101 {
+		t.Fatalf("records logged after closing should be ignored")
+	}
+}
+
+func TestLoggerDropped(t *testing.T) {
+	sink := &bufferSink{}
+	sink.Lock() // blocks the writing
+	l := &Logger{Sink: sink, QueueSize: 1, BufferSize: 1}
+	for i := 0; i < 10; i++ {
+		l.Log(testRecord())
+	}
+	if l.Dropped() == 0 {
+		t.Fatalf("records should be dropped when the queue is full")
+	}
+	sink.Unlock()
+	l.Close()
+}
+
+func TestFileSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "accesslog")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "access.log")
+	s := &FileSink{Filename: filename, MaxSize: 10, MaxBackups: 2}
+	for i := 0; i < 5; i++ {
+		if _, err := s.Write([]byte("0123456789")); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		// the backups are named in milliseconds
+		time.Sleep(2 * time.Millisecond)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(b) != "0123456789" {
+		t.Fatalf("unexpected content %q", b)
+	}
+	backups, _ := filepath.Glob(filename + ".*")
+	if len(backups) != 2 {
+		t.Fatalf("unexpected backups %v", backups)
+	}
+
+	// appends to the existing file
+	s = &FileSink{Filename: filename}
+	s.Write([]byte("abc"))
+	s.Close()
+	if b, _ = ioutil.ReadFile(filename); string(b) != "0123456789abc" {
+		t.Fatalf("unexpected content %q", b)
+	}
+}
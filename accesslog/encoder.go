@@ -0,0 +1,196 @@
+package accesslog
+
+import (
+	"net"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+// Encoder encodes the record into a line of log
+type Encoder interface {
+	// Encode appends the encoded record ended with a newline to dst
+	// and returns the extended buffer
+	Encode(dst []byte, r *Record) []byte
+}
+
+// CommonLogEncoder encodes the record in Common Log Format
+//
+//	127.0.0.1 - frank [10/Oct/2000:13:55:36 -0700] "GET http://a.com/ HTTP/1.1" 200 2326
+type CommonLogEncoder struct{}
+
+// Encode implements Encoder
+func (CommonLogEncoder) Encode(dst []byte, r *Record) []byte {
+	dst = appendCommonLog(dst, r)
+	return append(dst, '\n')
+}
+
+// CombinedLogEncoder encodes the record in Combined Log Format, which is the
+// Common Log Format followed by the referer and the user agent
+type CombinedLogEncoder struct{}
+
+// Encode implements Encoder
+func (CombinedLogEncoder) Encode(dst []byte, r *Record) []byte {
+	dst = appendCommonLog(dst, r)
+	dst = append(dst, ' ')
+	dst = appendQuotedField(dst, r.Referer)
+	dst = append(dst, ' ')
+	dst = appendQuotedField(dst, r.UserAgent)
+	return append(dst, '\n')
+}
+
+const commonLogTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+func appendCommonLog(dst []byte, r *Record) []byte {
+	dst = appendField(dst, clientHost(r.ClientAddr))
+	dst = append(dst, " - "...)
+	dst = appendField(dst, r.Username)
+	dst = append(dst, " ["...)
+	dst = r.Time.AppendFormat(dst, commonLogTimeFormat)
+	dst = append(dst, "] \""...)
+	dst = appendEscaped(dst, r.Method)
+	dst = append(dst, ' ')
+	dst = appendEscaped(dst, r.URL)
+	dst = append(dst, ' ')
+	dst = appendEscaped(dst, r.Protocol)
+	dst = append(dst, "\" "...)
+	if r.StatusCode > 0 {
+		dst = strconv.AppendInt(dst, int64(r.StatusCode), 10)
+	} else {
+		dst = append(dst, '-')
+	}
+	dst = append(dst, ' ')
+	if r.ResponseBytes > 0 {
+		dst = strconv.AppendInt(dst, r.ResponseBytes, 10)
+	} else {
+		dst = append(dst, '-')
+	}
+	return dst
+}
+
+// clientHost the host part of the client address
+func clientHost(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// appendField appends the unquoted field, `-` is used for the empty one
+func appendField(dst []byte, s string) []byte {
+	if len(s) == 0 {
+		return append(dst, '-')
+	}
+	return appendEscaped(dst, s)
+}
+
+// appendQuotedField appends the quoted field, `-` is used for the empty one
+func appendQuotedField(dst []byte, s string) []byte {
+	dst = append(dst, '"')
+	dst = appendField(dst, s)
+	return append(dst, '"')
+}
+
+// appendEscaped appends s with the quotes, backslashes, spaces and
+// control characters escaped like apache does
+func appendEscaped(dst []byte, s string) []byte {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			dst = append(dst, '\\', c)
+		case c <= ' ' || c >= 0x7f:
+			dst = append(dst, '\\', 'x', hexDigits[c>>4], hexDigits[c&0xf])
+		default:
+			dst = append(dst, c)
+		}
+	}
+	return dst
+}
+
+const hexDigits = "0123456789abcdef"
+
+// JSONEncoder encodes the record into a JSON object per line
+//
+//	{"time":"2000-10-10T13:55:36.123-07:00","client_addr":"127.0.0.1:52012",...}
+//
+// The zero-valued optional fields are omitted.
+type JSONEncoder struct{}
+
+// Encode implements Encoder
+func (JSONEncoder) Encode(dst []byte, r *Record) []byte {
+	dst = append(dst, `{"time":"`...)
+	dst = r.Time.AppendFormat(dst, time.RFC3339Nano)
+	dst = append(dst, `","duration_ms":`...)
+	dst = strconv.AppendFloat(dst, float64(r.Duration)/float64(time.Millisecond), 'f', 3, 64)
+	dst = appendJSONField(dst, "client_addr", r.ClientAddr)
+	dst = appendJSONField(dst, "user", r.Username)
+	dst = appendJSONField(dst, "method", r.Method)
+	dst = appendJSONField(dst, "url", r.URL)
+	dst = appendJSONField(dst, "protocol", r.Protocol)
+	dst = appendJSONField(dst, "referer", r.Referer)
+	dst = appendJSONField(dst, "user_agent", r.UserAgent)
+	dst = append(dst, `,"status":`...)
+	dst = strconv.AppendInt(dst, int64(r.StatusCode), 10)
+	dst = append(dst, `,"request_bytes":`...)
+	dst = strconv.AppendInt(dst, r.RequestBytes, 10)
+	dst = append(dst, `,"response_bytes":`...)
+	dst = strconv.AppendInt(dst, r.ResponseBytes, 10)
+	dst = appendJSONField(dst, "upstream_addr", r.UpstreamAddr)
+	dst = appendJSONField(dst, "super_proxy", r.SuperProxy)
+	if r.SSLBump {
+		dst = append(dst, `,"ssl_bump":true`...)
+	}
+	if r.Tunnel {
+		dst = append(dst, `,"tunnel":true`...)
+	}
+	if r.Err != nil {
+		dst = appendJSONField(dst, "error", r.Err.Error())
+	}
+	return append(dst, "}\n"...)
+}
+
+// appendJSONField appends `,"key":"value"` if value is not empty
+func appendJSONField(dst []byte, key, value string) []byte {
+	if len(value) == 0 {
+		return dst
+	}
+	dst = append(dst, `,"`...)
+	dst = append(dst, key...)
+	dst = append(dst, `":`...)
+	return appendJSONString(dst, value)
+}
+
+// appendJSONString appends s as a JSON string, invalid UTF-8 bytes are replaced
+func appendJSONString(dst []byte, s string) []byte {
+	dst = append(dst, '"')
+	for i := 0; i < len(s); {
+		c := s[i]
+		if c < utf8.RuneSelf {
+			switch {
+			case c == '"' || c == '\\':
+				dst = append(dst, '\\', c)
+			case c == '\n':
+				dst = append(dst, '\\', 'n')
+			case c == '\r':
+				dst = append(dst, '\\', 'r')
+			case c == '\t':
+				dst = append(dst, '\\', 't')
+			case c < ' ':
+				dst = append(dst, '\\', 'u', '0', '0', hexDigits[c>>4], hexDigits[c&0xf])
+			default:
+				dst = append(dst, c)
+			}
+			i++
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			dst = append(dst, `�`...)
+		} else {
+			dst = append(dst, s[i:i+size]...)
+		}
+		i += size
+	}
+	return append(dst, '"')
+}
@@ -0,0 +1,157 @@
+package accesslog
+
+import (
+	"bufio"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/haxii/fastproxy/bytebufferpool"
+	"github.com/haxii/log/v2"
+)
+
+// DefaultQueueSize used when logger's QueueSize not set
+const DefaultQueueSize = 1024
+
+// DefaultBufferSize used when logger's BufferSize not set
+const DefaultBufferSize = 32 * 1024
+
+// DefaultFlushInterval used when logger's FlushInterval not set
+var DefaultFlushInterval = time.Second
+
+// Logger writes the access log records to the sink asynchronously.
+//
+// The records are encoded by the calling goroutine, then queued and written
+// by a background goroutine through a buffered writer, so a slow sink never
+// blocks the requests. Records are dropped when the queue is full.
+type Logger struct {
+	// Sink where the log lines are written to, the records are dropped if not set
+	Sink Sink
+
+	// Encoder record encoder, CommonLogEncoder is used if not set
+	Encoder Encoder
+
+	// QueueSize max number of the records waiting for writing,
+	// DefaultQueueSize is used if not set
+	QueueSize int
+
+	// BufferSize size of the write buffer, DefaultBufferSize is used if not set
+	BufferSize int
+
+	// FlushInterval max duration the records stay in the write buffer,
+	// DefaultFlushInterval is used if not set
+	FlushInterval time.Duration
+
+	initOnce sync.Once
+	queue    chan *bytebufferpool.ByteBuffer
+	done     chan struct{}
+	stopped  chan struct{}
+	closed   uint32
+	dropped  uint64
+}
+
+func (l *Logger) init() {
+	l.initOnce.Do(func() {
+		if l.Encoder == nil {
+			l.Encoder = CommonLogEncoder{}
+		}
+		if l.QueueSize <= 0 {
+			l.QueueSize = DefaultQueueSize
+		}
+		if l.BufferSize <= 0 {
+			l.BufferSize = DefaultBufferSize
+		}
+		if l.FlushInterval <= 0 {
+			l.FlushInterval = DefaultFlushInterval
+		}
+		l.queue = make(chan *bytebufferpool.ByteBuffer, l.QueueSize)
+		l.done = make(chan struct{})
+		l.stopped = make(chan struct{})
+		go l.run()
+	})
+}
+
+// Log encodes the record and queues it for writing, r can be reused after Log returns
+func (l *Logger) Log(r *Record) {
+	l.init()
+	if l.Sink == nil || atomic.LoadUint32(&l.closed) != 0 {
+		return
+	}
+	buffer := bytebufferpool.Get()
+	buffer.B = l.Encoder.Encode(buffer.B, r)
+	select {
+	case l.queue <- buffer:
+	default:
+		atomic.AddUint64(&l.dropped, 1)
+		bytebufferpool.Put(buffer)
+	}
+}
+
+// Dropped number of the records dropped since the queue is full
+func (l *Logger) Dropped() uint64 {
+	return atomic.LoadUint64(&l.dropped)
+}
+
+// Close writes the queued records then closes the sink,
+// the records logged after closing are ignored
+func (l *Logger) Close() error {
+	l.init()
+	if !atomic.CompareAndSwapUint32(&l.closed, 0, 1) {
+		return nil
+	}
+	close(l.done)
+	<-l.stopped
+	if l.Sink == nil {
+		return nil
+	}
+	return l.Sink.Close()
+}
+
+func (l *Logger) run() {
+	defer close(l.stopped)
+	if l.Sink == nil {
+		return
+	}
+	writer := bufio.NewWriterSize(l.Sink, l.BufferSize)
+	ticker := time.NewTicker(l.FlushInterval)
+	defer ticker.Stop()
+	var lastErrorTime time.Time
+	write := func(buffer *bytebufferpool.ByteBuffer) {
+		if _, err := writer.Write(buffer.B); err != nil {
+			// the writer keeps failing once failed, so reset it for the next records
+			writer.Reset(l.Sink)
+			if time.Since(lastErrorTime) > time.Minute {
+				log.Errorf(err, "fail to write access log")
+				lastErrorTime = time.Now()
+			}
+		}
+		bytebufferpool.Put(buffer)
+	}
+	flush := func() {
+		if err := writer.Flush(); err != nil {
+			writer.Reset(l.Sink)
+			if time.Since(lastErrorTime) > time.Minute {
+				log.Errorf(err, "fail to flush access log")
+				lastErrorTime = time.Now()
+			}
+		}
+	}
+	for {
+		select {
+		case buffer := <-l.queue:
+			write(buffer)
+		case <-ticker.C:
+			flush()
+		case <-l.done:
+			for {
+				select {
+				case buffer := <-l.queue:
+					write(buffer)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
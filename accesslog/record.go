@@ -0,0 +1,51 @@
+package accesslog
+
+import (
+	"time"
+)
+
+// Record the access log record of a proxied http request, decrypted https request
+// or tunnel, the URL of a tunnel is the target host with port
+type Record struct {
+	// Time the time when the request received
+	Time time.Time
+	// Duration time taken to serve the request, including the whole tunneling
+	Duration time.Duration
+
+	// ClientAddr the remote address of the client
+	ClientAddr string
+	// Username the authenticated proxy user name, empty if not authenticated
+	Username string
+
+	// Method, URL and Protocol of the request line
+	Method   string
+	URL      string
+	Protocol string
+	// Referer and UserAgent the request headers, used by the combined log format
+	Referer   string
+	UserAgent string
+
+	// StatusCode the status code sent to client, 0 if no response sent
+	StatusCode int
+	// RequestBytes bytes read from client
+	RequestBytes int64
+	// ResponseBytes bytes written to client
+	ResponseBytes int64
+
+	// UpstreamAddr the target host with port the request forwarded to
+	UpstreamAddr string
+	// SuperProxy the host with port of the super proxy used, empty if not used
+	SuperProxy string
+	// SSLBump if the request is decrypted from a https tunnel
+	SSLBump bool
+	// Tunnel if the record is of a tunnel
+	Tunnel bool
+
+	// Err the error occurred when serving the request
+	Err error
+}
+
+// Reset reset the record
+func (r *Record) Reset() {
+	*r = Record{}
+}
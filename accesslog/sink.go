@@ -0,0 +1,152 @@
+package accesslog
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sink the destination of the encoded log lines, which is written
+// by one goroutine at a time and closed when the logger closed
+type Sink interface {
+	io.Writer
+	io.Closer
+}
+
+// WriterSink makes a sink writing to w without closing it, e.g. os.Stdout
+func WriterSink(w io.Writer) Sink {
+	return writerSink{w}
+}
+
+type writerSink struct{ io.Writer }
+
+func (writerSink) Close() error { return nil }
+
+// FileSink a sink writing to the file, which is rotated by size.
+//
+// The rotated files are renamed with the rotating time as the suffix,
+// e.g. access.log.20060102-150405.000
+type FileSink struct {
+	// Filename the path of the log file, which is created if not exist
+	Filename string
+
+	// MaxSize rotates the file when its size exceeds MaxSize in bytes,
+	// never rotates if not set
+	MaxSize int64
+
+	// MaxBackups max number of the rotated files kept, the oldest ones are
+	// removed when exceeded, all of them are kept if not set
+	MaxBackups int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+const backupTimeFormat = "20060102-150405.000"
+
+// Write implements Sink, the file is rotated before writing if p exceeds MaxSize
+func (s *FileSink) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		if err := s.openFile(); err != nil {
+			return 0, err
+		}
+	}
+	if s.MaxSize > 0 && s.size > 0 && s.size+int64(len(p)) > s.MaxSize {
+		if err := s.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := s.file.Write(p)
+	s.size += int64(n)
+	return n, err
+}
+
+// Rotate rotates the file immediately
+func (s *FileSink) Rotate() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rotate()
+}
+
+// Close implements Sink
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+func (s *FileSink) openFile() error {
+	f, err := os.OpenFile(s.Filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.file = f
+	s.size = info.Size()
+	return nil
+}
+
+func (s *FileSink) rotate() error {
+	if s.file != nil {
+		if err := s.file.Close(); err != nil {
+			return err
+		}
+		s.file = nil
+	}
+	backup := s.Filename + "." + time.Now().Format(backupTimeFormat)
+	if err := os.Rename(s.Filename, backup); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("fail to rename log file: %s", err)
+	}
+	if err := s.removeOldBackups(); err != nil {
+		return err
+	}
+	return s.openFile()
+}
+
+// removeOldBackups removes the oldest backups exceeds MaxBackups
+func (s *FileSink) removeOldBackups() error {
+	if s.MaxBackups <= 0 {
+		return nil
+	}
+	backups, err := filepath.Glob(s.Filename + ".*")
+	if err != nil {
+		return err
+	}
+	prefix := s.Filename + "."
+	n := 0
+	for _, backup := range backups {
+		if _, err := time.Parse(backupTimeFormat, strings.TrimPrefix(backup, prefix)); err == nil {
+			backups[n] = backup
+			n++
+		}
+	}
+	backups = backups[:n]
+	if len(backups) <= s.MaxBackups {
+		return nil
+	}
+	// the time suffixes are sorted in time order
+	sort.Strings(backups)
+	for _, backup := range backups[:len(backups)-s.MaxBackups] {
+		if err := os.Remove(backup); err != nil {
+			return err
+		}
+	}
+	return nil
+}
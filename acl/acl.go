@@ -0,0 +1,356 @@
+package acl
+
+import (
+	"context"
+	"errors"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Action the action taken on the matched requests
+type Action int
+
+const (
+	// ActionAllow allows the request
+	ActionAllow Action = iota
+	// ActionDeny denies the request with a 403 response
+	ActionDeny
+)
+
+// Side the side of the request checked
+type Side int
+
+const (
+	// SideSource the client of the request
+	SideSource Side = iota
+	// SideDestination the target of the request
+	SideDestination
+)
+
+var (
+	errInvalidCIDR   = errors.New("invalid IP or CIDR")
+	errInvalidDomain = errors.New("invalid domain glob")
+	errInvalidPort   = errors.New("invalid port or port range")
+	errEmptyMethod   = errors.New("empty method")
+	errNoAddress     = errors.New("no address resolved")
+)
+
+// SourceRule matches the clients by IP
+type SourceRule struct {
+	// Name the rule name reported in Decision
+	Name string
+	// Action the action taken on the matched clients
+	Action Action
+	// CIDRs client networks, e.g. `10.0.0.0/8`, a single IP is also accepted,
+	// all the clients are matched if empty
+	CIDRs []string
+
+	nets []*net.IPNet
+}
+
+// DestinationRule matches the targets, a target matches the rule
+// when all the conditions set are matched
+type DestinationRule struct {
+	// Name the rule name reported in Decision
+	Name string
+	// Action the action taken on the matched targets
+	Action Action
+	// Domains globs of the target host matched case-insensitively,
+	// e.g. `example.com`, `*.example.com` or `*`
+	Domains []string
+	// CIDRs networks of the target IP, the target domain is resolved to
+	// match them, which matches when any of the resolved IPs matches
+	CIDRs []string
+	// Ports target ports or port ranges, e.g. `443` or `8000-8999`
+	Ports []string
+	// Methods request methods matched case-insensitively,
+	// tunnels and SOCKS5 connections use `CONNECT`
+	Methods []string
+
+	nets  []*net.IPNet
+	ports [][2]int
+}
+
+// ACL access control lists checked against the clients and the targets,
+// rules are checked in order and the first matched one decides
+type ACL struct {
+	// SourceRules rules of the clients
+	SourceRules []*SourceRule
+	// DefaultSourceAction action taken when no source rule matched
+	DefaultSourceAction Action
+
+	// DestinationRules rules of the targets
+	DestinationRules []*DestinationRule
+	// DefaultDestinationAction action taken when no destination rule matched
+	DefaultDestinationAction Action
+
+	// Resolver resolves the target domains for the CIDRs of destination rules,
+	// net.DefaultResolver is used if not set
+	Resolver *net.Resolver
+
+	// Audit called with every decision made
+	Audit func(d *Decision)
+
+	hasDestinationCIDRs bool
+}
+
+// Decision the result of an ACL check
+type Decision struct {
+	// Allowed if the request is allowed
+	Allowed bool
+	// Side the side checked
+	Side Side
+	// Rule name of the matched rule, empty if the default action taken
+	Rule string
+
+	ClientAddr net.Addr
+	// Username the authenticated user name, empty if not authenticated
+	Username string
+	// Method, Host and Port of the target, empty for source checks
+	Method string
+	Host   string
+	Port   string
+	// IP the target IP matched by the rule, nil if not matched by CIDRs
+	IP net.IP
+	// ResolvedIP the IP of the target domain resolved for the check, the allowed
+	// target should be dialed with it rather than resolved again, otherwise the
+	// domain may be rebound to the denied IPs. nil if the domain is not resolved
+	ResolvedIP net.IP
+	// Err the error resolving the target domain, the target is denied then
+	// since it can't be matched against the CIDRs
+	Err error
+}
+
+// Compile parses the rules, it must be called before the ACL is used
+// and after the rules are changed
+func (a *ACL) Compile() error {
+	for _, r := range a.SourceRules {
+		nets, err := parseCIDRs(r.CIDRs)
+		if err != nil {
+			return err
+		}
+		r.nets = nets
+	}
+	a.hasDestinationCIDRs = false
+	for _, r := range a.DestinationRules {
+		nets, err := parseCIDRs(r.CIDRs)
+		if err != nil {
+			return err
+		}
+		r.nets = nets
+		a.hasDestinationCIDRs = a.hasDestinationCIDRs || len(nets) > 0
+		for _, d := range r.Domains {
+			if _, err := path.Match(strings.ToLower(d), ""); err != nil || len(d) == 0 {
+				return errInvalidDomain
+			}
+		}
+		r.ports = r.ports[:0]
+		for _, p := range r.Ports {
+			portRange, err := parsePortRange(p)
+			if err != nil {
+				return err
+			}
+			r.ports = append(r.ports, portRange)
+		}
+		for _, m := range r.Methods {
+			if len(m) == 0 {
+				return errEmptyMethod
+			}
+		}
+	}
+	return nil
+}
+
+// CheckSource checks the client against the source rules
+func (a *ACL) CheckSource(clientAddr net.Addr) *Decision {
+	d := &Decision{Side: SideSource, ClientAddr: clientAddr, Allowed: a.DefaultSourceAction == ActionAllow}
+	ip := addrIP(clientAddr)
+	for _, r := range a.SourceRules {
+		if len(r.nets) > 0 && (ip == nil || !containsIP(r.nets, ip)) {
+			continue
+		}
+		d.Allowed, d.Rule = r.Action == ActionAllow, r.Name
+		break
+	}
+	a.audit(d)
+	return d
+}
+
+// CheckDestination checks the target against the destination rules, the CIDRs
+// are matched by ip if known, e.g. the original destination of a transparent
+// connection, otherwise the target domain is resolved with ctx if any rule has CIDRs
+func (a *ACL) CheckDestination(ctx context.Context, clientAddr net.Addr, username,
+	method, host, port string, ip net.IP) *Decision {
+	d := &Decision{Side: SideDestination, ClientAddr: clientAddr, Username: username,
+		Method: method, Host: host, Port: port, Allowed: a.DefaultDestinationAction == ActionAllow}
+	lowerHost := strings.ToLower(host)
+	portNum, _ := strconv.Atoi(port)
+	if ip == nil {
+		ip = net.ParseIP(host)
+	}
+	var ips []net.IP
+	if ip != nil {
+		ips = []net.IP{ip}
+	} else if a.hasDestinationCIDRs {
+		if ips, d.Err = a.resolve(ctx, host); d.Err != nil {
+			// fail closed, the target may be in the denied networks
+			d.Allowed = false
+			a.audit(d)
+			return d
+		}
+		d.ResolvedIP = ips[0]
+	}
+	for _, r := range a.DestinationRules {
+		if len(r.Methods) > 0 && !matchMethod(r.Methods, method) {
+			continue
+		}
+		if len(r.ports) > 0 && !matchPort(r.ports, portNum) {
+			continue
+		}
+		if len(r.Domains) > 0 && !matchDomain(r.Domains, lowerHost) {
+			continue
+		}
+		var matchedIP net.IP
+		if len(r.nets) > 0 {
+			if matchedIP = matchIPs(r.nets, ips); matchedIP == nil {
+				continue
+			}
+		}
+		d.Allowed, d.Rule, d.IP = r.Action == ActionAllow, r.Name, matchedIP
+		if matchedIP != nil && d.ResolvedIP != nil {
+			d.ResolvedIP = matchedIP
+		}
+		break
+	}
+	a.audit(d)
+	return d
+}
+
+func (a *ACL) audit(d *Decision) {
+	if a.Audit != nil {
+		a.Audit(d)
+	}
+}
+
+// resolve resolves the host to one IP at least
+func (a *ACL) resolve(ctx context.Context, host string) ([]net.IP, error) {
+	resolver := a.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	addrs, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, errNoAddress
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, addr := range addrs {
+		ips[i] = addr.IP
+	}
+	return ips, nil
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, errInvalidCIDR
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, errInvalidCIDR
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+func parsePortRange(s string) ([2]int, error) {
+	first, last := s, s
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		first, last = s[:i], s[i+1:]
+	}
+	from, err1 := strconv.Atoi(first)
+	to, err2 := strconv.Atoi(last)
+	if err1 != nil || err2 != nil || from < 0 || to > 65535 || from > to {
+		return [2]int{}, errInvalidPort
+	}
+	return [2]int{from, to}, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchIPs(nets []*net.IPNet, ips []net.IP) net.IP {
+	for _, ip := range ips {
+		if containsIP(nets, ip) {
+			return ip
+		}
+	}
+	return nil
+}
+
+func matchDomain(patterns []string, lowerHost string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(strings.ToLower(p), lowerHost); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func matchPort(ports [][2]int, port int) bool {
+	for _, p := range ports {
+		if port >= p[0] && port <= p[1] {
+			return true
+		}
+	}
+	return false
+}
+
+func matchMethod(methods []string, method string) bool {
+	for _, m := range methods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+func addrIP(addr net.Addr) net.IP {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return addr.IP
+	case *net.UDPAddr:
+		return addr.IP
+	case *net.IPAddr:
+		return addr.IP
+	}
+	if addr == nil {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
@@ -0,0 +1,141 @@
+package acl
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+)
+
+func tcpAddr(ip string) net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP(ip), Port: 1234}
+}
+
+// hostsResolver resolves the names in the hosts file only
+var hostsResolver = &net.Resolver{PreferGo: true, Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+	return nil, errors.New("no name server")
+}}
+
+func TestCompileErrors(t *testing.T) {
+	testCompileError(t, &ACL{SourceRules: []*SourceRule{{CIDRs: []string{"10.0.0.0/33"}}}})
+	testCompileError(t, &ACL{SourceRules: []*SourceRule{{CIDRs: []string{"example.com"}}}})
+	testCompileError(t, &ACL{DestinationRules: []*DestinationRule{{Domains: []string{"[a-"}}}})
+	testCompileError(t, &ACL{DestinationRules: []*DestinationRule{{Ports: []string{"443-80"}}}})
+	testCompileError(t, &ACL{DestinationRules: []*DestinationRule{{Ports: []string{"65536"}}}})
+	testCompileError(t, &ACL{DestinationRules: []*DestinationRule{{Ports: []string{"http"}}}})
+	testCompileError(t, &ACL{DestinationRules: []*DestinationRule{{Methods: []string{""}}}})
+}
+
+func testCompileError(t *testing.T, a *ACL) {
+	if err := a.Compile(); err == nil {
+		t.Fatalf("expected compile error")
+	}
+}
+
+func TestCheckSource(t *testing.T) {
+	var audited []*Decision
+	a := &ACL{
+		SourceRules: []*SourceRule{
+			{Name: "blocked host", Action: ActionDeny, CIDRs: []string{"10.0.0.7"}},
+			{Name: "office", Action: ActionAllow, CIDRs: []string{"10.0.0.0/8", "2001:db8::/32"}},
+		},
+		DefaultSourceAction: ActionDeny,
+		Audit:               func(d *Decision) { audited = append(audited, d) },
+	}
+	if err := a.Compile(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	testCheckSource(t, a, tcpAddr("10.0.0.7"), false, "blocked host")
+	testCheckSource(t, a, tcpAddr("10.1.2.3"), true, "office")
+	testCheckSource(t, a, tcpAddr("2001:db8::1"), true, "office")
+	testCheckSource(t, a, tcpAddr("192.168.0.1"), false, "")
+	testCheckSource(t, a, &net.UnixAddr{Name: "/tmp/sock", Net: "unix"}, false, "")
+	if len(audited) != 5 {
+		t.Fatalf("expected 5 decisions audited, got %d", len(audited))
+	}
+}
+
+func testCheckSource(t *testing.T, a *ACL, addr net.Addr, expAllowed bool, expRule string) {
+	d := a.CheckSource(addr)
+	if d.Allowed != expAllowed || d.Rule != expRule || d.Side != SideSource {
+		t.Fatalf("client %s: expected (%v, %q), got (%v, %q)", addr, expAllowed, expRule, d.Allowed, d.Rule)
+	}
+}
+
+func TestCheckDestination(t *testing.T) {
+	a := &ACL{
+		DestinationRules: []*DestinationRule{
+			{Name: "tls tunnels", Action: ActionAllow, Methods: []string{"connect"}, Ports: []string{"443", "8443"}},
+			{Name: "no tunnels", Action: ActionDeny, Methods: []string{"CONNECT"}},
+			{Name: "blocked sites", Action: ActionDeny, Domains: []string{"*.example.com", "example.com"}},
+			{Name: "web", Action: ActionAllow, Ports: []string{"80", "8000-8999"}},
+		},
+		DefaultDestinationAction: ActionDeny,
+	}
+	if err := a.Compile(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	testCheckDestination(t, a, "CONNECT", "github.com", "443", true, "tls tunnels")
+	testCheckDestination(t, a, "CONNECT", "github.com", "8443", true, "tls tunnels")
+	testCheckDestination(t, a, "CONNECT", "github.com", "22", false, "no tunnels")
+	testCheckDestination(t, a, "GET", "www.Example.com", "80", false, "blocked sites")
+	testCheckDestination(t, a, "GET", "example.com", "80", false, "blocked sites")
+	testCheckDestination(t, a, "GET", "example.org", "8080", true, "web")
+	testCheckDestination(t, a, "GET", "example.org", "9000", false, "")
+
+	// the target domain is resolved to match the networks
+	a.DestinationRules = append([]*DestinationRule{
+		{Name: "private", Action: ActionDeny, CIDRs: []string{"127.0.0.0/8", "10.0.0.0/8", "::1"}},
+	}, a.DestinationRules...)
+	a.Resolver = hostsResolver
+	if err := a.Compile(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	testCheckDestination(t, a, "CONNECT", "10.0.0.1", "443", false, "private")
+	testCheckDestination(t, a, "GET", "localhost", "80", false, "private")
+	testCheckDestination(t, a, "CONNECT", "192.168.0.1", "443", true, "tls tunnels")
+	// the target failed to resolve is denied
+	testCheckDestination(t, a, "CONNECT", "github.com", "443", false, "")
+}
+
+func testCheckDestination(t *testing.T, a *ACL, method, host, port string, expAllowed bool, expRule string) {
+	d := a.CheckDestination(context.Background(), tcpAddr("10.0.0.1"), "", method, host, port, nil)
+	if d.Allowed != expAllowed || d.Rule != expRule || d.Side != SideDestination {
+		t.Fatalf("%s %s:%s: expected (%v, %q), got (%v, %q)",
+			method, host, port, expAllowed, expRule, d.Allowed, d.Rule)
+	}
+	if d.Rule == "private" && d.IP == nil {
+		t.Fatalf("%s %s:%s: expected the matched IP reported", method, host, port)
+	}
+}
+
+func TestCheckDestinationResolvedIP(t *testing.T) {
+	a := &ACL{
+		DestinationRules: []*DestinationRule{
+			{Name: "private", Action: ActionDeny, CIDRs: []string{"10.0.0.0/8"}},
+		},
+		DefaultDestinationAction: ActionAllow,
+		Resolver:                 hostsResolver,
+	}
+	if err := a.Compile(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	d := a.CheckDestination(context.Background(), tcpAddr("10.0.0.1"), "", "GET", "localhost", "80", nil)
+	if !d.Allowed || d.ResolvedIP == nil || !d.ResolvedIP.IsLoopback() {
+		t.Fatalf("expected localhost allowed with its resolved IP, got (%v, %v)", d.Allowed, d.ResolvedIP)
+	}
+	d = a.CheckDestination(context.Background(), tcpAddr("10.0.0.1"), "", "GET", "127.0.0.1", "80", nil)
+	if !d.Allowed || d.ResolvedIP != nil {
+		t.Fatalf("expected IP target allowed without resolving, got (%v, %v)", d.Allowed, d.ResolvedIP)
+	}
+	// the IP known is checked rather than the domain resolved
+	d = a.CheckDestination(context.Background(), tcpAddr("10.0.0.1"), "", "GET", "localhost", "80", net.ParseIP("10.0.0.2"))
+	if d.Allowed || d.Rule != "private" || d.ResolvedIP != nil {
+		t.Fatalf("expected the IP known denied without resolving, got (%v, %q, %v)", d.Allowed, d.Rule, d.ResolvedIP)
+	}
+	// the target failed to resolve is denied
+	d = a.CheckDestination(context.Background(), tcpAddr("10.0.0.1"), "", "GET", "unknown.invalid", "80", nil)
+	if d.Allowed || d.Err == nil {
+		t.Fatalf("expected the target failed to resolve denied, got (%v, %v)", d.Allowed, d.Err)
+	}
+}
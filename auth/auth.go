@@ -0,0 +1,109 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// Authenticator authenticates the clients of the proxy
+type Authenticator interface {
+	// Authenticate validates the `Proxy-Authorization` header value sent by client,
+	// returns the authenticated user name and whether the client is accepted
+	Authenticate(clientAddr net.Addr, proxyAuthorization []byte) (username string, ok bool)
+
+	// Challenge returns the `Proxy-Authenticate` header value which is sent
+	// with the `407 Proxy Authentication Required` response
+	Challenge() []byte
+}
+
+// PasswordVerifier verifies the user name and password pairs,
+// implemented by credential backends like MemoryStore and HtpasswdFile
+type PasswordVerifier interface {
+	// Verify returns true if the password matches the user
+	Verify(username, password string) bool
+}
+
+// DefaultRealm realm used in challenge if Basic's realm not set
+const DefaultRealm = "fastproxy"
+
+// Basic is an Authenticator using the HTTP Basic authentication scheme,
+// see https://tools.ietf.org/html/rfc7617
+type Basic struct {
+	// Realm the protection space in challenge, DefaultRealm is used if not set
+	Realm string
+
+	// Verifier credential backend to check the user name and password
+	Verifier PasswordVerifier
+
+	challenge     []byte
+	challengeOnce sync.Once
+}
+
+// NewBasic makes a Basic authenticator with given realm and credential backend
+func NewBasic(realm string, verifier PasswordVerifier) *Basic {
+	return &Basic{Realm: realm, Verifier: verifier}
+}
+
+var basicScheme = []byte("basic")
+
+// Authenticate implements Authenticator
+func (b *Basic) Authenticate(clientAddr net.Addr, proxyAuthorization []byte) (string, bool) {
+	username, password, ok := ParseBasicCredentials(proxyAuthorization)
+	if !ok {
+		return "", false
+	}
+	if !b.Verify(username, password) {
+		return "", false
+	}
+	return username, true
+}
+
+// Verify implements PasswordVerifier, so the credentials can also be used for
+// schemes other than HTTP, e.g. the SOCKS5 username/password authentication
+func (b *Basic) Verify(username, password string) bool {
+	if b.Verifier == nil {
+		return false
+	}
+	return b.Verifier.Verify(username, password)
+}
+
+// Challenge implements Authenticator, it's safe to be called concurrently
+func (b *Basic) Challenge() []byte {
+	b.challengeOnce.Do(func() {
+		b.challenge = makeBasicChallenge(b.Realm)
+	})
+	return b.challenge
+}
+
+func makeBasicChallenge(realm string) []byte {
+	if len(realm) == 0 {
+		realm = DefaultRealm
+	}
+	return []byte("Basic realm=" + strconv.Quote(realm))
+}
+
+// ParseBasicCredentials parses the user name and password from a Basic
+// authorization header value, e.g. `Basic dXNlcjpwYXNz`
+func ParseBasicCredentials(authorization []byte) (username, password string, ok bool) {
+	authorization = bytes.TrimSpace(authorization)
+	if len(authorization) <= len(basicScheme) ||
+		!bytes.EqualFold(authorization[:len(basicScheme)], basicScheme) ||
+		authorization[len(basicScheme)] != ' ' {
+		return "", "", false
+	}
+	encoded := bytes.TrimSpace(authorization[len(basicScheme):])
+	decoded := make([]byte, base64.StdEncoding.DecodedLen(len(encoded)))
+	n, err := base64.StdEncoding.Decode(decoded, encoded)
+	if err != nil {
+		return "", "", false
+	}
+	decoded = decoded[:n]
+	sep := bytes.IndexByte(decoded, ':')
+	if sep < 0 {
+		return "", "", false
+	}
+	return string(decoded[:sep]), string(decoded[sep+1:]), true
+}
@@ -0,0 +1,126 @@
+package auth
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func basicHeader(user, pass string) []byte {
+	return []byte("Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+pass)))
+}
+
+func TestParseBasicCredentials(t *testing.T) {
+	testParseBasicCredentials(t, string(basicHeader("user", "pass")), "user", "pass", true)
+	testParseBasicCredentials(t, " basic "+base64.StdEncoding.EncodeToString([]byte("u:p:q")), "u", "p:q", true)
+	testParseBasicCredentials(t, "Basic", "", "", false)
+	testParseBasicCredentials(t, "Bearer abc", "", "", false)
+	testParseBasicCredentials(t, "Basic !!!", "", "", false)
+	testParseBasicCredentials(t, "Basic "+base64.StdEncoding.EncodeToString([]byte("nocolon")), "", "", false)
+}
+
+func testParseBasicCredentials(t *testing.T, header, expUser, expPass string, expOK bool) {
+	user, pass, ok := ParseBasicCredentials([]byte(header))
+	if ok != expOK || user != expUser || pass != expPass {
+		t.Fatalf("header %q: expected (%s, %s, %v), got (%s, %s, %v)",
+			header, expUser, expPass, expOK, user, pass, ok)
+	}
+}
+
+func TestBasicWithMemoryStore(t *testing.T) {
+	store := NewMemoryStore(map[string]string{"alice": "secret"})
+	b := NewBasic("", store)
+	if string(b.Challenge()) != `Basic realm="fastproxy"` {
+		t.Fatalf("unexpected challenge %s", b.Challenge())
+	}
+	if user, ok := b.Authenticate(nil, basicHeader("alice", "secret")); !ok || user != "alice" {
+		t.Fatalf("alice should be authenticated")
+	}
+	if _, ok := b.Authenticate(nil, basicHeader("alice", "wrong")); ok {
+		t.Fatalf("wrong password should be rejected")
+	}
+	if _, ok := b.Authenticate(nil, nil); ok {
+		t.Fatalf("empty credentials should be rejected")
+	}
+	store.Set("bob", "pass")
+	if !b.Verify("bob", "pass") {
+		t.Fatalf("bob should be verified after set")
+	}
+	store.Delete("bob")
+	if b.Verify("bob", "pass") {
+		t.Fatalf("bob should be rejected after delete")
+	}
+}
+
+func TestBasicChallengeConcurrently(t *testing.T) {
+	b := &Basic{Realm: "test"}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if string(b.Challenge()) != `Basic realm="test"` {
+				t.Errorf("unexpected challenge %s", b.Challenge())
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestHtpasswdFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fastproxy-auth")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "htpasswd")
+	content := "# comment\n" +
+		"md5:$apr1$saltsalt$LrttParrLPdxvgutaSXWJ0\n" +
+		"sha:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n" +
+		"plain:secret\n"
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	h, err := NewHtpasswdFile(path, true)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	for _, user := range []string{"md5", "sha", "plain"} {
+		if !h.Verify(user, "secret") {
+			t.Fatalf("user %s should be verified", user)
+		}
+		if h.Verify(user, "Secret") {
+			t.Fatalf("user %s should be rejected with wrong password", user)
+		}
+	}
+	if h.Verify("nobody", "secret") {
+		t.Fatalf("unknown user should be rejected")
+	}
+
+	if err := ioutil.WriteFile(path, []byte("bcrypt:$2y$05$abcdefghijklmnopqrstuv\n"), 0600); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := h.Reload(); err == nil {
+		t.Fatalf("bcrypt hash should not be supported")
+	}
+	if !h.Verify("plain", "secret") {
+		t.Fatalf("users should be kept when reload failed")
+	}
+
+	// crypt(3) hashes are taken as plain text passwords only if allowed
+	if err := ioutil.WriteFile(path, []byte("crypt:saEgjgiP.TdtU\n"), 0600); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err := NewHtpasswdFile(path, false); err == nil {
+		t.Fatalf("crypt(3) hash should not be supported")
+	}
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err := NewHtpasswdFile(path, false); err == nil {
+		t.Fatalf("plain text password should not be allowed")
+	}
+}
@@ -0,0 +1,198 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// HtpasswdFile is a credential backend loaded from an Apache htpasswd file.
+//
+// Supported password formats are:
+//
+//   - MD5 (`htpasswd -m`, `$apr1$` prefixed)
+//   - SHA1 (`htpasswd -s`, `{SHA}` prefixed)
+//   - plain text (`htpasswd -p`), only if allowed on creation
+//
+// bcrypt and crypt(3) hashes are not supported, a load error is returned
+// when the file contains them. Since a crypt(3) hash cannot be told from a
+// plain text password, any password without a supported prefix is taken as
+// a crypt(3) hash unless the plain text passwords are allowed.
+type HtpasswdFile struct {
+	path           string
+	allowPlainText bool
+
+	mu    sync.RWMutex
+	users map[string]string
+}
+
+// NewHtpasswdFile loads the users from the htpasswd file of the given path,
+// the passwords without a supported prefix are taken as plain text ones if
+// allowPlainText is set, otherwise they are rejected
+func NewHtpasswdFile(path string, allowPlainText bool) (*HtpasswdFile, error) {
+	h := &HtpasswdFile{path: path, allowPlainText: allowPlainText}
+	if err := h.Reload(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// Reload reloads the users from file, the previous users are kept if any error occurred
+func (h *HtpasswdFile) Reload() error {
+	f, err := os.Open(h.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	users, err := parseHtpasswd(f, h.allowPlainText)
+	if err != nil {
+		return fmt.Errorf("fail to load htpasswd file %s: %s", h.path, err)
+	}
+	h.mu.Lock()
+	h.users = users
+	h.mu.Unlock()
+	return nil
+}
+
+// Verify implements PasswordVerifier
+func (h *HtpasswdFile) Verify(username, password string) bool {
+	h.mu.RLock()
+	hashed, exists := h.users[username]
+	h.mu.RUnlock()
+	if !exists {
+		return false
+	}
+	return verifyHtpasswdHash(hashed, password)
+}
+
+const (
+	htpasswdPrefixSHA  = "{SHA}"
+	htpasswdPrefixAPR1 = "$apr1$"
+)
+
+func parseHtpasswd(r io.Reader, allowPlainText bool) (map[string]string, error) {
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		sep := strings.IndexByte(line, ':')
+		if sep <= 0 {
+			return nil, fmt.Errorf("malformed line %d", lineNum)
+		}
+		username, hashed := line[:sep], line[sep+1:]
+		switch {
+		case strings.HasPrefix(hashed, htpasswdPrefixSHA), strings.HasPrefix(hashed, htpasswdPrefixAPR1):
+		case allowPlainText && !strings.HasPrefix(hashed, "$"):
+		default:
+			return nil, fmt.Errorf("unsupported password hash of user %s at line %d", username, lineNum)
+		}
+		users[username] = hashed
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func verifyHtpasswdHash(hashed, password string) bool {
+	var computed string
+	switch {
+	case strings.HasPrefix(hashed, htpasswdPrefixSHA):
+		digest := sha1.Sum([]byte(password))
+		computed = htpasswdPrefixSHA + base64.StdEncoding.EncodeToString(digest[:])
+	case strings.HasPrefix(hashed, htpasswdPrefixAPR1):
+		salt := hashed[len(htpasswdPrefixAPR1):]
+		if i := strings.IndexByte(salt, '$'); i >= 0 {
+			salt = salt[:i]
+		}
+		computed = apr1MD5(password, salt)
+	default:
+		computed = password
+	}
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(hashed)) == 1
+}
+
+const apr1Itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// apr1MD5 Apache's MD5 based password algorithm, a variant of the FreeBSD MD5 crypt
+// see https://svn.apache.org/viewvc/apr/apr-util/branches/1.3.x/crypto/apr_md5.c
+func apr1MD5(password, salt string) string {
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw := []byte(password)
+
+	alt := md5.New()
+	alt.Write(pw)
+	alt.Write([]byte(salt))
+	alt.Write(pw)
+	altSum := alt.Sum(nil)
+
+	ctx := md5.New()
+	ctx.Write(pw)
+	ctx.Write([]byte(htpasswdPrefixAPR1))
+	ctx.Write([]byte(salt))
+	for i := len(pw); i > 0; i -= md5.Size {
+		if i > md5.Size {
+			ctx.Write(altSum)
+		} else {
+			ctx.Write(altSum[:i])
+		}
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 == 1 {
+			ctx.Write([]byte{0})
+		} else {
+			ctx.Write(pw[:1])
+		}
+	}
+	final := ctx.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		round := md5.New()
+		if i&1 == 1 {
+			round.Write(pw)
+		} else {
+			round.Write(final)
+		}
+		if i%3 != 0 {
+			round.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			round.Write(pw)
+		}
+		if i&1 == 1 {
+			round.Write(final)
+		} else {
+			round.Write(pw)
+		}
+		final = round.Sum(nil)
+	}
+
+	encoded := make([]byte, 0, 22)
+	to64 := func(v uint32, n int) {
+		for ; n > 0; n-- {
+			encoded = append(encoded, apr1Itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	to64(uint32(final[0])<<16|uint32(final[6])<<8|uint32(final[12]), 4)
+	to64(uint32(final[1])<<16|uint32(final[7])<<8|uint32(final[13]), 4)
+	to64(uint32(final[2])<<16|uint32(final[8])<<8|uint32(final[14]), 4)
+	to64(uint32(final[3])<<16|uint32(final[9])<<8|uint32(final[15]), 4)
+	to64(uint32(final[4])<<16|uint32(final[10])<<8|uint32(final[5]), 4)
+	to64(uint32(final[11]), 2)
+	return htpasswdPrefixAPR1 + salt + "$" + string(encoded)
+}
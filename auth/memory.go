@@ -0,0 +1,52 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"sync"
+)
+
+// MemoryStore is an in-memory credential backend,
+// it is safe to change the users while serving
+type MemoryStore struct {
+	mu    sync.RWMutex
+	users map[string][sha256.Size]byte
+}
+
+// NewMemoryStore makes a memory store with the given user name to password map
+func NewMemoryStore(users map[string]string) *MemoryStore {
+	s := &MemoryStore{}
+	for username, password := range users {
+		s.Set(username, password)
+	}
+	return s
+}
+
+// Set adds a user or changes the password of an existing one
+func (s *MemoryStore) Set(username, password string) {
+	s.mu.Lock()
+	if s.users == nil {
+		s.users = make(map[string][sha256.Size]byte)
+	}
+	s.users[username] = sha256.Sum256([]byte(password))
+	s.mu.Unlock()
+}
+
+// Delete removes the user
+func (s *MemoryStore) Delete(username string) {
+	s.mu.Lock()
+	delete(s.users, username)
+	s.mu.Unlock()
+}
+
+// Verify implements PasswordVerifier
+func (s *MemoryStore) Verify(username, password string) bool {
+	s.mu.RLock()
+	digest, exists := s.users[username]
+	s.mu.RUnlock()
+	if !exists {
+		return false
+	}
+	passwordDigest := sha256.Sum256([]byte(password))
+	return subtle.ConstantTimeCompare(digest[:], passwordDigest[:]) == 1
+}
@@ -2,6 +2,7 @@ package client
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
 	"errors"
 	"io"
@@ -12,6 +13,7 @@ import (
 
 	"github.com/haxii/fastproxy/bufiopool"
 	"github.com/haxii/fastproxy/bytebufferpool"
+	"github.com/haxii/fastproxy/http"
 	"github.com/haxii/fastproxy/servertime"
 	"github.com/haxii/fastproxy/superproxy"
 	"github.com/haxii/fastproxy/transport"
@@ -28,6 +30,9 @@ import (
 var ErrConnectionClosed = errors.New("the server closed connection before returning the first response byte. " +
 	"Make sure the server returns 'Connection: close' response header before closing the connection")
 
+// DefaultContinueTimeout default duration waiting for the target's `100 Continue`
+const DefaultContinueTimeout = time.Second
+
 // Request http request used for client
 type Request interface {
 	// Method request method in UPPER case
@@ -48,6 +53,13 @@ type Request interface {
 	// WriteBodyTo read body from request, then Write To buffer IO writer
 	WriteBodyTo(*bufio.Writer) (int, error)
 
+	// ExpectContinue if the request's "Expect" header value is set as
+	// `100-continue`
+	//
+	// the body of such request is written after the target responds
+	// `100 Continue` or the ContinueTimeout elapsed
+	ExpectContinue() bool
+
 	// ConnectionClose if the request's "Connection" header value is
 	// set as `Close`
 	//
@@ -60,6 +72,11 @@ type Request interface {
 
 	// super proxy
 	GetProxy() *superproxy.SuperProxy
+
+	// GetDialer the dialer of the request, the client's dial functions are
+	// used if nil. The connections are pooled by the dialer, so the same
+	// *Dialer should be returned by the requests sharing the connections
+	GetDialer() *Dialer
 }
 
 // Response http response used for client
@@ -67,11 +84,22 @@ type Response interface {
 	// ReadFrom read the http response from the buffer IO reader
 	ReadFrom(discardBody bool, br *bufio.Reader) (int, error)
 
-	// ConnectionClose if the response's "Connection" header value is
-	// set as `Close`
+	// ReadInterimFrom read an interim 1xx response (e.g. `100 Continue`)
+	// from the buffer IO reader, which is followed by the final response
+	ReadInterimFrom(br *bufio.Reader) (int, error)
+
+	// ConnectionClose if the target closes the connection after the response,
+	// i.e. the response's "Connection" header value is set as `Close`, it's a
+	// HTTP/1.0 response without keep-alive, or its body is delimited by
+	// closing the connection
 	//
 	// this determines whether the client reusing the connections
 	ConnectionClose() bool
+
+	// UpgradedReadWriter returns the read writer of the client side if the
+	// response switched the protocol (e.g. WebSocket), the raw traffic is then
+	// forwarded between the target and it. nil if the protocol is not switched
+	UpgradedReadWriter() io.ReadWriter
 }
 
 // Client implements http client.
@@ -96,20 +124,64 @@ type Client struct {
 
 	BufioPool *bufiopool.Pool
 
-	// Maximum duration for full response reading (including body).
+	// Maximum duration for full response reading (including body),
+	// a.k.a. the whole-response deadline after the request written.
 	//
 	// By default response read timeout is unlimited.
 	ReadTimeout time.Duration
 
+	// Maximum duration waiting for the first byte of response after
+	// the request written.
+	//
+	// By default only ReadTimeout is applied.
+	FirstByteTimeout time.Duration
+
+	// Maximum duration establishing the TCP connection to the target or
+	// super proxy, which is applied to the default dialers only.
+	//
+	// transport.DefaultDialTimeout is used if not set.
+	DialTimeout time.Duration
+
+	// Maximum duration handshaking TLS with the target or super proxy.
+	//
+	// transport.DefaultTLSHandshakeTimeout is used if not set.
+	TLSHandshakeTimeout time.Duration
+
+	// Tunnels and upgraded connections are closed after idle for this duration.
+	//
+	// MaxIdleConnDuration is used if not set.
+	TunnelIdleTimeout time.Duration
+
 	// Maximum duration for full request writing (including body).
 	//
 	// By default request write timeout is unlimited.
 	WriteTimeout time.Duration
 
+	// Maximum duration waiting for the target's `100 Continue` before
+	// writing the body of the request expecting continue.
+	//
+	// DefaultContinueTimeout is used if not set.
+	ContinueTimeout time.Duration
+
+	// ParsingMode how the response header violating RFC 9112 is handled,
+	// which is passed to the responses implementing SetParsingMode.
+	//
+	// The recoverable violations are normalized by default.
+	ParsingMode http.ParsingMode
+
 	hostClientsLock sync.Mutex
 	// host clients pool, separate common and TLS clients
-	hostClients    map[string]*HostClient
-	hostTLSClients map[string]*HostClient
+	hostClients    map[hostClientKey]*HostClient
+	hostTLSClients map[hostClientKey]*HostClient
+}
+
+// hostClientKey the host clients are keyed by the host connected, the dialer
+// connecting it, and the TLS server name for the TLS targets connected directly,
+// whose connections are bound to the server name
+type hostClientKey struct {
+	hostWithPort  string
+	dialer        *Dialer
+	tlsServerName string
 }
 
 var (
@@ -153,9 +225,11 @@ func (c *Client) DoFake(req Request, resp Response, fakeRespReader io.Reader) er
 	return err
 }
 
-// DoRaw make simple raw traffic forwarding
-func (c *Client) DoRaw(rw io.ReadWriter, sProxy *superproxy.SuperProxy,
-	targetWithPort string, onTunnelMade func(error) error) (rwReadNum, rwWriteNum int64, err error) {
+// DoRaw make simple raw traffic forwarding, the tunnel is made with
+// the dialer, or the client's dial functions if nil,
+// the tunnel is closed when ctx is done
+func (c *Client) DoRaw(ctx context.Context, rw io.ReadWriter, sProxy *superproxy.SuperProxy,
+	dialer *Dialer, targetWithPort string, onTunnelMade func(error) error) (rwReadNum, rwWriteNum int64, err error) {
 	//TODO: TEST DoRaw, Do and DoFake with the same super proxy
 	if rw == nil {
 		return 0, 0, onTunnelMade(errNilReadWriter)
@@ -170,7 +244,7 @@ func (c *Client) DoRaw(rw io.ReadWriter, sProxy *superproxy.SuperProxy,
 		isConnectHostTLS = sProxy.GetProxyType() == superproxy.ProxyTypeHTTPS
 	}
 	return c.getHostClient(connectHostWithPort,
-		isConnectHostTLS).DoRaw(rw, sProxy, targetWithPort, onTunnelMade)
+		isConnectHostTLS, dialer, "").DoRaw(ctx, rw, sProxy, targetWithPort, onTunnelMade)
 }
 
 // Do performs the given http request and fills the given http response.
@@ -179,7 +253,12 @@ func (c *Client) DoRaw(rw io.ReadWriter, sProxy *superproxy.SuperProxy,
 //
 // ErrNoFreeConns is returned if all Client.MaxConnsPerHost connections
 // to the requested host are busy.
-func (c *Client) Do(req Request, resp Response) error {
+//
+// The request is aborted when ctx is done, ctx.Err() is returned then.
+//
+// The failures of dialing, DNS resolving, TLS handshaking and super proxy
+// authentication are told by transport.KindOf.
+func (c *Client) Do(ctx context.Context, req Request, resp Response) error {
 	if req == nil {
 		return errNilReq
 	}
@@ -192,6 +271,7 @@ func (c *Client) Do(req Request, resp Response) error {
 
 	connectHostWithPort := ""
 	isConnectHostTLS := false
+	tlsServerName := ""
 	if sProxy := req.GetProxy(); sProxy != nil {
 		connectHostWithPort = req.GetProxy().HostWithPort()
 		if len(connectHostWithPort) == 0 {
@@ -204,46 +284,85 @@ func (c *Client) Do(req Request, resp Response) error {
 			return errNilTargetHost
 		}
 		isConnectHostTLS = req.IsTLS()
+		if isConnectHostTLS {
+			tlsServerName = req.TLSServerName()
+		}
 	}
 
-	return c.getHostClient(connectHostWithPort, isConnectHostTLS).Do(req, resp)
+	return c.getHostClient(connectHostWithPort, isConnectHostTLS,
+		req.GetDialer(), tlsServerName).Do(ctx, req, resp)
 }
 
-// getHostClient get a host client with providing the host to connect
-// and whether it supports TLS. For a direct connection, connectHostWithPort
-// is the target server. For a proxy connection, connectHostWithPort is the proxy server
+// PendingRequests returns the current number of requests the client is
+// executing with the host using any dialer and TLS server name, isTLS tells
+// whether the host is connected with TLS
+//
+// This function may be used for balancing load among multiple hosts.
+func (c *Client) PendingRequests(connectHostWithPort string, isConnectHostTLS bool) int {
+	c.hostClientsLock.Lock()
+	hostClients := c.hostClients
+	if isConnectHostTLS {
+		hostClients = c.hostTLSClients
+	}
+	pending := 0
+	for key, hc := range hostClients {
+		if key.hostWithPort == connectHostWithPort {
+			pending += hc.PendingRequests()
+		}
+	}
+	c.hostClientsLock.Unlock()
+	return pending
+}
+
+// getHostClient get a host client with providing the host to connect, whether
+// it supports TLS, the dialer connecting it and the TLS server name of the
+// target connected directly. For a direct connection, connectHostWithPort is
+// the target server. For a proxy connection, connectHostWithPort is the proxy server
 func (c *Client) getHostClient(connectHostWithPort string,
-	isConnectHostTLS bool) *HostClient {
+	isConnectHostTLS bool, dialer *Dialer, tlsServerName string) *HostClient {
 	startCleaner := false
 
 	// add or get a host client
 	c.hostClientsLock.Lock()
-	var hostClients map[string]*HostClient
+	var hostClients map[hostClientKey]*HostClient
 	if isConnectHostTLS {
 		if c.hostTLSClients == nil {
-			c.hostTLSClients = make(map[string]*HostClient)
+			c.hostTLSClients = make(map[hostClientKey]*HostClient)
 		}
 		hostClients = c.hostTLSClients
 	} else {
 		if c.hostClients == nil {
-			c.hostClients = make(map[string]*HostClient)
+			c.hostClients = make(map[hostClientKey]*HostClient)
 		}
 		hostClients = c.hostClients
 	}
-	hc := hostClients[connectHostWithPort]
+	key := hostClientKey{hostWithPort: connectHostWithPort, dialer: dialer, tlsServerName: tlsServerName}
+	hc := hostClients[key]
 	if hc == nil {
+		dial, dialTLS := c.Dial, c.DialTLS
+		if dialer != nil {
+			dial, dialTLS = dialer.Dial, dialer.DialTLS
+		}
 		hc = &HostClient{
-			Dial:         c.Dial,
-			DialTLS:      c.DialTLS,
-			BufioPool:    c.BufioPool,
-			ReadTimeout:  c.ReadTimeout,
-			WriteTimeout: c.WriteTimeout,
+			Dial:                dial,
+			DialTLS:             dialTLS,
+			isDialerPrivate:     dialer != nil,
+			BufioPool:           c.BufioPool,
+			ReadTimeout:         c.ReadTimeout,
+			FirstByteTimeout:    c.FirstByteTimeout,
+			DialTimeout:         c.DialTimeout,
+			TLSHandshakeTimeout: c.TLSHandshakeTimeout,
+			TunnelIdleTimeout:   c.TunnelIdleTimeout,
+			WriteTimeout:        c.WriteTimeout,
+			ContinueTimeout:     c.ContinueTimeout,
+			ParsingMode:         c.ParsingMode,
 			ConnManager: transport.ConnManager{
 				MaxConns:            c.MaxConnsPerHost,
 				MaxIdleConnDuration: c.MaxIdleConnDuration,
 			},
 		}
-		hostClients[connectHostWithPort] = hc
+		hostClients[key] = hc
+		hostClientsGauge.Inc()
 		if len(hostClients) == 1 {
 			startCleaner = true
 		}
@@ -256,7 +375,7 @@ func (c *Client) getHostClient(connectHostWithPort string,
 	return hc
 }
 
-func (c *Client) mCleaner(m map[string]*HostClient) {
+func (c *Client) mCleaner(m map[hostClientKey]*HostClient) {
 	mustStop := false
 	for {
 		t := time.Now()
@@ -264,6 +383,7 @@ func (c *Client) mCleaner(m map[string]*HostClient) {
 		for k, v := range m {
 			if t.Sub(v.LastUseTime()) > time.Minute {
 				delete(m, k)
+				hostClientsGauge.Dec()
 			}
 		}
 		if len(m) == 0 {
@@ -296,23 +416,64 @@ type HostClient struct {
 	Dial    func(addr string) (net.Conn, error)
 	DialTLS func(addr string, tlsConfig *tls.Config) (net.Conn, error)
 
-	// cached TLS server config
-	tlsServerConfig *tls.Config
+	// isDialerPrivate the dial functions are provided by the requests, the
+	// connections to HTTP super proxies are not shared with other dialers then
+	isDialerPrivate bool
+
+	// TLS session cache shared by the server names, whose sessions
+	// are cached separately
+	tlsSessionCacheOnce sync.Once
+	tlsSessionCache     tls.ClientSessionCache
 
 	// TODO: should I give each HostClient a bufio pool rather than share one?
 	// BufioPool buffer connection reader & writer pool
 	BufioPool *bufiopool.Pool
 
-	// Maximum duration for full response reading (including body).
+	// Maximum duration for full response reading (including body),
+	// a.k.a. the whole-response deadline after the request written.
 	//
 	// By default response read timeout is unlimited.
 	ReadTimeout time.Duration
 
+	// Maximum duration waiting for the first byte of response after
+	// the request written.
+	//
+	// By default only ReadTimeout is applied.
+	FirstByteTimeout time.Duration
+
+	// Maximum duration establishing the TCP connection to the target or
+	// super proxy, which is applied to the default dialers only.
+	//
+	// transport.DefaultDialTimeout is used if not set.
+	DialTimeout time.Duration
+
+	// Maximum duration handshaking TLS with the target or super proxy.
+	//
+	// transport.DefaultTLSHandshakeTimeout is used if not set.
+	TLSHandshakeTimeout time.Duration
+
+	// Tunnels and upgraded connections are closed after idle for this duration.
+	//
+	// MaxIdleConnDuration is used if not set.
+	TunnelIdleTimeout time.Duration
+
 	// Maximum duration for full request writing (including body).
 	//
 	// By default request write timeout is unlimited.
 	WriteTimeout time.Duration
 
+	// Maximum duration waiting for the target's `100 Continue` before
+	// writing the body of the request expecting continue.
+	//
+	// DefaultContinueTimeout is used if not set.
+	ContinueTimeout time.Duration
+
+	// ParsingMode how the response header violating RFC 9112 is handled,
+	// which is passed to the responses implementing SetParsingMode.
+	//
+	// The recoverable violations are normalized by default.
+	ParsingMode http.ParsingMode
+
 	// ConnManager manager of the connections
 	ConnManager transport.ConnManager
 }
@@ -325,8 +486,9 @@ func (c *HostClient) LastUseTime() time.Time {
 	return time.Unix(startTimeUnix+int64(n), 0)
 }
 
-// DoRaw make simple raw traffic forwarding
-func (c *HostClient) DoRaw(rw io.ReadWriter, superProxy *superproxy.SuperProxy,
+// DoRaw make simple raw traffic forwarding, returns the bytes read from
+// and written to rw, the tunnel is closed when ctx is done
+func (c *HostClient) DoRaw(ctx context.Context, rw io.ReadWriter, superProxy *superproxy.SuperProxy,
 	targetWithPort string, onTunnelMade func(error) error) (rwReadNum, rwWriteNum int64, err error) {
 	// set hostClient's last used time
 	atomic.StoreUint64(&c.lastUseTime, uint64(servertime.CoarseTimeNow().Unix()-startTimeUnix))
@@ -334,19 +496,17 @@ func (c *HostClient) DoRaw(rw io.ReadWriter, superProxy *superproxy.SuperProxy,
 	// retrieve a connection from pool
 	var cc *transport.Conn
 	var netConn net.Conn
+	timeouts := c.timeouts(ctx)
+	dialFunc, dialTLSFunc := c.dialFuncs(ctx, &timeouts)
 	if superProxy == nil {
-		if c.Dial != nil {
-			netConn, err = c.Dial(targetWithPort)
-		} else {
-			netConn, err = transport.Dial(targetWithPort)
-		}
+		netConn, err = dialFunc(targetWithPort)
 	} else {
-		netConn, err = superProxy.MakeTunnel(c.Dial, c.DialTLS, c.BufioPool, targetWithPort)
+		netConn, err = superProxy.MakeTunnel(ctx, dialFunc, dialTLSFunc, c.BufioPool, targetWithPort)
 	}
 	if err != nil {
 		return 0, 0, onTunnelMade(err)
 	}
-	cc, err = c.ConnManager.AcquireConn(dialerWrapper(netConn, err))
+	cc, err = c.ConnManager.AcquireNewConn(dialerWrapper(netConn, err))
 	if err != nil {
 		return 0, 0, onTunnelMade(err)
 	}
@@ -386,13 +546,15 @@ func (c *HostClient) DoRaw(rw io.ReadWriter, superProxy *superproxy.SuperProxy,
 		}
 	}
 	// forward incoming connection to destination tunnel
+	stopWatching := transport.WatchContext(ctx, conn)
+	counter := &countingConn{Conn: conn}
 	errChan := make(chan error, 2)
 	go func() {
-		_, readErr := transport.Forward(conn, rw, c.ConnManager.MaxIdleConnDuration)
+		_, readErr := transport.Forward(counter, rw, timeouts.TunnelIdle)
 		errChan <- readErr
 	}()
 	go func() {
-		_, writeErr := transport.Forward(rw, conn, c.ConnManager.MaxIdleConnDuration)
+		_, writeErr := transport.Forward(rw, counter, timeouts.TunnelIdle)
 		errChan <- writeErr
 	}()
 	select {
@@ -401,19 +563,48 @@ func (c *HostClient) DoRaw(rw io.ReadWriter, superProxy *superproxy.SuperProxy,
 			err = util.ErrWrapper(err, "error occurred when tunneling")
 		}
 	}
+	stopWatching()
 
 	//TODO: should reuse these connections????? only close socks5 connections? more tests?
 	c.ConnManager.CloseConn(cc)
+	// the data written to the target is read from rw, and vice versa
+	rwReadNum, rwWriteNum = counter.counts()
 	return
 }
 
+// countingConn counts the bytes read from and written to the connection,
+// the counts are updated during forwarding and read when it ends
+type countingConn struct {
+	net.Conn
+	readNum, writeNum int64
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddInt64(&c.readNum, int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	atomic.AddInt64(&c.writeNum, int64(n))
+	return n, err
+}
+
+// counts returns the written and read bytes
+func (c *countingConn) counts() (int64, int64) {
+	return atomic.LoadInt64(&c.writeNum), atomic.LoadInt64(&c.readNum)
+}
+
 // Do performs the given http request and sets the corresponding response.
 //
 // The function doesn't follow redirects.
 //
 // ErrNoFreeConns is returned if all HostClient.MaxConns connections
 // to the host are busy.
-func (c *HostClient) Do(req Request, resp Response) (err error) {
+//
+// The request is aborted when ctx is done, ctx.Err() is returned then.
+func (c *HostClient) Do(ctx context.Context, req Request, resp Response) (err error) {
 	if req == nil {
 		return errors.New("nil request")
 	}
@@ -430,22 +621,24 @@ func (c *HostClient) Do(req Request, resp Response) (err error) {
 	buffer := bytebufferpool.Get()
 	var retry bool
 	for {
-		retry, err = c.do(req, resp, buffer)
+		retry, err = c.do(ctx, req, resp, buffer)
+		if err != nil && ctx.Err() != nil {
+			// the failure is caused by aborting
+			err = ctx.Err()
+			break
+		}
 		if err == nil || !retry {
 			break
 		}
 
 		if !isHeadOrGet(req.Method()) {
-			// Retry non-idempotent requests if the server closes
-			// the connection before sending the response.
-			//
-			// This case is possible if the server closes the idle
-			// keep-alive connection on timeout.
+			// Do NOT retry non-idempotent requests, their bodies are
+			// streamed from the request rather than cached for retry,
+			// which can't be written again.
 			//
-			// Apache and Nginx usually do this.
-			if err != io.EOF {
-				break
-			}
+			// The idle keep-alive connections closed by the server on
+			// timeout are detected before reuse, see ConnManager.
+			break
 		}
 		attempts++
 		if attempts >= maxAttempts {
@@ -472,26 +665,43 @@ func (c *HostClient) PendingRequests() int {
 
 var errDialEOF = errors.New("dial EOF")
 
-func (c *HostClient) do(req Request, resp Response,
+func (c *HostClient) do(ctx context.Context, req Request, resp Response,
 	reqCacheForRetry *bytebufferpool.ByteBuffer) (retry bool, e error) {
 	// set hostClient's last used time
 	atomic.StoreUint64(&c.lastUseTime, uint64(servertime.CoarseTimeNow().Unix()-startTimeUnix))
 
-	// analysis request type
-	viaProxy := req.GetProxy() != nil
+	// analysis request type, the connections to HTTP super proxies are pooled
+	// by the super proxy unless dialed by the request's dialer, the tunnels made
+	// through super proxies are bound to the target, which are never reused
+	reqType := parseRequestType(req.GetProxy(), req.IsTLS())
+	connManager := &c.ConnManager
+	acquireConn := connManager.AcquireConn
+	isTunnel := false
+	switch reqType {
+	case requestProxyHTTP:
+		if !c.isDialerPrivate {
+			connManager = req.GetProxy().ConnManager()
+			acquireConn = connManager.AcquireConn
+		}
+	case requestProxyHTTPS, requestProxySOCKS5:
+		acquireConn = connManager.AcquireNewConn
+		isTunnel = true
+	}
 
 	// get the connection
 	var cc *transport.Conn
 	var err error
 
-	cc, err = c.ConnManager.AcquireConn(c.makeDialer(req.GetProxy(),
+	cc, err = acquireConn(c.makeDialer(ctx, req.GetProxy(),
 		req.TargetWithPort(), req.IsTLS(), req.TLSServerName()))
 
 	redialCount := 0
 	for err == io.EOF && redialCount < 3 {
 		redialCount++
-		time.Sleep(time.Duration(redialCount*300) * time.Millisecond)
-		cc, err = c.ConnManager.AcquireConn(c.makeDialer(req.GetProxy(),
+		if !sleepContext(ctx, time.Duration(redialCount*300)*time.Millisecond) {
+			return false, ctx.Err()
+		}
+		cc, err = acquireConn(c.makeDialer(ctx, req.GetProxy(),
 			req.TargetWithPort(), req.IsTLS(), req.TLSServerName()))
 	}
 	if err != nil {
@@ -502,6 +712,10 @@ func (c *HostClient) do(req Request, resp Response,
 	}
 	conn := cc.Get()
 
+	// abort the reading and writing when ctx is done
+	stopWatching := transport.WatchContext(ctx, conn)
+	defer stopWatching()
+
 	// pre-setup
 	if c.WriteTimeout > 0 {
 		// Optimization: update write deadline only if more than 25%
@@ -510,90 +724,225 @@ func (c *HostClient) do(req Request, resp Response,
 		currentTime := servertime.CoarseTimeNow()
 		if currentTime.Sub(cc.LastWriteDeadlineTime) > (c.WriteTimeout >> 2) {
 			if err = conn.SetWriteDeadline(currentTime.Add(c.WriteTimeout)); err != nil {
-				c.ConnManager.CloseConn(cc)
+				connManager.CloseConn(cc)
 				return true, err
 			}
 			cc.LastWriteDeadlineTime = currentTime
 		}
 	}
 	resetConnection := false
-	if c.ConnManager.MaxConnDuration > 0 &&
-		time.Since(cc.CreatedTime()) > c.ConnManager.MaxConnDuration &&
+	if connManager.MaxConnDuration > 0 &&
+		time.Since(cc.CreatedTime()) > connManager.MaxConnDuration &&
 		!req.ConnectionClose() {
 		resetConnection = true
 	}
 
 	// write request
+	br := c.BufioPool.AcquireReader(conn)
 	shouldCacheReqForRetry := (reqCacheForRetry != nil) && isHeadOrGet(req.Method())
 	isCachedReqAvailable := func() bool { return shouldCacheReqForRetry && (reqCacheForRetry.Len() > 0) }
 	if (!shouldCacheReqForRetry) || (!isCachedReqAvailable()) {
 		// determine where the parsed request should write to
 		var reqWriteToTarget io.Writer
+		var waitContinue func() (bool, error)
 		if shouldCacheReqForRetry {
 			reqWriteToTarget = reqCacheForRetry
 		} else {
 			reqWriteToTarget = conn
+			if req.ExpectContinue() {
+				waitContinue = func() (bool, error) {
+					return c.waitContinue(ctx, cc, br, resp)
+				}
+			}
 		}
-		if err = c.readFromReqAndWriteToIOWriter(req, reqWriteToTarget); err != nil {
+		bodySkipped, err := c.readFromReqAndWriteToIOWriter(req, reqWriteToTarget, waitContinue)
+		if err != nil {
 			if shouldCacheReqForRetry {
 				reqCacheForRetry.Reset()
 			}
-			c.ConnManager.CloseConn(cc)
+			c.BufioPool.ReleaseReader(br)
+			connManager.CloseConn(cc)
 			// cannot even read a complete request, do NOT retry
 			return false, err
 		}
+		if bodySkipped {
+			// the unread body is left in the request, the connection
+			// is no longer in a known state
+			resetConnection = true
+		}
 	}
 	if isCachedReqAvailable() {
 		// write the cached http requests to conn
 		if _, err = c.writeData(reqCacheForRetry.Bytes(), conn); err != nil {
-			c.ConnManager.CloseConn(cc)
+			c.BufioPool.ReleaseReader(br)
+			connManager.CloseConn(cc)
 			return true, err
 		}
 	}
 
 	// get response
-	if c.ReadTimeout > 0 {
+	timeouts := c.timeouts(ctx)
+	// the deadlines are set exactly for the request if they differ from the
+	// client's ones, which are cleared after the response read
+	isDeadlineExact := timeouts.FirstByte > 0 || timeouts.Response != c.ReadTimeout
+	startTime := time.Now()
+	if isDeadlineExact {
+		firstByteTimeout := timeouts.FirstByte
+		if firstByteTimeout <= 0 || (timeouts.Response > 0 && timeouts.Response < firstByteTimeout) {
+			firstByteTimeout = timeouts.Response
+		}
+		if err = setReadDeadline(cc, startTime, firstByteTimeout); err != nil {
+			c.BufioPool.ReleaseReader(br)
+			connManager.CloseConn(cc)
+			return true, err
+		}
+	} else if c.ReadTimeout > 0 {
 		// Optimization: update read deadline only if more than 25%
 		// of the last read deadline exceeded.
 		// See https:// github.com/golang/go/issues/15133 for details.
 		currentTime := servertime.CoarseTimeNow()
 		if currentTime.Sub(cc.LastReadDeadlineTime) > (c.ReadTimeout >> 2) {
 			if err = conn.SetReadDeadline(currentTime.Add(c.ReadTimeout)); err != nil {
-				c.ConnManager.CloseConn(cc)
+				c.BufioPool.ReleaseReader(br)
+				connManager.CloseConn(cc)
 				return true, err
 			}
 			cc.LastReadDeadlineTime = currentTime
 		}
 	}
-	br := c.BufioPool.AcquireReader(conn)
 	// read a byte from response to test if the connection has been closed by remote
-	if b, err := br.Peek(1); err != nil {
-		if err == io.EOF {
+	if b, err := br.Peek(1); err != nil || len(b) == 0 {
+		c.BufioPool.ReleaseReader(br)
+		connManager.CloseConn(cc)
+		if err == nil || err == io.EOF {
 			return true, io.EOF
 		}
 		return false, err
-	} else if len(b) == 0 {
-		return true, io.EOF
+	}
+	if isDeadlineExact && timeouts.FirstByte > 0 {
+		if err = setReadDeadline(cc, startTime, timeouts.Response); err != nil {
+			c.BufioPool.ReleaseReader(br)
+			connManager.CloseConn(cc)
+			return false, err
+		}
 	}
 
+	if s, ok := resp.(parsingModeSetter); ok {
+		s.SetParsingMode(c.ParsingMode)
+	}
 	if _, err = resp.ReadFrom(isHead(req.Method()), br); err != nil {
 		c.BufioPool.ReleaseReader(br)
-		c.ConnManager.CloseConn(cc)
+		connManager.CloseConn(cc)
+		return false, err
+	}
+
+	// protocol switched, forward the raw traffic until any side closed,
+	// the upgraded connection is no longer aborted by ctx
+	stopWatching()
+	if rw := resp.UpgradedReadWriter(); rw != nil {
+		if err = ctx.Err(); err != nil {
+			c.BufioPool.ReleaseReader(br)
+			connManager.CloseConn(cc)
+			return false, err
+		}
+		err = c.forwardUpgraded(connManager, cc, br, rw, timeouts.TunnelIdle)
+		c.BufioPool.ReleaseReader(br)
 		return false, err
 	}
+	// data followed by the response is unexpected, which is lost after
+	// the reader released, the connection is no longer usable then
+	if br.Buffered() > 0 {
+		resetConnection = true
+	}
 	c.BufioPool.ReleaseReader(br)
 
-	// release or close connection
-	if viaProxy || resetConnection || req.ConnectionClose() || resp.ConnectionClose() {
-		//TODO: reuse super proxy connections
-		c.ConnManager.CloseConn(cc)
+	// release or close connection, the deadline is broken if aborted
+	if ctx.Err() != nil || isTunnel || resetConnection || req.ConnectionClose() || resp.ConnectionClose() {
+		connManager.CloseConn(cc)
+	} else if isDeadlineExact && setReadDeadline(cc, startTime, 0) != nil {
+		connManager.CloseConn(cc)
 	} else {
-		c.ConnManager.CloseConn(cc)
+		connManager.ReleaseConn(cc)
 	}
 
 	return false, err
 }
 
+// parsingModeSetter is implemented by the response which checks its header
+// against RFC 9112, e.g. for the response splitting
+type parsingModeSetter interface {
+	SetParsingMode(mode http.ParsingMode)
+}
+
+// readDeadlineSetter is implemented by the upgraded read writer which
+// can be interrupted by setting a read deadline, e.g. net.Conn
+type readDeadlineSetter interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// forwardUpgraded forwards the raw traffic between the upgraded connection and
+// the client side read writer, the same way as DoRaw does for tunnels.
+// Buffered data in br which is sent right after the switching response is
+// forwarded firstly, the connection is closed after forwarding.
+func (c *HostClient) forwardUpgraded(connManager *transport.ConnManager, cc *transport.Conn,
+	br *bufio.Reader, rw io.ReadWriter, idle time.Duration) (err error) {
+	conn := cc.Get()
+	// the connection is long-lived from now on, the idle duration is
+	// used rather than the read & write timeout
+	if err = conn.SetDeadline(zeroTime); err != nil {
+		connManager.CloseConn(cc)
+		return err
+	}
+	errChan := make(chan error, 2)
+	go func() {
+		_, readErr := transport.Forward(conn, rw, idle)
+		errChan <- readErr
+	}()
+	go func() {
+		_, writeErr := transport.Forward(rw, br, idle)
+		errChan <- writeErr
+	}()
+	err = <-errChan
+
+	// interrupt the other direction, then wait for it to make sure
+	// both br and rw are no longer in use
+	connManager.CloseConn(cc)
+	if s, ok := rw.(readDeadlineSetter); ok {
+		s.SetReadDeadline(time.Now())
+	}
+	<-errChan
+	if err != nil {
+		err = util.ErrWrapper(err, "error occurred when forwarding upgraded connection")
+	}
+	return err
+}
+
+var zeroTime time.Time
+
+// setReadDeadline sets the read deadline of cc to timeout after startTime,
+// the deadline is cleared if timeout not set
+func setReadDeadline(cc *transport.Conn, startTime time.Time, timeout time.Duration) error {
+	deadline := zeroTime
+	if timeout > 0 {
+		deadline = startTime.Add(timeout)
+	}
+	// the deadline is no longer the one updated by the optimization
+	cc.LastReadDeadlineTime = zeroTime
+	return cc.Get().SetReadDeadline(deadline)
+}
+
+// sleepContext sleeps for duration d, returns false if ctx is done before that
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	t := servertime.AcquireTimer(d)
+	defer servertime.ReleaseTimer(t)
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
 func (c *HostClient) writeData(data []byte, w io.Writer) (int, error) {
 	bw := c.BufioPool.AcquireWriter(w)
 	defer c.BufioPool.ReleaseWriter(bw)
@@ -606,7 +955,59 @@ func (c *HostClient) writeData(data []byte, w io.Writer) (int, error) {
 	return wn, bw.Flush()
 }
 
-func (c *HostClient) readFromReqAndWriteToIOWriter(req Request, w io.Writer) (err error) {
+// waitContinue waits for the target's response to the request expecting continue
+// before writing its body, the interim responses are read into resp. It returns
+// true if the body should be written, which is the case of `100 Continue` or no
+// response within the ContinueTimeout, and false if the target responds the final
+// status early, which is then read as usual.
+func (c *HostClient) waitContinue(ctx context.Context, cc *transport.Conn,
+	br *bufio.Reader, resp Response) (writeBody bool, err error) {
+	timeout := c.ContinueTimeout
+	if timeout <= 0 {
+		timeout = DefaultContinueTimeout
+	}
+	conn := cc.Get()
+	// restore the read deadline, which is updated again before reading the
+	// final response if the read timeout is set
+	cc.LastReadDeadlineTime = zeroTime
+	defer func() {
+		if e := conn.SetReadDeadline(zeroTime); e != nil && err == nil {
+			err = e
+		}
+	}()
+	deadline := time.Now().Add(timeout)
+	for {
+		if err = conn.SetReadDeadline(deadline); err != nil {
+			return false, err
+		}
+		if _, err = br.Peek(1); err != nil {
+			if e, ok := err.(net.Error); ok && e.Timeout() && ctx.Err() == nil {
+				// the target may not support the expectation, send the body anyway
+				return true, nil
+			}
+			return false, err
+		}
+		statusCode, err := http.PeekStatusCode(br)
+		if err != nil {
+			return false, err
+		}
+		if !http.IsStatusInterim(statusCode) {
+			return false, nil
+		}
+		if _, err = resp.ReadInterimFrom(br); err != nil {
+			return false, err
+		}
+		if statusCode == http.StatusContinue {
+			return true, nil
+		}
+		// other interim responses like `103 Early Hints`, keep waiting
+	}
+}
+
+// readFromReqAndWriteToIOWriter writes the request to w, waitContinue is called
+// before writing the body if not nil, returns true if the body is skipped then
+func (c *HostClient) readFromReqAndWriteToIOWriter(req Request, w io.Writer,
+	waitContinue func() (bool, error)) (bodySkipped bool, err error) {
 	bw := c.BufioPool.AcquireWriter(w)
 	defer c.BufioPool.ReleaseWriter(bw)
 	isReqProxyHTTP := parseRequestType(req.GetProxy(), req.IsTLS()) == requestProxyHTTP
@@ -626,25 +1027,38 @@ func (c *HostClient) readFromReqAndWriteToIOWriter(req Request, w io.Writer) (er
 	if isReqProxyHTTP {
 		if authHeader := req.GetProxy().HTTPProxyAuthHeaderWithCRLF(); authHeader != nil {
 			if nw, err := bw.Write(authHeader); err != nil {
-				return err
+				return false, err
 			} else if nw != len(authHeader) {
-				return io.ErrShortWrite
+				return false, io.ErrShortWrite
 			}
 		}
 	}
 	// other request headers
 	if _, _, err := req.WriteHeaderTo(bw); err != nil {
-		return err
+		return false, err
 	}
 
 	// do not read contents for get and head
 	if isHeadOrGet(req.Method()) {
-		return bw.Flush()
+		return false, bw.Flush()
+	}
+	// wait for the target's decision before sending the body
+	if waitContinue != nil {
+		if err = bw.Flush(); err != nil {
+			return false, err
+		}
+		writeBody, err := waitContinue()
+		if err != nil {
+			return false, err
+		}
+		if !writeBody {
+			return true, nil
+		}
 	}
 	// request body
 	if _, err := req.WriteBodyTo(bw); err != nil {
-		return err
+		return false, err
 	}
 
-	return bw.Flush()
+	return false, bw.Flush()
 }
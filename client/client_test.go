@@ -3,6 +3,7 @@ package client
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -12,6 +13,7 @@ import (
 	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -87,7 +89,7 @@ func testClientDoByDefaultParameters(t *testing.T) {
 	req := &SimpleRequest{}
 	req.SetTargetWithPort("0.0.0.0:10000")
 	resp := &SimpleResponse{}
-	_, _, _, err = c.Do(req, resp)
+	err = c.Do(context.Background(), req, resp)
 	if err != nil {
 		t.Fatalf("unexpected error : %s", err.Error())
 	}
@@ -106,7 +108,7 @@ func testClientDoWithBigHeader(t *testing.T) {
 	req := &BigHeaderRequest{}
 	req.SetTargetWithPort("0.0.0.0:8888")
 	resp := &SimpleResponse{}
-	_, _, _, err = c.Do(req, resp)
+	err = c.Do(context.Background(), req, resp)
 	if err == nil {
 		t.Fatalf("expected error : %s", io.ErrShortWrite.Error())
 	}
@@ -128,7 +130,7 @@ func testClientDoConcurrentWithLargeNumber(t *testing.T) {
 			req := &SimpleRequest{}
 			req.SetTargetWithPort("127.0.0.1:10000")
 			resp := &SimpleResponse{}
-			if _, _, _, err := c.Do(req, resp); err != nil {
+			if err := c.Do(context.Background(), req, resp); err != nil {
 				resultCh <- fmt.Errorf("unexpected error: %s", err)
 				return
 			}
@@ -198,7 +200,7 @@ func testClientDoTimeoutSuccess(t *testing.T, c *Client, n int) {
 			t.Fatalf("unexpected error: %s", err.Error())
 		}
 
-		_, _, _, err = c.Do(req, resp)
+		err = c.Do(context.Background(), req, resp)
 		if err != nil {
 			t.Fatalf("unexpected error: %s", err.Error())
 		}
@@ -245,7 +247,7 @@ func testClientDoWithErrorParamter(t *testing.T, bPool *bufiopool.Pool, req *Sim
 	c := &Client{
 		BufioPool: bPool,
 	}
-	_, _, _, err := c.Do(req, resp)
+	err := c.Do(context.Background(), req, resp)
 	if err == nil {
 		t.Fatal("expecting error")
 	}
@@ -264,14 +266,14 @@ func testClientDoWithEmptyRequestAndResponse(t *testing.T) {
 	c := &Client{
 		BufioPool: bPool,
 	}
-	_, _, _, err := c.Do(nil, resp)
+	err := c.Do(context.Background(), nil, resp)
 	if err == nil {
 		t.Fatal("expecting error")
 	}
 	if err != errNilReq {
 		t.Fatalf("unexpected error: %s", err.Error())
 	}
-	_, _, _, err = c.Do(req, nil)
+	err = c.Do(context.Background(), req, nil)
 	if err == nil {
 		t.Fatal("expecting error")
 	}
@@ -295,7 +297,7 @@ func testClientDoTimeoutError(t *testing.T, c *Client, n int) {
 		req.SetTargetWithPort("127.0.0.1:10000")
 		resp := &SimpleResponse{}
 
-		_, _, _, err = c.Do(req, resp)
+		err = c.Do(context.Background(), req, resp)
 		if err != nil {
 			if !strings.Contains(err.Error(), "timeout") {
 				t.Fatalf("unexpected error: %s", err.Error())
@@ -308,13 +310,13 @@ func testClientDoTimeoutError(t *testing.T, c *Client, n int) {
 func testClientDoIsIdempotent(t *testing.T) {
 	go func() {
 		ln, err := net.Listen("tcp4", "0.0.0.0:8080")
-		i := 0
+		var i int32
 		if err != nil {
-			t.Fatalf("unexpected error: %s", err.Error())
+			t.Errorf("unexpected error: %s", err.Error())
+			return
 		}
 		nethttp.HandleFunc("/idempotent", func(w nethttp.ResponseWriter, r *nethttp.Request) {
-			i++
-			if i < 5 {
+			if atomic.AddInt32(&i, 1) < 5 {
 				conn, _, _ := w.(nethttp.Hijacker).Hijack()
 				conn.Close()
 			} else {
@@ -333,7 +335,7 @@ func testClientDoIsIdempotent(t *testing.T) {
 	req.SetTargetWithPort("127.0.0.1:8080")
 	req.SetPathWithQueryFragment([]byte("/idempotent"))
 	resp := &SimpleResponse{}
-	_, _, _, err := c.Do(req, resp)
+	err := c.Do(context.Background(), req, resp)
 	if err != nil {
 		t.Fatalf("unexpected error: %s", err.Error())
 	}
@@ -355,7 +357,7 @@ func testClientDoWithBigBodyResponse(t *testing.T) {
 	req := &BigHeaderRequest{}
 	req.SetTargetWithPort("0.0.0.0:8888")
 	resp := &BigBodyResponse{}
-	_, _, _, err = c.Do(req, resp)
+	err = c.Do(context.Background(), req, resp)
 	if err == nil {
 		t.Fatalf("unexpected error: %s", io.ErrShortWrite.Error())
 	}
@@ -391,7 +393,7 @@ func testHostClientPendingRequests(t *testing.T) {
 			req := &SimpleRequest{}
 			req.SetTargetWithPort("127.0.0.1:9321")
 			resp := &SimpleResponse{}
-			if _, _, _, err := c.Do(req, resp); err != nil {
+			if err := c.Do(context.Background(), req, resp); err != nil {
 				resultCh <- fmt.Errorf("unexpected error: %s", err)
 				return
 			}
@@ -481,7 +483,8 @@ PAnrpRqdDz9eQITxrUgW8vJKxBH6hNNGcMz9VHUgnsSE
 `
 		f, err := os.Create(".server.crt")
 		if err != nil {
-			t.Fatalf("unexpected error: %s", err)
+			t.Errorf("unexpected error: %s", err)
+			return
 		}
 		f.Write([]byte(serverCrt))
 		f.Close()
@@ -503,7 +506,7 @@ PAnrpRqdDz9eQITxrUgW8vJKxBH6hNNGcMz9VHUgnsSE
 	}
 	req := &HTTPSRequest{}
 	resp := &SimpleResponse{}
-	_, _, _, err = c.Do(req, resp)
+	err = c.Do(context.Background(), req, resp)
 	if err != nil {
 		t.Fatalf("unexpected error : %s", err.Error())
 	}
@@ -519,10 +522,12 @@ func testClientDoWithSameConnectionPostMethod(t *testing.T) {
 	go func() {
 		ln, err := net.Listen("tcp4", "0.0.0.0:10002")
 		if err != nil {
-			t.Fatalf("unexpected error: %s", err.Error())
+			t.Errorf("unexpected error: %s", err.Error())
+			return
 		}
-		i := 0
+		var n int32
 		nethttp.HandleFunc("/closetest", func(w nethttp.ResponseWriter, r *nethttp.Request) {
+			i := atomic.AddInt32(&n, 1) - 1
 			if i > 0 && i < 2 {
 				fmt.Fprintf(w, "Post success")
 				conn, _, _ := w.(nethttp.Hijacker).Hijack()
@@ -534,10 +539,9 @@ func testClientDoWithSameConnectionPostMethod(t *testing.T) {
 			}
 			if i == 1 {
 				if r.Method != "POST" {
-					t.Fatalf("POST Failure")
+					t.Errorf("POST Failure")
 				}
 			}
-			i++
 		})
 		nethttp.Serve(ln, nil)
 	}()
@@ -551,42 +555,22 @@ func testClientDoWithSameConnectionPostMethod(t *testing.T) {
 	req.SetTargetWithPort("127.0.0.1:10002")
 	req.SetPathWithQueryFragment([]byte("/closetest"))
 	resp := &SimpleResponse{}
-	reqR, reqW, respN, err := c.Do(req, resp)
+	err := c.Do(context.Background(), req, resp)
 	if err != nil {
 		t.Fatalf("Unexpected error: %s", err.Error())
 	}
 	if !bytes.Contains(resp.GetBody(), []byte("Connection will close!")) {
 		t.Fatalf("Connection closed by peer, Client can't get any data")
 	}
-	currentReqSize, currentReqWriteSize := req.GetRequestSize()
-	if currentReqSize != reqR {
-		t.Fatal("Request read size count error")
-	}
-	if currentReqWriteSize != reqW {
-		t.Fatal("Request write size count error")
-	}
-	if len(resp.GetBody()) != respN {
-		t.Fatal("Response size count error")
-	}
 
 	req.SetMethod([]byte("POST"))
-	reqR, reqW, respN, err = c.Do(req, resp)
+	err = c.Do(context.Background(), req, resp)
 	if err == nil {
 		t.Fatalf("expected error: %s", ErrConnectionClosed)
 	}
 	if err != ErrConnectionClosed {
 		t.Fatalf("expected error: %s, but unexpected error: %s", ErrConnectionClosed, err)
 	}
-	currentReqSize, currentReqWriteSize = req.GetRequestSize()
-	if currentReqSize != reqR {
-		t.Fatal("Request read size count error")
-	}
-	if currentReqWriteSize != reqW {
-		t.Fatal("Request write size count error")
-	}
-	if respN != 0 {
-		t.Fatalf("unexpected resp num: %d", respN)
-	}
 }
 
 // test client do with post request
@@ -594,11 +578,12 @@ func testClientDoWithPostRequest(t *testing.T) {
 	go func() {
 		ln, err := net.Listen("tcp4", "0.0.0.0:10003")
 		if err != nil {
-			t.Fatalf("unexpected error: %s", err.Error())
+			t.Errorf("unexpected error: %s", err.Error())
+			return
 		}
 		nethttp.HandleFunc("/post", func(w nethttp.ResponseWriter, r *nethttp.Request) {
 			if r.Method != "POST" {
-				t.Fatalf("method is %s", r.Method)
+				t.Errorf("method is %s", r.Method)
 			}
 			conn, _, _ := w.(nethttp.Hijacker).Hijack()
 			conn.Write([]byte("Post success!"))
@@ -617,23 +602,13 @@ func testClientDoWithPostRequest(t *testing.T) {
 	req.SetTargetWithPort("127.0.0.1:10003")
 	req.SetPathWithQueryFragment([]byte("/post"))
 	resp := &SimpleResponse{}
-	reqR, reqW, respN, err := c.Do(req, resp)
+	err = c.Do(context.Background(), req, resp)
 	if err != nil {
 		t.Fatalf("unexpected error : %s", err.Error())
 	}
 	if !bytes.Contains(resp.GetBody(), []byte("Post success!")) {
 		t.Fatal("Response body is wrong")
 	}
-	currentReqSize, currentReqWriteSize := req.GetRequestSize()
-	if currentReqSize != reqR {
-		t.Fatal("Request read size count error")
-	}
-	if currentReqWriteSize != reqW {
-		t.Fatal("Request write size count error")
-	}
-	if respN != len(resp.GetBody()) {
-		t.Fatal("Response data count error")
-	}
 }
 
 // test client do with same connection using get method
@@ -641,15 +616,15 @@ func testClientDoWithSameConnectionGetMethod(t *testing.T) {
 	go func() {
 		ln, err := net.Listen("tcp4", "0.0.0.0:10001")
 		if err != nil {
-			t.Fatalf("unexpected error: %s", err.Error())
+			t.Errorf("unexpected error: %s", err.Error())
+			return
 		}
-		i := 0
+		var i int32
 		nethttp.HandleFunc("/close", func(w nethttp.ResponseWriter, r *nethttp.Request) {
-			if i < 1 {
+			if atomic.AddInt32(&i, 1) == 1 {
 				conn, _, _ := w.(nethttp.Hijacker).Hijack()
 				conn.Write([]byte("Connection will close!"))
 				conn.Close()
-				i++
 			} else {
 				fmt.Fprintf(w, "Hello world!")
 			}
@@ -667,7 +642,7 @@ func testClientDoWithSameConnectionGetMethod(t *testing.T) {
 	req.SetPathWithQueryFragment([]byte("/close"))
 	resp := &SimpleResponse{}
 	for i := 0; i < 2; i++ {
-		reqR, reqW, respN, err := c.Do(req, resp)
+		err := c.Do(context.Background(), req, resp)
 		if err != nil {
 			t.Fatalf("Unexpected error: %s", err.Error())
 		}
@@ -680,16 +655,6 @@ func testClientDoWithSameConnectionGetMethod(t *testing.T) {
 				t.Fatalf("Connection closed by peer, Client can't get any data")
 			}
 		}
-		currentReqSize, currentReqWriteSize := req.GetRequestSize()
-		if currentReqSize != reqR {
-			t.Fatal("Request read size count error")
-		}
-		if currentReqWriteSize != reqW {
-			t.Fatal("Request write size count error")
-		}
-		if len(resp.GetBody()) != respN {
-			t.Fatal("Response size count error")
-		}
 	}
 }
 
@@ -703,14 +668,14 @@ func testClientDoFake(t *testing.T) {
 	resp := &SimpleResponse{}
 	s := "hello faker!"
 	nr := strings.NewReader(s)
-	_, _, _, err := currentClient.DoFake(req, resp, nr)
+	err := currentClient.DoFake(req, resp, nr)
 	if err != nil {
 		t.Fatalf("unexpected error:%s", err)
 	}
 	if !bytes.Contains(resp.GetBody(), []byte("hello faker!")) {
 		t.Fatalf("do fake error, expected data %s, but get unexpected data %s", s, string(resp.GetBody()))
 	}
-	_, _, _, err = currentClient.DoFake(nil, resp, nr)
+	err = currentClient.DoFake(nil, resp, nr)
 	if err == nil {
 		t.Fatalf("expected error: %s", errNilReq)
 	}
@@ -718,7 +683,7 @@ func testClientDoFake(t *testing.T) {
 		t.Fatalf("expected error: %s, but get unexpected error: %s", errNilReq, err)
 	}
 
-	_, _, _, err = currentClient.DoFake(req, nil, nr)
+	err = currentClient.DoFake(req, nil, nr)
 	if err == nil {
 		t.Fatalf("expected error: %s", errNilResp)
 	}
@@ -726,7 +691,7 @@ func testClientDoFake(t *testing.T) {
 		t.Fatalf("expected error: %s, but get unexpected error: %s", errNilResp, err)
 	}
 
-	_, _, _, err = currentClient.DoFake(req, resp, nil)
+	err = currentClient.DoFake(req, resp, nil)
 	if err == nil {
 		t.Fatalf("expected error: %s", errNilFakeResp)
 	}
@@ -796,6 +761,10 @@ func (r *SimpleRequest) WriteBodyTo(w *bufio.Writer) (int, error) {
 	return 0, nil
 }
 
+func (r *SimpleRequest) ExpectContinue() bool {
+	return false
+}
+
 func (r *SimpleRequest) ConnectionClose() bool {
 	return false
 }
@@ -812,6 +781,10 @@ func (r *SimpleRequest) GetProxy() *superproxy.SuperProxy {
 	return nil
 }
 
+func (r *SimpleRequest) GetDialer() *Dialer {
+	return nil
+}
+
 type SimpleResponse struct {
 	size int
 	body []byte
@@ -831,10 +804,18 @@ func (r *SimpleResponse) GetBody() []byte {
 	return r.body
 }
 
+func (r *SimpleResponse) ReadInterimFrom(br *bufio.Reader) (int, error) {
+	return 0, nil
+}
+
 func (r *SimpleResponse) ConnectionClose() bool {
 	return false
 }
 
+func (r *SimpleResponse) UpgradedReadWriter() io.ReadWriter {
+	return nil
+}
+
 func (r *SimpleResponse) GetSize() int {
 	return r.size
 }
@@ -886,6 +867,10 @@ func (r *BigHeaderRequest) WriteBodyTo(w *bufio.Writer) (int, error) {
 	return 0, nil
 }
 
+func (r *BigHeaderRequest) ExpectContinue() bool {
+	return false
+}
+
 func (r *BigHeaderRequest) ConnectionClose() bool {
 	return false
 }
@@ -902,6 +887,10 @@ func (r *BigHeaderRequest) GetProxy() *superproxy.SuperProxy {
 	return nil
 }
 
+func (r *BigHeaderRequest) GetDialer() *Dialer {
+	return nil
+}
+
 func (r *BigHeaderRequest) GetReadSize() int {
 	return r.readSize
 }
@@ -937,10 +926,18 @@ func (r *BigBodyResponse) GetBody() []byte {
 	return r.body
 }
 
+func (r *BigBodyResponse) ReadInterimFrom(br *bufio.Reader) (int, error) {
+	return 0, nil
+}
+
 func (r *BigBodyResponse) ConnectionClose() bool {
 	return false
 }
 
+func (r *BigBodyResponse) UpgradedReadWriter() io.ReadWriter {
+	return nil
+}
+
 func (r *BigBodyResponse) GetSize() int {
 	return r.size
 }
@@ -1007,6 +1004,10 @@ func (r *IdempotentRequest) WriteBodyTo(w *bufio.Writer) (int, error) {
 	return n, err
 }
 
+func (r *IdempotentRequest) ExpectContinue() bool {
+	return false
+}
+
 func (r *IdempotentRequest) ConnectionClose() bool {
 	return false
 }
@@ -1023,6 +1024,10 @@ func (r *IdempotentRequest) GetProxy() *superproxy.SuperProxy {
 	return nil
 }
 
+func (r *IdempotentRequest) GetDialer() *Dialer {
+	return nil
+}
+
 func (r *IdempotentRequest) GetReadSize() int {
 	return 0
 }
@@ -1056,10 +1061,18 @@ func (r *IdempotentResponse) GetBody() []byte {
 	return r.body
 }
 
+func (r *IdempotentResponse) ReadInterimFrom(br *bufio.Reader) (int, error) {
+	return 0, nil
+}
+
 func (r *IdempotentResponse) ConnectionClose() bool {
 	return false
 }
 
+func (r *IdempotentResponse) UpgradedReadWriter() io.ReadWriter {
+	return nil
+}
+
 func (r *IdempotentResponse) GetSize() int {
 	return r.size
 }
@@ -1101,6 +1114,10 @@ func (r *HTTPSRequest) WriteBodyTo(w *bufio.Writer) (int, error) {
 	return 0, nil
 }
 
+func (r *HTTPSRequest) ExpectContinue() bool {
+	return false
+}
+
 func (r *HTTPSRequest) ConnectionClose() bool {
 	return false
 }
@@ -1117,6 +1134,10 @@ func (r *HTTPSRequest) GetProxy() *superproxy.SuperProxy {
 	return nil
 }
 
+func (r *HTTPSRequest) GetDialer() *Dialer {
+	return nil
+}
+
 func (r *HTTPSRequest) GetReadSize() int {
 	return 0
 }
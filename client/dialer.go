@@ -1,6 +1,7 @@
 package client
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
 	"net"
@@ -10,6 +11,13 @@ import (
 	"github.com/haxii/fastproxy/transport"
 )
 
+// Dialer the dial functions of the connections made for requests,
+// the default ones are used if nil
+type Dialer struct {
+	Dial    func(addr string) (net.Conn, error)
+	DialTLS func(addr string, tlsConfig *tls.Config) (net.Conn, error)
+}
+
 type requestType int
 
 const (
@@ -49,49 +57,100 @@ func parseRequestType(superProxy *superproxy.SuperProxy, isHTTPS bool) requestTy
 	return rt
 }
 
-func (c *HostClient) makeDialer(superProxy *superproxy.SuperProxy,
+// makeDialer makes the dialer of the connection manager, which dials only
+// if there is no idle connection to reuse
+func (c *HostClient) makeDialer(ctx context.Context, superProxy *superproxy.SuperProxy,
 	targetWithPort string, isTargetHTTPS bool, targetTLSServerName string) transport.NewConn {
-	reqType := parseRequestType(superProxy, isTargetHTTPS)
-	// setup dial functions
-	dialFunc := c.Dial
-	if dialFunc == nil {
-		dialFunc = transport.Dial
-	}
-	dialTLSFunc := c.DialTLS
-	if dialTLSFunc == nil {
-		dialTLSFunc = transport.DialTLS
+	return func() (net.Conn, error) {
+		return c.dial(ctx, superProxy, targetWithPort, isTargetHTTPS, targetTLSServerName)
 	}
+}
+
+// dial makes a new connection to the target or through the super proxy
+func (c *HostClient) dial(ctx context.Context, superProxy *superproxy.SuperProxy,
+	targetWithPort string, isTargetHTTPS bool, targetTLSServerName string) (net.Conn, error) {
+	reqType := parseRequestType(superProxy, isTargetHTTPS)
+	timeouts := c.timeouts(ctx)
+	dialFunc, dialTLSFunc := c.dialFuncs(ctx, &timeouts)
 	//set https tls config
 	switch reqType {
 	case requestDirectHTTP:
-		return dialerWrapper(dialFunc(targetWithPort))
+		return dialFunc(targetWithPort)
 	case requestDirectHTTPS:
-		if c.tlsServerConfig == nil {
-			c.tlsServerConfig = cert.MakeClientTLSConfig("", targetTLSServerName)
+		tlsConfig := cert.MakeClientTLSConfig("", targetTLSServerName)
+		tlsConfig.ClientSessionCache = c.getTLSSessionCache()
+		conn, err := dialTLSFunc(targetWithPort, tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+		// handshake here rather than on the first write,
+		// so the failure is told from the other ones
+		if err = transport.HandshakeTLS(ctx, conn, timeouts.TLSHandshake); err != nil {
+			conn.Close()
+			return nil, err
 		}
-		return dialerWrapper(dialTLSFunc(targetWithPort, c.tlsServerConfig))
+		return conn, nil
 	case requestProxyHTTP:
-		return dialerWrapper(dialFunc(superProxy.HostWithPort()))
+		return superProxy.Dial(ctx, dialFunc, dialTLSFunc)
 	case requestProxyHTTPS:
 		fallthrough
 	case requestProxySOCKS5:
-		tunnelConn, err := superProxy.MakeTunnel(c.Dial, c.DialTLS, c.BufioPool, targetWithPort)
+		tunnelConn, err := superProxy.MakeTunnel(ctx, dialFunc, dialTLSFunc, c.BufioPool, targetWithPort)
 		if err != nil {
-			return dialerWrapper(nil, err)
+			return nil, err
 		}
 		if isTargetHTTPS {
-			if c.tlsServerConfig == nil {
-				c.tlsServerConfig = &tls.Config{
-					ClientSessionCache: tls.NewLRUClientSessionCache(0),
-					InsecureSkipVerify: true, //TODO: cache every host config in more safe way in a concurrent map
-				}
+			conn := tls.Client(tunnelConn, &tls.Config{
+				ServerName:         targetTLSServerName,
+				ClientSessionCache: c.getTLSSessionCache(),
+				InsecureSkipVerify: true,
+			})
+			if err = transport.HandshakeTLS(ctx, conn, timeouts.TLSHandshake); err != nil {
+				conn.Close()
+				return nil, err
 			}
-			conn := tls.Client(tunnelConn, c.tlsServerConfig)
-			return dialerWrapper(conn, nil)
+			return conn, nil
 		}
-		return dialerWrapper(tunnelConn, nil)
+		return tunnelConn, nil
 	}
-	return dialerWrapper(nil, errors.New("request type not implemented"))
+	return nil, errors.New("request type not implemented")
+}
+
+// dialFuncs the dial functions of the connections, the default ones give up
+// when ctx is done or the timeouts exceed
+func (c *HostClient) dialFuncs(ctx context.Context, timeouts *Timeouts) (
+	func(addr string) (net.Conn, error), func(addr string, tlsConfig *tls.Config) (net.Conn, error)) {
+	dialFunc := c.Dial
+	if dialFunc == nil {
+		dialFunc = func(addr string) (net.Conn, error) {
+			return transport.DialTimeoutContext(ctx, addr, timeouts.Dial)
+		}
+	}
+	dialTLSFunc := c.DialTLS
+	if dialTLSFunc == nil {
+		dialTLSFunc = func(addr string, tlsConfig *tls.Config) (net.Conn, error) {
+			conn, err := transport.DialTimeoutContext(ctx, addr, timeouts.Dial)
+			if err != nil {
+				return nil, err
+			}
+			conn = tls.Client(conn, tlsConfig)
+			if err = transport.HandshakeTLS(ctx, conn, timeouts.TLSHandshake); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			return conn, nil
+		}
+	}
+	return dialFunc, dialTLSFunc
+}
+
+// getTLSSessionCache the TLS session cache shared by the connections
+// of the host client, the TLS configs are made per server name
+func (c *HostClient) getTLSSessionCache() tls.ClientSessionCache {
+	c.tlsSessionCacheOnce.Do(func() {
+		c.tlsSessionCache = tls.NewLRUClientSessionCache(0)
+	})
+	return c.tlsSessionCache
 }
 
 // wrap a connection and error into a transport Dialer
@@ -2,9 +2,20 @@ package client
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	nethttp "net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
 	"testing"
 
+	"github.com/haxii/fastproxy/bufiopool"
 	"github.com/haxii/fastproxy/superproxy"
+	"github.com/haxii/fastproxy/transport"
 )
 
 // test parse request type
@@ -93,3 +104,368 @@ func (r *VariedRequest) GetProxy() *superproxy.SuperProxy {
 func (r *VariedRequest) SetProxy(s *superproxy.SuperProxy) {
 	r.superProxy = s
 }
+
+// test the requests made with different dialers concurrently
+func TestClientDoWithTLSServerNames(t *testing.T) {
+	s := httptest.NewTLSServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		w.Write([]byte(r.TLS.ServerName + "!"))
+	}))
+	defer s.Close()
+	c := &Client{
+		BufioPool: bufiopool.New(bufiopool.MinReadBufferSize, bufiopool.MinWriteBufferSize),
+		DialTLS: func(addr string, tlsConfig *tls.Config) (net.Conn, error) {
+			// the certificate of the test server is not trusted
+			tlsConfig = tlsConfig.Clone()
+			tlsConfig.InsecureSkipVerify = true
+			return tls.Dial("tcp", addr, tlsConfig)
+		},
+	}
+	for _, serverName := range []string{"a.example.com", "b.example.com", "a.example.com"} {
+		req := &serverNameRequest{serverName: serverName}
+		req.SetTargetWithPort(s.Listener.Addr().String())
+		resp := &SimpleResponse{}
+		if err := c.Do(context.Background(), req, resp); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if !bytes.HasSuffix(resp.GetBody(), []byte("\r\n"+serverName+"!")) {
+			t.Fatalf("request of server name %s is sent to the connection of %q", serverName, resp.GetBody())
+		}
+	}
+}
+
+// serverNameRequest the TLS request of the server name
+type serverNameRequest struct {
+	SimpleRequest
+	serverName string
+}
+
+func (r *serverNameRequest) IsTLS() bool {
+	return true
+}
+
+func (r *serverNameRequest) TLSServerName() string {
+	return r.serverName
+}
+
+// test the keep-alive connections to the HTTP super proxy are pooled
+func TestClientDoWithDialer(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				br := bufio.NewReader(c)
+				for {
+					line, err := br.ReadSlice('\n')
+					if err != nil {
+						return
+					}
+					if len(line) == 2 {
+						c.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"))
+					}
+				}
+			}(c)
+		}
+	}()
+
+	c := &Client{BufioPool: bufiopool.New(bufiopool.MinReadBufferSize, bufiopool.MinWriteBufferSize)}
+	dialers := []*taggedDialer{newTaggedDialer("a"), newTaggedDialer("b"), newTaggedDialer("c")}
+	var wg sync.WaitGroup
+	for i := 0; i < 30; i++ {
+		for _, d := range dialers {
+			wg.Add(1)
+			go func(d *taggedDialer) {
+				defer wg.Done()
+				req := &dialerRequest{target: ln.Addr().String(), dialer: d}
+				if err := c.Do(context.Background(), req, &dialerResponse{}); err != nil {
+					t.Errorf("unexpected error: %s", err)
+				}
+			}(d)
+		}
+	}
+	wg.Wait()
+	for _, d := range dialers {
+		if atomic.LoadInt32(&d.dials) == 0 {
+			t.Fatalf("dialer %s is never used", d.tag)
+		}
+		if n := atomic.LoadInt32(&d.mismatches); n > 0 {
+			t.Fatalf("%d requests are written to the connections of dialer %s", n, d.tag)
+		}
+	}
+
+	// tunnels
+	d := newTaggedDialer("d")
+	_, _, err = c.DoRaw(context.Background(), &bytes.Buffer{}, nil, &d.Dialer, ln.Addr().String(), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if atomic.LoadInt32(&d.dials) != 1 {
+		t.Fatalf("tunnel is not made by the dialer")
+	}
+}
+
+// test the pending requests are counted over the host clients of all dialers
+func TestClientPendingRequestsWithDialers(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer ln.Close()
+	readyCh := make(chan struct{}, 3)
+	doneCh := make(chan struct{})
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				br := bufio.NewReader(c)
+				for {
+					line, err := br.ReadSlice('\n')
+					if err != nil {
+						return
+					}
+					if len(line) == 2 {
+						readyCh <- struct{}{}
+						<-doneCh
+						c.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"))
+					}
+				}
+			}(c)
+		}
+	}()
+
+	c := &Client{BufioPool: bufiopool.New(bufiopool.MinReadBufferSize, bufiopool.MinWriteBufferSize)}
+	target := ln.Addr().String()
+	reqs := []Request{
+		&SimpleRequest{targetwithport: target},
+		&dialerRequest{target: target, dialer: newTaggedDialer("a")},
+		&dialerRequest{target: target, dialer: newTaggedDialer("b")},
+	}
+	var wg sync.WaitGroup
+	for _, req := range reqs {
+		wg.Add(1)
+		go func(req Request) {
+			defer wg.Done()
+			if err := c.Do(context.Background(), req, &dialerResponse{}); err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+		}(req)
+	}
+	for range reqs {
+		<-readyCh
+	}
+	if n := c.PendingRequests(target, false); n != len(reqs) {
+		t.Fatalf("unexpected pending requests %d, expecting %d", n, len(reqs))
+	}
+	if n := c.PendingRequests(target, true); n != 0 {
+		t.Fatalf("unexpected pending TLS requests %d", n)
+	}
+	close(doneCh)
+	wg.Wait()
+	if n := c.PendingRequests(target, false); n != 0 {
+		t.Fatalf("unexpected pending requests %d after done", n)
+	}
+}
+
+// taggedDialer dials the connections which only accept the requests tagged by it
+type taggedDialer struct {
+	Dialer
+	tag        string
+	dials      int32
+	mismatches int32
+}
+
+func newTaggedDialer(tag string) *taggedDialer {
+	d := &taggedDialer{tag: tag}
+	d.Dial = func(addr string) (net.Conn, error) {
+		atomic.AddInt32(&d.dials, 1)
+		conn, err := transport.Dial(addr)
+		if err != nil {
+			return nil, err
+		}
+		return &taggedConn{Conn: conn, dialer: d}, nil
+	}
+	return d
+}
+
+type taggedConn struct {
+	net.Conn
+	dialer *taggedDialer
+}
+
+func (c *taggedConn) Write(p []byte) (int, error) {
+	if tag := []byte("X-Dialer: "); bytes.Contains(p, tag) &&
+		!bytes.Contains(p, append(tag, c.dialer.tag...)) {
+		atomic.AddInt32(&c.dialer.mismatches, 1)
+	}
+	return c.Conn.Write(p)
+}
+
+type dialerRequest struct {
+	target string
+	dialer *taggedDialer
+}
+
+func (r *dialerRequest) Method() []byte                         { return []byte("GET") }
+func (r *dialerRequest) TargetWithPort() string                 { return r.target }
+func (r *dialerRequest) PathWithQueryFragment() []byte          { return []byte("/") }
+func (r *dialerRequest) Protocol() []byte                       { return []byte("HTTP/1.1") }
+func (r *dialerRequest) PrePare() error                         { return nil }
+func (r *dialerRequest) WriteBodyTo(*bufio.Writer) (int, error) { return 0, nil }
+func (r *dialerRequest) ExpectContinue() bool                   { return false }
+func (r *dialerRequest) ConnectionClose() bool                  { return false }
+func (r *dialerRequest) IsTLS() bool                            { return false }
+func (r *dialerRequest) TLSServerName() string                  { return "" }
+func (r *dialerRequest) GetProxy() *superproxy.SuperProxy       { return nil }
+func (r *dialerRequest) GetDialer() *Dialer                     { return &r.dialer.Dialer }
+
+func (r *dialerRequest) WriteHeaderTo(w *bufio.Writer) (int, int, error) {
+	header := "Host: " + r.target + "\r\nX-Dialer: " + r.dialer.tag + "\r\n\r\n"
+	n, err := w.WriteString(header)
+	return len(header), n, err
+}
+
+type dialerResponse struct{}
+
+func (r *dialerResponse) ReadFrom(discardBody bool, br *bufio.Reader) (int, error) {
+	n := 0
+	for {
+		line, err := br.ReadSlice('\n')
+		n += len(line)
+		if err != nil {
+			return n, err
+		}
+		if len(line) == 2 {
+			break
+		}
+	}
+	m, err := br.Discard(2)
+	return n + m, err
+}
+
+func (r *dialerResponse) ReadInterimFrom(br *bufio.Reader) (int, error) { return 0, nil }
+func (r *dialerResponse) ConnectionClose() bool                         { return false }
+func (r *dialerResponse) UpgradedReadWriter() io.ReadWriter             { return nil }
+
+// superProxyRequest the request made through the super proxy, with the
+// private dialer if provided
+type superProxyRequest struct {
+	dialerRequest
+	superProxy *superproxy.SuperProxy
+}
+
+func (r *superProxyRequest) GetProxy() *superproxy.SuperProxy { return r.superProxy }
+
+func (r *superProxyRequest) GetDialer() *Dialer {
+	if r.dialer == nil {
+		return nil
+	}
+	return &r.dialer.Dialer
+}
+
+func (r *superProxyRequest) WriteHeaderTo(w *bufio.Writer) (int, int, error) {
+	header := "Host: " + r.target + "\r\n\r\n"
+	n, err := w.WriteString(header)
+	return len(header), n, err
+}
+
+// test the keep-alive connections to the HTTP super proxy are pooled
+func TestClientDoWithSuperProxyConnReuse(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer ln.Close()
+	var (
+		accepts   int32
+		connsLock sync.Mutex
+		conns     []net.Conn
+	)
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&accepts, 1)
+			connsLock.Lock()
+			conns = append(conns, c)
+			connsLock.Unlock()
+			go func(c net.Conn) {
+				defer c.Close()
+				br := bufio.NewReader(c)
+				for {
+					line, err := br.ReadSlice('\n')
+					if err != nil {
+						return
+					}
+					if bytes.HasPrefix(line, []byte("GET /")) {
+						// the requests to super proxies must be absolute-form
+						return
+					}
+					if len(line) == 2 {
+						c.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"))
+					}
+				}
+			}(c)
+		}
+	}()
+	closeServerConns := func() {
+		connsLock.Lock()
+		for _, c := range conns {
+			c.Close()
+		}
+		conns = nil
+		connsLock.Unlock()
+	}
+
+	sp, err := superproxy.NewSuperProxy("127.0.0.1", uint16(ln.Addr().(*net.TCPAddr).Port),
+		superproxy.ProxyTypeHTTP, "", "", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	c := &Client{BufioPool: bufiopool.New(bufiopool.MinReadBufferSize, bufiopool.MinWriteBufferSize)}
+	do := func(d *taggedDialer) {
+		req := &superProxyRequest{dialerRequest{target: "example.com:80", dialer: d}, sp}
+		if err := c.Do(context.Background(), req, &dialerResponse{}); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	// reused by the requests to different targets
+	do(nil)
+	do(nil)
+	if n := atomic.LoadInt32(&accepts); n != 1 {
+		t.Fatalf("unexpected connections %d made to super proxy, expecting 1", n)
+	}
+
+	// the stale pooled connection is given up
+	closeServerConns()
+	do(nil)
+	if n := atomic.LoadInt32(&accepts); n != 2 {
+		t.Fatalf("unexpected connections %d made to super proxy, expecting 2", n)
+	}
+
+	// the private dialers never share the pool of super proxy
+	d := newTaggedDialer("a")
+	do(d)
+	do(d)
+	if n := atomic.LoadInt32(&d.dials); n != 1 {
+		t.Fatalf("unexpected connections %d made by the private dialer, expecting 1", n)
+	}
+	do(nil)
+	if n := atomic.LoadInt32(&accepts); n != 3 {
+		t.Fatalf("unexpected connections %d made to super proxy, expecting 3", n)
+	}
+}
@@ -2,7 +2,9 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"fmt"
+	"io"
 	"net/http"
 	"strings"
 	"time"
@@ -44,6 +46,10 @@ func (r *simpleReq) WriteHeaderTo(w *bufio.Writer) (int, int, error) {
 func (r *simpleReq) WriteBodyTo(w *bufio.Writer) (int, error) {
 	return 0, nil
 }
+func (r *simpleReq) ExpectContinue() bool {
+	return false
+}
+
 func (r *simpleReq) ConnectionClose() bool {
 	return false
 }
@@ -59,6 +65,10 @@ func (r *simpleReq) GetProxy() *superproxy.SuperProxy {
 	return nil
 }
 
+func (r *simpleReq) GetDialer() *client.Dialer {
+	return nil
+}
+
 type simpleResp struct{}
 
 func (r *simpleResp) ReadFrom(discardBody bool, br *bufio.Reader) (int, error) {
@@ -71,10 +81,18 @@ func (r *simpleResp) ReadFrom(discardBody bool, br *bufio.Reader) (int, error) {
 	return len(b), nil
 }
 
+func (r *simpleResp) ReadInterimFrom(br *bufio.Reader) (int, error) {
+	return 0, nil
+}
+
 func (r *simpleResp) ConnectionClose() bool {
 	return false
 }
 
+func (r *simpleResp) UpgradedReadWriter() io.ReadWriter {
+	return nil
+}
+
 type simpleReadWriter struct {
 	readNum int
 }
@@ -119,7 +137,7 @@ func main() {
 	time.Sleep(time.Second)
 	fmt.Println()
 	client := &client.Client{BufioPool: bufiopool.New(1, 1)}
-	fmt.Println(client.Do(&simpleReq{}, &simpleResp{}))
+	fmt.Println(client.Do(context.Background(), &simpleReq{}, &simpleResp{}))
 
 	// Do Fake
 	time.Sleep(time.Second)
@@ -129,6 +147,6 @@ func main() {
 	// Do Raw
 	time.Sleep(time.Second)
 	fmt.Println()
-	fmt.Println(client.DoRaw(&simpleReadWriter{}, nil, "0.0.0.0:8090", nil))
+	fmt.Println(client.DoRaw(context.Background(), &simpleReadWriter{}, nil, nil, "0.0.0.0:8090", nil))
 
 }
@@ -0,0 +1,6 @@
+package client
+
+import "github.com/haxii/fastproxy/metrics"
+
+var hostClientsGauge = metrics.DefaultRegistry.Gauge("fastproxy_client_host_clients",
+	"Number of the host clients kept by the clients.")
@@ -0,0 +1,71 @@
+package client
+
+import (
+	"context"
+	"time"
+
+	"github.com/haxii/fastproxy/transport"
+)
+
+// Timeouts the timeouts of a request which override the client's ones,
+// the zero ones are not overridden
+type Timeouts struct {
+	// Dial max duration establishing the TCP connection to the target or super proxy
+	Dial time.Duration
+	// TLSHandshake max duration handshaking TLS with the target or super proxy
+	TLSHandshake time.Duration
+	// FirstByte max duration waiting for the first byte of response after
+	// the request written
+	FirstByte time.Duration
+	// Response max duration reading the full response (including body)
+	// after the request written
+	Response time.Duration
+	// TunnelIdle max idle duration of the tunnels and upgraded connections
+	TunnelIdle time.Duration
+}
+
+type timeoutsContextKey struct{}
+
+// WithTimeouts returns a copy of ctx carrying the timeouts overriding the
+// client's ones for the request made with it, both Do and DoRaw respect it
+func WithTimeouts(ctx context.Context, timeouts *Timeouts) context.Context {
+	if timeouts == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, timeoutsContextKey{}, timeouts)
+}
+
+// timeouts the timeouts of the request made with ctx
+func (c *HostClient) timeouts(ctx context.Context) Timeouts {
+	t := Timeouts{
+		Dial:         c.DialTimeout,
+		TLSHandshake: c.TLSHandshakeTimeout,
+		FirstByte:    c.FirstByteTimeout,
+		Response:     c.ReadTimeout,
+		TunnelIdle:   c.TunnelIdleTimeout,
+	}
+	if o, ok := ctx.Value(timeoutsContextKey{}).(*Timeouts); ok {
+		if o.Dial > 0 {
+			t.Dial = o.Dial
+		}
+		if o.TLSHandshake > 0 {
+			t.TLSHandshake = o.TLSHandshake
+		}
+		if o.FirstByte > 0 {
+			t.FirstByte = o.FirstByte
+		}
+		if o.Response > 0 {
+			t.Response = o.Response
+		}
+		if o.TunnelIdle > 0 {
+			t.TunnelIdle = o.TunnelIdle
+		}
+	}
+	if t.TunnelIdle <= 0 {
+		t.TunnelIdle = c.ConnManager.MaxIdleConnDuration
+	}
+	if t.TunnelIdle <= 0 {
+		t.TunnelIdle = transport.DefaultMaxIdleConnDuration
+	}
+	return t
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"fmt"
 	"io/ioutil"
@@ -30,9 +29,7 @@ func main() {
 			newPort = info.Port()
 			if strings.Contains(newHost, "postman-echo-via-proxy") {
 				newHost = strings.Replace(newHost, "-via-proxy", "", -1)
-				if info.Context == nil {
-					info.Context = context.WithValue(context.Background(), "proxy", true)
-				}
+				info.Context = context.WithValue(info.Context, "proxy", true)
 			}
 			fmt.Printf("RewriteHost handler called %s:%s -> %s:%s \n",
 				info.Host(), info.Port(), newHost, newPort)
@@ -164,9 +161,9 @@ func hijackPostmanEchoFunc(info *plugin.RequestConnInfo, u *uri.URI,
 	h *plugin.RequestHeader) (*plugin.HijackedRequest, *plugin.HijackedResponse) {
 	fmt.Printf("hijackPostmanEchoFunc called, with Scheme %s Host %s, URL %s, User-Agent %s\n\n",
 		u.Scheme(), u.HostInfo().HostWithPort(), u.PathWithQueryFragment(), h.Get("User-Agent"))
+	h.Set("Host", strings.Replace(h.Get("Host"), "-via-proxy", "", -1))
 	return &plugin.HijackedRequest{
-		SuperProxy:     postmanEchoProxy(info),
-		OverrideHeader: bytes.Replace(h.RawHeader(), []byte("-via-proxy"), []byte(""), -1),
+		SuperProxy: postmanEchoProxy(info),
 	}, nil
 }
 
@@ -1,7 +1,7 @@
 package main
 
 import (
-	"crypto/tls"
+	"context"
 	"fmt"
 	"io"
 	"net"
@@ -10,10 +10,10 @@ import (
 	"sync"
 	"time"
 
+	"github.com/haxii/fastproxy/client"
 	"github.com/haxii/fastproxy/http"
 	"github.com/haxii/fastproxy/proxy"
 	"github.com/haxii/fastproxy/superproxy"
-	"github.com/haxii/fastproxy/transport"
 )
 
 // this example generates a Pintrest proxy and cracks the images request
@@ -33,7 +33,8 @@ type mitmHijackerPool struct {
 	pool sync.Pool
 }
 
-func (p *mitmHijackerPool) Get(clientAddr net.Addr, isHTTPS bool, host, port string) proxy.Hijacker {
+func (p *mitmHijackerPool) Get(ctx context.Context, clientAddr net.Addr, username string,
+	isHTTPS bool, host, port string) proxy.Hijacker {
 	v := p.pool.Get()
 	var h *SimpleHijacker
 	if v == nil {
@@ -90,30 +91,29 @@ func (h *SimpleHijacker) RewriteTLSServerName(serverName string) string {
 	return serverName
 }
 
-func (h *SimpleHijacker) BeforeRequest(method, path []byte, header http.Header, rawHeader []byte) (newPath, newRawHeader []byte) {
-	return path, rawHeader
+func (h *SimpleHijacker) BeforeRequest(method, path []byte, header http.Header, fields *http.HeaderFields) (newPath []byte) {
+	return path
 }
 
 func (h *SimpleHijacker) Resolve() net.IP {
 	return nil
 }
 
-func (h *SimpleHijacker) SuperProxy() *superproxy.SuperProxy {
-	return h.superProxy
+func (h *SimpleHijacker) SuperProxy() (*superproxy.SuperProxy, error) {
+	return h.superProxy, nil
 }
 
 func (h *SimpleHijacker) Block() bool {
 	return false
 }
 
-func (h *SimpleHijacker) Dial() func(addr string) (net.Conn, error) {
-	return func(addr string) (conn net.Conn, e error) { return transport.Dial(addr) }
+func (h *SimpleHijacker) Timeouts() *proxy.Timeouts {
+	return nil
 }
 
-func (h *SimpleHijacker) DialTLS() func(addr string, tlsConfig *tls.Config) (net.Conn, error) {
-	return func(addr string, tlsConfig *tls.Config) (conn net.Conn, e error) {
-		return transport.DialTLS(addr, tlsConfig)
-	}
+func (h *SimpleHijacker) Dialer() *client.Dialer {
+	// the default dialers are used
+	return nil
 }
 
 func (h *SimpleHijacker) OnRequest(path []byte, header http.Header, rawHeader []byte) io.WriteCloser {
@@ -123,10 +123,25 @@ func (h *SimpleHijacker) OnRequest(path []byte, header http.Header, rawHeader []
 	return nil
 }
 
+func (h *SimpleHijacker) TransformRequest(header http.Header, fields *http.HeaderFields) (func(*http.HeaderFields, int64), func(io.Reader) io.Reader, bool) {
+	return nil, nil, false
+}
+
+func (h *SimpleHijacker) RewriteResponse(statusLine http.ResponseLine, header http.Header, fields *http.HeaderFields) int {
+	return 0
+}
+
+func (h *SimpleHijacker) TransformResponse(statusLine http.ResponseLine, header http.Header) (func(io.Reader) io.Reader, bool) {
+	return nil, false
+}
+
 func (h *SimpleHijacker) OnResponse(statusLine http.ResponseLine, header http.Header, rawHeader []byte) io.WriteCloser {
 	return nil
 }
 
+func (h *SimpleHijacker) OnTrailers(isResponse bool, trailers *http.HeaderFields) {
+}
+
 func (h *SimpleHijacker) AfterResponse(err error) {
 }
 
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"fmt"
 	"io"
@@ -11,6 +12,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/haxii/fastproxy/client"
 	"github.com/haxii/fastproxy/http"
 	"github.com/haxii/fastproxy/proxy"
 	"github.com/haxii/fastproxy/superproxy"
@@ -30,7 +32,8 @@ type SimpleHijackerPool struct {
 	pool sync.Pool
 }
 
-func (p *SimpleHijackerPool) Get(clientAddr net.Addr, isHTTPS bool, host, port string) proxy.Hijacker {
+func (p *SimpleHijackerPool) Get(ctx context.Context, clientAddr net.Addr, username string,
+	isHTTPS bool, host, port string) proxy.Hijacker {
 	v := p.pool.Get()
 	var h *SimpleHijacker
 	if v == nil {
@@ -84,18 +87,16 @@ func (h *SimpleHijacker) RewriteTLSServerName(serverName string) string {
 	return serverName
 }
 
-func (h *SimpleHijacker) BeforeRequest(method, path []byte, header http.Header, rawHeader []byte) (newPath, newRawHeader []byte) {
-	newPath = path
-	newRawHeader = rawHeader
-	if bytes.Contains(rawHeader, []byte("no-proxy")) {
+func (h *SimpleHijacker) BeforeRequest(method, path []byte, header http.Header, fields *http.HeaderFields) (newPath []byte) {
+	if bytes.Equal(fields.Peek("X-Fast-Proxy"), []byte("no-proxy")) {
 		// curl -H 'X-Fast-Proxy:no-proxy' -x 0.0.0.0:8081 http://httpbin.org/get
 		h.superProxy = nil
 	}
 
-	fmt.Printf("BeforeRequest called   %s with path: %s, rawHeader: %s\n", method, path, strconv.Quote(string(rawHeader)))
-	fmt.Printf("BeforeRequest returned %s with path: %s, rawHeader: %s\n", method, path, strconv.Quote(string(newRawHeader)))
-	return bytes.Replace(newPath, []byte("get"), []byte("get?a=b&&cc=dd#ee"), -1),
-		bytes.Replace(rawHeader, []byte("curl"), []byte("xurl"), -1)
+	fmt.Printf("BeforeRequest called   %s with path: %s, header: %s\n", method, path, strconv.Quote(fields.String()))
+	fields.SetBytes("User-Agent", bytes.Replace(fields.Peek("User-Agent"), []byte("curl"), []byte("xurl"), -1))
+	fmt.Printf("BeforeRequest returned %s with path: %s, header: %s\n", method, path, strconv.Quote(fields.String()))
+	return bytes.Replace(path, []byte("get"), []byte("get?a=b&&cc=dd#ee"), -1)
 }
 
 func (h *SimpleHijacker) Resolve() net.IP {
@@ -103,13 +104,13 @@ func (h *SimpleHijacker) Resolve() net.IP {
 	return nil
 }
 
-func (h *SimpleHijacker) SuperProxy() *superproxy.SuperProxy {
+func (h *SimpleHijacker) SuperProxy() (*superproxy.SuperProxy, error) {
 	if h.superProxy != nil {
 		fmt.Println("SuperProxy called, using super proxy", h.superProxy.HostWithPort())
 	} else {
 		fmt.Println("SuperProxy called, no super proxy used")
 	}
-	return h.superProxy
+	return h.superProxy, nil
 }
 
 func (h *SimpleHijacker) Block() bool {
@@ -122,18 +123,24 @@ func (h *SimpleHijacker) Block() bool {
 	return shouldBlock
 }
 
-func (h *SimpleHijacker) Dial() func(addr string) (net.Conn, error) {
-	return func(addr string) (conn net.Conn, e error) {
-		fmt.Println("Dial called")
-		return transport.Dial(addr)
-	}
+func (h *SimpleHijacker) Timeouts() *proxy.Timeouts {
+	return nil
 }
 
-func (h *SimpleHijacker) DialTLS() func(addr string, tlsConfig *tls.Config) (net.Conn, error) {
-	return func(addr string, tlsConfig *tls.Config) (conn net.Conn, e error) {
+// dialer the connections made by it are pooled, so it's shared by the hijackers
+var dialer = &client.Dialer{
+	Dial: func(addr string) (conn net.Conn, e error) {
+		fmt.Println("Dial called")
+		return transport.Dial(addr)
+	},
+	DialTLS: func(addr string, tlsConfig *tls.Config) (conn net.Conn, e error) {
 		fmt.Println("DialTLS called")
 		return transport.DialTLS(addr, tlsConfig)
-	}
+	},
+}
+
+func (h *SimpleHijacker) Dialer() *client.Dialer {
+	return dialer
 }
 
 func (h *SimpleHijacker) OnRequest(path []byte, header http.Header, rawHeader []byte) io.WriteCloser {
@@ -141,6 +148,18 @@ func (h *SimpleHijacker) OnRequest(path []byte, header http.Header, rawHeader []
 	return nil
 }
 
+func (h *SimpleHijacker) TransformRequest(header http.Header, fields *http.HeaderFields) (func(*http.HeaderFields, int64), func(io.Reader) io.Reader, bool) {
+	return nil, nil, false
+}
+
+func (h *SimpleHijacker) RewriteResponse(statusLine http.ResponseLine, header http.Header, fields *http.HeaderFields) int {
+	return 0
+}
+
+func (h *SimpleHijacker) TransformResponse(statusLine http.ResponseLine, header http.Header) (func(io.Reader) io.Reader, bool) {
+	return nil, false
+}
+
 func (h *SimpleHijacker) OnResponse(statusLine http.ResponseLine, header http.Header, rawHeader []byte) io.WriteCloser {
 	fmt.Println("OnResponse called")
 	return nil
@@ -151,6 +170,10 @@ func (h *SimpleHijacker) HijackResponse() io.ReadCloser {
 	return nil
 }
 
+func (h *SimpleHijacker) OnTrailers(isResponse bool, trailers *http.HeaderFields) {
+	fmt.Printf("OnTrailers called, trailers: %s\n", strconv.Quote(trailers.String()))
+}
+
 func (h *SimpleHijacker) AfterResponse(err error) {
 	fmt.Println("AfterResponse called with error", err)
 }
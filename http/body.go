@@ -2,15 +2,31 @@ package http
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"github.com/haxii/fastproxy/bytebufferpool"
 	"github.com/haxii/fastproxy/util"
 	"io"
 	"math"
+	"strconv"
 )
 
 // Body http body
-type Body struct{}
+type Body struct {
+	// trailers the trailer fields following the last chunk
+	trailers HeaderFields
+}
+
+// Reset resets the trailers parsed
+func (b *Body) Reset() {
+	b.trailers.Reset()
+}
+
+// Trailers the trailer fields of the chunked body parsed,
+// which is empty for the other bodies
+func (b *Body) Trailers() *HeaderFields {
+	return &b.trailers
+}
 
 // BodyType how http body is formed
 type BodyType int
@@ -30,13 +46,14 @@ type BodyWrapper func(isChunkHeader bool, data []byte) (int, error)
 // Parse parse body from reader and wraps data in BodyWrapper
 func (b *Body) Parse(reader *bufio.Reader, bodyType BodyType,
 	contentLength int64, w BodyWrapper) (int, error) {
+	b.trailers.Reset()
 	switch bodyType {
 	case BodyTypeFixedSize:
 		if contentLength > 0 {
 			return parseBodyFixedSize(reader, w, contentLength)
 		}
 	case BodyTypeChunked:
-		return parseBodyChunked(reader, w)
+		return b.parseChunked(reader, w)
 	case BodyTypeIdentity:
 		return parseBodyIdentity(reader, w)
 	}
@@ -81,7 +98,7 @@ func parseBodyFixedSize(src *bufio.Reader, w BodyWrapper, contentLength int64) (
 	}
 }
 
-func parseBodyChunked(src *bufio.Reader, w BodyWrapper) (int, error) {
+func (b *Body) parseChunked(src *bufio.Reader, w BodyWrapper) (int, error) {
 	buffer := bytebufferpool.Get()
 	defer bytebufferpool.Put(buffer)
 	var wn, n int
@@ -96,17 +113,68 @@ func parseBodyChunked(src *bufio.Reader, w BodyWrapper) (int, error) {
 			return wn, err
 		}
 		wn += n
+		if chunkSize == 0 {
+			break
+		}
 		// copy the chunk
-		if n, err = parseBodyFixedSize(src, w,
-			// 2 means the length of `\r\n` i.e. CRLF
-			int64(chunkSize+2)); err != nil {
+		if n, err = parseBodyFixedSize(src, w, int64(chunkSize)); err != nil {
 			return wn, err
 		}
 		wn += n
-		if chunkSize == 0 {
-			return wn, nil
+		// the chunk data must be followed by CRLF
+		if err = readCRLF(src); err != nil {
+			return wn, err
 		}
+		if n, err = w(true, crlf); err != nil {
+			return wn, err
+		}
+		wn += n
 	}
+
+	// copy the trailer fields till the empty line
+	buffer.Reset()
+	if err := readTrailers(src, buffer, &b.trailers); err != nil {
+		return wn, err
+	}
+	n, err := w(true, buffer.B)
+	wn += n
+	return wn, err
+}
+
+// maxTrailersSize the max size of the trailer section
+const maxTrailersSize = 64 * 1024
+
+var errTrailersTooLarge = errors.New("trailer section too large")
+
+// readTrailers reads the trailer section ended with an empty line into buffer,
+// then parses it into trailers
+func readTrailers(r *bufio.Reader, buffer *bytebufferpool.ByteBuffer, trailers *HeaderFields) error {
+	lineStart := buffer.Len()
+	for {
+		line, err := r.ReadSlice('\n')
+		if err != nil && err != bufio.ErrBufferFull {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		buffer.B = append(buffer.B, line...)
+		if buffer.Len() > maxTrailersSize {
+			return errTrailersTooLarge
+		}
+		if err == bufio.ErrBufferFull {
+			// the line is not finished yet
+			continue
+		}
+		if n := buffer.Len() - lineStart; n == 1 || (n == 2 && buffer.B[lineStart] == '\r') {
+			break
+		}
+		lineStart = buffer.Len()
+	}
+	if _, err := trailers.Parse(buffer.B); err != nil {
+		return util.ErrWrapper(err, "fail to parse trailer fields")
+	}
+	return nil
 }
 
 func parseBodyIdentity(src *bufio.Reader, w BodyWrapper) (int, error) {
@@ -132,7 +200,24 @@ func parseChunkSize(r *bufio.Reader, buffer *bytebufferpool.ByteBuffer) (int, er
 		return -1, fmt.Errorf("cannot read '\r' char at the end of chunk size: %s", err)
 	}
 	if c != '\r' {
-		return -1, fmt.Errorf("unexpected char %q at the end of chunk size. Expected %q", c, '\r')
+		if c != ';' && c != ' ' && c != '\t' {
+			return -1, fmt.Errorf("unexpected char %q at the end of chunk size. Expected %q", c, '\r')
+		}
+		// the chunk extensions till the CR
+		r.UnreadByte()
+		ext, err := r.ReadSlice('\r')
+		if err != nil {
+			if err == bufio.ErrBufferFull {
+				return -1, errChunkExtensionsTooLarge
+			}
+			return -1, fmt.Errorf("cannot read '\r' char at the end of chunk extensions: %s", err)
+		}
+		if err := VisitChunkExtensions(ext[:len(ext)-1], nil); err != nil {
+			return -1, err
+		}
+		if _, e := buffer.Write(ext[:len(ext)-1]); e != nil {
+			return -1, e
+		}
 	}
 	c, err = r.ReadByte()
 	if err != nil {
@@ -146,3 +231,248 @@ func parseChunkSize(r *bufio.Reader, buffer *bytebufferpool.ByteBuffer) (int, er
 	}
 	return n, nil
 }
+
+var (
+	errChunkExtensionsTooLarge = errors.New("chunk extensions too large")
+	errMalformedChunkExtension = errors.New("malformed chunk extension")
+)
+
+// VisitChunkExtensions parses the chunk extensions following the chunk size,
+// i.e. `*( BWS ";" BWS ext-name [ BWS "=" BWS ext-val ] )`, then calls f with
+// the name and value of every extension in order, the value is nil if absent and
+// a quoted value is passed with the quotes. f can be nil for validation only.
+func VisitChunkExtensions(ext []byte, f func(name, value []byte)) error {
+	for {
+		ext = trimBWS(ext)
+		if len(ext) == 0 {
+			return nil
+		}
+		if ext[0] != ';' {
+			return errMalformedChunkExtension
+		}
+		ext = trimBWS(ext[1:])
+		n := tokenLen(ext)
+		if n == 0 {
+			return errMalformedChunkExtension
+		}
+		name := ext[:n]
+		ext = trimBWS(ext[n:])
+		var value []byte
+		if len(ext) > 0 && ext[0] == '=' {
+			ext = trimBWS(ext[1:])
+			if len(ext) > 0 && ext[0] == '"' {
+				n = quotedStringLen(ext)
+			} else {
+				n = tokenLen(ext)
+			}
+			if n == 0 {
+				return errMalformedChunkExtension
+			}
+			value = ext[:n]
+			ext = ext[n:]
+		}
+		if f != nil {
+			f(name, value)
+		}
+	}
+}
+
+func trimBWS(b []byte) []byte {
+	for len(b) > 0 && (b[0] == ' ' || b[0] == '\t') {
+		b = b[1:]
+	}
+	return b
+}
+
+// tokenLen the length of the token at the beginning of b
+func tokenLen(b []byte) int {
+	for i, c := range b {
+		if !isTokenChar(c) {
+			return i
+		}
+	}
+	return len(b)
+}
+
+func isTokenChar(c byte) bool {
+	if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') {
+		return true
+	}
+	switch c {
+	case '!', '#', '$', '%', '&', '\'', '*', '+', '-', '.', '^', '_', '`', '|', '~':
+		return true
+	}
+	return false
+}
+
+// quotedStringLen the length of the quoted string at the beginning of b,
+// 0 if it's not closed
+func quotedStringLen(b []byte) int {
+	for i := 1; i < len(b); i++ {
+		switch b[i] {
+		case '"':
+			return i + 1
+		case '\\':
+			i++
+		case '\r', '\n':
+			return 0
+		}
+	}
+	return 0
+}
+
+// BodyReader reads the body from the source reader with the framing removed,
+// i.e. the chunks are decoded, io.EOF is returned at the end of the body
+type BodyReader struct {
+	src         *bufio.Reader
+	bodyType    BodyType
+	bytesRemain int64
+	// chunkRemain bytes remain in the current chunk, -1 before the first chunk
+	chunkRemain int
+	isEOF       bool
+	buffer      bytebufferpool.ByteBuffer
+	trailers    HeaderFields
+}
+
+// Reset resets the reader to read the body of bodyType from src
+func (r *BodyReader) Reset(src *bufio.Reader, bodyType BodyType, contentLength int64) {
+	r.src = src
+	r.bodyType = bodyType
+	r.bytesRemain = contentLength
+	r.chunkRemain = -1
+	r.isEOF = src == nil || (bodyType == BodyTypeFixedSize && contentLength <= 0)
+	r.buffer.Reset()
+	r.trailers.Reset()
+}
+
+// Trailers the trailer fields following the last chunk,
+// which are available after io.EOF returned
+func (r *BodyReader) Trailers() *HeaderFields {
+	return &r.trailers
+}
+
+// Read implements io.Reader
+func (r *BodyReader) Read(p []byte) (int, error) {
+	if r.isEOF {
+		return 0, io.EOF
+	}
+	switch r.bodyType {
+	case BodyTypeFixedSize:
+		if int64(len(p)) > r.bytesRemain {
+			p = p[:r.bytesRemain]
+		}
+		n, err := r.src.Read(p)
+		r.bytesRemain -= int64(n)
+		if r.bytesRemain == 0 {
+			r.isEOF = true
+		} else if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return n, err
+	case BodyTypeChunked:
+		return r.readChunked(p)
+	}
+	// identity body ends when the connection closed
+	n, err := r.src.Read(p)
+	if err == io.EOF {
+		r.isEOF = true
+	}
+	return n, err
+}
+
+func (r *BodyReader) readChunked(p []byte) (int, error) {
+	if r.chunkRemain <= 0 {
+		if r.chunkRemain == 0 {
+			// CRLF at the end of the chunk data
+			if err := readCRLF(r.src); err != nil {
+				return 0, err
+			}
+		}
+		r.buffer.Reset()
+		chunkSize, err := parseChunkSize(r.src, &r.buffer)
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		if chunkSize == 0 {
+			r.buffer.Reset()
+			if err := readTrailers(r.src, &r.buffer, &r.trailers); err != nil {
+				return 0, err
+			}
+			r.isEOF = true
+			return 0, io.EOF
+		}
+		r.chunkRemain = chunkSize
+	}
+	if len(p) > r.chunkRemain {
+		p = p[:r.chunkRemain]
+	}
+	n, err := r.src.Read(p)
+	r.chunkRemain -= n
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func readCRLF(r *bufio.Reader) error {
+	for _, expected := range []byte("\r\n") {
+		c, err := r.ReadByte()
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		if c != expected {
+			return fmt.Errorf("unexpected char %q at the end of chunk. Expected %q", c, expected)
+		}
+	}
+	return nil
+}
+
+// ChunkedWriter writes the data in chunked transfer coding,
+// Close writes the last chunk without closing the underlying writer
+type ChunkedWriter struct {
+	w      io.Writer
+	header []byte
+}
+
+// Reset resets the writer to write to w
+func (cw *ChunkedWriter) Reset(w io.Writer) {
+	cw.w = w
+}
+
+// Write writes p as a chunk, nothing is written if p is empty since
+// an empty chunk means the end of the body
+func (cw *ChunkedWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	cw.header = strconv.AppendInt(cw.header[:0], int64(len(p)), 16)
+	cw.header = append(cw.header, '\r', '\n')
+	if _, err := util.WriteWithValidation(cw.w, cw.header); err != nil {
+		return 0, err
+	}
+	n, err := util.WriteWithValidation(cw.w, p)
+	if err != nil {
+		return n, err
+	}
+	if _, err := util.WriteWithValidation(cw.w, crlf); err != nil {
+		return n, err
+	}
+	return n, nil
+}
+
+// Close writes the last chunk without trailers
+func (cw *ChunkedWriter) Close() error {
+	_, err := util.WriteWithValidation(cw.w, lastChunk)
+	return err
+}
+
+var (
+	crlf      = []byte("\r\n")
+	lastChunk = []byte("0\r\n\r\n")
+)
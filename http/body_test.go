@@ -2,7 +2,9 @@ package http
 
 import (
 	"bufio"
+	"bytes"
 	"io"
+	"io/ioutil"
 	"strings"
 	"testing"
 )
@@ -22,6 +24,63 @@ func TestParseBodyField(t *testing.T) {
 	testParseBodyFieldWithErrorBody(t, BodyTypeChunked, "\r\nsasfg\r\n0\n\r\n", `empty hex number`, w)
 	testParseBodyFieldWithErrorBody(t, BodyTypeChunked, "5\r\nasdfg\r\n\r\n\r\n", `empty hex number`, w)
 	testParseBodyFieldWithErrorBody(t, BodyTypeChunked, "5\r\n", io.EOF.Error(), w)
+	testParseBodyFieldWithErrorBody(t, BodyTypeChunked, "5\r\nasdfgh\n0\r\n\r\n", `unexpected char 'h' at the end of chunk`, w)
+	testParseBodyFieldWithErrorBody(t, BodyTypeChunked, "5\r\nasdfg\r0\r\n\r\n", `unexpected char '0' at the end of chunk`, w)
+	testParseBodyFieldWithErrorBody(t, BodyTypeChunked, "5;=x\r\nasdfg\r\n0\r\n\r\n", "malformed chunk extension", w)
+	testParseBodyFieldWithErrorBody(t, BodyTypeChunked, "5\r\nasdfg\r\n0\r\nX-Trailer\r\n\r\n", "fail to parse trailer fields", w)
+	testParseBodyFieldWithErrorBody(t, BodyTypeChunked, "5\r\nasdfg\r\n0\r\nX-Trailer: 1\r\n", io.ErrUnexpectedEOF.Error(), w)
+}
+
+func TestParseBodyChunkedTrailers(t *testing.T) {
+	s := "5;a=1\r\nhello\r\n6 ; b = \"x;y\" ;c\r\n world\r\n0\r\nX-Checksum: abc\r\nX-Count: 2\r\n\r\nnext"
+	br := bufio.NewReader(strings.NewReader(s))
+	var b bytes.Buffer
+	body := &Body{}
+	_, err := body.Parse(br, BodyTypeChunked, -1, func(isChunkHeader bool, data []byte) (int, error) {
+		return b.Write(data)
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if exp := s[:len(s)-len("next")]; b.String() != exp {
+		t.Fatalf("expected the body forwarded as is %q, but get %q", exp, b.String())
+	}
+	if rest, _ := ioutil.ReadAll(br); string(rest) != "next" {
+		t.Fatalf("the data following the body should be left unread, but get %q", rest)
+	}
+	trailers := body.Trailers()
+	if trailers.Len() != 2 || string(trailers.Peek("x-checksum")) != "abc" ||
+		string(trailers.Peek("X-Count")) != "2" {
+		t.Fatalf("unexpected trailers %q", trailers.String())
+	}
+
+	// trailers are cleared by the next parsing
+	br = bufio.NewReader(strings.NewReader("0\r\n\r\n"))
+	if _, err = body.Parse(br, BodyTypeChunked, -1, func(bool, []byte) (int, error) { return 0, nil }); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if body.Trailers().Len() != 0 {
+		t.Fatalf("unexpected trailers %q", body.Trailers().String())
+	}
+}
+
+func TestVisitChunkExtensions(t *testing.T) {
+	var visited []string
+	err := VisitChunkExtensions([]byte(` ;a=1; b ; c = "x;\"y" ;d=token!`), func(name, value []byte) {
+		visited = append(visited, string(name)+"|"+string(value))
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	exp := []string{"a|1", "b|", `c|"x;\"y"`, "d|token!"}
+	if strings.Join(visited, ",") != strings.Join(exp, ",") {
+		t.Fatalf("expected extensions %q, but get %q", exp, visited)
+	}
+	for _, ext := range []string{"a=1", ";", ";a=", `;a="1`, ";a=1 b", ";a b"} {
+		if err := VisitChunkExtensions([]byte(ext), nil); err == nil {
+			t.Fatalf("expected error for extensions %q", ext)
+		}
+	}
 }
 
 func testParseBodyFieldByBodyType(t *testing.T, bt BodyType, s string) {
@@ -48,3 +107,51 @@ func testParseBodyFieldWithErrorBody(t *testing.T, bt BodyType, s, expErr string
 		t.Fatalf("expected error: %s, but get unexpected error: %s", expErr, err.Error())
 	}
 }
+
+func TestBodyReader(t *testing.T) {
+	testBodyReader(t, BodyTypeChunked, -1, "5\r\nhello\r\n6\r\n world\r\n0\r\nX-Trailer: 1\r\n\r\nnext", "hello world")
+	testBodyReader(t, BodyTypeChunked, -1, "5;ext=1\r\nhello\r\n6\r\n world\r\n0\r\n\r\nnext", "hello world")
+	testBodyReader(t, BodyTypeFixedSize, 5, "hellonext", "hello")
+	testBodyReader(t, BodyTypeIdentity, -2, "hello world", "hello world")
+}
+
+func testBodyReader(t *testing.T, bt BodyType, contentLength int64, s, expBody string) {
+	br := bufio.NewReader(strings.NewReader(s))
+	r := &BodyReader{}
+	r.Reset(br, bt, contentLength)
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(body) != expBody {
+		t.Fatalf("expected body %q, but get %q", expBody, body)
+	}
+	rest, _ := ioutil.ReadAll(br)
+	if bt != BodyTypeIdentity && string(rest) != "next" {
+		t.Fatalf("the data following the body should be left unread, but get %q", rest)
+	}
+	if expTrailer := strings.Contains(s, "X-Trailer"); expTrailer != (string(r.Trailers().Peek("X-Trailer")) == "1") {
+		t.Fatalf("unexpected trailers %q", r.Trailers().String())
+	}
+}
+
+func TestChunkedWriter(t *testing.T) {
+	var b bytes.Buffer
+	w := &ChunkedWriter{}
+	w.Reset(&b)
+	w.Write([]byte("hello"))
+	w.Write(nil)
+	w.Write([]byte(" world, and more"))
+	if err := w.Close(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	exp := "5\r\nhello\r\n10\r\n world, and more\r\n0\r\n\r\n"
+	if b.String() != exp {
+		t.Fatalf("expected %q, but get %q", exp, b.String())
+	}
+	r := &BodyReader{}
+	r.Reset(bufio.NewReader(&b), BodyTypeChunked, -1)
+	if body, _ := ioutil.ReadAll(r); string(body) != "hello world, and more" {
+		t.Fatalf("unexpected body %q", body)
+	}
+}
@@ -0,0 +1,201 @@
+package http
+
+import (
+	"bytes"
+	"errors"
+)
+
+// HeaderFields the header fields in the order they appear, the field names are
+// matched case-insensitively with their original case preserved, a field appears
+// more than once (e.g. `Set-Cookie`) is kept as multiple entries.
+//
+// The zero value is ready to use, the memory is reused after Reset or Parse,
+// so no allocation is made once it is warmed up.
+type HeaderFields struct {
+	fields []headerField
+}
+
+type headerField struct {
+	key   []byte
+	value []byte
+}
+
+var errMalformedHeaderField = errors.New("malformed header field: no colon found")
+
+// Reset removes all the fields
+func (h *HeaderFields) Reset() {
+	h.fields = h.fields[:0]
+}
+
+// Len number of the fields
+func (h *HeaderFields) Len() int {
+	return len(h.fields)
+}
+
+// Parse parses the raw header ended with an empty line into the fields,
+// the fields are copied from buf, returns the header length in buf.
+// The obsolete line folding is replaced with a space.
+func (h *HeaderFields) Parse(buf []byte) (int, error) {
+	h.Reset()
+	n := 0
+	for {
+		m := bytes.IndexByte(buf[n:], '\n')
+		if m < 0 {
+			return 0, errNeedMore
+		}
+		line := buf[n : n+m]
+		n += m + 1
+		if len(line) > 0 && line[len(line)-1] == '\r' {
+			line = line[:len(line)-1]
+		}
+		if len(line) == 0 {
+			return n, nil
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			// obs-fold, the line continues the value of the previous field
+			if len(h.fields) == 0 {
+				return 0, errMalformedHeaderField
+			}
+			f := &h.fields[len(h.fields)-1]
+			if len(f.value) > 0 {
+				f.value = append(f.value, ' ')
+			}
+			f.value = append(f.value, bytes.TrimSpace(line)...)
+			continue
+		}
+		colon := bytes.IndexByte(line, ':')
+		if colon <= 0 {
+			return 0, errMalformedHeaderField
+		}
+		f := h.alloc()
+		f.key = append(f.key[:0], bytes.TrimRight(line[:colon], " \t")...)
+		f.value = append(f.value[:0], bytes.TrimSpace(line[colon+1:])...)
+	}
+}
+
+// Peek the value of the first field named key, nil if not found
+func (h *HeaderFields) Peek(key string) []byte {
+	for i := range h.fields {
+		if equalIgnoreCaseString(h.fields[i].key, key) {
+			return h.fields[i].value
+		}
+	}
+	return nil
+}
+
+// Has if any field named key exists
+func (h *HeaderFields) Has(key string) bool {
+	for i := range h.fields {
+		if equalIgnoreCaseString(h.fields[i].key, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// VisitValues calls f with the value of every field named key in order
+func (h *HeaderFields) VisitValues(key string, f func(value []byte)) {
+	for i := range h.fields {
+		if equalIgnoreCaseString(h.fields[i].key, key) {
+			f(h.fields[i].value)
+		}
+	}
+}
+
+// VisitAll calls f with every field in order
+func (h *HeaderFields) VisitAll(f func(key, value []byte)) {
+	for i := range h.fields {
+		f(h.fields[i].key, h.fields[i].value)
+	}
+}
+
+// Set sets the value of the first field named key and removes the rest ones,
+// the field is added if not found
+func (h *HeaderFields) Set(key, value string) {
+	if f := h.setFirst(key); f != nil {
+		f.value = append(f.value[:0], value...)
+		return
+	}
+	h.Add(key, value)
+}
+
+// SetBytes sets the value of the first field named key and removes the rest ones,
+// the field is added if not found
+func (h *HeaderFields) SetBytes(key string, value []byte) {
+	if f := h.setFirst(key); f != nil {
+		f.value = append(f.value[:0], value...)
+		return
+	}
+	h.AddBytes(key, value)
+}
+
+// Add adds a field after the existing ones
+func (h *HeaderFields) Add(key, value string) {
+	f := h.alloc()
+	f.key = append(f.key[:0], key...)
+	f.value = append(f.value[:0], value...)
+}
+
+// AddBytes adds a field after the existing ones
+func (h *HeaderFields) AddBytes(key string, value []byte) {
+	f := h.alloc()
+	f.key = append(f.key[:0], key...)
+	f.value = append(f.value[:0], value...)
+}
+
+// Del removes all the fields named key
+func (h *HeaderFields) Del(key string) {
+	h.delFrom(0, key)
+}
+
+// AppendBytes appends the fields in `Key: value` lines to dst,
+// followed by the empty line ends the header
+func (h *HeaderFields) AppendBytes(dst []byte) []byte {
+	for i := range h.fields {
+		dst = append(dst, h.fields[i].key...)
+		dst = append(dst, ':', ' ')
+		dst = append(dst, h.fields[i].value...)
+		dst = append(dst, '\r', '\n')
+	}
+	return append(dst, '\r', '\n')
+}
+
+// String the fields in raw header format
+func (h *HeaderFields) String() string {
+	return string(h.AppendBytes(nil))
+}
+
+// setFirst returns the first field named key with the rest ones removed
+func (h *HeaderFields) setFirst(key string) *headerField {
+	for i := range h.fields {
+		if equalIgnoreCaseString(h.fields[i].key, key) {
+			h.delFrom(i+1, key)
+			return &h.fields[i]
+		}
+	}
+	return nil
+}
+
+// delFrom removes the fields named key from the i-th one, the order of the rest
+// fields is kept while the removed ones are moved after them to be reused
+func (h *HeaderFields) delFrom(i int, key string) {
+	j := i
+	for ; i < len(h.fields); i++ {
+		if !equalIgnoreCaseString(h.fields[i].key, key) {
+			h.fields[i], h.fields[j] = h.fields[j], h.fields[i]
+			j++
+		}
+	}
+	h.fields = h.fields[:j]
+}
+
+// alloc appends a field reusing the memory of the removed ones
+func (h *HeaderFields) alloc() *headerField {
+	n := len(h.fields)
+	if cap(h.fields) > n {
+		h.fields = h.fields[:n+1]
+	} else {
+		h.fields = append(h.fields, headerField{})
+	}
+	return &h.fields[n]
+}
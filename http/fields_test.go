@@ -0,0 +1,76 @@
+package http
+
+import (
+	"testing"
+)
+
+func TestHeaderFieldsParse(t *testing.T) {
+	h := &HeaderFields{}
+	raw := "Host: example.com\r\nset-cookie: a=1\r\nX-Folded: first\r\n\tsecond\r\nSet-Cookie:b=2 \r\n\r\nbody"
+	n, err := h.Parse([]byte(raw))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if n != len(raw)-len("body") {
+		t.Fatalf("unexpected header length %d", n)
+	}
+	if h.Len() != 4 {
+		t.Fatalf("unexpected number of fields %d", h.Len())
+	}
+	if string(h.Peek("HOST")) != "example.com" || string(h.Peek("x-folded")) != "first second" {
+		t.Fatalf("unexpected values %q %q", h.Peek("HOST"), h.Peek("x-folded"))
+	}
+	var cookies []string
+	h.VisitValues("Set-Cookie", func(value []byte) {
+		cookies = append(cookies, string(value))
+	})
+	if len(cookies) != 2 || cookies[0] != "a=1" || cookies[1] != "b=2" {
+		t.Fatalf("unexpected multi-valued field %q", cookies)
+	}
+	exp := "Host: example.com\r\nset-cookie: a=1\r\nX-Folded: first second\r\nSet-Cookie: b=2\r\n\r\n"
+	if h.String() != exp {
+		t.Fatalf("expected %q, but get %q", exp, h.String())
+	}
+
+	if _, err := h.Parse([]byte("Host: example.com\r\n")); err != errNeedMore {
+		t.Fatalf("expected error %s, but get %v", errNeedMore, err)
+	}
+	if _, err := h.Parse([]byte("Host\r\n\r\n")); err != errMalformedHeaderField {
+		t.Fatalf("expected error %s, but get %v", errMalformedHeaderField, err)
+	}
+}
+
+func TestHeaderFieldsModify(t *testing.T) {
+	h := &HeaderFields{}
+	if _, err := h.Parse([]byte("A: 1\r\nSet-Cookie: a=1\r\nB: 2\r\nset-cookie: b=2\r\n\r\n")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	h.Set("SET-COOKIE", "c=3")
+	h.Add("Set-Cookie", "d=4")
+	h.Set("C", "3")
+	h.Del("a")
+	h.SetBytes("b", []byte("22"))
+	exp := "Set-Cookie: c=3\r\nB: 22\r\nSet-Cookie: d=4\r\nC: 3\r\n\r\n"
+	if h.String() != exp {
+		t.Fatalf("expected %q, but get %q", exp, h.String())
+	}
+	if h.Has("A") || !h.Has("c") || h.Peek("A") != nil {
+		t.Fatalf("unexpected fields %q", h.String())
+	}
+}
+
+func TestHeaderFieldsNoAlloc(t *testing.T) {
+	h := &HeaderFields{}
+	raw := []byte("Host: example.com\r\nCache-Control: max-age=60\r\n\r\n")
+	var buf []byte
+	allocs := testing.AllocsPerRun(100, func() {
+		h.Parse(raw)
+		h.Set("Cache-Control", "no-store")
+		h.Add("X-Forwarded-For", "127.0.0.1")
+		h.Del("Host")
+		buf = h.AppendBytes(buf[:0])
+	})
+	if allocs != 0 {
+		t.Fatalf("unexpected allocations %v", allocs)
+	}
+}
@@ -14,17 +14,35 @@ import (
 // Header header part of http request & response
 type Header struct {
 	isConnectionClose      bool
+	isConnectionUpgrade    bool
+	isConnectionKeepAlive  bool
 	isProxyConnectionClose bool
+	isExpectContinue       bool
 	contentLength          int64
+	isContentLengthSet     bool
 	contentType            string
+	contentEncoding        []byte
+	proxyAuthorization     []byte
+	host                   []byte
+	referer                []byte
+	userAgent              []byte
 }
 
 // Reset reset header info into default val
 func (header *Header) Reset() {
 	header.isConnectionClose = false
+	header.isConnectionUpgrade = false
+	header.isConnectionKeepAlive = false
 	header.isProxyConnectionClose = false
+	header.isExpectContinue = false
 	header.contentLength = 0
+	header.isContentLengthSet = false
 	header.contentType = ""
+	header.contentEncoding = header.contentEncoding[:0]
+	header.proxyAuthorization = header.proxyAuthorization[:0]
+	header.host = header.host[:0]
+	header.referer = header.referer[:0]
+	header.userAgent = header.userAgent[:0]
 }
 
 // IsConnectionClose is connection header set to `close`
@@ -32,16 +50,48 @@ func (header *Header) IsConnectionClose() bool {
 	return header.isConnectionClose
 }
 
+// IsConnectionUpgrade is connection header set to `upgrade`
+func (header *Header) IsConnectionUpgrade() bool {
+	return header.isConnectionUpgrade
+}
+
+// IsConnectionKeepAlive is connection header set to `keep-alive`
+func (header *Header) IsConnectionKeepAlive() bool {
+	return header.isConnectionKeepAlive
+}
+
 // IsProxyConnectionClose is Proxy-Connection header set to `close`
 func (header *Header) IsProxyConnectionClose() bool {
 	return header.isProxyConnectionClose
 }
 
+// IsExpectContinue is Expect header set to `100-continue`
+func (header *Header) IsExpectContinue() bool {
+	return header.isExpectContinue
+}
+
+// HasBody if a request body follows the header, which is
+// either chunked or with a positive content length
+func (header *Header) HasBody() bool {
+	return header.contentLength > 0 || header.contentLength == -1
+}
+
+// IsBodyDelimitedByClose if the response body is delimited by closing the connection,
+// i.e. with neither `Content-Length` nor chunked `Transfer-Encoding` set
+func (header *Header) IsBodyDelimitedByClose() bool {
+	return header.contentLength == -2 || (header.contentLength == 0 && !header.isContentLengthSet)
+}
+
 // ContentType content type in header
 func (header *Header) ContentType() string {
 	return header.contentType
 }
 
+// ContentEncoding the `Content-Encoding` header value in lower case, nil if not set
+func (header *Header) ContentEncoding() []byte {
+	return header.contentEncoding
+}
+
 // ContentLength content length header value,
 func (header *Header) ContentLength() int64 {
 	if header.contentLength > 0 {
@@ -50,6 +100,26 @@ func (header *Header) ContentLength() int64 {
 	return 0
 }
 
+// ProxyAuthorization the `Proxy-Authorization` header value, nil if not set
+func (header *Header) ProxyAuthorization() []byte {
+	return header.proxyAuthorization
+}
+
+// Host the `Host` header value, nil if not set
+func (header *Header) Host() []byte {
+	return header.host
+}
+
+// Referer the `Referer` header value, nil if not set
+func (header *Header) Referer() []byte {
+	return header.referer
+}
+
+// UserAgent the `User-Agent` header value, nil if not set
+func (header *Header) UserAgent() []byte {
+	return header.userAgent
+}
+
 // BodyType return body type parsed from header
 func (header *Header) BodyType() BodyType {
 	// negative means transfer encoding: -1 means chunked;  -2 means identity
@@ -137,6 +207,12 @@ func (header *Header) Parse(buf []byte) (headerLength int, err error) {
 			if bytes.Contains(rawHeaderLine, []byte("close")) {
 				header.isConnectionClose = true
 			}
+			if bytes.Contains(rawHeaderLine, []byte("upgrade")) {
+				header.isConnectionUpgrade = true
+			}
+			if bytes.Contains(rawHeaderLine, []byte("keep-alive")) {
+				header.isConnectionKeepAlive = true
+			}
 			return nil
 		}
 
@@ -158,10 +234,13 @@ func (header *Header) Parse(buf []byte) (headerLength int, err error) {
 			lengthBytesIndex := bytes.IndexByte(rawHeaderLine, ':')
 			if lengthBytesIndex > 0 {
 				lengthBytes := rawHeaderLine[lengthBytesIndex+1:]
-				length, _ := strconv.ParseInt(strings.TrimSpace(string(lengthBytes)), 10, 64)
+				length, err := strconv.ParseInt(strings.TrimSpace(string(lengthBytes)), 10, 64)
 				if length > 0 {
 					header.contentLength = length
 				}
+				if err == nil && length >= 0 {
+					header.isContentLengthSet = true
+				}
 			}
 		} else if isTransferEncodingHeader(rawHeaderLine) {
 			if bytes.Contains(rawHeaderLine, []byte("chunked")) {
@@ -176,6 +255,42 @@ func (header *Header) Parse(buf []byte) (headerLength int, err error) {
 					string(rawHeaderLine[contentTypeBytesIndex+1:]),
 				)
 			}
+		} else if isContentEncodingHeader(rawHeaderLine) {
+			contentEncodingBytesIndex := bytes.IndexByte(rawHeaderLine, ':')
+			if contentEncodingBytesIndex >= 0 {
+				header.contentEncoding = append(header.contentEncoding[:0],
+					bytes.TrimSpace(rawHeaderLine[contentEncodingBytesIndex+1:])...)
+				changeToLowerCase(header.contentEncoding)
+			}
+		} else if isProxyAuthorizationHeader(rawHeaderLine) {
+			authorizationBytesIndex := bytes.IndexByte(rawHeaderLine, ':')
+			if authorizationBytesIndex >= 0 {
+				header.proxyAuthorization = append(header.proxyAuthorization[:0],
+					bytes.TrimSpace(rawHeaderLine[authorizationBytesIndex+1:])...)
+			}
+		} else if isHostHeader(rawHeaderLine) {
+			hostBytesIndex := bytes.IndexByte(rawHeaderLine, ':')
+			if hostBytesIndex >= 0 {
+				header.host = append(header.host[:0],
+					bytes.TrimSpace(rawHeaderLine[hostBytesIndex+1:])...)
+			}
+		} else if isExpectHeader(rawHeaderLine) {
+			expectation := bytes.TrimSpace(rawHeaderLine[len(expectHeader):])
+			if equalIgnoreCaseString(expectation, "100-continue") {
+				header.isExpectContinue = true
+			}
+		} else if isRefererHeader(rawHeaderLine) {
+			refererBytesIndex := bytes.IndexByte(rawHeaderLine, ':')
+			if refererBytesIndex >= 0 {
+				header.referer = append(header.referer[:0],
+					bytes.TrimSpace(rawHeaderLine[refererBytesIndex+1:])...)
+			}
+		} else if isUserAgentHeader(rawHeaderLine) {
+			userAgentBytesIndex := bytes.IndexByte(rawHeaderLine, ':')
+			if userAgentBytesIndex >= 0 {
+				header.userAgent = append(header.userAgent[:0],
+					bytes.TrimSpace(rawHeaderLine[userAgentBytesIndex+1:])...)
+			}
 		}
 		return nil
 	}
@@ -225,7 +340,7 @@ func isProxyConnectionHeader(header []byte) bool {
 	return hasPrefixIgnoreCase(header, proxyConnectionHeader)
 }
 
-var contentLengthHeader = []byte("Content-Length")
+var contentLengthHeader = []byte("Content-Length:")
 
 func isContentLengthHeader(header []byte) bool {
 	return hasPrefixIgnoreCase(header, contentLengthHeader)
@@ -237,12 +352,48 @@ func isContentTypeHeader(header []byte) bool {
 	return hasPrefixIgnoreCase(header, contentTypeHeader)
 }
 
-var transferEncoding = []byte("Transfer-Encoding")
+var contentEncodingHeader = []byte("Content-Encoding:")
+
+func isContentEncodingHeader(header []byte) bool {
+	return hasPrefixIgnoreCase(header, contentEncodingHeader)
+}
+
+var transferEncoding = []byte("Transfer-Encoding:")
 
 func isTransferEncodingHeader(header []byte) bool {
 	return hasPrefixIgnoreCase(header, transferEncoding)
 }
 
+var proxyAuthorizationHeader = []byte("Proxy-Authorization:")
+
+func isProxyAuthorizationHeader(header []byte) bool {
+	return hasPrefixIgnoreCase(header, proxyAuthorizationHeader)
+}
+
+var hostHeader = []byte("Host:")
+
+func isHostHeader(header []byte) bool {
+	return hasPrefixIgnoreCase(header, hostHeader)
+}
+
+var expectHeader = []byte("Expect:")
+
+func isExpectHeader(header []byte) bool {
+	return hasPrefixIgnoreCase(header, expectHeader)
+}
+
+var refererHeader = []byte("Referer:")
+
+func isRefererHeader(header []byte) bool {
+	return hasPrefixIgnoreCase(header, refererHeader)
+}
+
+var userAgentHeader = []byte("User-Agent:")
+
+func isUserAgentHeader(header []byte) bool {
+	return hasPrefixIgnoreCase(header, userAgentHeader)
+}
+
 var proxyHeaders = [][]byte{
 	// If no Accept-Encoding header exists, Transport will add the headers it can accept
 	// and would wrap the response body with the relevant reader.
@@ -262,3 +413,19 @@ func IsProxyHeader(header []byte) bool {
 	}
 	return false
 }
+
+// IsBodyFramingHeader is the given header a `Content-Length` or `Transfer-Encoding`
+// header, which determines how the body is framed
+func IsBodyFramingHeader(header []byte) bool {
+	return isContentLengthHeader(header) || isTransferEncodingHeader(header)
+}
+
+// IsConnectionHeader is the given header a `Connection` header
+func IsConnectionHeader(header []byte) bool {
+	return isConnectionHeader(header)
+}
+
+// IsExpectHeader is the given header an `Expect` header
+func IsExpectHeader(header []byte) bool {
+	return isExpectHeader(header)
+}
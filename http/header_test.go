@@ -91,3 +91,152 @@ func testParseHeaderFields(t *testing.T, bufioBufferSize int, sampleHeader strin
 			header.contentType, expectingContentType)
 	}
 }
+
+func TestParseProxyAuthorization(t *testing.T) {
+	header := Header{}
+	if _, err := header.Parse([]byte("Host: a.com\r\nProxy-Authorization:  Basic dXNlcjpwYXNz \r\n\r\n")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(header.ProxyAuthorization()) != "Basic dXNlcjpwYXNz" {
+		t.Fatalf("unexpected proxy authorization %q", header.ProxyAuthorization())
+	}
+	if _, err := header.Parse([]byte("Host: a.com\r\n\r\n")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(header.ProxyAuthorization()) != 0 {
+		t.Fatalf("proxy authorization should be reset, got %q", header.ProxyAuthorization())
+	}
+	// the header of a longer name is not the proxy authorization
+	if _, err := header.Parse([]byte("Host: a.com\r\nProxy-Authorization-Foo: Basic dXNlcjpwYXNz\r\n\r\n")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(header.ProxyAuthorization()) != 0 {
+		t.Fatalf("unexpected proxy authorization %q", header.ProxyAuthorization())
+	}
+}
+
+func TestParseConnectionUpgrade(t *testing.T) {
+	header := Header{}
+	if _, err := header.Parse([]byte("Connection: keep-alive, Upgrade\r\nUpgrade: websocket\r\n\r\n")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !header.IsConnectionUpgrade() || header.IsConnectionClose() {
+		t.Fatalf("connection should be upgrade")
+	}
+	if _, err := header.Parse([]byte("Connection: close\r\n\r\n")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if header.IsConnectionUpgrade() {
+		t.Fatalf("connection upgrade should be reset")
+	}
+}
+
+func TestParseHost(t *testing.T) {
+	header := Header{}
+	if _, err := header.Parse([]byte("Host-Extra: b.com\r\nhost: a.com:8080 \r\n\r\n")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(header.Host()) != "a.com:8080" {
+		t.Fatalf("unexpected host %q", header.Host())
+	}
+	if _, err := header.Parse([]byte("Accept: */*\r\n\r\n")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(header.Host()) != 0 {
+		t.Fatalf("host should be reset, got %q", header.Host())
+	}
+}
+
+func TestParseRefererUserAgent(t *testing.T) {
+	header := Header{}
+	if _, err := header.Parse([]byte("referer: http://a.com/\r\nUser-Agent: curl/7.58.0\r\n\r\n")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(header.Referer()) != "http://a.com/" {
+		t.Fatalf("unexpected referer %q", header.Referer())
+	}
+	if string(header.UserAgent()) != "curl/7.58.0" {
+		t.Fatalf("unexpected user agent %q", header.UserAgent())
+	}
+	if _, err := header.Parse([]byte("Accept: */*\r\n\r\n")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(header.Referer()) != 0 || len(header.UserAgent()) != 0 {
+		t.Fatalf("referer and user agent should be reset")
+	}
+}
+
+func TestParseExpectContinue(t *testing.T) {
+	header := Header{}
+	if _, err := header.Parse([]byte("expect: 100-Continue\r\nContent-Length: 10\r\n\r\n")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !header.IsExpectContinue() || !header.HasBody() {
+		t.Fatalf("header should expect continue with body")
+	}
+	if _, err := header.Parse([]byte("Transfer-Encoding: chunked\r\n\r\n")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if header.IsExpectContinue() || !header.HasBody() {
+		t.Fatalf("expect continue should be reset and chunked body found")
+	}
+	if _, err := header.Parse([]byte("Expect: 100-continued\r\nContent-Length: 10\r\n\r\n")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if header.IsExpectContinue() {
+		t.Fatalf("unknown expectation should not expect continue")
+	}
+	rawHeader := []byte("Expect: 100-continue\r\n\r\n")
+	if n := testing.AllocsPerRun(100, func() { header.Parse(rawHeader) }); n > 0 {
+		t.Fatalf("unexpected allocations %v of parsing expect header", n)
+	}
+	if _, err := header.Parse([]byte("Content-Length: 0\r\n\r\n")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if header.HasBody() {
+		t.Fatalf("header should have no body")
+	}
+}
+
+func TestParseBodyDelimitedByClose(t *testing.T) {
+	header := Header{}
+	if _, err := header.Parse([]byte("Connection: Keep-Alive\r\n\r\n")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !header.IsConnectionKeepAlive() || !header.IsBodyDelimitedByClose() {
+		t.Fatalf("header should keep alive with body delimited by close")
+	}
+	if _, err := header.Parse([]byte("Content-Length: 0\r\n\r\n")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if header.IsConnectionKeepAlive() || header.IsBodyDelimitedByClose() {
+		t.Fatalf("empty body should not be delimited by close")
+	}
+	if _, err := header.Parse([]byte("Transfer-Encoding: chunked\r\n\r\n")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if header.IsBodyDelimitedByClose() {
+		t.Fatalf("chunked body should not be delimited by close")
+	}
+	if _, err := header.Parse([]byte("Transfer-Encoding: identity\r\n\r\n")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !header.IsBodyDelimitedByClose() {
+		t.Fatalf("identity body should be delimited by close")
+	}
+}
+
+func TestParseContentEncoding(t *testing.T) {
+	header := Header{}
+	if _, err := header.Parse([]byte("Content-Encoding: GZip\r\nContent-Length: 10\r\n\r\n")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(header.ContentEncoding()) != "gzip" {
+		t.Fatalf("unexpected content encoding %q", header.ContentEncoding())
+	}
+	if !IsBodyFramingHeader([]byte("content-length: 10\r\n")) ||
+		!IsBodyFramingHeader([]byte("Transfer-Encoding: chunked\r\n")) ||
+		IsBodyFramingHeader([]byte("Content-Encoding: gzip\r\n")) {
+		t.Fatalf("unexpected body framing header check")
+	}
+}
@@ -0,0 +1,261 @@
+package http
+
+import (
+	"bytes"
+	"errors"
+)
+
+// ParsingMode how the header violating RFC 9112 is handled
+type ParsingMode int
+
+const (
+	// ParsingModePermissive the default mode, normalizes the recoverable
+	// violations made by legacy peers: the bare LF line endings are replaced by
+	// CRLF, the folded lines are unfolded, the duplicate `Content-Length` fields
+	// of the same value are merged into one, the `Content-Length` sent with
+	// `Transfer-Encoding` is removed and the connection is closed after the
+	// message, the whitespace between the field name and colon is removed from
+	// responses.
+	// The ambiguous framing like conflicting `Content-Length` values is still
+	// rejected
+	ParsingModePermissive ParsingMode = iota
+	// ParsingModeStrict rejects every header violating RFC 9112, including
+	// bare LF line endings, obsolete line folding, whitespace between the field
+	// name and colon, duplicate `Content-Length` fields and `Content-Length`
+	// sent with `Transfer-Encoding`
+	ParsingModeStrict
+)
+
+var (
+	errBareLF                 = errors.New("bare LF line ending")
+	errObsFold                = errors.New("obsolete line folding")
+	errWhitespaceBeforeColon  = errors.New("whitespace between field name and colon")
+	errInvalidFieldName       = errors.New("invalid character in field name")
+	errInvalidFieldValue      = errors.New("invalid character in field value")
+	errInvalidContentLength   = errors.New("invalid Content-Length")
+	errDuplicateContentLength = errors.New("duplicate Content-Length")
+	errConflictContentLength  = errors.New("conflicting Content-Length values")
+	errContentLengthWithTE    = errors.New("Content-Length sent with Transfer-Encoding")
+	errInvalidTransferCoding  = errors.New("chunked is not the final transfer coding")
+)
+
+// HeaderNormalizer checks the header against the message framing rules of
+// RFC 9112, which defends the request smuggling, i.e. the message framed in
+// different ways by the proxy and the next hop
+type HeaderNormalizer struct {
+	fields HeaderFields
+	header []byte
+	// isFramingAmbiguous both `Content-Length` and `Transfer-Encoding` are sent
+	isFramingAmbiguous bool
+}
+
+// Reset resets the normalizer
+func (n *HeaderNormalizer) Reset() {
+	n.fields.Reset()
+	n.header = n.header[:0]
+	n.isFramingAmbiguous = false
+}
+
+// IsFramingAmbiguous if the message is sent with both `Content-Length` and
+// `Transfer-Encoding`, the connection should be closed after the message
+func (n *HeaderNormalizer) IsFramingAmbiguous() bool {
+	return n.isFramingAmbiguous
+}
+
+// Normalize checks the raw header ended with an empty line, returns the header
+// normalized in mode, which is valid until the next call, nil is returned if the
+// header needs no normalization. Error returned if the header is rejected.
+func (n *HeaderNormalizer) Normalize(rawHeader []byte, mode ParsingMode, isRequest bool) ([]byte, error) {
+	n.Reset()
+	isPermissive := mode == ParsingModePermissive
+	changed := false
+	for i := 0; ; {
+		m := bytes.IndexByte(rawHeader[i:], '\n')
+		if m < 0 {
+			return nil, errNeedMore
+		}
+		line := rawHeader[i : i+m]
+		i += m + 1
+		if len(line) > 0 && line[len(line)-1] == '\r' {
+			line = line[:len(line)-1]
+		} else {
+			if !isPermissive {
+				return nil, errBareLF
+			}
+			changed = true
+		}
+		if len(line) == 0 {
+			break
+		}
+
+		if line[0] == ' ' || line[0] == '\t' {
+			// a field folded into lines
+			if !isPermissive {
+				return nil, errObsFold
+			}
+			if n.fields.Len() == 0 {
+				return nil, errMalformedHeaderField
+			}
+			value := bytes.TrimSpace(line)
+			if err := checkFieldValue(value, isPermissive); err != nil {
+				return nil, err
+			}
+			f := &n.fields.fields[n.fields.Len()-1]
+			if len(f.value) > 0 {
+				f.value = append(f.value, ' ')
+			}
+			f.value = append(f.value, value...)
+			changed = true
+			continue
+		}
+
+		colon := bytes.IndexByte(line, ':')
+		if colon <= 0 {
+			return nil, errMalformedHeaderField
+		}
+		name := line[:colon]
+		if trimmed := bytes.TrimRight(name, " \t"); len(trimmed) != len(name) {
+			// a proxy must reject the request and remove the whitespace from response
+			if isRequest || !isPermissive {
+				return nil, errWhitespaceBeforeColon
+			}
+			name = trimmed
+			changed = true
+		}
+		if len(name) == 0 || tokenLen(name) != len(name) {
+			return nil, errInvalidFieldName
+		}
+		value := bytes.Trim(line[colon+1:], " \t")
+		if err := checkFieldValue(value, isPermissive); err != nil {
+			return nil, err
+		}
+		f := n.fields.alloc()
+		f.key = append(f.key[:0], name...)
+		f.value = append(f.value[:0], value...)
+	}
+
+	frameChanged, err := n.checkFraming(isPermissive, isRequest)
+	if err != nil {
+		return nil, err
+	}
+	if !changed && !frameChanged {
+		return nil, nil
+	}
+	n.header = n.fields.AppendBytes(n.header[:0])
+	return n.header, nil
+}
+
+// checkFieldValue rejects the control characters in the field value, the
+// permissive mode only rejects the ones able to break the message, i.e. CR and NUL
+func checkFieldValue(value []byte, isPermissive bool) error {
+	for _, c := range value {
+		if c == '\r' || c == 0 {
+			return errInvalidFieldValue
+		}
+		if !isPermissive && ((c < ' ' && c != '\t') || c == 0x7f) {
+			return errInvalidFieldValue
+		}
+	}
+	return nil
+}
+
+// checkFraming checks the `Content-Length` and `Transfer-Encoding` fields,
+// returns if the fields are changed for normalization
+func (n *HeaderNormalizer) checkFraming(isPermissive, isRequest bool) (bool, error) {
+	var contentLength []byte
+	contentLengthCount := 0
+	isContentLengthMerged := false
+	hasTransferEncoding := false
+	isChunkedFinal := false
+	var err error
+	n.fields.VisitAll(func(key, value []byte) {
+		if err != nil {
+			return
+		}
+		switch {
+		case equalIgnoreCaseString(key, "Content-Length"):
+			// a list of the same values, e.g. `42, 42`, is treated as a duplicate
+			for len(value) > 0 {
+				var v []byte
+				if i := bytes.IndexByte(value, ','); i >= 0 {
+					v, value = bytes.Trim(value[:i], " \t"), value[i+1:]
+					isContentLengthMerged = true
+				} else {
+					v, value = bytes.Trim(value, " \t"), nil
+				}
+				if len(v) == 0 || !isDigits(v) {
+					err = errInvalidContentLength
+					return
+				}
+				if contentLength != nil && !bytes.Equal(contentLength, v) {
+					err = errConflictContentLength
+					return
+				}
+				contentLength = v
+				contentLengthCount++
+			}
+			if contentLength == nil {
+				err = errInvalidContentLength
+			}
+		case equalIgnoreCaseString(key, "Transfer-Encoding"):
+			hasTransferEncoding = true
+			for len(value) > 0 {
+				var coding []byte
+				if i := bytes.IndexByte(value, ','); i >= 0 {
+					coding, value = bytes.Trim(value[:i], " \t"), value[i+1:]
+				} else {
+					coding, value = bytes.Trim(value, " \t"), nil
+				}
+				if len(coding) == 0 {
+					continue
+				}
+				if isChunkedFinal {
+					// chunked must be applied only once as the final coding
+					err = errInvalidTransferCoding
+					return
+				}
+				isChunkedFinal = equalIgnoreCaseString(coding, "chunked")
+				if !isChunkedFinal && tokenLen(coding) != len(coding) {
+					err = errInvalidTransferCoding
+					return
+				}
+			}
+		}
+	})
+	if err != nil {
+		return false, err
+	}
+
+	// the request body is framed by chunked only, the response without chunked
+	// is delimited by closing the connection instead
+	if hasTransferEncoding && isRequest && !isChunkedFinal {
+		return false, errInvalidTransferCoding
+	}
+	if hasTransferEncoding && contentLengthCount > 0 {
+		if !isPermissive {
+			return false, errContentLengthWithTE
+		}
+		// Transfer-Encoding overrides Content-Length
+		n.isFramingAmbiguous = true
+		n.fields.Del("Content-Length")
+		return true, nil
+	}
+	if contentLengthCount > 1 || isContentLengthMerged {
+		if !isPermissive {
+			return false, errDuplicateContentLength
+		}
+		var length [20]byte
+		n.fields.SetBytes("Content-Length", append(length[:0], contentLength...))
+		return true, nil
+	}
+	return false, nil
+}
+
+func isDigits(b []byte) bool {
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
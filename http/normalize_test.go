@@ -0,0 +1,221 @@
+package http
+
+import (
+	"testing"
+)
+
+// smugglingCase a header checked in both strict and permissive modes,
+// normalized is the header expected in permissive mode, empty if unchanged
+type smugglingCase struct {
+	name       string
+	header     string
+	isRequest  bool
+	strictErr  error
+	permErr    error
+	normalized string
+	ambiguous  bool
+}
+
+// smugglingCorpus the known desync payloads and the legitimate headers
+var smugglingCorpus = []smugglingCase{
+	// legitimate
+	{name: "plain", isRequest: true,
+		header: "Host: a.com\r\nContent-Length: 5\r\n\r\n"},
+	{name: "chunked", isRequest: true,
+		header: "Host: a.com\r\nTransfer-Encoding: chunked\r\n\r\n"},
+	{name: "gzip then chunked", isRequest: true,
+		header: "Host: a.com\r\nTransfer-Encoding: gzip, chunked\r\n\r\n"},
+	{name: "chunked in upper case", isRequest: true,
+		header: "Host: a.com\r\nTRANSFER-ENCODING: CHUNKED\r\n\r\n"},
+	{name: "value with tab", isRequest: true,
+		header: "Host: a.com\r\nX-A: a\tb\r\n\r\n"},
+	{name: "response close delimited", isRequest: false,
+		header: "Transfer-Encoding: gzip\r\n\r\n"},
+
+	// CL.TE and TE.CL
+	{name: "CL.TE", isRequest: true,
+		header:     "Host: a.com\r\nContent-Length: 6\r\nTransfer-Encoding: chunked\r\n\r\n",
+		strictErr:  errContentLengthWithTE,
+		normalized: "Host: a.com\r\nTransfer-Encoding: chunked\r\n\r\n", ambiguous: true},
+	{name: "TE.CL", isRequest: true,
+		header:     "Host: a.com\r\nTransfer-Encoding: chunked\r\nContent-Length: 3\r\n\r\n",
+		strictErr:  errContentLengthWithTE,
+		normalized: "Host: a.com\r\nTransfer-Encoding: chunked\r\n\r\n", ambiguous: true},
+	{name: "CL.TE response", isRequest: false,
+		header:     "Content-Length: 6\r\nTransfer-Encoding: chunked\r\n\r\n",
+		strictErr:  errContentLengthWithTE,
+		normalized: "Transfer-Encoding: chunked\r\n\r\n", ambiguous: true},
+
+	// TE obfuscation
+	{name: "TE space before colon", isRequest: true,
+		header:    "Host: a.com\r\nContent-Length: 6\r\nTransfer-Encoding : chunked\r\n\r\n",
+		strictErr: errWhitespaceBeforeColon, permErr: errWhitespaceBeforeColon},
+	{name: "TE tab before colon", isRequest: true,
+		header:    "Host: a.com\r\nTransfer-Encoding\t: chunked\r\n\r\n",
+		strictErr: errWhitespaceBeforeColon, permErr: errWhitespaceBeforeColon},
+	{name: "TE space before colon response", isRequest: false,
+		header:     "Transfer-Encoding : chunked\r\n\r\n",
+		strictErr:  errWhitespaceBeforeColon,
+		normalized: "Transfer-Encoding: chunked\r\n\r\n"},
+	{name: "TE xchunked", isRequest: true,
+		header:    "Host: a.com\r\nTransfer-Encoding: xchunked\r\n\r\n",
+		strictErr: errInvalidTransferCoding, permErr: errInvalidTransferCoding},
+	{name: "TE chunked then identity", isRequest: true,
+		header:    "Host: a.com\r\nTransfer-Encoding: chunked, identity\r\n\r\n",
+		strictErr: errInvalidTransferCoding, permErr: errInvalidTransferCoding},
+	{name: "TE identity", isRequest: true,
+		header:    "Host: a.com\r\nTransfer-Encoding: identity\r\n\r\n",
+		strictErr: errInvalidTransferCoding, permErr: errInvalidTransferCoding},
+	{name: "TE duplicate fields", isRequest: true,
+		header:    "Host: a.com\r\nTransfer-Encoding: chunked\r\nTransfer-Encoding: x\r\n\r\n",
+		strictErr: errInvalidTransferCoding, permErr: errInvalidTransferCoding},
+	{name: "TE chunked twice", isRequest: true,
+		header:    "Host: a.com\r\nTransfer-Encoding: chunked, chunked\r\n\r\n",
+		strictErr: errInvalidTransferCoding, permErr: errInvalidTransferCoding},
+	{name: "TE vertical tab", isRequest: true,
+		header:    "Host: a.com\r\nTransfer-Encoding: chunked\x0b\r\n\r\n",
+		strictErr: errInvalidFieldValue, permErr: errInvalidTransferCoding},
+	{name: "TE quoted", isRequest: true,
+		header:    "Host: a.com\r\nTransfer-Encoding: \"chunked\"\r\n\r\n",
+		strictErr: errInvalidTransferCoding, permErr: errInvalidTransferCoding},
+	{name: "TE empty", isRequest: true,
+		header:    "Host: a.com\r\nTransfer-Encoding:\r\n\r\n",
+		strictErr: errInvalidTransferCoding, permErr: errInvalidTransferCoding},
+	{name: "TE folded", isRequest: true,
+		header:     "Host: a.com\r\nTransfer-Encoding:\r\n chunked\r\n\r\n",
+		strictErr:  errObsFold,
+		normalized: "Host: a.com\r\nTransfer-Encoding: chunked\r\n\r\n"},
+	{name: "TE chunked folded into next", isRequest: true,
+		header:    "Host: a.com\r\nTransfer-Encoding: chunked\r\n x\r\n\r\n",
+		strictErr: errObsFold, permErr: errInvalidTransferCoding},
+	{name: "TE with underscore name", isRequest: true,
+		header: "Host: a.com\r\nTransfer_Encoding: chunked\r\nContent-Length: 3\r\n\r\n"},
+	{name: "TE null in name", isRequest: true,
+		header:    "Host: a.com\r\nTransfer-Encoding\x00: chunked\r\n\r\n",
+		strictErr: errInvalidFieldName, permErr: errInvalidFieldName},
+	{name: "TE space in name", isRequest: true,
+		header:    "Host: a.com\r\nTransfer Encoding: chunked\r\n\r\n",
+		strictErr: errInvalidFieldName, permErr: errInvalidFieldName},
+	{name: "TE leading space line", isRequest: true,
+		header:    " Transfer-Encoding: chunked\r\nHost: a.com\r\n\r\n",
+		strictErr: errObsFold, permErr: errMalformedHeaderField},
+
+	// CL obfuscation
+	{name: "CL conflicting", isRequest: true,
+		header:    "Host: a.com\r\nContent-Length: 5\r\nContent-Length: 6\r\n\r\n",
+		strictErr: errConflictContentLength, permErr: errConflictContentLength},
+	{name: "CL conflicting list", isRequest: true,
+		header:    "Host: a.com\r\nContent-Length: 5, 6\r\n\r\n",
+		strictErr: errConflictContentLength, permErr: errConflictContentLength},
+	{name: "CL duplicate", isRequest: true,
+		header:     "Host: a.com\r\nContent-Length: 5\r\nContent-Length: 5\r\n\r\n",
+		strictErr:  errDuplicateContentLength,
+		normalized: "Host: a.com\r\nContent-Length: 5\r\n\r\n"},
+	{name: "CL duplicate list", isRequest: true,
+		header:     "Host: a.com\r\nContent-Length: 5,5\r\n\r\n",
+		strictErr:  errDuplicateContentLength,
+		normalized: "Host: a.com\r\nContent-Length: 5\r\n\r\n"},
+	{name: "CL signed", isRequest: true,
+		header:    "Host: a.com\r\nContent-Length: +5\r\n\r\n",
+		strictErr: errInvalidContentLength, permErr: errInvalidContentLength},
+	{name: "CL negative", isRequest: true,
+		header:    "Host: a.com\r\nContent-Length: -1\r\n\r\n",
+		strictErr: errInvalidContentLength, permErr: errInvalidContentLength},
+	{name: "CL hex", isRequest: true,
+		header:    "Host: a.com\r\nContent-Length: 0x5\r\n\r\n",
+		strictErr: errInvalidContentLength, permErr: errInvalidContentLength},
+	{name: "CL empty", isRequest: true,
+		header:    "Host: a.com\r\nContent-Length:\r\n\r\n",
+		strictErr: errInvalidContentLength, permErr: errInvalidContentLength},
+	{name: "CL with space inside", isRequest: true,
+		header:    "Host: a.com\r\nContent-Length: 1 0\r\n\r\n",
+		strictErr: errInvalidContentLength, permErr: errInvalidContentLength},
+	{name: "CL space before colon", isRequest: true,
+		header:    "Host: a.com\r\nContent-Length : 5\r\n\r\n",
+		strictErr: errWhitespaceBeforeColon, permErr: errWhitespaceBeforeColon},
+
+	// line endings and control characters
+	{name: "bare LF", isRequest: true,
+		header:     "Host: a.com\nContent-Length: 5\n\n",
+		strictErr:  errBareLF,
+		normalized: "Host: a.com\r\nContent-Length: 5\r\n\r\n"},
+	{name: "bare CR in value", isRequest: true,
+		header:    "Host: a.com\r\nX-A: a\rTransfer-Encoding: chunked\r\n\r\n",
+		strictErr: errInvalidFieldValue, permErr: errInvalidFieldValue},
+	{name: "null in value", isRequest: true,
+		header:    "Host: a.com\r\nX-A: a\x00b\r\n\r\n",
+		strictErr: errInvalidFieldValue, permErr: errInvalidFieldValue},
+	{name: "no colon", isRequest: true,
+		header:    "Host: a.com\r\nTransfer-Encoding chunked\r\n\r\n",
+		strictErr: errMalformedHeaderField, permErr: errMalformedHeaderField},
+}
+
+func TestHeaderNormalizerCorpus(t *testing.T) {
+	n := &HeaderNormalizer{}
+	for _, c := range smugglingCorpus {
+		header, err := n.Normalize([]byte(c.header), ParsingModeStrict, c.isRequest)
+		if err != c.strictErr {
+			t.Fatalf("%s: expected strict error %v, but get %v", c.name, c.strictErr, err)
+		}
+		if err == nil && header != nil {
+			t.Fatalf("%s: the header should never be changed in strict mode, but get %q", c.name, header)
+		}
+
+		header, err = n.Normalize([]byte(c.header), ParsingModePermissive, c.isRequest)
+		if err != c.permErr {
+			t.Fatalf("%s: expected permissive error %v, but get %v", c.name, c.permErr, err)
+		}
+		if err != nil {
+			continue
+		}
+		if string(header) != c.normalized {
+			t.Fatalf("%s: expected normalized header %q, but get %q", c.name, c.normalized, header)
+		}
+		if n.IsFramingAmbiguous() != c.ambiguous {
+			t.Fatalf("%s: expected framing ambiguous %v", c.name, c.ambiguous)
+		}
+
+		// the normalized header is accepted in strict mode as is
+		if header != nil {
+			if header, err = n.Normalize(header, ParsingModeStrict, c.isRequest); err != nil || header != nil {
+				t.Fatalf("%s: unexpected normalized header %q in strict mode, error %v", c.name, header, err)
+			}
+		}
+	}
+}
+
+func TestHeaderNormalizerFraming(t *testing.T) {
+	// the framing of the normalized header is parsed as the permissive mode decided
+	n := &HeaderNormalizer{}
+	var h Header
+	header, err := n.Normalize([]byte("Content-Length: 6\r\nTransfer-Encoding: chunked\r\n\r\n"),
+		ParsingModePermissive, true)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err = h.Parse(header); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if h.BodyType() != BodyTypeChunked {
+		t.Fatalf("expected chunked body")
+	}
+
+	header, err = n.Normalize([]byte("Content-Length: 6,6\r\n\r\n"), ParsingModePermissive, true)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err = h.Parse(header); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if h.BodyType() != BodyTypeFixedSize || h.ContentLength() != 6 {
+		t.Fatalf("expected content length 6, but get %d", h.ContentLength())
+	}
+
+	// the fields similar to the framing ones are not treated as them
+	if _, err = h.Parse([]byte("Content-Length-X: 6\r\nTransfer-Encoding-X: chunked\r\n\r\n")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if h.BodyType() != BodyTypeFixedSize || h.ContentLength() != 0 {
+		t.Fatalf("unexpected framing of the similar fields")
+	}
+}
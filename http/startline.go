@@ -47,6 +47,23 @@ func (l *ResponseLine) Reset() {
 	l.statusMsg = l.statusMsg[:0]
 }
 
+// ChangeStatusCode change the status code, the status message is changed to
+// the standard one of the status code while the protocol is kept
+func (l *ResponseLine) ChangeStatusCode(statusCode int) {
+	statusMsg := StatusMessage(statusCode)
+	line := make([]byte, 0, len(l.protocol)+len(" 200 \r\n")+len(statusMsg))
+	line = append(line, l.protocol...)
+	line = append(line, ' ')
+	line = strconv.AppendInt(line, int64(statusCode), 10)
+	line = append(line, ' ')
+	line = append(line, statusMsg...)
+	line = append(line, '\r', '\n')
+	l.fullLine = line
+	l.protocol = line[:len(l.protocol)]
+	l.statusCode = statusCode
+	l.statusMsg = line[len(line)-len(statusMsg)-2 : len(line)-2]
+}
+
 var (
 	errRespLineNOProtocol   = errors.New("no protocol provided")
 	errRespLineNOStatusCode = errors.New("no status code provided")
@@ -99,6 +116,34 @@ func (l *ResponseLine) Parse(reader *bufio.Reader) error {
 	return nil
 }
 
+// IsStatusInterim if the status code is of an interim response, i.e. 1xx
+// except `101 Switching Protocols` which is the final one of the connection
+func IsStatusInterim(statusCode int) bool {
+	return statusCode >= 100 && statusCode < 200 && statusCode != StatusSwitchingProtocols
+}
+
+var errRespLineBadStatusCode = errors.New("bad status code")
+
+// PeekStatusCode peeks the status code of the response in reader without consuming it
+func PeekStatusCode(reader *bufio.Reader) (int, error) {
+	// HTTP-version SP 3DIGIT
+	b, err := reader.Peek(len("HTTP/1.1 200"))
+	if err != nil {
+		return 0, err
+	}
+	if b[8] != ' ' {
+		return 0, errRespLineNOProtocol
+	}
+	statusCode := 0
+	for _, c := range b[9:] {
+		if c < '0' || c > '9' {
+			return 0, errRespLineBadStatusCode
+		}
+		statusCode = statusCode*10 + int(c-'0')
+	}
+	return statusCode, nil
+}
+
 // RequestLine start line of a http request
 type RequestLine struct {
 	fullLine []byte
@@ -46,3 +46,52 @@ func testRespLineParse(t *testing.T, line string, expErr error, expProtocol stri
 		t.Fatalf("unexpected status msg %s, expecting %s,", resp.GetStatusMessage(), expMsg)
 	}
 }
+
+func TestRespLineChangeStatusCode(t *testing.T) {
+	resp := &ResponseLine{}
+	if err := resp.Parse(bufio.NewReader(strings.NewReader("HTTP/1.0 200 Fine\r\n"))); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	resp.ChangeStatusCode(StatusForbidden)
+	if string(resp.GetResponseLine()) != "HTTP/1.0 403 Forbidden\r\n" {
+		t.Fatalf("unexpected response line %q", resp.GetResponseLine())
+	}
+	if string(resp.GetProtocol()) != "HTTP/1.0" || resp.GetStatusCode() != StatusForbidden ||
+		string(resp.GetStatusMessage()) != "Forbidden" {
+		t.Fatalf("unexpected response line fields %q %d %q",
+			resp.GetProtocol(), resp.GetStatusCode(), resp.GetStatusMessage())
+	}
+}
+
+func TestPeekStatusCode(t *testing.T) {
+	testPeekStatusCode(t, "HTTP/1.1 100 Continue\r\n\r\n", 100, nil)
+	testPeekStatusCode(t, "HTTP/1.0 404 Not Found\r\n", 404, nil)
+	testPeekStatusCode(t, "HTTP/1.1 20", 0, io.EOF)
+	testPeekStatusCode(t, "HTTP/1.1  200 OK\r\n", 0, errRespLineBadStatusCode)
+	testPeekStatusCode(t, "HTTP/2 200 OK\r\n", 0, errRespLineNOProtocol)
+}
+
+func testPeekStatusCode(t *testing.T, resp string, expCode int, expErr error) {
+	reader := bufio.NewReader(strings.NewReader(resp))
+	code, err := PeekStatusCode(reader)
+	if err != expErr {
+		t.Fatalf("unexpected error %v, expecting %v", err, expErr)
+	}
+	if code != expCode {
+		t.Fatalf("unexpected status code %d, expecting %d", code, expCode)
+	}
+	if err == nil && reader.Buffered() != len(resp) {
+		t.Fatalf("the response should not be consumed")
+	}
+}
+
+func TestIsStatusInterim(t *testing.T) {
+	for code, expected := range map[int]bool{
+		StatusContinue: true, StatusEarlyHints: true, StatusSwitchingProtocols: false,
+		StatusOK: false, 99: false,
+	} {
+		if IsStatusInterim(code) != expected {
+			t.Fatalf("unexpected interim status of %d, expecting %v", code, expected)
+		}
+	}
+}
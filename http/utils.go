@@ -2,13 +2,27 @@ package http
 
 import "bytes"
 
-var methodConnect = []byte("CONNECT")
+var (
+	methodConnect = []byte("CONNECT")
+	methodGet     = []byte("GET")
+	methodHead    = []byte("HEAD")
+)
 
 // IsMethodConnect if the method is `CONNECT`
 func IsMethodConnect(method []byte) bool {
 	return bytes.Equal(method, methodConnect)
 }
 
+// IsMethodGet if the method is `GET`
+func IsMethodGet(method []byte) bool {
+	return bytes.Equal(method, methodGet)
+}
+
+// IsMethodHead if the method is `HEAD`
+func IsMethodHead(method []byte) bool {
+	return bytes.Equal(method, methodHead)
+}
+
 func changeToUpperCase(s []byte) {
 	for i, b := range s {
 		if 'a' <= b && b <= 'z' {
@@ -58,3 +72,23 @@ func equalIgnoreCase(a, b []byte) bool {
 	}
 	return true
 }
+
+// equalIgnoreCaseString equalIgnoreCase with b in string
+func equalIgnoreCaseString(a []byte, b string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := 0; i < len(a); i++ {
+		_a, _b := a[i], b[i]
+		if 'A' <= _a && _a <= 'Z' {
+			_a += 'a' - 'A'
+		}
+		if 'A' <= _b && _b <= 'Z' {
+			_b += 'a' - 'A'
+		}
+		if _a != _b {
+			return false
+		}
+	}
+	return true
+}
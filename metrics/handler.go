@@ -0,0 +1,36 @@
+package metrics
+
+import (
+	"net/http"
+	"time"
+)
+
+// contentType content type of the Prometheus text exposition format
+const contentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Handler makes a http handler exposing the metrics of the registry
+func Handler(r *Registry) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet && req.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", contentType)
+		if req.Method == http.MethodHead {
+			return
+		}
+		r.WriteTo(w)
+	})
+}
+
+// NewServer makes a http server exposing the metrics of the registry on `/metrics`,
+// which is supposed to serve on an admin listener separated from the proxy's
+func NewServer(r *Registry) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler(r))
+	return &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+}
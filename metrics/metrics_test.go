@@ -0,0 +1,99 @@
+package metrics
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRegistryWriteTo(t *testing.T) {
+	r := &Registry{}
+	r.Counter("requests_total", "Number of requests.", "class", "2xx").Add(3)
+	r.Counter("requests_total", "Number of requests.", "class", "5xx").Inc()
+	if c := r.Counter("requests_total", "Number of requests.", "class", "2xx"); c.Value() != 3 {
+		t.Fatalf("the same counter should be got, value %d", c.Value())
+	}
+	g := r.Gauge("conns", "Open\nconnections.")
+	g.Inc()
+	g.Inc()
+	g.Dec()
+	r.GaugeFunc("cache_size", "Cache size.", func() float64 { return 1.5 }, "name", `a"b`)
+	h := r.Histogram("latency_seconds", "Latency.", []float64{1, 0.1})
+	h.Observe(0.05)
+	h.Observe(0.1)
+	h.Observe(0.5)
+	h.Observe(2)
+
+	var b bytes.Buffer
+	n, err := r.WriteTo(&b)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if n != int64(b.Len()) {
+		t.Fatalf("unexpected written bytes %d, expected %d", n, b.Len())
+	}
+	expected := `# HELP cache_size Cache size.
+# TYPE cache_size gauge
+cache_size{name="a\"b"} 1.5
+# HELP conns Open\nconnections.
+# TYPE conns gauge
+conns 1
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 2
+latency_seconds_bucket{le="1"} 3
+latency_seconds_bucket{le="+Inf"} 4
+latency_seconds_sum 2.65
+latency_seconds_count 4
+# HELP requests_total Number of requests.
+# TYPE requests_total counter
+requests_total{class="2xx"} 3
+requests_total{class="5xx"} 1
+`
+	if b.String() != expected {
+		t.Fatalf("unexpected exposition:\n%s\nexpected:\n%s", b.String(), expected)
+	}
+}
+
+func TestRegistryTypeConflict(t *testing.T) {
+	r := &Registry{}
+	r.Counter("a", "")
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("registering a counter as gauge should panic")
+		}
+	}()
+	r.Gauge("a", "")
+}
+
+func TestHandler(t *testing.T) {
+	r := &Registry{}
+	r.Counter("requests_total", "Number of requests.").Inc()
+	s := httptest.NewServer(NewServer(r).Handler)
+	defer s.Close()
+
+	resp, err := http.Get(s.URL + "/metrics")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain") {
+		t.Fatalf("unexpected response %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	if !strings.Contains(string(body), "requests_total 1\n") {
+		t.Fatalf("unexpected body %s", body)
+	}
+
+	resp, err = http.Post(s.URL+"/metrics", "text/plain", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("unexpected status %d", resp.StatusCode)
+	}
+}
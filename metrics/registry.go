@@ -0,0 +1,245 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultRegistry the registry used by the fastproxy packages
+var DefaultRegistry = &Registry{}
+
+// metricType type of the metric family
+type metricType int
+
+const (
+	typeCounter metricType = iota
+	typeGauge
+	typeHistogram
+)
+
+func (t metricType) String() string {
+	switch t {
+	case typeCounter:
+		return "counter"
+	case typeGauge:
+		return "gauge"
+	case typeHistogram:
+		return "histogram"
+	}
+	return "untyped"
+}
+
+// family metrics sharing the same name, help and type, distinguished by labels
+type family struct {
+	name    string
+	help    string
+	typ     metricType
+	metrics map[string]*metric
+}
+
+type metric struct {
+	labels    string
+	counter   *Counter
+	gauge     *Gauge
+	gaugeFunc func() float64
+	histogram *Histogram
+}
+
+// Registry a set of the metrics, the metrics are got or created by name and labels,
+// labels are given in pairs, e.g. Counter("requests_total", "...", "class", "2xx").
+//
+// Getting a metric takes a lock, so the hot paths should hold the metric got.
+type Registry struct {
+	mu       sync.Mutex
+	families map[string]*family
+}
+
+// Counter gets or creates the counter with the name and labels
+func (r *Registry) Counter(name, help string, labels ...string) *Counter {
+	m := r.getOrCreate(name, help, typeCounter, labels, func(m *metric) {
+		m.counter = &Counter{}
+	})
+	return m.counter
+}
+
+// Gauge gets or creates the gauge with the name and labels
+func (r *Registry) Gauge(name, help string, labels ...string) *Gauge {
+	m := r.getOrCreate(name, help, typeGauge, labels, func(m *metric) {
+		m.gauge = &Gauge{}
+	})
+	return m.gauge
+}
+
+// GaugeFunc registers the gauge whose value is got from f when exposing,
+// f is replaced if the gauge is already registered
+func (r *Registry) GaugeFunc(name, help string, f func() float64, labels ...string) {
+	r.getOrCreate(name, help, typeGauge, labels, func(m *metric) {})
+	r.mu.Lock()
+	r.families[name].metrics[formatLabels(labels)].gaugeFunc = f
+	r.mu.Unlock()
+}
+
+// Histogram gets or creates the histogram with the name and labels,
+// DefaultBuckets is used if buckets not provided
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	m := r.getOrCreate(name, help, typeHistogram, labels, func(m *metric) {
+		m.histogram = newHistogram(buckets)
+	})
+	return m.histogram
+}
+
+func (r *Registry) getOrCreate(name, help string, typ metricType,
+	labels []string, create func(*metric)) *metric {
+	if len(labels)%2 != 0 {
+		panic("BUG: labels of metric " + name + " should be given in pairs")
+	}
+	key := formatLabels(labels)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.families == nil {
+		r.families = make(map[string]*family)
+	}
+	f := r.families[name]
+	if f == nil {
+		f = &family{name: name, help: help, typ: typ, metrics: make(map[string]*metric)}
+		r.families[name] = f
+	} else if f.typ != typ {
+		panic(fmt.Sprintf("BUG: metric %s registered as %s", name, f.typ))
+	}
+	m := f.metrics[key]
+	if m == nil {
+		m = &metric{labels: key}
+		create(m)
+		f.metrics[key] = m
+	}
+	return m
+}
+
+// formatLabels formats the label pairs into `k1="v1",k2="v2"`
+func formatLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	for i := 0; i < len(labels); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(labels[i])
+		b.WriteString(`="`)
+		b.WriteString(escapeLabelValue(labels[i+1]))
+		b.WriteByte('"')
+	}
+	return b.String()
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(v string) string {
+	return labelValueEscaper.Replace(v)
+}
+
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+// WriteTo writes all the metrics in the Prometheus text exposition format,
+// the families are sorted by name
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	families := make([]*family, 0, len(r.families))
+	for _, f := range r.families {
+		families = append(families, f)
+	}
+	sort.Slice(families, func(i, j int) bool { return families[i].name < families[j].name })
+	snapshots := make([][]*metric, len(families))
+	for i, f := range families {
+		metrics := make([]*metric, 0, len(f.metrics))
+		for _, m := range f.metrics {
+			metrics = append(metrics, m)
+		}
+		sort.Slice(metrics, func(i, j int) bool { return metrics[i].labels < metrics[j].labels })
+		snapshots[i] = metrics
+	}
+	r.mu.Unlock()
+
+	cw := &countWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	for i, f := range families {
+		fmt.Fprintf(bw, "# HELP %s %s\n", f.name, helpEscaper.Replace(f.help))
+		fmt.Fprintf(bw, "# TYPE %s %s\n", f.name, f.typ)
+		for _, m := range snapshots[i] {
+			writeMetric(bw, f.name, m)
+		}
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
+
+func writeMetric(w *bufio.Writer, name string, m *metric) {
+	switch {
+	case m.counter != nil:
+		writeSample(w, name, m.labels, "", strconv.FormatUint(m.counter.Value(), 10))
+	case m.gauge != nil:
+		writeSample(w, name, m.labels, "", strconv.FormatInt(m.gauge.Value(), 10))
+	case m.gaugeFunc != nil:
+		writeSample(w, name, m.labels, "", formatFloat(m.gaugeFunc()))
+	case m.histogram != nil:
+		h := m.histogram
+		var cumulative uint64
+		for i, upperBound := range h.upperBounds {
+			cumulative += atomic.LoadUint64(&h.counts[i])
+			writeSample(w, name+"_bucket", m.labels, `le="`+formatFloat(upperBound)+`"`,
+				strconv.FormatUint(cumulative, 10))
+		}
+		cumulative += atomic.LoadUint64(&h.counts[len(h.upperBounds)])
+		writeSample(w, name+"_bucket", m.labels, `le="+Inf"`, strconv.FormatUint(cumulative, 10))
+		writeSample(w, name+"_sum", m.labels, "", formatFloat(h.Sum()))
+		// the count is consistent with the +Inf bucket
+		writeSample(w, name+"_count", m.labels, "", strconv.FormatUint(cumulative, 10))
+	}
+}
+
+func writeSample(w *bufio.Writer, name, labels, extraLabel, value string) {
+	w.WriteString(name)
+	if len(labels) > 0 || len(extraLabel) > 0 {
+		w.WriteByte('{')
+		w.WriteString(labels)
+		if len(labels) > 0 && len(extraLabel) > 0 {
+			w.WriteByte(',')
+		}
+		w.WriteString(extraLabel)
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(value)
+	w.WriteByte('\n')
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, +1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
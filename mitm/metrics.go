@@ -0,0 +1,6 @@
+package mitm
+
+import "github.com/haxii/fastproxy/metrics"
+
+var certCacheGauge = metrics.DefaultRegistry.Gauge("fastproxy_mitm_cert_cache_size",
+	"Number of the leaf certificates cached for the decryption.")
@@ -239,6 +239,9 @@ func SignLeafCertUsingCertAuthority(certAuthority *tls.Certificate,
 	cert.Certificate = append(cert.Certificate, x)
 	cert.PrivateKey = key
 	cert.Leaf, _ = x509.ParseCertificate(x)
-	cachedCert, _ := mitmCertPool.LoadOrStore(domainName, cert)
+	cachedCert, loaded := mitmCertPool.LoadOrStore(domainName, cert)
+	if !loaded {
+		certCacheGauge.Inc()
+	}
 	return cachedCert.(*tls.Certificate), nil
 }
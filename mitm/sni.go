@@ -0,0 +1,135 @@
+package mitm
+
+import (
+	"bufio"
+	"errors"
+)
+
+const (
+	recordTypeHandshake      = 0x16
+	handshakeTypeClientHello = 1
+	extensionServerName      = 0
+	serverNameTypeHostName   = 0
+	recordHeaderLen          = 5
+)
+
+var (
+	errNotTLSHandshake = errors.New("not a TLS handshake")
+	errBadClientHello  = errors.New("malformed TLS client hello")
+	errNoServerName    = errors.New("no server name in TLS client hello")
+)
+
+// IsTLSHandshake if the first byte of the reader is a TLS handshake record,
+// it blocks until the first byte is available
+func IsTLSHandshake(reader *bufio.Reader) (bool, error) {
+	b, err := reader.Peek(1)
+	if err != nil {
+		return false, err
+	}
+	return b[0] == recordTypeHandshake, nil
+}
+
+// PeekClientHelloServerName peeks the TLS client hello from the reader then
+// returns the server name declared in the SNI extension, the reader is not
+// advanced, so the handshake can be performed later with the peeked data.
+//
+// The client hello must be in the first TLS record and fit into the reader's buffer
+func PeekClientHelloServerName(reader *bufio.Reader) (string, error) {
+	header, err := reader.Peek(recordHeaderLen)
+	if err != nil {
+		return "", err
+	}
+	if header[0] != recordTypeHandshake {
+		return "", errNotTLSHandshake
+	}
+	recordLen := int(header[3])<<8 | int(header[4])
+	record, err := reader.Peek(recordHeaderLen + recordLen)
+	if err != nil && err != bufio.ErrBufferFull {
+		return "", err
+	}
+	return parseClientHelloServerName(record[recordHeaderLen:])
+}
+
+// parseClientHelloServerName parses the server name from the handshake message
+func parseClientHelloServerName(b []byte) (string, error) {
+	// handshake type & length, client version, random
+	if len(b) < 4 || b[0] != handshakeTypeClientHello {
+		return "", errBadClientHello
+	}
+	b = b[4:]
+	if len(b) < 2+32 {
+		return "", errBadClientHello
+	}
+	b = b[2+32:]
+
+	// session id, cipher suites, compression methods
+	var ok bool
+	if b, ok = skipVector(b, 1); !ok {
+		return "", errBadClientHello
+	}
+	if b, ok = skipVector(b, 2); !ok {
+		return "", errBadClientHello
+	}
+	if b, ok = skipVector(b, 1); !ok {
+		return "", errBadClientHello
+	}
+
+	// extensions
+	if len(b) < 2 {
+		return "", errNoServerName
+	}
+	extensionsLen := int(b[0])<<8 | int(b[1])
+	b = b[2:]
+	if len(b) > extensionsLen {
+		b = b[:extensionsLen]
+	}
+	for len(b) >= 4 {
+		extType := int(b[0])<<8 | int(b[1])
+		extLen := int(b[2])<<8 | int(b[3])
+		b = b[4:]
+		if len(b) < extLen {
+			return "", errBadClientHello
+		}
+		if extType == extensionServerName {
+			return parseServerNameExtension(b[:extLen])
+		}
+		b = b[extLen:]
+	}
+	return "", errNoServerName
+}
+
+func parseServerNameExtension(b []byte) (string, error) {
+	if len(b) < 2 {
+		return "", errBadClientHello
+	}
+	b = b[2:]
+	for len(b) >= 3 {
+		nameType := b[0]
+		nameLen := int(b[1])<<8 | int(b[2])
+		b = b[3:]
+		if len(b) < nameLen {
+			return "", errBadClientHello
+		}
+		if nameType == serverNameTypeHostName {
+			return string(b[:nameLen]), nil
+		}
+		b = b[nameLen:]
+	}
+	return "", errNoServerName
+}
+
+// skipVector skips a TLS vector with lenBytes bytes length prefix
+func skipVector(b []byte, lenBytes int) ([]byte, bool) {
+	if len(b) < lenBytes {
+		return nil, false
+	}
+	n := 0
+	for i := 0; i < lenBytes; i++ {
+		n = n<<8 | int(b[i])
+	}
+	b = b[lenBytes:]
+	if len(b) < n {
+		return nil, false
+	}
+	return b[n:], true
+}
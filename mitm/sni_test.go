@@ -0,0 +1,63 @@
+package mitm
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"net"
+	"testing"
+)
+
+// recordClientHello records the client hello sent by a tls client
+func recordClientHello(t *testing.T, serverName string) []byte {
+	clientConn, serverConn := net.Pipe()
+	go func() {
+		tls.Client(clientConn, &tls.Config{ServerName: serverName, InsecureSkipVerify: true}).Handshake()
+	}()
+	buf := make([]byte, 16*1024)
+	n, err := serverConn.Read(buf)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	clientConn.Close()
+	serverConn.Close()
+	return buf[:n]
+}
+
+func TestPeekClientHelloServerName(t *testing.T) {
+	hello := recordClientHello(t, "example.com")
+	reader := bufio.NewReaderSize(bytes.NewReader(hello), 16*1024)
+	if isTLS, err := IsTLSHandshake(reader); err != nil || !isTLS {
+		t.Fatalf("client hello should be a tls handshake, error %v", err)
+	}
+	serverName, err := PeekClientHelloServerName(reader)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if serverName != "example.com" {
+		t.Fatalf("unexpected server name %s", serverName)
+	}
+	if reader.Buffered() != len(hello) {
+		t.Fatalf("reader should not be advanced")
+	}
+
+	// ip address is not sent as server name
+	hello = recordClientHello(t, "127.0.0.1")
+	if _, err = PeekClientHelloServerName(bufio.NewReaderSize(bytes.NewReader(hello), 16*1024)); err != errNoServerName {
+		t.Fatalf("expecting no server name error, got %v", err)
+	}
+
+	// not a tls handshake
+	reader = bufio.NewReader(bytes.NewReader([]byte("GET / HTTP/1.1\r\n\r\n")))
+	if isTLS, _ := IsTLSHandshake(reader); isTLS {
+		t.Fatalf("http request should not be a tls handshake")
+	}
+	if _, err = PeekClientHelloServerName(reader); err != errNotTLSHandshake {
+		t.Fatalf("expecting not tls handshake error, got %v", err)
+	}
+
+	// truncated client hello
+	if _, err = parseClientHelloServerName(hello[recordHeaderLen : recordHeaderLen+40]); err != errBadClientHello {
+		t.Fatalf("expecting bad client hello error, got %v", err)
+	}
+}
@@ -1,17 +1,13 @@
 package plugin
 
 import (
-	"bytes"
 	"context"
-	"crypto/tls"
 	"io"
 	"net"
-	"net/textproto"
 	"strings"
 	"sync"
 
-	"github.com/haxii/fastproxy/bufiopool"
-	"github.com/haxii/fastproxy/bytebufferpool"
+	"github.com/haxii/fastproxy/client"
 	"github.com/haxii/fastproxy/http"
 	"github.com/haxii/fastproxy/proxy"
 	"github.com/haxii/fastproxy/superproxy"
@@ -38,8 +34,9 @@ type HijackHandler struct {
 	// default handlers
 	BlockByDefault    bool
 	DefaultSuperProxy *superproxy.SuperProxy
-	DefaultDial       func(addr string) (net.Conn, error)
-	DefaultDialTLS    func(addr string, tlsConfig *tls.Config) (net.Conn, error)
+	// DefaultSuperProxyPool used when DefaultSuperProxy not set, picked by the client IP
+	DefaultSuperProxyPool *superproxy.Pool
+	DefaultDialer         *client.Dialer
 
 	// hijackers
 	RewriteHost          func(connInfo *RequestConnInfo) (newHost, newPort string)
@@ -68,7 +65,8 @@ type HijackerPool struct {
 	Handler HijackHandler
 }
 
-func (p *HijackerPool) Get(clientAddr net.Addr, isHTTPS bool, host, port string) proxy.Hijacker {
+func (p *HijackerPool) Get(ctx context.Context, clientAddr net.Addr, username string,
+	isHTTPS bool, host, port string) proxy.Hijacker {
 	v := p.pool.Get()
 	var h *Hijacker
 	if v == nil {
@@ -76,7 +74,7 @@ func (p *HijackerPool) Get(clientAddr net.Addr, isHTTPS bool, host, port string)
 	} else {
 		h = v.(*Hijacker)
 	}
-	h.Init(clientAddr, isHTTPS, host, port, &p.Handler)
+	h.Init(ctx, clientAddr, username, isHTTPS, host, port, &p.Handler)
 	return h
 }
 
@@ -95,39 +93,78 @@ const (
 	HijackedResponseTypeBlock HijackedResponseType = iota
 	HijackedResponseTypeInspect
 	HijackedResponseTypeOverride
+	HijackedResponseTypeTransform
+	HijackedResponseTypeRewrite
 )
 
 type HijackedRequest struct {
-	OverridePath   []byte
-	OverrideHeader []byte
-	ResolvedIP     net.IP
-	SuperProxy     *superproxy.SuperProxy
-	Dial           func(addr string) (net.Conn, error)
-	DialTLS        func(addr string, tlsConfig *tls.Config) (net.Conn, error)
+	OverridePath []byte
+	ResolvedIP   net.IP
+	SuperProxy   *superproxy.SuperProxy
+	// SuperProxyPool used when SuperProxy not set, the requests are responded
+	// with `503 Service Unavailable` if none of its members available
+	SuperProxyPool *superproxy.Pool
+	// SuperProxyKey picks the super proxy from SuperProxyPool, e.g. a session key
+	// for the sticky strategy, the client IP is used if not set
+	SuperProxyKey string
+	// Dialer the connections are pooled by, share it among the requests reusing connections
+	Dialer *client.Dialer
 
 	BodyInspectWriter io.WriteCloser // used by request body writer
+	// InspectTrailers called with the trailers of the chunked request body
+	InspectTrailers func(trailers *http.HeaderFields)
+
+	// request body transformation, see proxy.Hijacker's TransformRequest
+	TransformHeader func(fields *http.HeaderFields, bodySize int64)
+	TransformBody   func(io.Reader) io.Reader
+	BufferBody      bool
+
+	// Timeouts overrides the proxy's timeouts of the request, the zero ones are not overridden
+	Timeouts proxy.Timeouts
 }
 
 func (h *HijackedRequest) Reset() {
 	h.OverridePath = nil
-	h.OverrideHeader = nil
 	h.ResolvedIP = nil
 	h.SuperProxy = nil
-	h.Dial = nil
-	h.DialTLS = nil
+	h.SuperProxyPool = nil
+	h.SuperProxyKey = ""
+	h.Dialer = nil
 	h.BodyInspectWriter = nil
+	h.InspectTrailers = nil
+	h.TransformHeader = nil
+	h.TransformBody = nil
+	h.BufferBody = false
+	h.Timeouts = proxy.Timeouts{}
 }
 
 type HijackedResponse struct {
 	ResponseType   HijackedResponseType
 	InspectWriter  ResponseWriter // used by HijackedResponseTypeInspect
 	OverrideReader io.ReadCloser  // used by HijackedResponseTypeOverride
+
+	// used by HijackedResponseTypeTransform
+	TransformBody func(io.Reader) io.Reader
+	DecodeBody    bool
+
+	// used by HijackedResponseTypeRewrite, HijackedResponseTypeInspect and HijackedResponseTypeTransform
+	RewriteStatusCode int
+	RewriteHeader     func(statusLine http.ResponseLine, header http.Header, fields *http.HeaderFields)
+
+	// used by HijackedResponseTypeInspect and HijackedResponseTypeTransform,
+	// called with the trailers of the chunked response body
+	InspectTrailers func(trailers *http.HeaderFields)
 }
 
 func (h *HijackedResponse) Reset() {
 	h.ResponseType = HijackedResponseTypeBlock
 	h.InspectWriter = nil
 	h.OverrideReader = nil
+	h.TransformBody = nil
+	h.DecodeBody = false
+	h.RewriteStatusCode = 0
+	h.RewriteHeader = nil
+	h.InspectTrailers = nil
 }
 
 // Hijacker is handler implementation of proxy/hijacker
@@ -145,11 +182,14 @@ type Hijacker struct {
 }
 
 // Init initialize hijacker
-func (h *Hijacker) Init(clientAddr net.Addr, isHTTPS bool, host, port string, handler *HijackHandler) {
+func (h *Hijacker) Init(ctx context.Context, clientAddr net.Addr, username string,
+	isHTTPS bool, host, port string, handler *HijackHandler) {
 	h.connInfo.reset()
 	h.requestHeader.reset()
 
+	h.connInfo.Context = ctx
 	h.connInfo.clientAddr = clientAddr
+	h.connInfo.username = username
 	h.connInfo.isHTTPS = isHTTPS
 	h.connInfo.host = host
 	h.connInfo.port = port
@@ -206,27 +246,26 @@ func (h *Hijacker) RewriteTLSServerName(serverName string) string {
 }
 
 func (h *Hijacker) BeforeRequest(method, path []byte, httpHeader http.Header,
-	rawHeader []byte) (newPath, newRawHeader []byte) {
+	fields *http.HeaderFields) (newPath []byte) {
 	h.connInfo.method = string(method)
 	if h.handler != nil {
 		h.uri.ChangePathWithFragment(path)
 		pathOnly := h.uri.Path()
 		handleFunc, _ := h.handler.router.GetHandleFunc(string(method), h.connInfo.host, string(pathOnly))
 		if handleFunc != nil {
-			h.requestHeader.rawHeader = rawHeader
+			h.requestHeader.fields = fields
 			h.hijackedReq, h.hijackedResp = handleFunc(&h.connInfo, &h.uri, &h.requestHeader)
 		}
 	}
 
 	if h.hijackedReq != nil {
 		newPath = h.hijackedReq.OverridePath
-		newRawHeader = h.hijackedReq.OverrideHeader
 	}
 	if newPath == nil {
 		newPath = path
 	}
 
-	return newPath, newRawHeader
+	return newPath
 }
 
 func (h *Hijacker) Resolve() net.IP {
@@ -243,14 +282,27 @@ func (h *Hijacker) Resolve() net.IP {
 	return nil
 }
 
-func (h *Hijacker) SuperProxy() *superproxy.SuperProxy {
+func (h *Hijacker) SuperProxy() (*superproxy.SuperProxy, error) {
+	var pool *superproxy.Pool
+	key := ""
 	if h.hijackedReq != nil {
-		return h.hijackedReq.SuperProxy
+		h.superProxy, pool, key = h.hijackedReq.SuperProxy, h.hijackedReq.SuperProxyPool, h.hijackedReq.SuperProxyKey
+	} else if h.handler != nil {
+		h.superProxy, pool = h.handler.DefaultSuperProxy, h.handler.DefaultSuperProxyPool
 	}
-	if h.handler != nil {
-		return h.handler.DefaultSuperProxy
+	if h.superProxy != nil || pool == nil {
+		return h.superProxy, nil
 	}
-	return nil
+	if len(key) == 0 && h.connInfo.clientAddr != nil {
+		key = h.connInfo.clientAddr.String()
+		if host, _, err := net.SplitHostPort(key); err == nil {
+			key = host
+		}
+	}
+	if h.superProxy = pool.Pick(key); h.superProxy == nil {
+		return nil, superproxy.ErrNoSuperProxyAvail
+	}
+	return h.superProxy, nil
 }
 
 func (h *Hijacker) Block() bool {
@@ -272,22 +324,27 @@ func (h *Hijacker) HijackResponse() io.ReadCloser {
 	return nil
 }
 
-func (h *Hijacker) Dial() func(addr string) (net.Conn, error) {
+func (h *Hijacker) TransformRequest(header http.Header,
+	fields *http.HeaderFields) (func(*http.HeaderFields, int64), func(io.Reader) io.Reader, bool) {
 	if h.hijackedReq != nil {
-		return h.hijackedReq.Dial
+		return h.hijackedReq.TransformHeader, h.hijackedReq.TransformBody, h.hijackedReq.BufferBody
 	}
-	if h.handler != nil {
-		return h.handler.DefaultDial
+	return nil, nil, false
+}
+
+func (h *Hijacker) Timeouts() *proxy.Timeouts {
+	if h.hijackedReq != nil {
+		return &h.hijackedReq.Timeouts
 	}
 	return nil
 }
 
-func (h *Hijacker) DialTLS() func(addr string, tlsConfig *tls.Config) (net.Conn, error) {
+func (h *Hijacker) Dialer() *client.Dialer {
 	if h.hijackedReq != nil {
-		return h.hijackedReq.DialTLS
+		return h.hijackedReq.Dialer
 	}
 	if h.handler != nil {
-		return h.handler.DefaultDialTLS
+		return h.handler.DefaultDialer
 	}
 	return nil
 }
@@ -299,6 +356,30 @@ func (h *Hijacker) OnRequest(path []byte, header http.Header, rawHeader []byte)
 	return nil
 }
 
+func (h *Hijacker) RewriteResponse(statusLine http.ResponseLine,
+	header http.Header, fields *http.HeaderFields) int {
+	if h.hijackedResp != nil {
+		switch h.hijackedResp.ResponseType {
+		case HijackedResponseTypeRewrite, HijackedResponseTypeInspect, HijackedResponseTypeTransform:
+			if h.hijackedResp.RewriteHeader != nil {
+				h.hijackedResp.RewriteHeader(statusLine, header, fields)
+			}
+			return h.hijackedResp.RewriteStatusCode
+		}
+	}
+	return 0
+}
+
+func (h *Hijacker) TransformResponse(statusLine http.ResponseLine,
+	header http.Header) (func(io.Reader) io.Reader, bool) {
+	if h.hijackedResp != nil {
+		if h.hijackedResp.ResponseType == HijackedResponseTypeTransform {
+			return h.hijackedResp.TransformBody, h.hijackedResp.DecodeBody
+		}
+	}
+	return nil, false
+}
+
 func (h *Hijacker) OnResponse(statusLine http.ResponseLine,
 	header http.Header, rawHeader []byte) io.WriteCloser {
 	if h.hijackedResp != nil {
@@ -316,6 +397,21 @@ func (h *Hijacker) OnResponse(statusLine http.ResponseLine,
 	return nil
 }
 
+func (h *Hijacker) OnTrailers(isResponse bool, trailers *http.HeaderFields) {
+	if !isResponse {
+		if h.hijackedReq != nil && h.hijackedReq.InspectTrailers != nil {
+			h.hijackedReq.InspectTrailers(trailers)
+		}
+		return
+	}
+	if h.hijackedResp != nil && h.hijackedResp.InspectTrailers != nil {
+		switch h.hijackedResp.ResponseType {
+		case HijackedResponseTypeInspect, HijackedResponseTypeTransform:
+			h.hijackedResp.InspectTrailers(trailers)
+		}
+	}
+}
+
 func (h *Hijacker) AfterResponse(err error) {
 	if h.handler != nil {
 		if h.handler.onHijackFinished != nil {
@@ -334,6 +430,7 @@ type ResponseWriter interface {
 
 type RequestConnInfo struct {
 	clientAddr net.Addr
+	username   string
 
 	isHTTPS       bool
 	host, port    string
@@ -342,11 +439,15 @@ type RequestConnInfo struct {
 
 	method string
 
+	// Context the context of the request, which is cancelled when the client
+	// closes the connection, the proxy is closed or the request timed out.
+	// Derive a new one from it to pass values between handlers
 	Context context.Context
 }
 
 func (i *RequestConnInfo) reset() {
 	i.clientAddr = nil
+	i.username = ""
 	i.isHTTPS = false
 	i.host = ""
 	i.port = ""
@@ -360,6 +461,12 @@ func (i *RequestConnInfo) ClientAddr() net.Addr {
 	return i.clientAddr
 }
 
+// Username the authenticated user name of the proxy client,
+// empty if the proxy doesn't require authentication
+func (i *RequestConnInfo) Username() string {
+	return i.username
+}
+
 func (i *RequestConnInfo) IsHTTPS() bool {
 	return i.isHTTPS
 }
@@ -384,34 +491,57 @@ func (i *RequestConnInfo) Port() string {
 	return i.port
 }
 
-// RequestHeader MIME Header wrapper, offers get key and raw header method
+// RequestHeader request header wrapper, offers the ability to get and change
+// the header fields, the changes are sent to the target
 type RequestHeader struct {
-	mimeHeader textproto.MIMEHeader
-	rawHeader  []byte
+	fields    *http.HeaderFields
+	rawHeader []byte
 }
 
 func (h *RequestHeader) reset() {
-	h.mimeHeader = nil
-	h.rawHeader = nil
+	h.fields = nil
+	h.rawHeader = h.rawHeader[:0]
 }
 
-var requestHeaderBufioPool = bufiopool.New(128*1024, 4096)
-
+// Get gets the value of the first field named key
 func (h *RequestHeader) Get(key string) string {
-	if h.mimeHeader == nil { // lazy init
-		bytebufferpool.Get()
-		headerReader := bytes.NewReader(h.rawHeader)
-		headerBufioReader := requestHeaderBufioPool.AcquireReader(headerReader)
-		defer requestHeaderBufioPool.ReleaseReader(headerBufioReader)
-		headerTextProtoReader := textproto.NewReader(headerBufioReader)
-		h.mimeHeader, _ = headerTextProtoReader.ReadMIMEHeader()
-	}
-	if h.mimeHeader == nil {
+	if h.fields == nil {
 		return ""
 	}
-	return h.mimeHeader.Get(key)
+	return string(h.fields.Peek(key))
 }
 
+// Set sets the field named key, the existing ones are replaced
+func (h *RequestHeader) Set(key, value string) {
+	if h.fields != nil {
+		h.fields.Set(key, value)
+	}
+}
+
+// Add adds a field after the existing ones
+func (h *RequestHeader) Add(key, value string) {
+	if h.fields != nil {
+		h.fields.Add(key, value)
+	}
+}
+
+// Del removes all the fields named key
+func (h *RequestHeader) Del(key string) {
+	if h.fields != nil {
+		h.fields.Del(key)
+	}
+}
+
+// Fields the header fields of the request
+func (h *RequestHeader) Fields() *http.HeaderFields {
+	return h.fields
+}
+
+// RawHeader the raw header made of the current header fields
 func (h *RequestHeader) RawHeader() []byte {
+	if h.fields == nil {
+		return nil
+	}
+	h.rawHeader = h.fields.AppendBytes(h.rawHeader[:0])
 	return h.rawHeader
 }
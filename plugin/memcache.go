@@ -133,6 +133,8 @@ type MemoryCache struct {
 	cacheWriter     *bytes.Buffer
 	expectCacheSize int64
 	expectTTL       int
+
+	fields http.HeaderFields
 }
 
 func (c *MemoryCache) Init(pool *MemoryCachePool, cacheKey string) {
@@ -165,34 +167,34 @@ func (c *MemoryCache) WriteHeader(statusLine http.ResponseLine, header http.Head
 		return err
 	}
 
-	c.expectTTL = parseMaxAge(rawHeader)
+	if _, err = c.fields.Parse(rawHeader); err != nil {
+		return err
+	}
+	c.expectTTL = parseMaxAge(&c.fields)
 	return nil
 }
 
-func parseMaxAge(rawHeader []byte) int {
-	if cacheControlIndex := bytes.Index(rawHeader, []byte("Cache-Control")); cacheControlIndex >= 0 {
-		if cacheControlEndIndex := bytes.Index(rawHeader[cacheControlIndex:], []byte("\n")); cacheControlEndIndex > 0 {
-			cacheControlEndIndex = cacheControlIndex + cacheControlEndIndex
-			cacheControlHeader := rawHeader[cacheControlIndex:cacheControlEndIndex]
-			if maxAgeIndex := bytes.Index(cacheControlHeader, []byte("max-age")); maxAgeIndex > 0 {
-				maxAgeEndIndex := bytes.IndexByte(cacheControlHeader[maxAgeIndex:], ';')
-				if maxAgeEndIndex < 0 {
-					maxAgeEndIndex = len(cacheControlHeader)
-				} else {
-					maxAgeEndIndex = maxAgeEndIndex + maxAgeIndex
-				}
-				maxAgeDef := cacheControlHeader[maxAgeIndex:maxAgeEndIndex]
-				if sepIndex := bytes.IndexByte(maxAgeDef, '='); sepIndex > 0 {
-					maxAgeBytes := maxAgeDef[sepIndex+1:]
-					if maxAge, err := strconv.Atoi(string(bytes.TrimSpace(maxAgeBytes))); err == nil {
-						return maxAge
-					}
+func parseMaxAge(fields *http.HeaderFields) int {
+	maxAge := -1
+	fields.VisitValues("Cache-Control", func(value []byte) {
+		for len(value) > 0 {
+			var directive []byte
+			if n := bytes.IndexByte(value, ','); n >= 0 {
+				directive, value = value[:n], value[n+1:]
+			} else {
+				directive, value = value, nil
+			}
+			if sepIndex := bytes.IndexByte(directive, '='); sepIndex > 0 &&
+				bytes.EqualFold(bytes.TrimSpace(directive[:sepIndex]), []byte("max-age")) {
+				if n, err := strconv.Atoi(string(bytes.TrimSpace(directive[sepIndex+1:]))); err == nil {
+					maxAge = n
 				}
 			}
 		}
-	}
-	return -1
+	})
+	return maxAge
 }
+
 func (c *MemoryCache) Write(p []byte) (n int, err error) {
 	if c.cacheWriter == nil {
 		return 0, errNothingToWrite
@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	"github.com/haxii/fastproxy/accesslog"
+	"github.com/haxii/fastproxy/http"
+)
+
+// logAccess writes the access log record of the request if the access log is set,
+// statusCode is the one sent to client, reqBytes and respBytes are the bytes
+// read from and written to client
+func (p *Proxy) logAccess(c net.Conn, req *Request, statusCode int,
+	reqBytes, respBytes int64, err error) {
+	if p.AccessLog == nil {
+		return
+	}
+	isTunnel := http.IsMethodConnect(req.Method())
+	r := accesslog.Record{
+		Time:          req.startTime,
+		Duration:      time.Since(req.startTime),
+		Username:      req.username,
+		Method:        string(req.Method()),
+		Protocol:      string(req.reqLine.Protocol()),
+		Referer:       string(req.header.Referer()),
+		UserAgent:     string(req.header.UserAgent()),
+		StatusCode:    statusCode,
+		RequestBytes:  reqBytes,
+		ResponseBytes: respBytes,
+		UpstreamAddr:  req.TargetWithPort(),
+		SSLBump:       req.isSSLBump,
+		Tunnel:        isTunnel,
+		Err:           err,
+	}
+	if addr := c.RemoteAddr(); addr != nil {
+		r.ClientAddr = addr.String()
+	}
+	if isTunnel {
+		r.URL = req.reqLine.HostInfo().HostWithPort()
+	} else {
+		r.URL = requestURL(req)
+	}
+	if req.proxy != nil {
+		r.SuperProxy = req.proxy.HostWithPort()
+	}
+	p.AccessLog.Log(&r)
+}
+
+// requestURL the absolute URL of the http request, the default port is omitted
+func requestURL(req *Request) string {
+	scheme, defaultPort := "http://", "80"
+	if req.isTLS {
+		scheme, defaultPort = "https://", "443"
+	}
+	hostInfo := req.reqLine.HostInfo()
+	host := hostInfo.HostWithPort()
+	if hostInfo.Port() == defaultPort && !strings.Contains(hostInfo.Domain(), ":") {
+		host = hostInfo.Domain()
+	}
+	return scheme + host + string(req.PathWithQueryFragment())
+}
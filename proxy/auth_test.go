@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net"
+	nethttp "net/http"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/haxii/fastproxy/auth"
+)
+
+// startTarget serves the target with handler, returns its URL
+func startTarget(t *testing.T, handler nethttp.HandlerFunc) (string, *nethttp.Server) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	s := &nethttp.Server{Handler: handler}
+	go s.Serve(ln)
+	return "http://" + ln.Addr().String(), s
+}
+
+func TestProxyAuthenticationRequired(t *testing.T) {
+	target, s := startTarget(t, func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		w.Write([]byte("ok"))
+	})
+	defer s.Close()
+	u, _ := url.Parse(target)
+	// the challenge is made on the first use by the concurrent requests
+	proxy := &Proxy{Authenticator: &auth.Basic{Realm: "test",
+		Verifier: auth.NewMemoryStore(map[string]string{"user": "pass"})}}
+	go proxy.Serve("tcp4", "127.0.0.1:7088")
+	defer proxy.Close()
+	time.Sleep(time.Millisecond * 10)
+
+	testAuthenticate := func(reqLine, proxyAuthorization string, expStatusCode int) error {
+		c, err := net.Dial("tcp", "127.0.0.1:7088")
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		fmt.Fprintf(c, "%s\r\nHost: %s\r\n%sConnection: close\r\n\r\n", reqLine, u.Host, proxyAuthorization)
+		resp, err := nethttp.ReadResponse(bufio.NewReader(c), nil)
+		if err != nil {
+			return err
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != expStatusCode {
+			return fmt.Errorf("unexpected status code %d of %s, expecting %d", resp.StatusCode, reqLine, expStatusCode)
+		}
+		if expStatusCode != nethttp.StatusProxyAuthRequired {
+			return nil
+		}
+		if challenge := resp.Header.Get("Proxy-Authenticate"); challenge != `Basic realm="test"` {
+			return fmt.Errorf("unexpected challenge %q of %s", challenge, reqLine)
+		}
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	for _, reqLine := range []string{"GET " + target + "/ HTTP/1.1", "CONNECT " + u.Host + " HTTP/1.1"} {
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func(reqLine string) {
+				defer wg.Done()
+				if err := testAuthenticate(reqLine, "", nethttp.StatusProxyAuthRequired); err != nil {
+					t.Error(err)
+				}
+			}(reqLine)
+		}
+	}
+	wg.Wait()
+
+	wrong := "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte("user:wrong")) + "\r\n"
+	if err := testAuthenticate("GET "+target+"/ HTTP/1.1", wrong, nethttp.StatusProxyAuthRequired); err != nil {
+		t.Fatal(err)
+	}
+	right := "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte("user:pass")) + "\r\n"
+	if err := testAuthenticate("GET "+target+"/ HTTP/1.1", right, nethttp.StatusOK); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -3,12 +3,18 @@ package proxy
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"errors"
 	"io"
+	"io/ioutil"
+	"net"
 	"sync"
+	"time"
 
+	"github.com/haxii/fastproxy/client"
 	"github.com/haxii/fastproxy/http"
 	"github.com/haxii/fastproxy/superproxy"
+	"github.com/haxii/fastproxy/upstream"
 	"github.com/haxii/fastproxy/util"
 )
 
@@ -57,6 +63,25 @@ type Request struct {
 	// reader stores the original raw data of request
 	reader *bufio.Reader
 
+	// ctx the context of the request, cancelled by cancel when the request is served
+	ctx    context.Context
+	cancel context.CancelFunc
+	// watcher watches the client connection to cancel the request if the client closed,
+	// isClientWatched tells whether the read deadline of client connection is cleared by it
+	watcher         clientWatcher
+	isClientWatched bool
+	// bodyReadConn the client connection whose read deadline is set for reading
+	// the body until the request read completely, bodyReadDeadline the deadline
+	bodyReadConn     net.Conn
+	bodyReadDeadline time.Time
+
+	// clientConn the client connection the request read from
+	clientConn *clientConn
+
+	// startTime when the request line read, readBytes bytes read from client
+	startTime time.Time
+	readBytes int64
+
 	// start line of http request, i.e. request line
 	// build from reader
 	reqLine http.RequestLine
@@ -65,11 +90,29 @@ type Request struct {
 	header http.Header
 	// rawHeader the raw header in bytes to be sent to target, which can be changed by hijacker
 	rawHeader []byte
+	// fields the header fields changed by hijacker, hijackedHeader is made of them
+	fields         http.HeaderFields
+	hijackedHeader []byte
 	// originalHeaderLength the header size send by client, before hijacking
 	originalHeaderLength int
+	// isRawHeaderDiscarded the raw header is discarded from reader already
+	isRawHeaderDiscarded bool
+	// normalizer checks the header against the request smuggling
+	normalizer http.HeaderNormalizer
 
 	// body body parser
 	body http.Body
+	// isBodyWritten the body is read from client and written to target
+	isBodyWritten bool
+
+	// transformedBody the body transformed by hijacker, which is sent to target
+	// instead, it's either buffered in bodyBuffer or streamed chunked
+	transformedBody io.Reader
+	// transformedHeader the header re-generated for the transformed body
+	transformedHeader []byte
+	bodyReader        http.BodyReader
+	bodyBuffer        requestBodyBuffer
+	chunkedWriter     http.ChunkedWriter
 
 	// hijacker, used for recording the http traffic
 	hijacker              Hijacker
@@ -79,6 +122,22 @@ type Request struct {
 	// proxy super proxy used for target connection
 	proxy *superproxy.SuperProxy
 
+	// username the authenticated user name of the proxy client
+	username string
+
+	// isSOCKS5 the request is made by a SOCKS5 client
+	isSOCKS5 bool
+	// isTransparent the request is made for a transparently redirected connection
+	isTransparent bool
+	// isRawTunnel the tunnel carries neither http nor tls traffic, which can't be decrypted
+	isRawTunnel bool
+	// isSSLBump the request is decrypted from a https tunnel
+	isSSLBump bool
+
+	// upstream the upstream picked for reverse proxy request, and the pool it belongs to
+	upstream     *upstream.Upstream
+	upstreamPool *upstream.Pool
+
 	// TLS request settings
 	isTLS         bool
 	tlsServerName string
@@ -87,14 +146,43 @@ type Request struct {
 // Reset reset request
 func (r *Request) Reset() {
 	r.reader = nil
+	if r.cancel != nil {
+		r.cancel()
+	}
+	r.ctx = nil
+	r.cancel = nil
+	r.isClientWatched = false
+	r.bodyReadConn = nil
+	r.bodyReadDeadline = zeroTime
+	r.clientConn = nil
+	r.startTime = zeroTime
+	r.readBytes = 0
 	r.reqLine.Reset()
 	r.header.Reset()
 	r.rawHeader = nil
+	r.fields.Reset()
+	r.hijackedHeader = r.hijackedHeader[:0]
 	r.originalHeaderLength = 0
+	r.isRawHeaderDiscarded = false
+	r.normalizer.Reset()
+	r.body.Reset()
+	r.isBodyWritten = false
+	r.transformedBody = nil
+	r.transformedHeader = r.transformedHeader[:0]
+	r.bodyReader.Reset(nil, http.BodyTypeFixedSize, 0)
+	r.bodyBuffer.reset()
+	r.chunkedWriter.Reset(nil)
 	r.hijacker = nil
 	r.hijackerBodyWriter = nil
 	r.isBeforeRequestCalled = false
 	r.proxy = nil
+	r.username = ""
+	r.isSOCKS5 = false
+	r.isTransparent = false
+	r.isRawTunnel = false
+	r.isSSLBump = false
+	r.upstream = nil
+	r.upstreamPool = nil
 	r.isTLS = false
 	r.tlsServerName = ""
 }
@@ -119,9 +207,33 @@ func (r *Request) parseStartLine(reader *bufio.Reader) (int, error) {
 	rn += len(r.reqLine.GetRequestLine())
 
 	r.reader = reader
+	r.startTime = time.Now()
+	r.readBytes = int64(rn)
 	return rn, nil
 }
 
+// Context the context of the request, it is cancelled when the client closes
+// the connection, the proxy is closed or the RequestTimeout of proxy exceeded
+func (r *Request) Context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+	return r.ctx
+}
+
+// setContext set the context of the request, cancel is called when the request reset
+func (r *Request) setContext(ctx context.Context, cancel context.CancelFunc) {
+	r.ctx = ctx
+	r.cancel = cancel
+}
+
+// setConnState set the state of the client connection if tracked
+func (r *Request) setConnState(state connState) {
+	if r.clientConn != nil {
+		r.clientConn.setState(state)
+	}
+}
+
 // SetTLS set request as TLS
 func (r *Request) SetTLS(tlsServerName string) {
 	r.isTLS = true
@@ -143,6 +255,27 @@ func (r *Request) GetProxy() *superproxy.SuperProxy {
 	return r.proxy
 }
 
+// GetDialer get the dialer made by hijacker for this request, nil if not set
+// implemented client's request interface
+func (r *Request) GetDialer() *client.Dialer {
+	if r.hijacker == nil {
+		return nil
+	}
+	return r.hijacker.Dialer()
+}
+
+// Username the authenticated user name of the proxy client,
+// empty if the proxy doesn't require authentication
+func (r *Request) Username() string {
+	return r.username
+}
+
+// isProxyRequest if the request is sent by a http proxy client, rather than
+// the SOCKS5, transparent or reverse proxy ones
+func (r *Request) isProxyRequest() bool {
+	return !r.isSOCKS5 && !r.isTransparent && r.upstream == nil
+}
+
 // Method request method in UPPER case
 func (r *Request) Method() []byte {
 	return r.reqLine.Method()
@@ -171,6 +304,10 @@ func (r *Request) peekRawHeader() error {
 	if r.reader == nil {
 		return ErrNilRequestReader
 	}
+	if r.rawHeader != nil {
+		// peeked already
+		return nil
+	}
 
 	// parse header info from request
 	var err error
@@ -188,8 +325,34 @@ func (r *Request) peekRawHeader() error {
 	return nil
 }
 
+// checkHeader checks the header against the request smuggling in mode, the
+// header is normalized if the violations are recoverable in the mode.
+// The request should be answered with a 400 response if any error returned
+func (r *Request) checkHeader(mode http.ParsingMode) error {
+	if err := r.peekRawHeader(); err != nil {
+		return err
+	}
+	header, err := r.normalizer.Normalize(r.rawHeader, mode, true)
+	if err != nil {
+		return util.ErrWrapper(err, "malformed request http headers")
+	}
+	if header == nil {
+		return nil
+	}
+	if _, err := r.header.Parse(header); err != nil {
+		return util.ErrWrapper(err, "fail to parse normalized request http headers")
+	}
+	r.rawHeader = header
+	return nil
+}
+
 // discardRawHeader discard the raw header after using
 func (r *Request) discardRawHeader() error {
+	r.rawHeader = nil
+	if r.isRawHeaderDiscarded {
+		return nil
+	}
+	r.isRawHeaderDiscarded = true
 	_, err := r.reader.Discard(r.originalHeaderLength)
 	return err
 }
@@ -197,31 +360,37 @@ func (r *Request) discardRawHeader() error {
 // PrePare pre-process the request header, hijack the request if available
 func (r *Request) PrePare() error {
 	r.isBeforeRequestCalled = false
-	if err := r.peekRawHeader(); err != nil {
-		return err
+	// the header may be peeked and changed already, e.g. by the reverse proxy
+	if r.rawHeader == nil {
+		if err := r.peekRawHeader(); err != nil {
+			return err
+		}
 	}
 	// hijack the request URL and header
 	if r.hijacker == nil {
 		return nil
 	}
 
+	if _, err := r.fields.Parse(r.rawHeader); err != nil {
+		return util.ErrWrapper(err, "fail to parse request http header fields")
+	}
 	// modify request header and change super proxy if needed
-	newPath, newHeader := r.hijacker.BeforeRequest(r.Method(),
-		r.reqLine.PathWithQueryFragment(), r.header, r.rawHeader)
+	newPath := r.hijacker.BeforeRequest(r.Method(),
+		r.reqLine.PathWithQueryFragment(), r.header, &r.fields)
 	r.isBeforeRequestCalled = true
 	// reset new path
 	r.reqLine.ChangePathWithFragment(newPath)
 
 	// header not modified return it
-	if newHeader == nil || bytes.Equal(newHeader, r.rawHeader) {
+	newHeader := r.fields.AppendBytes(r.hijackedHeader[:0])
+	r.hijackedHeader = newHeader
+	if bytes.Equal(newHeader, r.rawHeader) {
 		return nil
 	}
 
 	// re-generate the header
-	if newHeaderLen, err := r.header.Parse(newHeader); err != nil {
+	if _, err := r.header.Parse(newHeader); err != nil {
 		return util.ErrWrapper(err, "fail to parse hijacked request http headers")
-	} else {
-		newHeader = newHeader[:newHeaderLen]
 	}
 	r.rawHeader = newHeader
 	return nil
@@ -231,11 +400,13 @@ func (r *Request) IsBeforeRequestCalled() bool {
 	return r.isBeforeRequestCalled
 }
 
-func (r *Request) makeDNSLookUpAndSetSuperProxy(defaultSuperProxy *superproxy.SuperProxy) {
+// makeDNSLookUpAndSetSuperProxy resolves the target and sets the super proxy with
+// the hijacker, defaultSuperProxy is used if the hijacker returns none
+func (r *Request) makeDNSLookUpAndSetSuperProxy(defaultSuperProxy *superproxy.SuperProxy) error {
 	hijacker := r.hijacker
 	if hijacker == nil {
 		r.SetProxy(defaultSuperProxy)
-		return
+		return nil
 	}
 
 	// do a manual DNS look up
@@ -246,9 +417,15 @@ func (r *Request) makeDNSLookUpAndSetSuperProxy(defaultSuperProxy *superproxy.Su
 	}
 
 	// set requests proxy
-	superProxy := hijacker.SuperProxy()
+	superProxy, err := hijacker.SuperProxy()
+	if err != nil {
+		return err
+	}
+	if superProxy == nil {
+		superProxy = defaultSuperProxy
+	}
 	r.SetProxy(superProxy)
-
+	return nil
 }
 
 // WriteHeaderTo write raw http request header to http client
@@ -258,9 +435,6 @@ func (r *Request) WriteHeaderTo(writer *bufio.Writer) (int, int, error) {
 		return 0, 0, ErrNilRequestReader
 	}
 
-	// the header only peeks for parsing in `PrePare`, discard it after using
-	defer r.discardRawHeader()
-
 	copiedHeaderLen, err := parallelWriteHeader(
 		writer,
 		func(header []byte) {
@@ -268,7 +442,17 @@ func (r *Request) WriteHeaderTo(writer *bufio.Writer) (int, int, error) {
 				r.hijackerBodyWriter = r.hijacker.OnRequest(r.reqLine.PathWithQueryFragment(), r.header, header)
 			}
 		},
-		r.rawHeader)
+		r.rawHeader, false)
+
+	// the header only peeks for parsing in `PrePare`, discard it after using
+	r.discardRawHeader()
+	if err == nil && (http.IsMethodGet(r.Method()) || http.IsMethodHead(r.Method())) {
+		// the client doesn't send the body of GET & HEAD requests,
+		// so the request is read completely
+		r.clearBodyReadDeadline()
+		r.watcher.start()
+	}
+	r.readBytes += int64(r.originalHeaderLength)
 	return r.originalHeaderLength, copiedHeaderLen, err
 }
 
@@ -284,20 +468,91 @@ func (r *Request) WriteBodyTo(writer *bufio.Writer) (int, error) {
 		}
 	}()
 	// write the request body (if any)
-	return copyBody(&r.header, &r.body, r.reader, writer,
-		func(rawBody []byte) {
-			if _, err := util.WriteWithValidation(r.hijackerBodyWriter, rawBody); err != nil {
-				// TODO: log the sniffer error
-			}
-		},
-	)
+	var n int
+	var err error
+	if r.transformedBody != nil {
+		// the bytes read are counted by the body reader
+		n, err = r.writeTransformedBodyTo(writer)
+	} else {
+		n, err = copyBody(&r.header, &r.body, r.reader, writer,
+			func(rawBody []byte) {
+				if _, err := util.WriteWithValidation(r.hijackerBodyWriter, rawBody); err != nil {
+					// TODO: log the sniffer error
+				}
+			},
+		)
+		r.readBytes += int64(n)
+		if err == nil {
+			r.onTrailers(r.body.Trailers())
+		}
+	}
+	r.isBodyWritten = true
+	if err == nil {
+		// the request is read completely
+		r.clearBodyReadDeadline()
+		r.watcher.start()
+	}
+	return n, err
+}
+
+// timeouts the timeouts of the request overridden by the hijacker, nil if not
+func (r *Request) timeouts() *Timeouts {
+	if r.hijacker == nil {
+		return nil
+	}
+	return r.hijacker.Timeouts()
+}
+
+// setBodyReadDeadline limits the reading of the body from the client connection
+// c within timeout, the deadline is cleared once the request read completely
+func (r *Request) setBodyReadDeadline(c net.Conn, timeout time.Duration) error {
+	if timeout <= 0 {
+		return nil
+	}
+	r.bodyReadConn = c
+	r.bodyReadDeadline = time.Now().Add(timeout)
+	return c.SetReadDeadline(r.bodyReadDeadline)
+}
+
+// clearBodyReadDeadline clears the read deadline set for the body if not yet
+func (r *Request) clearBodyReadDeadline() {
+	if r.bodyReadConn != nil {
+		r.bodyReadConn.SetReadDeadline(zeroTime)
+		r.bodyReadConn = nil
+	}
+}
+
+// isBodyReadTimedOut tells whether the body is not read completely before the deadline
+func (r *Request) isBodyReadTimedOut() bool {
+	return r.bodyReadConn != nil && !time.Now().Before(r.bodyReadDeadline)
+}
+
+// onTrailers passes the trailers of the body read to hijacker
+func (r *Request) onTrailers(trailers *http.HeaderFields) {
+	if r.hijacker != nil && trailers.Len() > 0 {
+		r.hijacker.OnTrailers(false, trailers)
+	}
+}
+
+// ExpectContinue if the request's "Expect" header value is set as "100-continue"
+// implemented client's request interface
+func (r *Request) ExpectContinue() bool {
+	return r.header.IsExpectContinue()
+}
+
+// bodySkipped if the body of the request expecting continue is left unread,
+// which happens when the target responds the final status early, the rest of
+// the client connection can't be parsed as the next request then
+func (r *Request) bodySkipped() bool {
+	return r.ExpectContinue() && !r.isBodyWritten && r.header.HasBody()
 }
 
 // ConnectionClose if the request's "Connection" or "Proxy-Connection" header value is set as "close".
 // this determines how the client reusing the connections.
 // this func. result is only valid after `WriteTo` method is called
 func (r *Request) ConnectionClose() bool {
-	return r.header.IsConnectionClose() || r.header.IsProxyConnectionClose()
+	return r.header.IsConnectionClose() || r.header.IsProxyConnectionClose() ||
+		r.normalizer.IsFramingAmbiguous()
 }
 
 // IsTLS is tls requests
@@ -324,6 +579,36 @@ type Response struct {
 
 	// body http body parser
 	body http.Body
+
+	// upgraded the client side read writer used after protocol switched
+	upgraded upgradedReadWriter
+
+	// writtenBytes bytes written to the client
+	writtenBytes int64
+
+	// connectionClose tells if the client connection is closed after the response,
+	// the response is sent with `Connection: close` instead of the target's then
+	connectionClose func() bool
+
+	// isClientHTTP10 the client speaks HTTP/1.0, which expects neither the
+	// interim responses nor the chunked body
+	isClientHTTP10 bool
+
+	// isBodyDelimitedByClose the body is read until the target closes the connection
+	isBodyDelimitedByClose bool
+	// isClientBodyDelimitedByClose the body sent to client is delimited by closing
+	// the client connection, the client knows the end of it in this way only
+	isClientBodyDelimitedByClose bool
+
+	// bodyReader reads the body to be transformed
+	bodyReader http.BodyReader
+	// fields the header fields rewritten by hijacker, rewrittenHeader is made of them
+	fields          http.HeaderFields
+	rewrittenHeader []byte
+
+	// parsingMode how the header violating RFC 9112 is handled
+	parsingMode http.ParsingMode
+	normalizer  http.HeaderNormalizer
 }
 
 // Reset reset response
@@ -331,6 +616,18 @@ func (r *Response) Reset() {
 	r.writer = nil
 	r.respLine.Reset()
 	r.header.Reset()
+	r.body.Reset()
+	r.upgraded.reset()
+	r.writtenBytes = 0
+	r.connectionClose = nil
+	r.isClientHTTP10 = false
+	r.isBodyDelimitedByClose = false
+	r.isClientBodyDelimitedByClose = false
+	r.bodyReader.Reset(nil, http.BodyTypeFixedSize, 0)
+	r.fields.Reset()
+	r.rewrittenHeader = r.rewrittenHeader[:0]
+	r.parsingMode = http.ParsingModePermissive
+	r.normalizer.Reset()
 }
 
 // WriteTo init response with writer which would write to
@@ -352,69 +649,316 @@ func (r *Response) SetHijacker(h Hijacker) {
 	r.hijacker = h
 }
 
+// SetUpgradeConn set the client connection and its reader, which are used to
+// forward the raw traffic if the response switched the protocol
+func (r *Response) SetUpgradeConn(conn net.Conn, reader *bufio.Reader) {
+	r.upgraded.conn = conn
+	r.upgraded.reader = reader
+}
+
+// setConnectionClose set the func telling if the client connection is closed
+// after the response, which is called before the header written
+func (r *Response) setConnectionClose(connectionClose func() bool) {
+	r.connectionClose = connectionClose
+}
+
+// setClientHTTP10 set if the client speaks HTTP/1.0, the interim responses are
+// discarded rather than relayed to it then
+func (r *Response) setClientHTTP10(isHTTP10 bool) {
+	r.isClientHTTP10 = isHTTP10
+}
+
+// isProtocolSwitched if the response is a `101 Switching Protocols` with connection upgraded
+func (r *Response) isProtocolSwitched() bool {
+	return r.respLine.GetStatusCode() == http.StatusSwitchingProtocols &&
+		r.header.IsConnectionUpgrade()
+}
+
 // ReadFrom read data from http response got
 func (r *Response) ReadFrom(discardBody bool, reader *bufio.Reader) (int, error) {
+	n, err := r.readFrom(discardBody, reader)
+	r.writtenBytes += int64(n)
+	return n, err
+}
+
+func (r *Response) readFrom(discardBody bool, reader *bufio.Reader) (int, error) {
 	var num, wn int
 	var err error
-	// write back the start line to writer(i.e. net/connection)
+	// relay the interim responses followed by the final one
+	for {
+		statusCode, err := http.PeekStatusCode(reader)
+		if err != nil {
+			return num, util.ErrWrapper(err, "fail to read start line of response")
+		}
+		if !http.IsStatusInterim(statusCode) {
+			break
+		}
+		wn, err = r.readInterimFrom(reader)
+		num += wn
+		if err != nil {
+			return num, err
+		}
+	}
+
+	// read the start line and the headers, rewrite them if the hijacker asks
 	if err = r.respLine.Parse(reader); err != nil {
 		return num, util.ErrWrapper(err, "fail to read start line of response")
 	}
+	headerLen, err := r.header.ParseHeaderFields(reader)
+	if err != nil {
+		return num, util.ErrWrapper(err, "fail to parse http headers")
+	}
+	rawHeader, err := reader.Peek(headerLen)
+	if err != nil {
+		// should NOT have any errors
+		return num, util.ErrWrapper(err, "fail to reader raw headers")
+	}
+	if rawHeader, err = r.normalize(rawHeader); err != nil {
+		return num, err
+	}
+	hasBody := r.hasBody(discardBody)
+	if r.hijacker != nil {
+		if rawHeader, err = r.rewrite(rawHeader); err != nil {
+			return num, err
+		}
+	}
 
-	// rebuild  the start line
-	respLineBytes := r.respLine.GetResponseLine()
-	// write start line
-	if wn, err = util.WriteWithValidation(r.writer, respLineBytes); err != nil {
+	// write back the start line to writer(i.e. net/connection)
+	if wn, err = util.WriteWithValidation(r.writer, r.respLine.GetResponseLine()); err != nil {
 		return num, util.ErrWrapper(err, "fail to write start line of response")
 	}
 	num += wn
 
-	// read & write the headers
+	// transform the response if the hijacker asks
+	if hasBody && r.hijacker != nil {
+		if transform, decodeBody := r.hijacker.TransformResponse(r.respLine, r.header); transform != nil {
+			wn, err = r.transformFrom(reader, headerLen, rawHeader, transform, decodeBody)
+			num += wn
+			return num, err
+		}
+	}
+
+	// write the headers
 	var hijackerBodyWriter io.WriteCloser
 	defer func() {
 		if hijackerBodyWriter != nil {
 			hijackerBodyWriter.Close()
 		}
 	}()
-	if _, wn, err = copyHeader(&r.header, reader, r.writer,
+	wn, err = parallelWriteHeader(r.writer,
 		func(rawHeader []byte) {
 			if r.hijacker != nil {
 				hijackerBodyWriter = r.hijacker.OnResponse(
 					r.respLine, r.header, rawHeader)
 			}
-		},
-	); err != nil {
+		}, rawHeader, r.isConnectionClose(),
+	)
+	reader.Discard(headerLen)
+	if err != nil {
 		return num, err
 	}
 	num += wn
 
-	if discardBody {
+	// no body follows a protocol switching response,
+	// send the header to client before the raw traffic
+	if r.isProtocolSwitched() {
+		if err = r.writer.Flush(); err != nil {
+			return num, util.ErrWrapper(err, "fail to write switching protocols response")
+		}
+		// the upgraded connection is long-lived, clear the client's deadlines
+		if r.upgraded.conn != nil {
+			if err = r.upgraded.conn.SetDeadline(time.Time{}); err != nil {
+				return num, util.ErrWrapper(err, "fail to clear deadline of upgraded connection")
+			}
+		}
 		return num, nil
 	}
 
-	// write the request body (if any)
-	wn, err = copyBody(&r.header, &r.body, reader, r.writer,
-		func(rawBody []byte) {
-			if _, err := util.WriteWithValidation(hijackerBodyWriter, rawBody); err != nil {
-				// TODO: log the sniffer error
-			}
+	if !hasBody {
+		return num, nil
+	}
+
+	// write the response body (if any)
+	bodyType := r.bodyType()
+	r.isClientBodyDelimitedByClose = r.isBodyDelimitedByClose
+	wn, err = r.body.Parse(reader, bodyType, r.header.ContentLength(),
+		func(isChunkHeader bool, data []byte) (int, error) {
+			return parallelWriteBody(r.writer, func(rawBody []byte) {
+				if _, err := util.WriteWithValidation(hijackerBodyWriter, rawBody); err != nil {
+					// TODO: log the sniffer error
+				}
+			}, data)
 		},
 	)
 	num += wn
+	if err == nil {
+		r.onTrailers(r.body.Trailers())
+	}
 	return num, err
 }
 
-// ConnectionClose if the request's "Connection" header value is set as "Close"
+// onTrailers passes the trailers of the body read to hijacker
+func (r *Response) onTrailers(trailers *http.HeaderFields) {
+	if r.hijacker != nil && trailers.Len() > 0 {
+		r.hijacker.OnTrailers(true, trailers)
+	}
+}
+
+// SetParsingMode set how the header violating RFC 9112 is handled
+func (r *Response) SetParsingMode(mode http.ParsingMode) {
+	r.parsingMode = mode
+}
+
+// normalize checks the header against the response splitting, returns
+// the header normalized, or rawHeader itself if nothing changed
+func (r *Response) normalize(rawHeader []byte) ([]byte, error) {
+	header, err := r.normalizer.Normalize(rawHeader, r.parsingMode, false)
+	if err != nil {
+		return nil, util.ErrWrapper(err, "malformed response http headers")
+	}
+	if header == nil {
+		return rawHeader, nil
+	}
+	if _, err := r.header.Parse(header); err != nil {
+		return nil, util.ErrWrapper(err, "fail to parse normalized response http headers")
+	}
+	return header, nil
+}
+
+// hasBody if a body follows the response, no body follows the response of HEAD
+// requests, 1xx, `204 No Content` and `304 Not Modified`, even the content length
+// is set
+func (r *Response) hasBody(discardBody bool) bool {
+	return !discardBody && statusHasBody(r.respLine.GetStatusCode())
+}
+
+func statusHasBody(statusCode int) bool {
+	return statusCode >= 200 &&
+		statusCode != http.StatusNoContent && statusCode != http.StatusNotModified
+}
+
+// bodyType how the body is framed, the body delimited by closing the
+// connection is read as an identity one
+func (r *Response) bodyType() http.BodyType {
+	if r.header.IsBodyDelimitedByClose() {
+		r.isBodyDelimitedByClose = true
+		return http.BodyTypeIdentity
+	}
+	return r.header.BodyType()
+}
+
+// isConnectionClose if the response is sent with `Connection: close`,
+// which is not the case for the connection upgrading ones
+func (r *Response) isConnectionClose() bool {
+	return r.connectionClose != nil && r.connectionClose() && !r.header.IsConnectionUpgrade()
+}
+
+// ReadInterimFrom read an interim 1xx response then relay it to the client
+// implemented client's response interface
+func (r *Response) ReadInterimFrom(reader *bufio.Reader) (int, error) {
+	n, err := r.readInterimFrom(reader)
+	r.writtenBytes += int64(n)
+	return n, err
+}
+
+func (r *Response) readInterimFrom(reader *bufio.Reader) (int, error) {
+	var num, wn int
+	var err error
+	if err = r.respLine.Parse(reader); err != nil {
+		return num, util.ErrWrapper(err, "fail to read start line of interim response")
+	}
+	defer func() {
+		r.respLine.Reset()
+		r.header.Reset()
+	}()
+	if !http.IsStatusInterim(r.respLine.GetStatusCode()) {
+		return num, errNotInterimResponse
+	}
+
+	writer := io.Writer(r.writer)
+	if r.isClientHTTP10 {
+		writer = ioutil.Discard
+	}
+	if wn, err = util.WriteWithValidation(writer, r.respLine.GetResponseLine()); err != nil {
+		return num, util.ErrWrapper(err, "fail to write start line of interim response")
+	}
+	num += wn
+	if _, wn, err = copyHeader(&r.header, reader, writer, func([]byte) {}, false); err != nil {
+		return num, err
+	}
+	num += wn
+	if r.isClientHTTP10 {
+		return 0, nil
+	}
+	// the client is waiting for it, e.g. `100 Continue` before sending the body
+	if err = r.writer.Flush(); err != nil {
+		return num, util.ErrWrapper(err, "fail to write interim response")
+	}
+	return num, nil
+}
+
+var errNotInterimResponse = errors.New("not an interim response")
+
+// ConnectionClose if the target closes the connection after the response
 // this determines how the client reusing the connections
 func (r *Response) ConnectionClose() bool {
-	return false
+	if r.header.IsConnectionClose() || r.isBodyDelimitedByClose || r.normalizer.IsFramingAmbiguous() {
+		return true
+	}
+	// HTTP/1.0 connections are closed unless kept alive explicitly
+	return bytes.Equal(r.respLine.GetProtocol(), protocolHTTP10) &&
+		!r.header.IsConnectionKeepAlive()
+}
+
+// UpgradedReadWriter the client side read writer if the protocol is switched
+// implemented client's response interface
+func (r *Response) UpgradedReadWriter() io.ReadWriter {
+	if r.upgraded.conn == nil || !r.isProtocolSwitched() {
+		return nil
+	}
+	r.upgraded.writer = r.writer
+	return &r.upgraded
+}
+
+// upgradedReadWriter reads from the client connection's buffered reader,
+// writes & flushes to the client connection's buffered writer
+type upgradedReadWriter struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+}
+
+func (rw *upgradedReadWriter) reset() {
+	rw.conn = nil
+	rw.reader = nil
+	rw.writer = nil
+}
+
+func (rw *upgradedReadWriter) Read(p []byte) (int, error) {
+	return rw.reader.Read(p)
+}
+
+func (rw *upgradedReadWriter) Write(p []byte) (int, error) {
+	n, err := rw.writer.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, rw.writer.Flush()
+}
+
+// SetReadDeadline interrupts the reading from client when forwarding finished
+func (rw *upgradedReadWriter) SetReadDeadline(t time.Time) error {
+	return rw.conn.SetReadDeadline(t)
 }
 
 // additionalDst used by copyHeader and copyBody for additional write
 type additionalDst func([]byte)
 
-func copyHeader(header *http.Header,
-	src *bufio.Reader, dst1 io.Writer, dst2 additionalDst) (int, int, error) {
+// copyHeader parses the header from src then writes it to dst1 dst2,
+// the `Connection` header written to dst1 is replaced by `Connection: close`
+// if connectionClose is set, except for the connection upgrading ones
+func copyHeader(header *http.Header, src *bufio.Reader,
+	dst1 io.Writer, dst2 additionalDst, connectionClose bool) (int, int, error) {
 	// read and write header
 	var originalHeaderLen, copiedHeaderLen int
 	var err error
@@ -429,13 +973,16 @@ func copyHeader(header *http.Header,
 	}
 	defer src.Discard(originalHeaderLen)
 
-	copiedHeaderLen, err = parallelWriteHeader(dst1, dst2, rawHeader)
+	copiedHeaderLen, err = parallelWriteHeader(dst1, dst2, rawHeader,
+		connectionClose && !header.IsConnectionUpgrade())
 	return originalHeaderLen, copiedHeaderLen, err
 }
 
-// parallelWriteBody write body data to dst1 dst2 concurrently
+// parallelWriteHeader write header to dst1 dst2 concurrently, the proxy headers
+// are not written to dst1, neither are the `Connection` headers if connectionClose
+// is set, in which case `Connection: close` is written instead
 // TODO: @daizong with timeout
-func parallelWriteHeader(dst1 io.Writer, dst2 additionalDst, header []byte) (int, error) {
+func parallelWriteHeader(dst1 io.Writer, dst2 additionalDst, header []byte, connectionClose bool) (int, error) {
 	var wg sync.WaitGroup
 	var wn int
 	var err error
@@ -451,6 +998,20 @@ func parallelWriteHeader(dst1 io.Writer, dst2 additionalDst, header []byte) (int
 			}
 			m++
 			headerLine := unReadHeader[:m]
+			if connectionClose {
+				if http.IsConnectionHeader(headerLine) {
+					continue
+				}
+				if len(bytes.TrimSpace(headerLine)) == 0 {
+					// the empty line ends the header
+					n, e := util.WriteWithValidation(dst1, connectionCloseHeaderLine)
+					wn += n
+					if e != nil {
+						err = e
+						break
+					}
+				}
+			}
 			if !http.IsProxyHeader(headerLine) {
 				n, e := util.WriteWithValidation(dst1, headerLine)
 				wn += n
@@ -474,6 +1035,8 @@ func parallelWriteHeader(dst1 io.Writer, dst2 additionalDst, header []byte) (int
 	return wn, nil
 }
 
+var connectionCloseHeaderLine = []byte("Connection: close\r\n")
+
 func copyBody(header *http.Header, body *http.Body,
 	src *bufio.Reader, dst1 io.Writer, dst2 additionalDst) (int, error) {
 	w := func(isChunkHeader bool, data []byte) (int, error) {
@@ -3,9 +3,11 @@ package proxy
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	nethttp "net/http"
 	"strings"
 	"testing"
@@ -33,7 +35,7 @@ func TestParallelWriteHeader(t *testing.T) {
 func testParallelWriteHeader(t *testing.T, buffer *bytebufferpool.ByteBuffer, fixedsizeB *bytebufferpool.FixedSizeByteBuffer, header []byte, expErr, expResult string) {
 	var additionalDst string
 	if buffer != nil {
-		n, err := parallelWriteHeader(buffer, func(p []byte) { additionalDst += string(p) }, header)
+		n, err := parallelWriteHeader(buffer, func(p []byte) { additionalDst += string(p) }, header, false)
 		if err != nil {
 			if !strings.Contains(err.Error(), expErr) {
 				t.Fatalf("expected error: error short buffer, but error: %s", err)
@@ -55,7 +57,7 @@ func testParallelWriteHeader(t *testing.T, buffer *bytebufferpool.ByteBuffer, fi
 			}
 		}
 	} else {
-		_, err := parallelWriteHeader(fixedsizeB, func(p []byte) { additionalDst += string(p) }, header)
+		_, err := parallelWriteHeader(fixedsizeB, func(p []byte) { additionalDst += string(p) }, header, false)
 		if err != nil {
 			if !strings.Contains(err.Error(), expErr) {
 				t.Fatalf("expected error: error short buffer, but error: %s", err)
@@ -98,6 +100,9 @@ func testRequest(t *testing.T, reqString string, expMethod string, expProtocol s
 		bw := bufio.NewWriter(w)
 		sHijacker := &hijacker{}
 		req.SetHijacker(sHijacker)
+		if err = req.PrePare(); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
 		_, _, err = req.WriteHeaderTo(bw)
 		if err != nil {
 			t.Fatalf("unexpected error: %s", err)
@@ -137,7 +142,7 @@ func testResponse(t *testing.T, respString string, expErr string, expSize int) {
 
 func TestHTTPResponse(t *testing.T) {
 	s := "HTTP/1.1 200 ok\r\n" +
-		"Cache-Control:no-cache\r\n" +
+		"Cache-Control: no-cache\r\n" +
 		"\r\n"
 	testResponse(t, s, "", len(s))
 	s = "HTTP/1.1 200 ok\n"
@@ -165,8 +170,11 @@ func testWithClient(t *testing.T, reqString string) {
 		t.Fatalf("unexpected error: %s", err)
 	}
 
-	sHijack := &simpleHijacker{}
+	sHijack := &hijacker{}
 	req.SetHijacker(sHijack)
+	if err = req.PrePare(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
 	b := bytebufferpool.MakeFixedSizeByteBuffer(100)
 	bw := bufio.NewWriter(b)
 	resp := &Response{}
@@ -175,13 +183,10 @@ func testWithClient(t *testing.T, reqString string) {
 		t.Fatalf("unexpected error: %s", err)
 	}
 	resp.SetHijacker(sHijack)
-	_, _, respSize, err := c.Do(req, resp)
+	err = c.Do(context.Background(), req, resp)
 	if err != nil {
 		t.Fatalf("unexpected error : %s", err.Error())
 	}
-	if respSize == 0 {
-		t.Fatalf("No response data can get, client do with proxy http request and response error")
-	}
 	if !bytes.Contains(resp.respLine.GetResponseLine(), []byte("HTTP/1.1 200 OK")) {
 		t.Fatalf("No response data can get, client do with proxy http request and response error")
 	}
@@ -230,26 +235,104 @@ func (a *testAddr) Network() string {
 var bReq = bytebufferpool.MakeFixedSizeByteBuffer(100)
 var bResp = bytebufferpool.MakeFixedSizeByteBuffer(100)
 
-type hijacker struct {
-	clientAddr, targetHost string
-	method, path           []byte
+// nopHijacker forwards the requests as is, the test hijackers embed it
+// and override the hooks they are testing
+type nopHijacker struct {
+	host, port string
+}
+
+func (s *nopHijacker) RewriteHost() (newHost, newPort string) {
+	return s.host, s.port
+}
+
+func (s *nopHijacker) OnConnect(header http.Header, rawHeader []byte) bool {
+	return true
+}
+
+func (s *nopHijacker) SSLBump() bool {
+	return false
+}
+
+func (s *nopHijacker) RewriteTLSServerName(serverName string) string {
+	return serverName
 }
 
-func (s *hijacker) HijackRequest(header http.Header, rawHeader []byte, superProxy **superproxy.SuperProxy) []byte {
+func (s *nopHijacker) BeforeRequest(method, path []byte, header http.Header, fields *http.HeaderFields) []byte {
+	return path
+}
+
+func (s *nopHijacker) Resolve() net.IP {
 	return nil
 }
 
-func (s *hijacker) OnRequest(header http.Header, rawHeader []byte) io.Writer {
-	bReq.Write(rawHeader)
-	return bReq
+func (s *nopHijacker) SuperProxy() (*superproxy.SuperProxy, error) {
+	return nil, nil
+}
+
+func (s *nopHijacker) Block() bool {
+	return false
+}
+
+func (s *nopHijacker) HijackResponse() io.ReadCloser {
+	return nil
+}
+
+func (s *nopHijacker) Timeouts() *Timeouts {
+	return nil
+}
+
+func (s *nopHijacker) TransformRequest(header http.Header,
+	fields *http.HeaderFields) (func(*http.HeaderFields, int64), func(io.Reader) io.Reader, bool) {
+	return nil, nil, false
+}
+
+func (s *nopHijacker) Dialer() *client.Dialer {
+	return nil
 }
 
-func (s *hijacker) HijackResponse() io.Reader {
+func (s *nopHijacker) OnRequest(path []byte, header http.Header, rawHeader []byte) io.WriteCloser {
 	return nil
 }
 
+func (s *nopHijacker) RewriteResponse(respLine http.ResponseLine,
+	header http.Header, fields *http.HeaderFields) int {
+	return 0
+}
+
+func (s *nopHijacker) TransformResponse(respLine http.ResponseLine,
+	header http.Header) (func(io.Reader) io.Reader, bool) {
+	return nil, false
+}
+
+func (s *nopHijacker) OnResponse(respLine http.ResponseLine,
+	header http.Header, rawHeader []byte) io.WriteCloser {
+	return nil
+}
+
+func (s *nopHijacker) OnTrailers(isResponse bool, trailers *http.HeaderFields) {
+}
+
+func (s *nopHijacker) AfterResponse(err error) {
+}
+
+// nopCloseWriter a writer sniffing the body without closing
+type nopCloseWriter struct {
+	io.Writer
+}
+
+func (w nopCloseWriter) Close() error { return nil }
+
+type hijacker struct {
+	nopHijacker
+}
+
+func (s *hijacker) OnRequest(path []byte, header http.Header, rawHeader []byte) io.WriteCloser {
+	bReq.Write(rawHeader)
+	return nopCloseWriter{bReq}
+}
+
 func (s *hijacker) OnResponse(respLine http.ResponseLine,
-	header http.Header, rawHeader []byte) io.Writer {
+	header http.Header, rawHeader []byte) io.WriteCloser {
 	fmt.Fprintf(bResp, `
 			************************
 			%s %d %s
@@ -263,7 +346,7 @@ func (s *hijacker) OnResponse(respLine http.ResponseLine,
 
 		respLine.GetProtocol(), respLine.GetStatusCode(), respLine.GetStatusMessage(),
 		header.ContentLength(), header.ContentType(), rawHeader)
-	return bResp
+	return nopCloseWriter{bResp}
 }
 
 func TestCopyHeader(t *testing.T) {
@@ -277,7 +360,7 @@ func TestCopyHeader(t *testing.T) {
 	testF := func(b []byte) {
 		return
 	}
-	n, _, err := copyHeader(h, br, bw, testF)
+	n, _, err := copyHeader(h, br, bw, testF, false)
 	if err != nil {
 		t.Fatalf("unexpected error: %s", err)
 	}
@@ -293,7 +376,7 @@ func TestCopyHeader(t *testing.T) {
 	testF = func(b []byte) {
 		return
 	}
-	n, _, err = copyHeader(h, ebr, bw, testF)
+	n, _, err = copyHeader(h, ebr, bw, testF, false)
 	if err == nil {
 		t.Fatalf("unexpected error: fail to parse header")
 	}
@@ -406,21 +489,6 @@ func TestResponsePool(t *testing.T) {
 	respPool.Release(resp)
 }
 
-type simpleHijacker struct{}
-
-func (s *simpleHijacker) HijackRequest(header http.Header, rawHeader []byte, superProxy **superproxy.SuperProxy) []byte {
-	return nil
-}
-
-func (s *simpleHijacker) OnRequest(header http.Header, rawHeader []byte) io.Writer {
-	return nil
-}
-
-func (s *simpleHijacker) HijackResponse() io.Reader {
-	return nil
-}
-
-func (s *simpleHijacker) OnResponse(respLine http.ResponseLine,
-	header http.Header, rawHeader []byte) io.Writer {
-	return nil
+type simpleHijacker struct {
+	nopHijacker
 }
@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"time"
+)
+
+// requestContext makes the context of a request derived from the connection's,
+// RequestTimeout is not applied to the tunnels which are long-lived
+func (p *Proxy) requestContext(connCtx context.Context, isTunnel bool) (context.Context, context.CancelFunc) {
+	if p.RequestTimeout > 0 && !isTunnel {
+		return context.WithTimeout(connCtx, p.RequestTimeout)
+	}
+	return context.WithCancel(connCtx)
+}
+
+// clientWatcher cancels the request when the client closes the connection
+// while the request is being served.
+//
+// The client connection is peeked in background after the request is read
+// completely, the pipelined requests are kept in the reader's buffer.
+type clientWatcher struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	cancel  context.CancelFunc
+	started bool
+	done    chan struct{}
+}
+
+// init setup the watcher with client connection and its buffered reader
+func (w *clientWatcher) init(conn net.Conn, reader *bufio.Reader, cancel context.CancelFunc) {
+	w.conn = conn
+	w.reader = reader
+	w.cancel = cancel
+}
+
+// start starts watching if the watcher is set, the reader must not
+// be used by others until the watcher stopped
+func (w *clientWatcher) start() {
+	if w.conn == nil || w.started {
+		return
+	}
+	w.started = true
+	w.done = make(chan struct{})
+	go func(reader *bufio.Reader, cancel context.CancelFunc, done chan struct{}) {
+		if _, err := reader.Peek(1); err != nil {
+			if e, ok := err.(net.Error); !ok || !e.Timeout() {
+				// the connection is closed or broken
+				cancel()
+			}
+		}
+		close(done)
+	}(w.reader, w.cancel, w.done)
+}
+
+// stop stops watching and resets the watcher, returns true if the watcher was
+// started, the read deadline of the client connection is cleared then
+func (w *clientWatcher) stop() bool {
+	started := w.started
+	if started {
+		// interrupt the peeking
+		w.conn.SetReadDeadline(aLongTimeAgo)
+		<-w.done
+		w.conn.SetReadDeadline(zeroTime)
+	}
+	w.conn = nil
+	w.reader = nil
+	w.cancel = nil
+	w.started = false
+	w.done = nil
+	return started
+}
+
+// aLongTimeAgo a non-zero time in the past, used to interrupt the blocking reads
+var aLongTimeAgo = time.Unix(1, 0)
@@ -0,0 +1,116 @@
+package proxy
+
+import (
+	"encoding/json"
+	htmltemplate "html/template"
+	"io"
+
+	"github.com/haxii/fastproxy/http"
+	"github.com/haxii/fastproxy/transport"
+)
+
+// ErrorHeader the diagnostic header sent with the error responses made for
+// the upstream failures, the value is the kind of failure, e.g. `dns_failure`
+const ErrorHeader = "X-Proxy-Error"
+
+// ErrorInfo the details of an error response made by proxy
+type ErrorInfo struct {
+	// StatusCode and Status the status code and text of the response
+	StatusCode int    `json:"status_code"`
+	Status     string `json:"status"`
+	// Kind the kind of upstream failure, empty if not caused by the upstream
+	Kind string `json:"kind,omitempty"`
+	// Message brief description of the error
+	Message string `json:"message,omitempty"`
+	// Target the target host with port, empty if unknown
+	Target string `json:"target,omitempty"`
+}
+
+// ErrorPage renders the body of the error responses made by proxy
+type ErrorPage interface {
+	// ContentType the `Content-Type` of the rendered body
+	ContentType() string
+	// Render writes the body of the error response into w
+	Render(w io.Writer, info *ErrorInfo) error
+}
+
+// Template is implemented by both text/template and html/template
+type Template interface {
+	Execute(w io.Writer, data interface{}) error
+}
+
+// TemplateErrorPage renders the error page by executing Template with ErrorInfo
+type TemplateErrorPage struct {
+	// Type the `Content-Type` of the page, e.g. `text/html; charset=utf-8`
+	Type     string
+	Template Template
+}
+
+// ContentType implements ErrorPage
+func (p *TemplateErrorPage) ContentType() string {
+	return p.Type
+}
+
+// Render implements ErrorPage
+func (p *TemplateErrorPage) Render(w io.Writer, info *ErrorInfo) error {
+	return p.Template.Execute(w, info)
+}
+
+// DefaultHTMLErrorTemplate the template used by NewHTMLErrorPage if not provided
+const DefaultHTMLErrorTemplate = `<!DOCTYPE html>
+<html>
+<head><title>{{.StatusCode}} {{.Status}}</title></head>
+<body>
+<h1>{{.StatusCode}} {{.Status}}</h1>
+{{if .Message}}<p>{{.Message}}</p>{{end}}
+{{if .Target}}<p>Target: {{.Target}}</p>{{end}}
+{{if .Kind}}<p>Error: {{.Kind}}</p>{{end}}
+</body>
+</html>
+`
+
+// NewHTMLErrorPage makes an HTML error page with the html/template text,
+// DefaultHTMLErrorTemplate is used if text is empty
+func NewHTMLErrorPage(text string) (*TemplateErrorPage, error) {
+	if len(text) == 0 {
+		text = DefaultHTMLErrorTemplate
+	}
+	tmpl, err := htmltemplate.New("error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	return &TemplateErrorPage{Type: "text/html; charset=utf-8", Template: tmpl}, nil
+}
+
+// JSONErrorPage renders the ErrorInfo as a JSON object
+type JSONErrorPage struct{}
+
+// ContentType implements ErrorPage
+func (JSONErrorPage) ContentType() string {
+	return "application/json"
+}
+
+// Render implements ErrorPage
+func (JSONErrorPage) Render(w io.Writer, info *ErrorInfo) error {
+	return json.NewEncoder(w).Encode(info)
+}
+
+// upstreamErrorStatus the status code and message of the error response
+// made for the upstream failure of kind
+func upstreamErrorStatus(kind transport.ErrorKind) (int, string) {
+	switch kind {
+	case transport.ErrorKindDial:
+		return http.StatusBadGateway, "Fail to connect to the target.\n"
+	case transport.ErrorKindDNS:
+		return http.StatusBadGateway, "Fail to resolve the target host.\n"
+	case transport.ErrorKindTLSHandshake:
+		return http.StatusBadGateway, "Fail to handshake TLS with the target.\n"
+	case transport.ErrorKindTimeout:
+		return http.StatusGatewayTimeout, "The target timed out.\n"
+	case transport.ErrorKindSuperProxyAuth:
+		return http.StatusBadGateway, "Fail to authenticate with the super proxy.\n"
+	case transport.ErrorKindUnavailable:
+		return http.StatusServiceUnavailable, "Too many connections to the target.\n"
+	}
+	return http.StatusBadGateway, "Bad Gateway.\n"
+}
@@ -1,22 +1,27 @@
 package proxy
 
 import (
-	"crypto/tls"
+	"context"
 	"io"
 	"net"
+	"time"
 
+	"github.com/haxii/fastproxy/client"
 	"github.com/haxii/fastproxy/http"
 	"github.com/haxii/fastproxy/superproxy"
 )
 
 // Hijacker hijacker of each http connection and decrypted https connection
 // For HTTP Connections, the call chain is:
-// - RewriteHost -> [BeforeRequest -> Resolve -> SuperProxy -> Block -> HijackResponse -> Dial/DialTLS -> OnRequest -> OnResponse -> AfterResponse]
+// - RewriteHost -> [BeforeRequest -> Resolve -> SuperProxy -> Block -> HijackResponse -> Timeouts -> TransformRequest -> Dialer -> OnRequest -> RewriteResponse -> TransformResponse -> OnResponse -> AfterResponse]
+// OnTrailers is called after OnRequest and OnResponse if the chunked body carries trailer fields
 // For HTTPS Tunnels, the call chain is:
-// - RewriteHost -> BeforeConnect -> SSLBump(false) -> Resolve -> SuperProxy -> Block -> Dial/DialTLS
+// - RewriteHost -> BeforeConnect -> SSLBump(false) -> Resolve -> SuperProxy -> Block -> Timeouts -> Dialer
 // For HTTPS Sniffer, the call chain is:
-// - RewriteHost -> BeforeConnect -> SSLBump(true) -> RewriteTLSServerName -> [BeforeRequest -> Resolve -> SuperProxy -> Block -> HijackResponse -> Dial/DialTLS -> OnRequest -> OnResponse -> AfterResponse]
+// - RewriteHost -> BeforeConnect -> SSLBump(true) -> RewriteTLSServerName -> [BeforeRequest -> Resolve -> SuperProxy -> Block -> HijackResponse -> Timeouts -> TransformRequest -> Dialer -> OnRequest -> RewriteResponse -> TransformResponse -> OnResponse -> AfterResponse]
 // the chain in square brackets `[]` can be called more than one time during one connection due to keep-alive
+// For upgraded connections (e.g. WebSocket), OnRequest and OnResponse are only called for the handshake,
+// the raw traffic after the protocol switched is forwarded without sniffing
 type Hijacker interface {
 	// RewriteHost rewrites the incoming host and port, return a nil newHost or nil newPort to end the request
 	RewriteHost() (newHost, newPort string)
@@ -32,16 +37,19 @@ type Hijacker interface {
 
 	// BeforeRequest is a request hijack handler.
 	// which provides the ability to change the request resources and header.
-	// Return new super header to change the original header, please do NOT change payload related fields
+	// Change the header fields to change the original header, please do NOT change payload related fields
 	// (like Content-Length, Transfer-Encoding etc.) to avoid exceptions.
 	// For advanced Hijack options, use the HijackResponse instead
-	BeforeRequest(method, path []byte, header http.Header, rawHeader []byte) (newPath, newRawHeader []byte)
+	BeforeRequest(method, path []byte, header http.Header, fields *http.HeaderFields) (newPath []byte)
 
 	// Resolve performs a DNS Lookup, should not block for long time
 	Resolve() net.IP
 
-	// SuperProxy returns the super-proxy
-	SuperProxy() *superproxy.SuperProxy
+	// SuperProxy returns the super-proxy, the proxy's one is used when nil returned.
+	// The failed tunnels made with the one picked from a superproxy.Pool are retried
+	// on the other members. Return an error to end the request with the error response
+	// of its transport.ErrorKind, e.g. superproxy.ErrNoSuperProxyAvail
+	SuperProxy() (*superproxy.SuperProxy, error)
 
 	// Block blocks the request and returns a error to client
 	// For advanced blocking options, use the HijackResponse instead
@@ -52,31 +60,87 @@ type Hijacker interface {
 	// server then return the reader's response
 	HijackResponse() io.ReadCloser
 
-	// Dial called every TCP connection made to addr, default dialer is used when nil func returned
-	Dial() func(addr string) (net.Conn, error)
-
-	// DialTLS called every TLS connection made to addr, default dialer is used when nil func returned
-	DialTLS() func(addr string, tlsConfig *tls.Config) (net.Conn, error)
+	// TransformRequest is a request hijack handler, which is called only for
+	// the requests with a body, except GET and HEAD ones.
+	// Return a transform func to wrap the body reader into the transformed one,
+	// and a rewriteHeader func to change the header fields, which is called with
+	// the size of the transformed body, return nil for both to forward the request
+	// as is. If bufferBody is set, the transformed body is buffered before
+	// forwarding and sent with `Content-Length`, rewriteHeader is called after
+	// the buffering then, e.g. to sign the body digested by transform. Otherwise
+	// the body is streamed chunked and rewriteHeader is called with a size of -1
+	// before that. The body of HTTP/1.0 requests is always buffered.
+	// The payload related fields (Content-Length, Transfer-Encoding) of the new
+	// header are ignored. OnRequest sniffs the transformed request.
+	TransformRequest(header http.Header, fields *http.HeaderFields) (
+		rewriteHeader func(fields *http.HeaderFields, bodySize int64), transform func(io.Reader) io.Reader, bufferBody bool)
+
+	// Timeouts returns the timeouts of the request overriding the proxy's ones,
+	// return nil to use the proxy's ones
+	Timeouts() *Timeouts
+
+	// Dialer returns the dialer of the connections made for the request, the proxy's
+	// Dial and DialTLS are used when nil returned. The connections are pooled by the
+	// dialer, so return the same one for the requests sharing the connections
+	Dialer() *client.Dialer
 
 	// OnRequest is a sniffer handler.
 	// Which gives the request header in parameters then
 	// write request body in the writer returned
 	OnRequest(path []byte, header http.Header, rawHeader []byte) io.WriteCloser
 
+	// RewriteResponse is a response hijack handler, which is called for every
+	// final response, including the decrypted https ones.
+	// Return a non-zero status code to change the status, the change is ignored if
+	// it alters whether a body follows the response, e.g. to `204 No Content`.
+	// Change the header fields to add, remove or replace them, the changes of the
+	// payload related fields (Content-Length, Transfer-Encoding) and `Connection`
+	// are ignored, the target's ones are kept.
+	RewriteResponse(statusLine http.ResponseLine, header http.Header, fields *http.HeaderFields) (newStatusCode int)
+
+	// TransformResponse is a response hijack handler, which is called only for
+	// the responses with a body.
+	// Return a transform func to wrap the body reader into the transformed one,
+	// return nil to forward the response as is. The transformed response is
+	// re-framed by the proxy. If decodeBody is set, the body encoded in gzip,
+	// x-gzip or deflate is decoded before transforming and encoded again after,
+	// the body of other encodings is forwarded without transforming.
+	// OnResponse sniffs the response before transforming.
+	TransformResponse(statusLine http.ResponseLine, header http.Header) (
+		transform func(io.Reader) io.Reader, decodeBody bool)
+
 	// OnResponse is a sniffer handler
 	// Which gives the response header in parameters then
 	// write response body in the writer returned
 	OnResponse(statusLine http.ResponseLine, header http.Header, rawHeader []byte) io.WriteCloser
 
+	// OnTrailers is a sniffer handler, which is called after a chunked request or
+	// response body with the trailer fields following the last chunk, if any.
+	// The trailers are forwarded already, they are dropped if the body is transformed
+	OnTrailers(isResponse bool, trailers *http.HeaderFields)
+
 	// AfterResponse is defer handler which always paired with BeforeRequest
 	// passes any error if occurred during the hijacking or forwarding
 	AfterResponse(error)
 }
 
+// Timeouts the timeouts of a request overriding the proxy's ones, the zero ones
+// are not overridden. The header is read before the hijacker made, so that
+// ClientHeaderTimeout can't be overridden
+type Timeouts struct {
+	// ClientBody max duration reading the request body from client
+	ClientBody time.Duration
+	// Timeouts the timeouts talking to the target
+	client.Timeouts
+}
+
 // HijackerPool pooling hijacker instances
 type HijackerPool interface {
-	// Get get a hijacker with client address
-	Get(clientAddr net.Addr, isHTTPS bool, host, port string) Hijacker
+	// Get get a hijacker with client address and the authenticated user name,
+	// username is empty if the proxy doesn't require authentication.
+	// ctx is the context of the request, which is cancelled when the client
+	// closes the connection, the proxy is closed or the request timed out
+	Get(ctx context.Context, clientAddr net.Addr, username string, isHTTPS bool, host, port string) Hijacker
 	// Put put a hijacker back to pool
 	Put(Hijacker)
 }
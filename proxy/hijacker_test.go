@@ -0,0 +1,316 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	nethttp "net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/haxii/fastproxy/client"
+	"github.com/haxii/fastproxy/http"
+)
+
+// startHijackedProxy serves a proxy hijacking the requests with the hijackers
+// made by newHijacker, returns the client sending requests through the proxy
+func startHijackedProxy(t *testing.T, newHijacker func(host, port string) Hijacker) (*nethttp.Client, *Proxy) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	proxy := &Proxy{HijackerPool: hijackerPoolFunc(newHijacker)}
+	go proxy.serve(ln, "TestProxy", proxy.serveConn, nil, nil)
+	proxyURL, _ := url.Parse("http://" + ln.Addr().String())
+	return &nethttp.Client{
+		Transport: &nethttp.Transport{Proxy: nethttp.ProxyURL(proxyURL)},
+		Timeout:   10 * time.Second,
+	}, proxy
+}
+
+// upperReader upper-cases the ASCII letters read
+type upperReader struct {
+	r io.Reader
+}
+
+func (u upperReader) Read(p []byte) (int, error) {
+	n, err := u.r.Read(p)
+	copy(p, bytes.ToUpper(p[:n]))
+	return n, err
+}
+
+func upper(r io.Reader) io.Reader { return upperReader{r} }
+
+type transformResponseHijacker struct {
+	nopHijacker
+}
+
+func (s *transformResponseHijacker) TransformResponse(respLine http.ResponseLine,
+	header http.Header) (func(io.Reader) io.Reader, bool) {
+	return upper, true
+}
+
+func TestTransformResponse(t *testing.T) {
+	target, s := startTarget(t, func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		if r.URL.Path == "/gzip" {
+			w.Header().Set("Content-Encoding", "gzip")
+			zw := gzip.NewWriter(w)
+			zw.Write([]byte("hello gzip"))
+			zw.Close()
+			return
+		}
+		w.Header().Set("Content-Length", "11")
+		w.Write([]byte("hello world"))
+	})
+	defer s.Close()
+	c, proxy := startHijackedProxy(t, func(host, port string) Hijacker {
+		return &transformResponseHijacker{nopHijacker{host: host, port: port}}
+	})
+	defer proxy.Close()
+
+	// the transformed body is re-framed with its own length
+	resp, err := c.Get(target + "/")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(body) != "HELLO WORLD" {
+		t.Fatalf("unexpected body %q", body)
+	}
+	if resp.ContentLength != int64(len(body)) {
+		t.Fatalf("unexpected content length %d", resp.ContentLength)
+	}
+
+	// the gzip body is decoded before transforming and encoded again after
+	req, _ := nethttp.NewRequest("GET", target+"/gzip", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err = c.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("transformed body should be encoded again")
+	}
+	zr, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	body, err = ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(body) != "HELLO GZIP" {
+		t.Fatalf("unexpected body %q", body)
+	}
+}
+
+type transformRequestHijacker struct {
+	nopHijacker
+}
+
+func (s *transformRequestHijacker) TransformRequest(header http.Header,
+	fields *http.HeaderFields) (func(*http.HeaderFields, int64), func(io.Reader) io.Reader, bool) {
+	rewriteHeader := func(fields *http.HeaderFields, bodySize int64) {
+		fields.Set("X-Body-Size", strconv.FormatInt(bodySize, 10))
+	}
+	transform := func(r io.Reader) io.Reader {
+		return io.MultiReader(upper(r), strings.NewReader("!"))
+	}
+	return rewriteHeader, transform, fields.Has("X-Buffer-Body")
+}
+
+func TestTransformRequest(t *testing.T) {
+	target, s := startTarget(t, func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s %d %v %s", body, r.ContentLength,
+			r.TransferEncoding, r.Header.Get("X-Body-Size"))
+	})
+	defer s.Close()
+	c, proxy := startHijackedProxy(t, func(host, port string) Hijacker {
+		return &transformRequestHijacker{nopHijacker{host: host, port: port}}
+	})
+	defer proxy.Close()
+
+	testTransformRequest := func(bufferBody bool, expResult string) {
+		req, _ := nethttp.NewRequest("POST", target+"/", strings.NewReader("hello"))
+		if bufferBody {
+			req.Header.Set("X-Buffer-Body", "1")
+		}
+		resp, err := c.Do(req)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if string(body) != expResult {
+			t.Fatalf("unexpected result %q, expecting %q", body, expResult)
+		}
+	}
+	// the buffered body is re-framed with its own length
+	testTransformRequest(true, "HELLO! 6 [] 6")
+	// the streamed body is re-framed chunked
+	testTransformRequest(false, "HELLO! -1 [chunked] -1")
+}
+
+type rewriteResponseHijacker struct {
+	nopHijacker
+}
+
+func (s *rewriteResponseHijacker) RewriteResponse(respLine http.ResponseLine,
+	header http.Header, fields *http.HeaderFields) int {
+	newStatusCode, _ := strconv.Atoi(string(fields.Peek("X-New-Status")))
+	fields.Del("X-New-Status")
+	fields.Set("X-Rewritten", "1")
+	fields.Set("Content-Length", "100")
+	return newStatusCode
+}
+
+func TestRewriteResponse(t *testing.T) {
+	target, s := startTarget(t, func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		w.Header().Set("X-New-Status", r.URL.Query().Get("status"))
+		w.Write([]byte("ok"))
+	})
+	defer s.Close()
+	c, proxy := startHijackedProxy(t, func(host, port string) Hijacker {
+		return &rewriteResponseHijacker{nopHijacker{host: host, port: port}}
+	})
+	defer proxy.Close()
+
+	testRewriteResponse := func(newStatus string, expStatusCode int) {
+		resp, err := c.Get(target + "/?status=" + newStatus)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if resp.StatusCode != expStatusCode {
+			t.Fatalf("unexpected status code %d, expecting %d", resp.StatusCode, expStatusCode)
+		}
+		if resp.Header.Get("X-Rewritten") != "1" || len(resp.Header.Get("X-New-Status")) > 0 {
+			t.Fatalf("header fields are not rewritten: %v", resp.Header)
+		}
+		// the payload related fields are kept
+		if string(body) != "ok" || resp.ContentLength != 2 {
+			t.Fatalf("unexpected body %q of content length %d", body, resp.ContentLength)
+		}
+	}
+	testRewriteResponse("", nethttp.StatusOK)
+	testRewriteResponse("203", nethttp.StatusNonAuthoritativeInfo)
+	// the status without a body is ignored
+	testRewriteResponse("204", nethttp.StatusOK)
+}
+
+type trailersHijacker struct {
+	nopHijacker
+	trailers chan string
+}
+
+func (s *trailersHijacker) OnTrailers(isResponse bool, trailers *http.HeaderFields) {
+	trailers.VisitAll(func(key, value []byte) {
+		s.trailers <- fmt.Sprintf("%v %s: %s", isResponse, key, value)
+	})
+}
+
+func TestOnTrailers(t *testing.T) {
+	target, s := startTarget(t, func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		ioutil.ReadAll(r.Body)
+		w.Header().Set("Trailer", "X-Response-Trailer")
+		w.Write([]byte(r.Trailer.Get("X-Request-Trailer")))
+		w.Header().Set("X-Response-Trailer", "bar")
+	})
+	defer s.Close()
+	trailers := make(chan string, 2)
+	c, proxy := startHijackedProxy(t, func(host, port string) Hijacker {
+		return &trailersHijacker{nopHijacker{host: host, port: port}, trailers}
+	})
+	defer proxy.Close()
+
+	req, _ := nethttp.NewRequest("POST", target+"/", ioutil.NopCloser(strings.NewReader("hello")))
+	req.ContentLength = -1
+	req.Trailer = nethttp.Header{"X-Request-Trailer": []string{"foo"}}
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	// the trailers are forwarded
+	if string(body) != "foo" {
+		t.Fatalf("request trailer is not forwarded, got %q", body)
+	}
+	if resp.Trailer.Get("X-Response-Trailer") != "bar" {
+		t.Fatalf("response trailer is not forwarded, got %v", resp.Trailer)
+	}
+
+	for _, expTrailer := range []string{"false X-Request-Trailer: foo", "true X-Response-Trailer: bar"} {
+		select {
+		case trailer := <-trailers:
+			if trailer != expTrailer {
+				t.Fatalf("unexpected trailer %q, expecting %q", trailer, expTrailer)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("trailer %q is not passed to hijacker", expTrailer)
+		}
+	}
+}
+
+type timeoutsHijacker struct {
+	nopHijacker
+}
+
+func (s *timeoutsHijacker) Timeouts() *Timeouts {
+	return &Timeouts{Timeouts: client.Timeouts{FirstByte: 100 * time.Millisecond}}
+}
+
+func TestHijackerTimeouts(t *testing.T) {
+	target, s := startTarget(t, func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(time.Second)
+		}
+		w.Write([]byte("ok"))
+	})
+	defer s.Close()
+	c, proxy := startHijackedProxy(t, func(host, port string) Hijacker {
+		return &timeoutsHijacker{nopHijacker{host: host, port: port}}
+	})
+	defer proxy.Close()
+
+	testTimeouts := func(path string, expStatusCode int) {
+		resp, err := c.Get(target + path)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != expStatusCode {
+			t.Fatalf("unexpected status code %d, expecting %d", resp.StatusCode, expStatusCode)
+		}
+	}
+	testTimeouts("/", nethttp.StatusOK)
+	// the first byte timeout of the hijacker overrides the proxy's
+	start := time.Now()
+	testTimeouts("/slow", nethttp.StatusGatewayTimeout)
+	if d := time.Since(start); d >= time.Second {
+		t.Fatalf("request should time out before the response, took %s", d)
+	}
+}
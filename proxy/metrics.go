@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"net"
+	nethttp "net/http"
+	"time"
+
+	"github.com/haxii/fastproxy/http"
+	"github.com/haxii/fastproxy/metrics"
+)
+
+// status classes of the request metrics, `none` for the requests without response
+var statusClasses = [...]string{"none", "1xx", "2xx", "3xx", "4xx", "5xx"}
+
+// tunnelBuckets upper bounds of the tunnel duration buckets in seconds
+var tunnelBuckets = []float64{1, 5, 15, 30, 60, 300, 900, 1800, 3600}
+
+var (
+	requestsCounters  [len(statusClasses)]*metrics.Counter
+	requestHistograms [len(statusClasses)]*metrics.Histogram
+
+	requestBytesCounter = metrics.DefaultRegistry.Counter("fastproxy_proxy_request_bytes_total",
+		"Bytes read from the clients, including the tunnels.")
+	responseBytesCounter = metrics.DefaultRegistry.Counter("fastproxy_proxy_response_bytes_total",
+		"Bytes written to the clients, including the tunnels.")
+
+	tunnelsGauge = metrics.DefaultRegistry.Gauge("fastproxy_proxy_active_tunnels",
+		"Number of the tunnels being forwarded.")
+	tunnelHistogram = metrics.DefaultRegistry.Histogram("fastproxy_proxy_tunnel_duration_seconds",
+		"Duration of the tunnels.", tunnelBuckets)
+)
+
+func init() {
+	for i, class := range statusClasses {
+		requestsCounters[i] = metrics.DefaultRegistry.Counter("fastproxy_proxy_requests_total",
+			"Number of the http requests and tunnels served by status class.", "class", class)
+		requestHistograms[i] = metrics.DefaultRegistry.Histogram("fastproxy_proxy_request_duration_seconds",
+			"Latency of the http requests by status class.", nil, "class", class)
+	}
+}
+
+// statusClass the index of the status class in statusClasses
+func statusClass(statusCode int) int {
+	if statusCode < 100 || statusCode > 599 {
+		return 0
+	}
+	return statusCode / 100
+}
+
+// finishRequest records the metrics and writes the access log of the request,
+// statusCode is the one sent to client, reqBytes and respBytes are the bytes
+// read from and written to client
+func (p *Proxy) finishRequest(c net.Conn, req *Request, statusCode int,
+	reqBytes, respBytes int64, err error) {
+	class := statusClass(statusCode)
+	requestsCounters[class].Inc()
+	duration := time.Since(req.startTime).Seconds()
+	if http.IsMethodConnect(req.Method()) {
+		tunnelHistogram.Observe(duration)
+	} else {
+		requestHistograms[class].Observe(duration)
+	}
+	if reqBytes > 0 {
+		requestBytesCounter.Add(uint64(reqBytes))
+	}
+	if respBytes > 0 {
+		responseBytesCounter.Add(uint64(respBytes))
+	}
+	p.logAccess(c, req, statusCode, reqBytes, respBytes, err)
+}
+
+// ServeMetrics serves the metrics in Prometheus text format on `/metrics`
+// of the provided admin address, which should not be exposed to the proxy clients
+func (p *Proxy) ServeMetrics(network, addr string) error {
+	ln, lnErr := net.Listen(network, addr)
+	if lnErr != nil {
+		return lnErr
+	}
+	p.init()
+	s := metrics.NewServer(metrics.DefaultRegistry)
+	p.serversLock.Lock()
+	p.adminServers = append(p.adminServers, s)
+	p.serversLock.Unlock()
+	if err := s.Serve(ln); err != nethttp.ErrServerClosed {
+		return err
+	}
+	return nil
+}
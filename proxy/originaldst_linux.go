@@ -0,0 +1,68 @@
+//go:build linux
+// +build linux
+
+package proxy
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// SO_ORIGINAL_DST and IP6T_SO_ORIGINAL_DST in linux/netfilter_ipv4.h & linux/netfilter_ipv6/ip6_tables.h
+const soOriginalDst = 80
+
+// originalDst returns the destination address before NAT redirected
+// by iptables `REDIRECT`, a.k.a. SO_ORIGINAL_DST
+func originalDst(c net.Conn) (*net.TCPAddr, error) {
+	tcpConn, ok := unwrapConn(c).(*net.TCPConn)
+	if !ok {
+		return nil, errors.New("not a TCP connection")
+	}
+	rawConn, err := tcpConn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	isIPv6 := false
+	if localAddr, ok := c.LocalAddr().(*net.TCPAddr); ok && localAddr.IP.To4() == nil {
+		isIPv6 = true
+	}
+
+	var addr *net.TCPAddr
+	var sockErr error
+	err = rawConn.Control(func(fd uintptr) {
+		if !isIPv6 {
+			// sockaddr_in fits in the IPv6Mreq
+			var mreq *syscall.IPv6Mreq
+			mreq, sockErr = syscall.GetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IP, soOriginalDst)
+			if sockErr != nil {
+				return
+			}
+			raw := mreq.Multiaddr
+			addr = &net.TCPAddr{
+				IP:   net.IPv4(raw[4], raw[5], raw[6], raw[7]),
+				Port: int(raw[2])<<8 | int(raw[3]),
+			}
+			return
+		}
+		// sockaddr_in6 fits in the IPv6MTUInfo
+		var info *syscall.IPv6MTUInfo
+		info, sockErr = syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.IPPROTO_IPV6, soOriginalDst)
+		if sockErr != nil {
+			return
+		}
+		// port is in network byte order
+		port := (*[2]byte)(unsafe.Pointer(&info.Addr.Port))
+		ip := make(net.IP, net.IPv6len)
+		copy(ip, info.Addr.Addr[:])
+		addr = &net.TCPAddr{IP: ip, Port: int(port[0])<<8 | int(port[1])}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if sockErr != nil {
+		return nil, sockErr
+	}
+	return addr, nil
+}
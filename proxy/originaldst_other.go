@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package proxy
+
+import (
+	"errors"
+	"net"
+)
+
+// originalDst SO_ORIGINAL_DST is only supported on linux
+func originalDst(c net.Conn) (*net.TCPAddr, error) {
+	return nil, errors.New("SO_ORIGINAL_DST not supported on this platform")
+}
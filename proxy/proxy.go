@@ -1,25 +1,41 @@
 package proxy
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	nethttp "net/http"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/haxii/fastproxy/accesslog"
+	"github.com/haxii/fastproxy/acl"
+	"github.com/haxii/fastproxy/auth"
 	"github.com/haxii/fastproxy/bufiopool"
+	"github.com/haxii/fastproxy/bytebufferpool"
 	"github.com/haxii/fastproxy/client"
 	"github.com/haxii/fastproxy/http"
 	"github.com/haxii/fastproxy/mitm"
 	"github.com/haxii/fastproxy/server"
 	"github.com/haxii/fastproxy/servertime"
 	"github.com/haxii/fastproxy/superproxy"
+	"github.com/haxii/fastproxy/transport"
+	"github.com/haxii/fastproxy/upstream"
 	"github.com/haxii/fastproxy/util"
 )
 
 // DefaultServerShutdownWaitTime used when ServerShutdownWaitTime not set
 var DefaultServerShutdownWaitTime = time.Second * 30
 
+// DefaultRequestBodyBufferSize used when RequestBodyBufferSize not set
+var DefaultRequestBodyBufferSize = 1 << 20
+
 // Proxy is a HTTP / HTTPS forward proxy with the ability to
 // sniff or modify the forwarding traffic
 type Proxy struct {
@@ -40,11 +56,28 @@ type Proxy struct {
 	// BufioPool buffer reader and writer pool
 	bufioPool *bufiopool.Pool
 
-	// server basic connection server used by proxy
-	server server.Server
+	// initOnce init the shared parts used by all the servers
+	initOnce sync.Once
+
+	// ctx the parent context of all the connections, cancelled when the proxy closed
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// servers basic connection servers used by proxy, one for each listener
+	servers     []*server.Server
+	serversLock sync.Mutex
+	// adminServers servers exposing the metrics
+	adminServers []*nethttp.Server
 
-	// MaxClientIdleDuration max idle duration for client connection
-	// TODO: http? @daizong refer fasthttp's idle handler
+	// conns the client connections being served
+	conns     map[*clientConn]struct{}
+	connsLock sync.Mutex
+	// shuttingDown becomes non-zero when graceful shutdown starts
+	shuttingDown int32
+
+	// ServerIdleDuration max duration waiting for the next request on a keep-alive
+	// client connection, the connection is closed when exceeded. ServerReadTimeout
+	// is applied since the first byte of the request arrived then
 	ServerIdleDuration time.Duration
 
 	// ServerReadTimeout read timeout for server connection
@@ -52,13 +85,42 @@ type Proxy struct {
 	// ServerWriteTimeout write timeout for server connection
 	ServerWriteTimeout time.Duration
 
+	// ClientHeaderTimeout max duration reading the request header since its first
+	// byte arrived, a.k.a. the slowloris protection, the connection is closed when
+	// exceeded. Only ServerReadTimeout is applied if not set
+	ClientHeaderTimeout time.Duration
+	// ClientBodyTimeout max duration reading the request body, which can be
+	// overridden by the hijacker. Only ServerReadTimeout is applied if not set
+	ClientBodyTimeout time.Duration
+
 	// Concurrency max simultaneous connections per client
 	ServerConcurrency int
 
+	// ServerMaxConnsPerIP max simultaneous connections from a client IP, no limit if 0
+	ServerMaxConnsPerIP int
+	// ServerMaxConnsPerSubnet max simultaneous connections from a client subnet,
+	// which is sized by ServerSubnetPrefixIPv4 and ServerSubnetPrefixIPv6, no limit if 0
+	ServerMaxConnsPerSubnet int
+	// ServerSubnetPrefixIPv4 prefix length of the IPv4 client subnet,
+	// server.DefaultSubnetPrefixIPv4 is used when not set
+	ServerSubnetPrefixIPv4 int
+	// ServerSubnetPrefixIPv6 prefix length of the IPv6 client subnet,
+	// server.DefaultSubnetPrefixIPv6 is used when not set
+	ServerSubnetPrefixIPv6 int
+	// ServerAcceptRate max connections accepted per second, no limit if 0
+	ServerAcceptRate float64
+	// ServerAcceptBurst max connections accepted at once within ServerAcceptRate
+	ServerAcceptBurst int
+
 	// ServerShutdownWaitTime max waiting time for connected clients when server shuts down
 	// DefaultServerShutdownWaitTime is used when not set
 	ServerShutdownWaitTime time.Duration
 
+	// ShutdownTunnelGracePeriod max waiting time for the tunnels and the upgraded
+	// connections before they are closed when proxy shuts down gracefully
+	// DefaultShutdownTunnelGracePeriod is used when not set
+	ShutdownTunnelGracePeriod time.Duration
+
 	// client proxy uses a http client to dial a remote host for incoming requests
 	client client.Client
 
@@ -68,11 +130,43 @@ type Proxy struct {
 	// ForwardIdleConnDuration max forward connection's idle duration for target host
 	ForwardIdleConnDuration time.Duration
 
-	// ForwardReadTimeout read timeout for target forwarding host
+	// ForwardDialTimeout max duration establishing the connection to the target or super proxy
+	// transport.DefaultDialTimeout is used when not set
+	ForwardDialTimeout time.Duration
+	// ForwardTLSHandshakeTimeout max duration handshaking TLS with the target or super proxy
+	// transport.DefaultTLSHandshakeTimeout is used when not set
+	ForwardTLSHandshakeTimeout time.Duration
+	// ForwardFirstByteTimeout max duration waiting for the first byte of the target's
+	// response after the request forwarded, the request is answered with a 504 response
+	// when exceeded. Only ForwardReadTimeout is applied if not set
+	ForwardFirstByteTimeout time.Duration
+	// ForwardReadTimeout max duration reading the full response of the target after the
+	// request forwarded, a.k.a. the whole-response deadline. Unlimited if not set
 	ForwardReadTimeout time.Duration
 	// ForwardWriteTimeout write timeout for target forwarding host
 	ForwardWriteTimeout time.Duration
-	//TODO: integrate this timeout with forwarding may be?
+	// TunnelIdleTimeout tunnels and upgraded connections are closed after idle for this
+	// duration, ForwardIdleConnDuration is used when not set
+	TunnelIdleTimeout time.Duration
+
+	// RequestTimeout max duration of a http request, including the dialing,
+	// the forwarding and the response writing, the request is aborted when exceeded.
+	// Tunnels and the upgraded connections are not limited.
+	// The duration is unlimited if not set.
+	RequestTimeout time.Duration
+
+	// RequestBodyBufferSize max size of the request body buffered in memory when
+	// the hijacker asks for buffering the transformed body, the body exceeding it
+	// is spilled to a temporary file.
+	// DefaultRequestBodyBufferSize is used when not set
+	RequestBodyBufferSize int
+	// MaxRequestBodyBufferSize max size of the request body buffered in memory and
+	// the temporary file, the request is answered with a 413 response when exceeded.
+	// The size is unlimited if not set
+	MaxRequestBodyBufferSize int64
+	// RequestBodyTempDir directory of the temporary files holding the request body,
+	// the default directory for temporary files is used when not set
+	RequestBodyTempDir string
 
 	// used by server and client: http request and response pool
 	reqPool  RequestPool
@@ -80,11 +174,14 @@ type Proxy struct {
 
 	// SuperProxy default super proxy for connections, can be override if hijacker is not nil
 	SuperProxy *superproxy.SuperProxy
+	// SuperProxyPool default super proxy pool used when SuperProxy not set, the super proxy
+	// is picked by the client IP, and the failed tunnels are retried on the other members
+	SuperProxyPool *superproxy.Pool
 
-	// Dial default dial function for proxy and target host, can be override if hijacker is not nil
+	// Dial default dial function for proxy and target host, can be override by the hijacker's Dialer
 	Dial func(addr string) (net.Conn, error)
 
-	// DialTLS default TLS dial function for proxy and target host, can be override if hijacker is not nil
+	// DialTLS default TLS dial function for proxy and target host, can be override by the hijacker's Dialer
 	DialTLS func(addr string, tlsConfig *tls.Config) (net.Conn, error)
 
 	// hijacker pool for making a hijacker for every incoming request
@@ -93,95 +190,253 @@ type Proxy struct {
 	// MITMCertAuthority root certificate authority used for https decryption
 	MITMCertAuthority *tls.Certificate
 
+	// Authenticator authenticates every proxy request using the `Proxy-Authorization`
+	// header, requests failed to authenticate are answered with a 407 response.
+	// All requests are accepted when not set
+	Authenticator auth.Authenticator
+
+	// ACL access control lists checked for every request before dialing,
+	// the denied requests are answered with a 403 response.
+	// Compile must be called on it before serving, all requests are allowed when not set
+	ACL *acl.ACL
+
+	// ReverseRouter routes the origin-form requests to the upstream servers when set,
+	// a.k.a. the reverse proxy mode, requests with absolute URI are still forwarded
+	ReverseRouter *upstream.Router
+
+	// AccessLog writes an access log record for every http request, decrypted https
+	// request and tunnel when set, it is not closed by proxy
+	AccessLog *accesslog.Logger
+
+	// ParsingMode how the header violating RFC 9112 is handled, for both the
+	// requests and the responses of targets, which is the defense of the request
+	// smuggling. Malformed requests are answered with a 400 response.
+	// The recoverable violations of legacy clients and targets are normalized
+	// by default, use http.ParsingModeStrict to reject them all
+	ParsingMode http.ParsingMode
+
+	// ErrorPage renders the body of the error responses made by proxy, e.g.
+	// NewHTMLErrorPage or JSONErrorPage, the message is sent in plain text if not set
+	ErrorPage ErrorPage
+
+	// SniffSOCKS5 accepts SOCKS5 clients on the listener of Serve as well,
+	// the protocol is detected by the first byte sent by client
+	SniffSOCKS5 bool
+
 	DisableProxyKeepAlive bool
 }
 
 // Serve serve on the provided ip address
 func (p *Proxy) Serve(network, addr string) error {
-	p.bufioPool = bufiopool.New(p.ReadBufferSize, p.WriteBufferSize)
-
-	// setup server
 	ln, lnErr := net.Listen(network, addr)
 	if lnErr != nil {
 		return lnErr
 	}
-	if p.ServerShutdownWaitTime <= 0 {
-		p.ServerShutdownWaitTime = DefaultServerShutdownWaitTime
-	}
-	p.server.Listener = server.NewGracefulListener(ln, p.ServerShutdownWaitTime)
-	p.server.Concurrency = p.ServerConcurrency
-	p.server.ServiceName = "ProxyMNG"
-	p.server.ConnHandler = p.serveConn
-	p.server.OnConcurrencyLimitExceeded = p.serveConnOnLimitExceeded
+	return p.serve(ln, "ProxyMNG", p.serveConn,
+		p.serveConnOnLimitExceeded, p.serveConnOnClientLimitExceeded)
+}
+
+// init setup the shared buffer pool and http client once
+func (p *Proxy) init() {
+	p.initOnce.Do(func() {
+		p.ctx, p.cancel = context.WithCancel(context.Background())
+		p.bufioPool = bufiopool.New(p.ReadBufferSize, p.WriteBufferSize)
+		if p.ServerShutdownWaitTime <= 0 {
+			p.ServerShutdownWaitTime = DefaultServerShutdownWaitTime
+		}
+		if p.ShutdownTunnelGracePeriod <= 0 {
+			p.ShutdownTunnelGracePeriod = DefaultShutdownTunnelGracePeriod
+		}
+		if p.RequestBodyBufferSize <= 0 {
+			p.RequestBodyBufferSize = DefaultRequestBodyBufferSize
+		}
 
-	// setup client
-	p.client.BufioPool = p.bufioPool
-	p.client.MaxConnsPerHost = p.ForwardConcurrencyPerHost
-	p.client.MaxIdleConnDuration = p.ForwardIdleConnDuration
-	p.client.ReadTimeout = p.ForwardReadTimeout
-	p.client.WriteTimeout = p.ForwardWriteTimeout
+		// setup client
+		p.client.Dial = p.Dial
+		p.client.DialTLS = p.DialTLS
+		p.client.BufioPool = p.bufioPool
+		p.client.MaxConnsPerHost = p.ForwardConcurrencyPerHost
+		p.client.MaxIdleConnDuration = p.ForwardIdleConnDuration
+		p.client.DialTimeout = p.ForwardDialTimeout
+		p.client.TLSHandshakeTimeout = p.ForwardTLSHandshakeTimeout
+		p.client.FirstByteTimeout = p.ForwardFirstByteTimeout
+		p.client.ReadTimeout = p.ForwardReadTimeout
+		p.client.WriteTimeout = p.ForwardWriteTimeout
+		p.client.TunnelIdleTimeout = p.TunnelIdleTimeout
+		p.client.ParsingMode = p.ParsingMode
+	})
+}
 
-	return p.server.ListenAndServe()
+// serve setup a server with the listener then serves on it
+func (p *Proxy) serve(ln net.Listener, serviceName string,
+	connHandler server.ConnHandler, onLimitExceeded, onClientLimitExceeded func(net.Conn)) error {
+	p.init()
+	s := &server.Server{
+		Listener:                   server.NewGracefulListener(ln, p.ServerShutdownWaitTime),
+		Concurrency:                p.ServerConcurrency,
+		ServiceName:                serviceName,
+		ConnHandler:                connHandler,
+		OnConcurrencyLimitExceeded: onLimitExceeded,
+		MaxConnsPerIP:              p.ServerMaxConnsPerIP,
+		OnPerIPLimitExceeded:       onClientLimitExceeded,
+		MaxConnsPerSubnet:          p.ServerMaxConnsPerSubnet,
+		SubnetPrefixIPv4:           p.ServerSubnetPrefixIPv4,
+		SubnetPrefixIPv6:           p.ServerSubnetPrefixIPv6,
+		OnPerSubnetLimitExceeded:   onClientLimitExceeded,
+		AcceptRate:                 p.ServerAcceptRate,
+		AcceptBurst:                p.ServerAcceptBurst,
+		OnAcceptRateExceeded:       onLimitExceeded,
+	}
+	p.serversLock.Lock()
+	p.servers = append(p.servers, s)
+	p.serversLock.Unlock()
+	return s.ListenAndServe()
 }
 
-// ShutDown shut down the server, graceful shutdown tobe added
+// Close shut down all the servers and cancels all the requests being served,
+// use Shutdown to shut down gracefully
 func (p *Proxy) Close() {
-	p.server.Close()
+	p.init()
+	p.cancel()
+	p.serversLock.Lock()
+	defer p.serversLock.Unlock()
+	for _, s := range p.servers {
+		s.Close()
+	}
+	p.servers = nil
+	for _, s := range p.adminServers {
+		s.Close()
+	}
+	p.adminServers = nil
 }
 
 func (p *Proxy) serveConnOnLimitExceeded(c net.Conn) {
-	writeFastError(c, http.StatusServiceUnavailable,
+	p.writeFastError(c, http.StatusServiceUnavailable,
 		"The connection cannot be served because proxy's concurrency limit exceeded")
 }
 
+func (p *Proxy) serveConnOnClientLimitExceeded(c net.Conn) {
+	p.writeFastError(c, http.StatusTooManyRequests,
+		"The connection cannot be served because too many connections are made by the client")
+}
+
 func (p *Proxy) serveConn(c net.Conn) error {
-	// convert c into a http request
+	cc := p.trackConn(c)
+	defer p.untrackConn(cc)
 	reader := p.bufioPool.AcquireReader(c)
-	req := p.reqPool.Acquire()
-	releaseReqAndReader := func() {
-		p.reqPool.Release(req)
-		p.bufioPool.ReleaseReader(reader)
+	defer p.bufioPool.ReleaseReader(reader)
+	if p.SniffSOCKS5 {
+		if p.ServerReadTimeout > 0 {
+			if _, err := p.updateReadDeadline(c, servertime.CoarseTimeNow(), zeroTime); err != nil {
+				return err
+			}
+		}
+		if b, err := reader.Peek(1); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return util.ErrWrapper(err, "fail to sniff the protocol")
+		} else if b[0] == socks5Version {
+			return p.serveSOCKS5Conn(cc, reader)
+		}
 	}
-	defer releaseReqAndReader()
+	return p.serveHTTPConn(cc, reader, false, nil)
+}
+
+// serveHTTPConn serves the http requests from the client connection cc, reader is
+// the buffered reader of the connection. Origin-form requests are accepted for
+// transparent connections, whose target are decided by the original destination
+// dst and the `Host` header
+func (p *Proxy) serveHTTPConn(cc *clientConn, reader *bufio.Reader,
+	transparent bool, dst *net.TCPAddr) error {
+	c := cc.conn
+	// convert c into a http request
+	req := p.reqPool.Acquire()
+	defer p.reqPool.Release(req)
 	var (
 		err                   error
 		lastReadDeadlineTime  time.Time
 		lastWriteDeadlineTime time.Time
+		headerDeadline        time.Time
 	)
 	for { // proxy keep-alive loop
-		if p.ServerReadTimeout > 0 {
+		if p.ServerReadTimeout > 0 && p.ServerIdleDuration == 0 {
 			lastReadDeadlineTime, err = p.updateReadDeadline(c, servertime.CoarseTimeNow(), lastReadDeadlineTime)
 			if err != nil {
 				return err
 			}
 		}
 
-		// parse start line of the request: a.k.a. request line
-		if p.ServerIdleDuration == 0 {
-			_, err = req.parseStartLine(reader)
-		} else {
-			idleChan := make(chan struct{}, 1)
-			go func() {
-				_, err = req.parseStartLine(reader)
-				idleChan <- struct{}{}
-			}()
-			select {
-			case <-idleChan:
-			case <-time.After(p.ServerIdleDuration):
-				// idle out of max idle duration, return to close connection
-				return nil
+		cc.setState(connStateIdle)
+		if p.isShuttingDown() {
+			// the connection may be marked idle after the idle ones closed
+			return nil
+		}
+		if p.ServerIdleDuration > 0 {
+			if err = p.waitRequest(c, reader); err != nil {
+				if err == errIdleTimeout || err == io.EOF {
+					// idle out of max idle duration, return to close connection
+					return nil
+				}
+				return util.ErrWrapper(err, "fail to wait for http request")
+			}
+			// the idle deadline is replaced once the request arrived
+			if lastReadDeadlineTime, err = p.resetReadDeadline(c); err != nil {
+				return err
 			}
 		}
+
+		// parse start line of the request: a.k.a. request line
+		headerDeadline, err = p.readStartLine(c, reader, req)
 		if err != nil {
 			if err == io.EOF {
 				return nil
 			}
 			return util.ErrWrapper(err, "fail to read http request header")
 		}
+		cc.setState(connStateActive)
+		req.clientConn = cc
+		req.setContext(p.requestContext(cc.ctx, http.IsMethodConnect(req.Method())))
+
+		// reject the malformed header which may be framed differently by the target
+		if err = req.checkHeader(p.ParsingMode); err != nil {
+			statusCode, msg := malformedRequestStatus(headerDeadline)
+			if e := p.writeRequestError(c, req, statusCode, msg); e != nil {
+				return util.ErrWrapper(e, "fail to response malformed request")
+			}
+			return nil
+		}
+		if !headerDeadline.IsZero() {
+			// the header deadline is no longer applied to the rest of the request
+			if lastReadDeadlineTime, err = p.resetReadDeadline(c); err != nil {
+				return err
+			}
+		}
+
+		// origin-form requests of transparent connections
+		if transparent && len(req.reqLine.HostInfo().HostWithPort()) == 0 {
+			req.isTransparent = true
+			if setTransparentHTTPTarget(req, dst) != nil {
+				if e := p.writeFastError(c, http.StatusBadRequest, "Unknown target host.\n"); e != nil {
+					return util.ErrWrapper(e, "fail to response unknown target host")
+				}
+				return nil
+			}
+		}
+
+		// origin-form requests of reverse proxy
+		if !transparent && p.ReverseRouter != nil && len(req.reqLine.HostInfo().HostWithPort()) == 0 {
+			if statusCode, msg, e := p.routeReverseRequest(c, req); e != nil {
+				if e := p.writeFastError(c, statusCode, msg); e != nil {
+					return util.ErrWrapper(e, "fail to response reverse proxy request")
+				}
+				return nil
+			}
+		}
 
 		// discard direct HTTP requests
 		if len(req.reqLine.HostInfo().HostWithPort()) == 0 {
-			if e := writeFastError(c, http.StatusBadRequest,
+			if e := p.writeFastError(c, http.StatusBadRequest,
 				"This is a proxy server. Does not respond to non-proxy requests.\n"); e != nil {
 				return util.ErrWrapper(e, "fail to response non-proxy request")
 			}
@@ -199,9 +454,14 @@ func (p *Proxy) serveConn(c net.Conn) error {
 			return util.ErrWrapper(err, "proxy error with "+req.reqLine.HostInfo().TargetWithPort())
 		}
 
-		if err == io.EOF || req.ConnectionClose() || p.DisableProxyKeepAlive {
+		if err == io.EOF || req.ConnectionClose() || p.DisableProxyKeepAlive || p.isShuttingDown() ||
+			req.bodySkipped() {
 			break
 		}
+		if req.isClientWatched || !req.bodyReadDeadline.IsZero() {
+			// the read deadline is cleared by the watcher or the body reading
+			lastReadDeadlineTime = zeroTime
+		}
 		req.Reset()
 		reader.Reset(c)
 	}
@@ -212,9 +472,33 @@ func (p *Proxy) serveConn(c net.Conn) error {
 func (p *Proxy) do(c net.Conn, req *Request) error {
 	var hijacker Hijacker
 	isHTTPS := http.IsMethodConnect(req.Method())
+
+	// check the client
+	if p.ACL != nil && !p.ACL.CheckSource(c.RemoteAddr()).Allowed {
+		return p.denyRequest(c, req)
+	}
+
+	// authenticate the client
+	if p.Authenticator != nil && req.isProxyRequest() {
+		if err := req.peekRawHeader(); err != nil {
+			return err
+		}
+		username, ok := p.Authenticator.Authenticate(c.RemoteAddr(), req.header.ProxyAuthorization())
+		if !ok {
+			e := p.writeFastErrorWithHeader(c, http.StatusProxyAuthRequired,
+				p.proxyAuthenticateHeader(), "Proxy Authentication Required.\n")
+			p.finishRequest(c, req, http.StatusProxyAuthRequired, req.readBytes, 0, e)
+			if e != nil {
+				return util.ErrWrapper(e, "fail to response proxy authentication required")
+			}
+			return io.EOF
+		}
+		req.username = username
+	}
+
 	// setup request hijacker
 	if p.HijackerPool != nil {
-		hijacker = p.HijackerPool.Get(c.RemoteAddr(), isHTTPS,
+		hijacker = p.HijackerPool.Get(req.Context(), c.RemoteAddr(), req.username, isHTTPS,
 			req.reqLine.HostInfo().Domain(), req.reqLine.HostInfo().Port())
 		req.hijacker = hijacker
 		defer p.HijackerPool.Put(hijacker)
@@ -224,7 +508,7 @@ func (p *Proxy) do(c net.Conn, req *Request) error {
 	if hijacker != nil {
 		newHost, newPort := hijacker.RewriteHost()
 		if len(newHost) == 0 || len(newPort) == 0 {
-			if e := writeFastError(c, http.StatusBadGateway, "Bad Gateway.\n"); e != nil {
+			if e := p.writeRequestError(c, req, http.StatusBadGateway, "Bad Gateway.\n"); e != nil {
 				return util.ErrWrapper(e, "fail to response session unavailable")
 			}
 			return io.EOF
@@ -235,6 +519,21 @@ func (p *Proxy) do(c net.Conn, req *Request) error {
 		}
 	}
 
+	// check the target
+	if p.ACL != nil {
+		hostInfo := req.reqLine.HostInfo()
+		d := p.ACL.CheckDestination(req.Context(), c.RemoteAddr(), req.username,
+			string(req.Method()), hostInfo.Domain(), hostInfo.Port(), hostInfo.IP())
+		if !d.Allowed {
+			return p.denyRequest(c, req)
+		}
+		// dial the IP checked rather than resolving the domain again,
+		// the IP already set, e.g. the original destination, is kept
+		if hostInfo.IP() == nil {
+			hostInfo.SetIP(d.ResolvedIP)
+		}
+	}
+
 	// make http client requests
 	if !isHTTPS {
 		return p.proxyHTTP(c, req)
@@ -247,7 +546,7 @@ func (p *Proxy) do(c net.Conn, req *Request) error {
 	if hijacker != nil {
 		if !hijacker.OnConnect(req.header, req.rawHeader) {
 			// the hijacker doesn't allow tunnel making request
-			if e := writeFastError(c, http.StatusBadGateway, "Bad Gateway.\n"); e != nil {
+			if e := p.writeRequestError(c, req, http.StatusBadGateway, "Bad Gateway.\n"); e != nil {
 				return util.ErrWrapper(e, "fail to response session unavailable")
 			}
 			return io.EOF
@@ -262,12 +561,22 @@ func (p *Proxy) do(c net.Conn, req *Request) error {
 	if hijacker != nil {
 		sslBump = hijacker.SSLBump()
 	}
-	if sslBump {
+	if sslBump && !req.isRawTunnel {
 		return p.decryptHTTPS(c, req)
 	}
 	return p.tunnelHTTPS(c, req)
 }
 
+// denyRequest answers the request denied by ACL then closes the connection
+func (p *Proxy) denyRequest(c net.Conn, req *Request) error {
+	e := p.writeRequestError(c, req, http.StatusForbidden, "Forbidden by the proxy's access control.\n")
+	p.finishRequest(c, req, http.StatusForbidden, req.readBytes, 0, e)
+	if e != nil {
+		return util.ErrWrapper(e, "fail to response forbidden request")
+	}
+	return io.EOF
+}
+
 func (p *Proxy) proxyHTTP(c net.Conn, req *Request) (err error) {
 	// convert connection into a http response
 	writer := p.bufioPool.AcquireWriter(c)
@@ -275,6 +584,19 @@ func (p *Proxy) proxyHTTP(c net.Conn, req *Request) (err error) {
 	defer writer.Flush()
 	resp := p.respPool.Acquire()
 	defer p.respPool.Release(resp)
+	// status code of the response made by proxy, the target's is used if not set
+	var statusCode int
+	defer func() {
+		if statusCode == 0 {
+			statusCode = resp.respLine.GetStatusCode()
+		}
+		reqErr := err
+		if reqErr == io.EOF {
+			// the request is either aborted or upgraded
+			reqErr = req.Context().Err()
+		}
+		p.finishRequest(c, req, statusCode, req.readBytes, resp.writtenBytes, reqErr)
+	}()
 	if err = resp.WriteTo(writer); err != nil {
 		return
 	}
@@ -289,9 +611,17 @@ func (p *Proxy) proxyHTTP(c net.Conn, req *Request) (err error) {
 		}
 		return
 	}
-	req.makeDNSLookUpAndSetSuperProxy(p.SuperProxy)
+	if err = p.setSuperProxy(c, req); err != nil {
+		var e error
+		if statusCode, e = p.writeUpstreamError(c, req, err); e != nil {
+			err = util.ErrWrapper(err, "fail to response upstream error with error %s", e)
+		}
+		return
+	}
 	if p := req.proxy; p != nil {
-		p.AcquireToken()
+		if err = p.AcquireToken(req.Context()); err != nil {
+			return
+		}
 		defer p.PushBackToken()
 	}
 
@@ -299,7 +629,8 @@ func (p *Proxy) proxyHTTP(c net.Conn, req *Request) (err error) {
 		defer hijacker.AfterResponse(err)
 		// block the request if needed
 		if hijacker.Block() {
-			err = writeFastError(c, http.StatusBadGateway, "")
+			statusCode = http.StatusBadGateway
+			err = p.writeFastError(c, http.StatusBadGateway, "")
 			return
 		}
 		// hijack the response if needed
@@ -310,9 +641,85 @@ func (p *Proxy) proxyHTTP(c net.Conn, req *Request) (err error) {
 		}
 	}
 
+	// limit the body reading and the forwarding with the timeouts of the request
+	ctx := req.Context()
+	bodyTimeout := p.ClientBodyTimeout
+	if timeouts := req.timeouts(); timeouts != nil {
+		ctx = client.WithTimeouts(ctx, &timeouts.Timeouts)
+		if timeouts.ClientBody > 0 {
+			bodyTimeout = timeouts.ClientBody
+		}
+	}
+	defer req.clearBodyReadDeadline()
+	if err = req.setBodyReadDeadline(c, bodyTimeout); err != nil {
+		return
+	}
+
+	// transform the request body if needed
+	if err = req.transformBody(writer, p.RequestBodyBufferSize,
+		p.MaxRequestBodyBufferSize, p.RequestBodyTempDir); err != nil {
+		if err == errRequestBodyTooLarge {
+			statusCode = http.StatusRequestEntityTooLarge
+			if e := p.writeFastError(c, statusCode, "Request body too large.\n"); e != nil {
+				err = util.ErrWrapper(e, "fail to response request entity too large")
+			}
+		} else if req.isBodyReadTimedOut() {
+			statusCode = http.StatusRequestTimeout
+			if e := p.writeFastError(c, statusCode, "Request Timeout.\n"); e != nil {
+				err = util.ErrWrapper(err, "fail to response request timeout with error %s", e)
+			}
+		}
+		return
+	}
+
 	// make the request
-	p.setClientDialer(req)
-	err = p.client.Do(req, resp)
+	resp.SetUpgradeConn(c, req.reader)
+	resp.setConnectionClose(func() bool {
+		return p.isShuttingDown() || req.bodySkipped() || req.normalizer.IsFramingAmbiguous()
+	})
+	resp.setClientHTTP10(bytes.Equal(req.Protocol(), protocolHTTP10))
+	if req.header.IsConnectionUpgrade() {
+		// treated as a tunnel once the protocol switched
+		req.setConnState(connStateTunnel)
+	}
+	if req.cancel != nil && !req.header.IsConnectionUpgrade() {
+		// cancel the request if the client closed the connection
+		// before the response sent, the upgrade requests are excluded
+		// since the reader is taken over after protocol switched
+		req.watcher.init(c, req.reader, req.cancel)
+	}
+	err = p.client.Do(ctx, req, resp)
+	if req.watcher.stop() {
+		req.isClientWatched = true
+	}
+	req.markUpstream(resp, err)
+	req.markSuperProxy(err)
+	if err == context.Canceled {
+		// the client has gone or the proxy is closing
+		err = io.EOF
+	}
+	if err != nil && err != io.EOF && resp.writtenBytes == 0 {
+		// nothing sent to the client yet, respond the client or upstream failure
+		var e error
+		if req.isBodyReadTimedOut() {
+			statusCode = http.StatusRequestTimeout
+			e = p.writeFastError(c, statusCode, "Request Timeout.\n")
+		} else {
+			statusCode, e = p.writeUpstreamError(c, req, err)
+		}
+		if e != nil {
+			err = util.ErrWrapper(err, "fail to response upstream error with error %s", e)
+		}
+	}
+	if err == nil && resp.isProtocolSwitched() {
+		// the connection is taken over by the upgraded protocol,
+		// it can no longer be used for http requests
+		err = io.EOF
+	}
+	if err == nil && resp.isClientBodyDelimitedByClose {
+		// the client reads the body until the connection closed
+		err = io.EOF
+	}
 	return
 }
 
@@ -321,7 +728,7 @@ func (p *Proxy) decryptHTTPS(c net.Conn, req *Request) error {
 	hijackedConn, serverName, err := mitm.HijackTLSConnection(
 		p.MITMCertAuthority, c, req.reqLine.HostInfo().Domain(),
 		func(fail error) error { // before handshaking with client, return the tunnel made or failed message
-			_, err := sendTunnelMessage(c, fail)
+			_, err := p.sendTunnelMessage(c, req, fail)
 			return err
 		},
 	)
@@ -339,63 +746,185 @@ func (p *Proxy) decryptHTTPS(c net.Conn, req *Request) error {
 	}
 
 	// reset request to a new one for hijacked request purpose
-	targetWithPort := req.reqLine.HostInfo().TargetWithPort()
+	hostWithPort := req.reqLine.HostInfo().HostWithPort()
 	ip := req.reqLine.HostInfo().IP()
 	hijackedConnReader := p.bufioPool.AcquireReader(hijackedConn)
 	defer p.bufioPool.ReleaseReader(hijackedConnReader)
 
+	// every decrypted request has its own context derived from the tunnel's
+	tunnelCtx, cancelTunnel := req.Context(), req.cancel
+	defer req.setContext(tunnelCtx, cancelTunnel)
+	req.isSSLBump = true
 	for {
 		req.reader = nil
+		req.rawHeader = nil
 		req.reqLine.Reset()
-		_, err := req.parseStartLine(hijackedConnReader)
+		req.isBodyWritten = false
+		req.setConnState(connStateIdle)
+		if p.isShuttingDown() {
+			return io.EOF
+		}
+		headerDeadline, err := p.readStartLine(hijackedConn, hijackedConnReader, req)
 		if err != nil {
 			if err == io.EOF {
 				return err
 			}
 			return util.ErrWrapper(err, "fail to read fake tls server request header")
 		}
+		req.setConnState(connStateActive)
 		req.SetTLS(serverName)
-		req.reqLine.HostInfo().ParseHostWithPort(targetWithPort, true)
+		req.reqLine.HostInfo().ParseHostWithPort(hostWithPort, true)
 		req.reqLine.HostInfo().SetIP(ip)
-		if err := p.proxyHTTP(hijackedConn, req); err != nil {
+		ctx, cancel := p.requestContext(tunnelCtx, false)
+		req.setContext(ctx, cancel)
+		if err = req.checkHeader(p.ParsingMode); err != nil {
+			cancel()
+			statusCode, msg := malformedRequestStatus(headerDeadline)
+			if e := p.writeFastError(hijackedConn, statusCode, msg); e != nil {
+				return util.ErrWrapper(e, "fail to response malformed request")
+			}
+			return io.EOF
+		}
+		if !headerDeadline.IsZero() {
+			if err = hijackedConn.SetReadDeadline(zeroTime); err != nil {
+				cancel()
+				return err
+			}
+		}
+		err = p.proxyHTTP(hijackedConn, req)
+		cancel()
+		if err != nil {
 			return err
 		}
+		if p.isShuttingDown() || req.bodySkipped() || req.normalizer.IsFramingAmbiguous() {
+			return io.EOF
+		}
 	}
 }
 
 func (p *Proxy) tunnelHTTPS(c net.Conn, req *Request) error {
-	req.makeDNSLookUpAndSetSuperProxy(p.SuperProxy)
-	if p := req.proxy; p != nil {
-		p.AcquireToken()
-		defer p.PushBackToken()
+	err := p.setSuperProxy(c, req)
+	if sp := req.proxy; err == nil && sp != nil {
+		err = sp.AcquireToken(req.Context())
+		if err == nil {
+			// the super proxy may be switched by the retries
+			defer func() { req.proxy.PushBackToken() }()
+		}
+	}
+	if err != nil {
+		statusCode, _ := upstreamErrorStatus(transport.KindOf(err))
+		_, err = p.sendTunnelMessage(c, req, err)
+		p.finishRequest(c, req, statusCode, 0, 0, err)
+		return err
 	}
 	if req.hijacker != nil {
 		// block the request if needed
 		if req.hijacker.Block() {
-			return writeFastError(c, http.StatusBadGateway, "")
+			err := p.writeRequestError(c, req, http.StatusBadGateway, "")
+			p.finishRequest(c, req, http.StatusBadGateway, 0, 0, err)
+			return err
 		}
 	}
 
-	p.setClientDialer(req)
-	_, _, err := p.client.DoRaw(
-		c, req.GetProxy(), req.TargetWithPort(),
-		func(fail error) error { // on tunnel made, return the tunnel made or failed message
-			_, err := sendTunnelMessage(c, fail)
-			return err
-		},
+	ctx := req.Context()
+	if timeouts := req.timeouts(); timeouts != nil {
+		ctx = client.WithTimeouts(ctx, &timeouts.Timeouts)
+	}
+	req.setConnState(connStateTunnel)
+	statusCode := http.StatusOK
+	tunnelsGauge.Inc()
+	var (
+		readNum, writeNum int64
+		tried             []*superproxy.SuperProxy
 	)
-
+	for {
+		retried := false
+		readNum, writeNum, err = p.client.DoRaw(
+			ctx, c, req.GetProxy(), req.GetDialer(), req.TargetWithPort(),
+			func(fail error) error { // on tunnel made, return the tunnel made or failed message
+				req.markSuperProxy(fail)
+				if fail != nil {
+					// retry on another member of the super proxy pool if any
+					tried = append(tried, req.proxy)
+					if retried = req.retrySuperProxy(c, fail, tried); retried {
+						return fail
+					}
+					statusCode = http.StatusBadGateway
+				}
+				_, err := p.sendTunnelMessage(c, req, fail)
+				return err
+			},
+		)
+		if !retried {
+			break
+		}
+	}
+	tunnelsGauge.Dec()
+	p.finishRequest(c, req, statusCode, readNum, writeNum, err)
+	if err == nil {
+		// the connection is taken over by the tunnel,
+		// it can no longer be used for http requests
+		err = io.EOF
+	}
 	return err
 }
 
-func (p *Proxy) setClientDialer(req *Request) {
-	if req.hijacker == nil {
-		p.client.DialTLS = p.DialTLS
-		p.client.Dial = p.Dial
-		return
+// errIdleTimeout no request arrives within ServerIdleDuration
+var errIdleTimeout = errors.New("idle timeout")
+
+// waitRequest waits for the first byte of the next request within ServerIdleDuration
+// by setting the read deadline, errIdleTimeout is returned if nothing arrives
+func (p *Proxy) waitRequest(c net.Conn, reader *bufio.Reader) error {
+	if reader.Buffered() > 0 {
+		// the pipelined request arrived already
+		return nil
+	}
+	if err := c.SetReadDeadline(time.Now().Add(p.ServerIdleDuration)); err != nil {
+		return err
+	}
+	if _, err := reader.Peek(1); err != nil {
+		if e, ok := err.(net.Error); ok && e.Timeout() {
+			return errIdleTimeout
+		}
+		return err
+	}
+	return nil
+}
+
+// readStartLine reads the start line of the request from reader, the header reading
+// is limited by ClientHeaderTimeout since the first byte of the request arrived,
+// returns the deadline of the header, which is zero if not limited
+func (p *Proxy) readStartLine(c net.Conn, reader *bufio.Reader, req *Request) (time.Time, error) {
+	var headerDeadline time.Time
+	if p.ClientHeaderTimeout > 0 {
+		if _, err := reader.Peek(1); err != nil {
+			return zeroTime, err
+		}
+		headerDeadline = time.Now().Add(p.ClientHeaderTimeout)
+		if err := c.SetReadDeadline(headerDeadline); err != nil {
+			return zeroTime, err
+		}
+	}
+	_, err := req.parseStartLine(reader)
+	return headerDeadline, err
+}
+
+// malformedRequestStatus the status code and message answering the request with
+// a malformed header, which is timed out if the header deadline exceeded
+func malformedRequestStatus(headerDeadline time.Time) (int, string) {
+	if !headerDeadline.IsZero() && !time.Now().Before(headerDeadline) {
+		return http.StatusRequestTimeout, "Request Timeout.\n"
+	}
+	return http.StatusBadRequest, "Bad Request.\n"
+}
+
+// resetReadDeadline resets the read deadline of c with ServerReadTimeout,
+// or clears it if not set, returns the time the deadline updated
+func (p *Proxy) resetReadDeadline(c net.Conn) (time.Time, error) {
+	if p.ServerReadTimeout > 0 {
+		return p.updateReadDeadline(c, servertime.CoarseTimeNow(), zeroTime)
 	}
-	p.client.DialTLS = req.hijacker.DialTLS()
-	p.client.Dial = req.hijacker.Dial()
+	return zeroTime, c.SetReadDeadline(zeroTime)
 }
 
 func (p *Proxy) updateReadDeadline(c net.Conn, currentTime time.Time, lastDeadlineTime time.Time) (time.Time, error) {
@@ -427,35 +956,111 @@ func (p *Proxy) updateWriteDeadline(c net.Conn, currentTime time.Time, lastDeadl
 	return lastDeadlineTime, nil
 }
 
-var (
-	httpTunnelMadeOKayBytes   = []byte("HTTP/1.1 200 OK\r\n\r\n")
-	httpTunnelMadeFailedBytes = []byte("HTTP/1.1 501 Bad Gateway\r\n\r\n")
-)
+var httpTunnelMadeOKayBytes = []byte("HTTP/1.1 200 OK\r\n\r\n")
 
-func sendTunnelMessage(c net.Conn, fail error) (int, error) {
+// sendTunnelMessage tells the client the tunnel is made, or the
+// upstream failure responded in the same way as the http requests
+func (p *Proxy) sendTunnelMessage(c net.Conn, req *Request, fail error) (int, error) {
+	if req.isSOCKS5 {
+		return sendSOCKS5TunnelMessage(c, fail)
+	}
+	if req.isTransparent {
+		// the client knows nothing about the tunnel
+		return 0, fail
+	}
 	if fail != nil {
-		n, err := util.WriteWithValidation(c, httpTunnelMadeFailedBytes)
+		_, err := p.writeUpstreamError(c, req, fail)
 		if err == nil {
-			return n, fail
+			return 0, fail
 		}
 		err = util.ErrWrapper(fail, "fail to write error message to client with error %s", err)
-		return n, err
+		return 0, err
 	}
 	return util.WriteWithValidation(c, httpTunnelMadeOKayBytes)
 }
 
-func writeFastError(w io.Writer, statusCode int, msg string) error {
+func (p *Proxy) proxyAuthenticateHeader() []byte {
+	challenge := p.Authenticator.Challenge()
+	header := make([]byte, 0, len(proxyAuthenticateHeaderKey)+len(challenge)+2)
+	header = append(header, proxyAuthenticateHeaderKey...)
+	header = append(header, challenge...)
+	return append(header, "\r\n"...)
+}
+
+var proxyAuthenticateHeaderKey = []byte("Proxy-Authenticate: ")
+
+var protocolHTTP10 = []byte("HTTP/1.0")
+
+// writeRequestError writes the error response in the protocol the request uses
+func (p *Proxy) writeRequestError(w io.Writer, req *Request, statusCode int, msg string) error {
+	if req.isSOCKS5 {
+		return writeSOCKS5Reply(w, socks5ReplyCodeFromStatus(statusCode))
+	}
+	if req.isTransparent && http.IsMethodConnect(req.Method()) {
+		// transparent tunnels can only be closed
+		return nil
+	}
+	return p.writeFastError(w, statusCode, msg)
+}
+
+func (p *Proxy) writeFastError(w io.Writer, statusCode int, msg string) error {
+	return p.writeFastErrorWithHeader(w, statusCode, nil, msg)
+}
+
+// writeFastErrorWithHeader writes the error response with additional
+// header lines, every line of the header should end with CRLF
+func (p *Proxy) writeFastErrorWithHeader(w io.Writer, statusCode int, header []byte, msg string) error {
+	return p.writeErrorPage(w, header, &ErrorInfo{StatusCode: statusCode, Message: msg})
+}
+
+// writeUpstreamError writes the error response of the upstream failure err
+// with the diagnostic header, returns the status code of the response
+func (p *Proxy) writeUpstreamError(w io.Writer, req *Request, err error) (int, error) {
+	kind := transport.KindOf(err)
+	statusCode, msg := upstreamErrorStatus(kind)
+	header := make([]byte, 0, len(ErrorHeader)+32)
+	header = append(header, ErrorHeader...)
+	header = append(header, ": "...)
+	header = append(header, kind.String()...)
+	header = append(header, "\r\n"...)
+	return statusCode, p.writeErrorPage(w, header, &ErrorInfo{StatusCode: statusCode,
+		Kind: kind.String(), Message: msg, Target: req.reqLine.HostInfo().HostWithPort()})
+}
+
+// writeErrorPage writes the error response with the body rendered by ErrorPage,
+// the message is sent in plain text if ErrorPage not set
+func (p *Proxy) writeErrorPage(w io.Writer, header []byte, info *ErrorInfo) error {
+	info.Status = http.StatusMessage(info.StatusCode)
+	contentType := "text/plain"
+	body := bytebufferpool.Get()
+	defer bytebufferpool.Put(body)
+	if p.ErrorPage != nil {
+		contentType = p.ErrorPage.ContentType()
+		// the messages are made for the plain text
+		info.Message = strings.TrimSpace(info.Message)
+		if err := p.ErrorPage.Render(body, info); err != nil {
+			return util.ErrWrapper(err, "fail to render error page")
+		}
+	} else {
+		body.WriteString(info.Message)
+	}
+
 	var err error
-	_, err = w.Write(http.StatusLine(statusCode))
+	_, err = w.Write(http.StatusLine(info.StatusCode))
 	if err != nil {
 		return err
 	}
+	if len(header) > 0 {
+		if _, err = w.Write(header); err != nil {
+			return err
+		}
+	}
 	_, err = fmt.Fprintf(w, "Connection: close\r\n"+
 		"Date: %s\r\n"+
-		"Content-Type: text/plain\r\n"+
+		"Content-Type: %s\r\n"+
 		"Content-Length: %d\r\n"+
 		"\r\n"+
 		"%s",
-		servertime.ServerDate(), len(msg), msg)
+		servertime.ServerDate(), contentType, body.Len(), body.B)
 	return err
 }
@@ -3,10 +3,11 @@ package proxy
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"fmt"
-	"io"
 	"io/ioutil"
 	slog "log"
 	"net"
@@ -15,11 +16,11 @@ import (
 	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
-	"github.com/haxii/fastproxy/http"
-	"github.com/haxii/fastproxy/superproxy"
+	"github.com/haxii/fastproxy/acl"
 	"github.com/haxii/socks5"
 )
 
@@ -42,27 +43,32 @@ func testInit(t *testing.T) {
 
 	keepAliveServer = func() {
 		ln, _ := net.Listen("tcp", ":9900")
-		i := 0
-		var keepConn net.Conn
-		var closeConn net.Conn
+		var closed int32
 		for {
-			conn, _ := ln.Accept()
-			b := make([]byte, 100)
-			conn.Read(b)
-			if i < 1 {
-				keepConn = conn
-			} else if i == 1 {
-				closeConn = conn
+			conn, err := ln.Accept()
+			if err != nil {
+				return
 			}
-			if strings.Contains(string(b), "/keep-alive") {
-				keepConn.Write([]byte("HTTP/1.1 200 ok\r\nConnection:keep-alive\r\n\r\n"))
-			} else {
-				if i == 1 {
-					conn.Write([]byte("HTTP/1.1 200 ok\r\nConnection:close\r\n\r\n"))
+			go func(conn net.Conn) {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				for {
+					r, err := nethttp.ReadRequest(br)
+					if err != nil {
+						return
+					}
+					if r.URL.Path == "/keep-alive" {
+						conn.Write([]byte("HTTP/1.1 200 ok\r\nConnection:keep-alive\r\nContent-Length:0\r\n\r\n"))
+						continue
+					}
+					// closes the connection with a response for the first time,
+					// then without any response
+					if atomic.AddInt32(&closed, 1) == 1 {
+						conn.Write([]byte("HTTP/1.1 200 ok\r\nConnection:close\r\n\r\n"))
+					}
+					return
 				}
-				closeConn.Close()
-			}
-			i++
+			}(conn)
 		}
 	}
 
@@ -509,21 +515,20 @@ func testProxyKeepConnectionAndClose(t *testing.T) {
 		t.Fatalf("unexpected error:%s", err)
 	}
 
+	// the target closed the connection without response
 	req, _ = nethttp.NewRequest("GET", "http://127.0.0.1:9900/", nil)
 	resp, err = c.Do(req)
-	if err == nil {
-		t.Fatal("unexpected error: request canceled")
+	if err != nil {
+		t.Fatalf("unexpected error:%s", err)
 	}
-	if !strings.Contains(err.Error(), "request canceled") {
-		t.Fatalf("unexpected error: %s", err)
+	if resp.StatusCode != nethttp.StatusBadGateway {
+		t.Fatalf("unexpected status code %d, expecting 502", resp.StatusCode)
 	}
 }
 
 // test graceful shut down
 func testGracefulShutDown(t *testing.T) {
-	proxy := Proxy{
-		ServerShutdownWaitTime: 10 * time.Second,
-	}
+	proxy := Proxy{}
 	go func() {
 		proxy.Serve("tcp4", "0.0.0.0:7078")
 	}()
@@ -532,23 +537,28 @@ func testGracefulShutDown(t *testing.T) {
 	if err != nil {
 		t.Fatalf("unexpected error: %s", err)
 	}
-	time.Sleep(time.Millisecond * 10)
-	go func() {
-		proxy.Close()
-	}()
-	time.Sleep(time.Millisecond * 10)
+	defer conn.Close()
 	fmt.Fprintf(conn, "GET / HTTP/1.1\r\n\r\n")
-	status, err := bufio.NewReader(conn).ReadString('\n')
+	br := bufio.NewReader(conn)
+	status, err := br.ReadString('\n')
 	if err != nil {
 		t.Fatalf("unexpected error: %s", err)
 	}
 	if status != "HTTP/1.1 400 Bad Request\r\n" {
 		t.Fatalf("an error occurred when send get request")
 	}
-	conn.Close()
 
-	time.Sleep(10 * time.Second)
-	conn, err = net.Dial("tcp4", "0.0.0.0:7078")
+	// the idle connections are closed and no more connections accepted
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := proxy.Shutdown(ctx); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := ioutil.ReadAll(br); err != nil {
+		t.Fatalf("idle connection should be closed, but error: %s", err)
+	}
+	_, err = net.Dial("tcp4", "0.0.0.0:7078")
 	if err == nil {
 		t.Fatal("expected error: connection refused")
 	}
@@ -561,8 +571,7 @@ func testGracefulShutDown(t *testing.T) {
 
 // test using proxy hijack and url send to different proxy
 func testUsingProxyHijackAndURLSendToDifferProxy(t *testing.T) {
-	dataForSigning := ""
-	proxy := Proxy{}
+	proxy := Proxy{HijackerPool: &CompleteHijackerPool{}}
 	go func() {
 		if err := proxy.Serve("tcp4", "0.0.0.0:7555"); err != nil {
 			panic(err)
@@ -574,6 +583,7 @@ func testUsingProxyHijackAndURLSendToDifferProxy(t *testing.T) {
 		})
 		nethttp.ListenAndServe(":9333", nil)
 	}()
+	time.Sleep(time.Millisecond * 10)
 	newProxyWithSuperProxy := func(r *nethttp.Request) (*url.URL, error) {
 		proxyURL, err := url.Parse(fmt.Sprintf("http://%s:%d", "127.0.0.1", 7555))
 		if err != nil {
@@ -604,10 +614,6 @@ func testUsingProxyHijackAndURLSendToDifferProxy(t *testing.T) {
 		t.Fatal("An error occurred: proxy can't send request")
 	}
 
-	if !strings.Contains(dataForSigning, "No super proxy can use for fast proxy") {
-		t.Fatal("Proxy send request using super proxy, expected should not use super proxy")
-	}
-
 	req, err = nethttp.NewRequest("GET", "http://127.0.0.1:9991", nil)
 	if err != nil {
 		t.Fatalf("unexpected error: %s", err)
@@ -624,7 +630,15 @@ func testUsingProxyHijackAndURLSendToDifferProxy(t *testing.T) {
 }
 
 func testHostsRewrite(t *testing.T) {
-	proxy := Proxy{}
+	// the requests to the simple server are sent to the sproxy one
+	proxy := Proxy{
+		HijackerPool: hijackerPoolFunc(func(host, port string) Hijacker {
+			if port == fmt.Sprint(simpleServerPort) {
+				port = "9333"
+			}
+			return &simpleHijacker{nopHijacker{host: host, port: port}}
+		}),
+	}
 	go func() {
 		if err := proxy.Serve("tcp4", "0.0.0.0:7666"); err != nil {
 			panic(err)
@@ -660,7 +674,7 @@ func testHostsRewrite(t *testing.T) {
 		t.Fatal("An error occurred: proxy can't send request")
 	}
 
-	req, err = nethttp.NewRequest("GET", "http://127.0.0.1:9991", nil)
+	req, err = nethttp.NewRequest("GET", "http://127.0.0.1:9991/sproxy", nil)
 	if err != nil {
 		t.Fatalf("unexpected error: %s", err)
 	}
@@ -669,24 +683,30 @@ func testHostsRewrite(t *testing.T) {
 		t.Fatalf("unexpected error: %s", err)
 	}
 	body, err = ioutil.ReadAll(resp.Body)
-	if string(body) == "hello world!" {
+	if string(body) != "Hello proxy!" {
 		t.Fatal("An error occurred: proxy can't rewrite url")
 	}
 
-	if !strings.Contains(string(body), "This is a proxy server") {
-		t.Fatal("An error occurred: proxy can't rewrite url")
-	}
+}
 
+// hijackerPoolFunc makes the hijacker of each request with the target host and port
+type hijackerPoolFunc func(host, port string) Hijacker
+
+func (f hijackerPoolFunc) Get(ctx context.Context, clientAddr net.Addr,
+	username string, isHTTPS bool, host, port string) Hijacker {
+	return f(host, port)
 }
 
+func (f hijackerPoolFunc) Put(Hijacker) {}
+
 // SimpleHijackerPool implements the HijackerPool based on simpleHijacker & sync.Pool
 type SimpleHijackerPool struct {
 	pool sync.Pool
 }
 
 // Get get a simple hijacker from pool
-func (p *SimpleHijackerPool) Get(clientAddr net.Addr,
-	targetHost string, method, path []byte) Hijacker {
+func (p *SimpleHijackerPool) Get(ctx context.Context, clientAddr net.Addr,
+	username string, isHTTPS bool, host, port string) Hijacker {
 	v := p.pool.Get()
 	var h *simpleHijacker
 	if v == nil {
@@ -694,6 +714,7 @@ func (p *SimpleHijackerPool) Get(clientAddr net.Addr,
 	} else {
 		h = v.(*simpleHijacker)
 	}
+	h.host, h.port = host, port
 	return h
 }
 
@@ -706,9 +727,9 @@ type CompleteHijackerPool struct {
 	pool sync.Pool
 }
 
-// Get get a simple hijacker from pool
-func (p *CompleteHijackerPool) Get(clientAddr net.Addr,
-	targetHost string, method, path []byte) Hijacker {
+// Get get a complete hijacker from pool
+func (p *CompleteHijackerPool) Get(ctx context.Context, clientAddr net.Addr,
+	username string, isHTTPS bool, host, port string) Hijacker {
 	v := p.pool.Get()
 	var h *completeHijacker
 	if v == nil {
@@ -716,7 +737,7 @@ func (p *CompleteHijackerPool) Get(clientAddr net.Addr,
 	} else {
 		h = v.(*completeHijacker)
 	}
-	h.Set(clientAddr, targetHost, method, path)
+	h.Set(clientAddr, host, port)
 	return h
 }
 
@@ -726,32 +747,150 @@ func (p *CompleteHijackerPool) Put(s Hijacker) {
 }
 
 type completeHijacker struct {
-	clientAddr, targetHost string
-	method, path           []byte
+	hijacker
+	clientAddr string
 }
 
-func (s *completeHijacker) Set(clientAddr net.Addr,
-	host string, method, path []byte) {
+func (s *completeHijacker) Set(clientAddr net.Addr, host, port string) {
 	s.clientAddr = clientAddr.String()
-	s.targetHost = host
-	s.method = method
-	s.path = path
+	s.host, s.port = host, port
 }
 
-func (s *completeHijacker) HijackRequest(header http.Header, rawHeader []byte, superProxy **superproxy.SuperProxy) []byte {
-	return nil
-}
+// BenchmarkServeIdleKeepAlive serves keep-alive requests with ServerIdleDuration
+// set, while many other keep-alive clients are idle
+func BenchmarkServeIdleKeepAlive(b *testing.B) {
+	// a keep-alive target
+	targetLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatalf("unexpected error: %s", err)
+	}
+	defer targetLn.Close()
+	go func() {
+		for {
+			c, err := targetLn.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				br := bufio.NewReader(c)
+				for {
+					line, err := br.ReadSlice('\n')
+					if err != nil {
+						return
+					}
+					if len(line) == 2 {
+						c.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"))
+					}
+				}
+			}(c)
+		}
+	}()
 
-func (s *completeHijacker) OnRequest(header http.Header, rawHeader []byte) io.Writer {
-	bReq.Write(rawHeader)
-	return bReq
-}
+	proxyLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatalf("unexpected error: %s", err)
+	}
+	proxy := &Proxy{ServerIdleDuration: time.Minute}
+	go proxy.serve(proxyLn, "BenchmarkProxy", proxy.serveConn, nil, nil)
+	defer proxy.Close()
 
-func (s *completeHijacker) HijackResponse() io.Reader {
-	return nil
+	const idleClients = 1000
+	for i := 0; i < idleClients; i++ {
+		c, err := net.Dial("tcp", proxyLn.Addr().String())
+		if err != nil {
+			b.Fatalf("unexpected error: %s", err)
+		}
+		defer c.Close()
+	}
+
+	req := []byte("GET http://" + targetLn.Addr().String() + "/ HTTP/1.1\r\nHost: " +
+		targetLn.Addr().String() + "\r\n\r\n")
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		c, err := net.Dial("tcp", proxyLn.Addr().String())
+		if err != nil {
+			b.Errorf("unexpected error: %s", err)
+			return
+		}
+		defer c.Close()
+		br := bufio.NewReader(c)
+		for pb.Next() {
+			if _, err := c.Write(req); err != nil {
+				b.Errorf("unexpected error: %s", err)
+				return
+			}
+			for {
+				line, err := br.ReadSlice('\n')
+				if err != nil {
+					b.Errorf("unexpected error: %s", err)
+					return
+				}
+				if len(line) == 2 {
+					break
+				}
+			}
+			if _, err := br.Discard(2); err != nil {
+				b.Errorf("unexpected error: %s", err)
+				return
+			}
+		}
+	})
 }
 
-func (s *completeHijacker) OnResponse(respLine http.ResponseLine,
-	header http.Header, rawHeader []byte) io.Writer {
-	return bResp
+func TestACLResolvedDestination(t *testing.T) {
+	target, s := startTarget(t, func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		w.Write([]byte("ok"))
+	})
+	defer s.Close()
+	u, _ := url.Parse(target)
+	// localhost is only resolved by the hosts file
+	resolver := &net.Resolver{PreferGo: true, Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+		return nil, errors.New("no name server")
+	}}
+	testACL := func(rule *acl.DestinationRule, defaultAction acl.Action, expStatusCode int, expDialed string) {
+		a := &acl.ACL{
+			DestinationRules:         []*acl.DestinationRule{rule},
+			DefaultDestinationAction: defaultAction,
+			Resolver:                 resolver,
+		}
+		if err := a.Compile(); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		var dialed string
+		proxy := &Proxy{ACL: a, Dial: func(addr string) (net.Conn, error) {
+			dialed = addr
+			return net.Dial("tcp", addr)
+		}}
+		go proxy.serve(ln, "TestProxy", proxy.serveConn, nil, nil)
+		defer proxy.Close()
+		proxyURL, _ := url.Parse("http://" + ln.Addr().String())
+		c := &nethttp.Client{
+			Transport: &nethttp.Transport{Proxy: nethttp.ProxyURL(proxyURL)},
+			Timeout:   10 * time.Second,
+		}
+		resp, err := c.Get("http://localhost:" + u.Port() + "/")
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != expStatusCode {
+			t.Fatalf("unexpected status code %d, expecting %d", resp.StatusCode, expStatusCode)
+		}
+		if dialed != expDialed {
+			t.Fatalf("unexpected address dialed %q, expecting %q", dialed, expDialed)
+		}
+	}
+	// the deny CIDR matches the resolved localhost
+	testACL(&acl.DestinationRule{Action: acl.ActionDeny, CIDRs: []string{"127.0.0.0/8"}},
+		acl.ActionAllow, nethttp.StatusForbidden, "")
+	// the target is dialed with the IP checked rather than resolved again
+	testACL(&acl.DestinationRule{Action: acl.ActionAllow, CIDRs: []string{"127.0.0.0/8"}},
+		acl.ActionDeny, nethttp.StatusOK, "127.0.0.1:"+u.Port())
 }
@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+
+	"github.com/haxii/fastproxy/http"
+	"github.com/haxii/fastproxy/upstream"
+)
+
+var (
+	errNoReverseRoute    = errors.New("no route matched")
+	errNoUpstreamAvail   = errors.New("no upstream available")
+	reverseNoRouteMsg    = "No route matched.\n"
+	reverseNoUpstreamMsg = "No upstream available.\n"
+)
+
+// routeReverseRequest routes the origin-form request to an upstream picked
+// from the matched pool, then appends the `X-Forwarded-*` headers.
+// The status code and message should be responded if any error returned
+func (p *Proxy) routeReverseRequest(c net.Conn, req *Request) (int, string, error) {
+	if err := req.peekRawHeader(); err != nil {
+		return http.StatusBadRequest, "Bad Request.\n", err
+	}
+	host := req.header.Host()
+	route := p.ReverseRouter.Match(host, req.PathWithQueryFragment())
+	if route == nil || route.Pool == nil {
+		return http.StatusNotFound, reverseNoRouteMsg, errNoReverseRoute
+	}
+
+	pool := route.Pool
+	clientIP := addrIP(c.RemoteAddr())
+	u := pool.Pick(clientIP, func(u *upstream.Upstream) int {
+		return p.client.PendingRequests(u.Addr, pool.TLS)
+	})
+	if u == nil {
+		return http.StatusBadGateway, reverseNoUpstreamMsg, errNoUpstreamAvail
+	}
+	req.reqLine.ChangeHost(u.Addr)
+	if len(req.reqLine.HostInfo().HostWithPort()) == 0 {
+		return http.StatusBadGateway, reverseNoUpstreamMsg, errNoUpstreamAvail
+	}
+	if pool.TLS {
+		req.SetTLS(pool.ServerName(u))
+	}
+	req.upstreamPool = pool
+	req.upstream = u
+
+	if err := appendForwardedHeaders(req, clientIP, host); err != nil {
+		return http.StatusBadRequest, "Bad Request.\n", err
+	}
+	return 0, "", nil
+}
+
+// appendForwardedHeaders sets the `X-Forwarded-*` headers of the header, the client IP
+// is appended to the existing X-Forwarded-For list to keep the proxies before
+func appendForwardedHeaders(req *Request, clientIP string, host []byte) error {
+	if _, err := req.fields.Parse(req.rawHeader); err != nil {
+		return err
+	}
+	forwardedFor := make([]byte, 0, 64)
+	req.fields.VisitValues("X-Forwarded-For", func(value []byte) {
+		if len(value) > 0 {
+			forwardedFor = append(append(forwardedFor, value...), ", "...)
+		}
+	})
+	forwardedFor = append(forwardedFor, clientIP...)
+	req.fields.SetBytes("X-Forwarded-For", forwardedFor)
+	if len(host) > 0 {
+		req.fields.SetBytes("X-Forwarded-Host", host)
+	} else {
+		req.fields.Del("X-Forwarded-Host")
+	}
+	req.fields.Set("X-Forwarded-Proto", "http")
+	req.rawHeader = req.fields.AppendBytes(make([]byte, 0, len(req.rawHeader)+len(clientIP)+len(host)+64))
+	return nil
+}
+
+// markUpstream records the result of the reverse request for passive health checking,
+// the upstream fails if no response received from it, the failures after the request
+// is canceled, e.g. the client has gone, are not recorded
+func (r *Request) markUpstream(resp *Response, err error) {
+	if r.upstream == nil || r.Context().Err() != nil {
+		return
+	}
+	if err != nil && resp.respLine.GetStatusCode() == 0 {
+		r.upstreamPool.MarkFailed(r.upstream)
+		return
+	}
+	r.upstreamPool.MarkSucceeded(r.upstream)
+}
+
+func addrIP(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	nethttp "net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/haxii/fastproxy/upstream"
+)
+
+// startReverseProxy serves a reverse proxy routing all the requests to pool
+func startReverseProxy(t *testing.T, pool *upstream.Pool) (string, *Proxy) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	proxy := &Proxy{ReverseRouter: &upstream.Router{Routes: []*upstream.Route{{Pool: pool}}}}
+	go proxy.serve(ln, "TestReverseProxy", proxy.serveConn, nil, nil)
+	return ln.Addr().String(), proxy
+}
+
+func TestReverseForwardedHeaders(t *testing.T) {
+	target, s := startTarget(t, func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		fmt.Fprintf(w, "%q %q %q", r.Header["X-Forwarded-For"],
+			r.Header["X-Forwarded-Host"], r.Header["X-Forwarded-Proto"])
+	})
+	defer s.Close()
+	u, _ := url.Parse(target)
+	addr, proxy := startReverseProxy(t, upstream.NewPool(upstream.BalanceRoundRobin, u.Host))
+	defer proxy.Close()
+
+	testForwardedHeaders := func(reqHeader, expResult string) {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		defer c.Close()
+		fmt.Fprintf(c, "GET / HTTP/1.1\r\nHost: example.com\r\n%sConnection: close\r\n\r\n", reqHeader)
+		resp, err := nethttp.ReadResponse(bufio.NewReader(c), nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		defer resp.Body.Close()
+		var body strings.Builder
+		bufio.NewReader(resp.Body).WriteTo(&body)
+		if body.String() != expResult {
+			t.Fatalf("unexpected forwarded headers %s, expecting %s", body.String(), expResult)
+		}
+	}
+	testForwardedHeaders("", `["127.0.0.1"] ["example.com"] ["http"]`)
+	// the client IP is appended to the list, the others are replaced
+	testForwardedHeaders("X-Forwarded-For: 10.0.0.1\r\nX-Forwarded-For: 10.0.0.2, 10.0.0.3\r\n"+
+		"X-Forwarded-Host: evil.com\r\nX-Forwarded-Proto: https\r\n",
+		`["10.0.0.1, 10.0.0.2, 10.0.0.3, 127.0.0.1"] ["example.com"] ["http"]`)
+}
+
+func TestReverseClientGoneNotMarkUpstream(t *testing.T) {
+	received := make(chan struct{}, 1)
+	target, s := startTarget(t, func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		received <- struct{}{}
+		time.Sleep(500 * time.Millisecond)
+	})
+	defer s.Close()
+	u, _ := url.Parse(target)
+	pool := upstream.NewPool(upstream.BalanceRoundRobin, u.Host)
+	pool.MaxFails = 1
+	addr, proxy := startReverseProxy(t, pool)
+	defer proxy.Close()
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	fmt.Fprintf(c, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	<-received
+	// the client hangs up before the upstream responds
+	c.Close()
+	time.Sleep(100 * time.Millisecond)
+	if pool.Upstreams[0].IsEjected() {
+		t.Fatalf("upstream should not be ejected for the client gone")
+	}
+}
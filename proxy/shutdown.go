@@ -0,0 +1,163 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/haxii/fastproxy/server"
+)
+
+// DefaultShutdownTunnelGracePeriod used when ShutdownTunnelGracePeriod not set
+var DefaultShutdownTunnelGracePeriod = time.Second * 5
+
+// shutdownPollInterval how often the connections are checked during shutdown
+const shutdownPollInterval = 100 * time.Millisecond
+
+// connState the state of a client connection
+type connState int32
+
+const (
+	// connStateActive the connection is serving a request
+	connStateActive connState = iota
+	// connStateIdle the connection is waiting for the next request
+	connStateIdle
+	// connStateTunnel the connection is taken over by a tunnel or an upgraded protocol
+	connStateTunnel
+)
+
+// clientConn a client connection tracked by proxy
+type clientConn struct {
+	conn net.Conn
+
+	// ctx the context of the connection, cancelled when the connection
+	// is served or the proxy is closed
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	state int32
+}
+
+func (cc *clientConn) setState(state connState) {
+	atomic.StoreInt32(&cc.state, int32(state))
+}
+
+func (cc *clientConn) getState() connState {
+	return connState(atomic.LoadInt32(&cc.state))
+}
+
+// trackConn tracks the client connection until untrackConn called
+func (p *Proxy) trackConn(c net.Conn) *clientConn {
+	ctx, cancel := context.WithCancel(p.ctx)
+	cc := &clientConn{conn: c, ctx: ctx, cancel: cancel}
+	p.connsLock.Lock()
+	if p.conns == nil {
+		p.conns = make(map[*clientConn]struct{})
+	}
+	p.conns[cc] = struct{}{}
+	p.connsLock.Unlock()
+	return cc
+}
+
+// untrackConn stops tracking the client connection and cancels its context
+func (p *Proxy) untrackConn(cc *clientConn) {
+	cc.cancel()
+	p.connsLock.Lock()
+	delete(p.conns, cc)
+	p.connsLock.Unlock()
+}
+
+// isShuttingDown if the proxy is shutting down, the client connections
+// are closed after the response being served
+func (p *Proxy) isShuttingDown() bool {
+	return atomic.LoadInt32(&p.shuttingDown) != 0
+}
+
+// Shutdown gracefully shuts down the proxy without interrupting the requests
+// being served. The listeners are closed firstly, then the idle connections are
+// closed, the keep-alive connections are closed after the response being served,
+// which is sent with `Connection: close`, and the tunnels are closed after
+// ShutdownTunnelGracePeriod.
+//
+// Shutdown returns when all the connections are closed or ctx is done, in the latter
+// case the remaining connections are closed and ctx.Err() is returned.
+// The proxy can not serve again after shut down.
+func (p *Proxy) Shutdown(ctx context.Context) error {
+	p.init()
+	atomic.StoreInt32(&p.shuttingDown, 1)
+	p.serversLock.Lock()
+	servers := p.servers
+	p.servers = nil
+	adminServers := p.adminServers
+	p.adminServers = nil
+	p.serversLock.Unlock()
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(servers))
+	for i, s := range servers {
+		wg.Add(1)
+		go func(i int, s *server.Server) {
+			errs[i] = s.Shutdown(ctx)
+			wg.Done()
+		}(i, s)
+	}
+	err := p.drainConns(ctx)
+	wg.Wait()
+	// cancel the requests left
+	p.cancel()
+	// the metrics are available until drained
+	for _, s := range adminServers {
+		s.Close()
+	}
+	if err != nil {
+		return err
+	}
+	for _, e := range errs {
+		if e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// drainConns closes the idle connections until all the connections are
+// closed, the tunnels are closed after ShutdownTunnelGracePeriod
+func (p *Proxy) drainConns(ctx context.Context) error {
+	tunnelDeadline := time.Now().Add(p.ShutdownTunnelGracePeriod)
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		closeTunnels := !time.Now().Before(tunnelDeadline)
+		if p.closeConns(closeTunnels) == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// closeConns closes the idle connections, as well as the tunnels if closeTunnels
+// is set, returns the number of connections left
+func (p *Proxy) closeConns(closeTunnels bool) int {
+	p.connsLock.Lock()
+	defer p.connsLock.Unlock()
+	for cc := range p.conns {
+		switch cc.getState() {
+		case connStateIdle:
+			cc.conn.Close()
+			delete(p.conns, cc)
+		case connStateTunnel:
+			if closeTunnels {
+				cc.cancel()
+				cc.conn.Close()
+				delete(p.conns, cc)
+			}
+		}
+	}
+	return len(p.conns)
+}
@@ -0,0 +1,337 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/haxii/fastproxy/auth"
+	"github.com/haxii/fastproxy/http"
+	"github.com/haxii/fastproxy/servertime"
+	"github.com/haxii/fastproxy/transport"
+	"github.com/haxii/fastproxy/util"
+)
+
+// SOCKS5 server side protocol, see RFC 1928 and RFC 1929
+const socks5Version = 5
+
+const (
+	socks5AuthNone         = 0
+	socks5AuthPassword     = 2
+	socks5AuthNoAcceptable = 0xff
+)
+
+const (
+	socks5PasswordVersion = 1
+	socks5PasswordSuccess = 0
+	socks5PasswordFailure = 1
+)
+
+const socks5Connect = 1
+
+const (
+	socks5IP4    = 1
+	socks5Domain = 3
+	socks5IP6    = 4
+)
+
+// SOCKS5 reply codes
+const (
+	socks5ReplySucceeded           = 0
+	socks5ReplyGeneralFailure      = 1
+	socks5ReplyNotAllowed          = 2
+	socks5ReplyNetworkUnreachable  = 3
+	socks5ReplyHostUnreachable     = 4
+	socks5ReplyConnectionRefused   = 5
+	socks5ReplyCommandNotSupported = 7
+	socks5ReplyAddrNotSupported    = 8
+)
+
+var (
+	errSOCKS5Version           = errors.New("unsupported SOCKS version")
+	errSOCKS5NoAcceptableAuth  = errors.New("no acceptable SOCKS5 authentication method")
+	errSOCKS5AuthFailed        = errors.New("SOCKS5 username/password authentication failed")
+	errSOCKS5CommandNotSupport = errors.New("unsupported SOCKS5 command")
+	errSOCKS5AddrNotSupport    = errors.New("unsupported SOCKS5 address type")
+)
+
+// ServeSOCKS5 serve SOCKS5 clients on the provided ip address.
+//
+// CONNECT requests of SOCKS5 clients go through the same hijacker chain as
+// the HTTPS tunnels, SSL bump is also available. If Authenticator is set,
+// it must implement auth.PasswordVerifier to verify the SOCKS5 username
+// and password, otherwise all the SOCKS5 clients are declined.
+func (p *Proxy) ServeSOCKS5(network, addr string) error {
+	ln, lnErr := net.Listen(network, addr)
+	if lnErr != nil {
+		return lnErr
+	}
+	return p.serve(ln, "ProxySOCKS5", p.serveSOCKS5, nil, nil)
+}
+
+func (p *Proxy) serveSOCKS5(c net.Conn) error {
+	cc := p.trackConn(c)
+	defer p.untrackConn(cc)
+	reader := p.bufioPool.AcquireReader(c)
+	defer p.bufioPool.ReleaseReader(reader)
+	return p.serveSOCKS5Conn(cc, reader)
+}
+
+// serveSOCKS5Conn serves a SOCKS5 client connection cc, reader is the buffered
+// reader of the connection
+func (p *Proxy) serveSOCKS5Conn(cc *clientConn, reader *bufio.Reader) error {
+	c := cc.conn
+	if p.ServerReadTimeout > 0 {
+		if _, err := p.updateReadDeadline(c, servertime.CoarseTimeNow(), zeroTime); err != nil {
+			return err
+		}
+	}
+	if p.ServerWriteTimeout > 0 {
+		if _, err := p.updateWriteDeadline(c, servertime.CoarseTimeNow(), zeroTime); err != nil {
+			return err
+		}
+	}
+
+	username, err := p.socks5Handshake(c, reader)
+	if err != nil {
+		if err == errSOCKS5AuthFailed || err == errSOCKS5NoAcceptableAuth {
+			// the client is declined, same as the 407 response of http
+			return nil
+		}
+		return err
+	}
+	hostWithPort, err := readSOCKS5ConnectRequest(c, reader)
+	if err != nil {
+		return err
+	}
+	// the handshake is done, clear its deadlines before the long-lived tunnel
+	if err = c.SetDeadline(zeroTime); err != nil {
+		return util.ErrWrapper(err, "fail to clear deadline of SOCKS5 connection")
+	}
+
+	// make a CONNECT request for the SOCKS5 connection
+	connectReader := p.bufioPool.AcquireReader(bytes.NewReader(makeConnectRequest(hostWithPort)))
+	defer p.bufioPool.ReleaseReader(connectReader)
+	req := p.reqPool.Acquire()
+	defer p.reqPool.Release(req)
+	if _, err = req.parseStartLine(connectReader); err != nil {
+		writeSOCKS5Reply(c, socks5ReplyAddrNotSupported)
+		return err
+	}
+	req.username = username
+	req.isSOCKS5 = true
+	req.clientConn = cc
+	req.setContext(p.requestContext(cc.ctx, true))
+
+	// data may be already buffered by the reader, e.g. the TLS client hello
+	err = p.do(&bufferedConn{Conn: c, reader: reader}, req)
+	if err != nil && err != io.EOF {
+		return util.ErrWrapper(err, "proxy error with SOCKS5 target "+hostWithPort)
+	}
+	return nil
+}
+
+// socks5Handshake negotiates the authentication method then authenticates
+// the client, returns the authenticated user name
+func (p *Proxy) socks5Handshake(c net.Conn, reader *bufio.Reader) (string, error) {
+	var buf [255]byte
+	// version & methods
+	if _, err := io.ReadFull(reader, buf[:2]); err != nil {
+		return "", util.ErrWrapper(err, "fail to read SOCKS5 greeting")
+	}
+	if buf[0] != socks5Version {
+		return "", errSOCKS5Version
+	}
+	methods := buf[:buf[1]]
+	if _, err := io.ReadFull(reader, methods); err != nil {
+		return "", util.ErrWrapper(err, "fail to read SOCKS5 authentication methods")
+	}
+
+	var verifier auth.PasswordVerifier
+	method := byte(socks5AuthNoAcceptable)
+	if p.Authenticator == nil {
+		if bytes.IndexByte(methods, socks5AuthNone) >= 0 {
+			method = socks5AuthNone
+		}
+	} else if v, ok := p.Authenticator.(auth.PasswordVerifier); ok {
+		if bytes.IndexByte(methods, socks5AuthPassword) >= 0 {
+			verifier = v
+			method = socks5AuthPassword
+		}
+	}
+	if _, err := util.WriteWithValidation(c, []byte{socks5Version, method}); err != nil {
+		return "", util.ErrWrapper(err, "fail to write SOCKS5 authentication method")
+	}
+	switch method {
+	case socks5AuthNone:
+		return "", nil
+	case socks5AuthNoAcceptable:
+		return "", errSOCKS5NoAcceptableAuth
+	}
+
+	// username & password, see RFC 1929
+	if _, err := io.ReadFull(reader, buf[:2]); err != nil {
+		return "", util.ErrWrapper(err, "fail to read SOCKS5 username")
+	}
+	if buf[0] != socks5PasswordVersion {
+		return "", errSOCKS5AuthFailed
+	}
+	usernameBytes := buf[:buf[1]]
+	if _, err := io.ReadFull(reader, usernameBytes); err != nil {
+		return "", util.ErrWrapper(err, "fail to read SOCKS5 username")
+	}
+	username := string(usernameBytes)
+	if _, err := io.ReadFull(reader, buf[:1]); err != nil {
+		return "", util.ErrWrapper(err, "fail to read SOCKS5 password")
+	}
+	passwordBytes := buf[:buf[0]]
+	if _, err := io.ReadFull(reader, passwordBytes); err != nil {
+		return "", util.ErrWrapper(err, "fail to read SOCKS5 password")
+	}
+	password := string(passwordBytes)
+
+	if !verifier.Verify(username, password) {
+		util.WriteWithValidation(c, []byte{socks5PasswordVersion, socks5PasswordFailure})
+		return "", errSOCKS5AuthFailed
+	}
+	if _, err := util.WriteWithValidation(c, []byte{socks5PasswordVersion, socks5PasswordSuccess}); err != nil {
+		return "", util.ErrWrapper(err, "fail to write SOCKS5 authentication result")
+	}
+	return username, nil
+}
+
+// readSOCKS5ConnectRequest reads the SOCKS5 request and returns the target
+// host with port, only the CONNECT command is supported
+func readSOCKS5ConnectRequest(c net.Conn, reader *bufio.Reader) (string, error) {
+	var buf [255]byte
+	if _, err := io.ReadFull(reader, buf[:4]); err != nil {
+		return "", util.ErrWrapper(err, "fail to read SOCKS5 request")
+	}
+	if buf[0] != socks5Version {
+		return "", errSOCKS5Version
+	}
+	if buf[1] != socks5Connect {
+		writeSOCKS5Reply(c, socks5ReplyCommandNotSupported)
+		return "", errSOCKS5CommandNotSupport
+	}
+
+	var host string
+	switch buf[3] {
+	case socks5IP4, socks5IP6:
+		ipLen := net.IPv4len
+		if buf[3] == socks5IP6 {
+			ipLen = net.IPv6len
+		}
+		if _, err := io.ReadFull(reader, buf[:ipLen]); err != nil {
+			return "", util.ErrWrapper(err, "fail to read SOCKS5 target address")
+		}
+		host = net.IP(buf[:ipLen]).String()
+	case socks5Domain:
+		if _, err := io.ReadFull(reader, buf[:1]); err != nil {
+			return "", util.ErrWrapper(err, "fail to read SOCKS5 target domain length")
+		}
+		domain := buf[:buf[0]]
+		if _, err := io.ReadFull(reader, domain); err != nil {
+			return "", util.ErrWrapper(err, "fail to read SOCKS5 target domain")
+		}
+		if !isValidSOCKS5Domain(domain) {
+			writeSOCKS5Reply(c, socks5ReplyAddrNotSupported)
+			return "", errSOCKS5AddrNotSupport
+		}
+		host = string(domain)
+	default:
+		writeSOCKS5Reply(c, socks5ReplyAddrNotSupported)
+		return "", errSOCKS5AddrNotSupport
+	}
+	if _, err := io.ReadFull(reader, buf[:2]); err != nil {
+		return "", util.ErrWrapper(err, "fail to read SOCKS5 target port")
+	}
+	port := int(buf[0])<<8 | int(buf[1])
+	return net.JoinHostPort(host, strconv.Itoa(port)), nil
+}
+
+// isValidSOCKS5Domain tells if the domain can be put into the CONNECT request,
+// which must be non-empty and without spaces or control bytes
+func isValidSOCKS5Domain(domain []byte) bool {
+	if len(domain) == 0 {
+		return false
+	}
+	for _, b := range domain {
+		if b <= ' ' || b == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// makeConnectRequest makes a http CONNECT request to the target
+func makeConnectRequest(hostWithPort string) []byte {
+	return []byte("CONNECT " + hostWithPort + " HTTP/1.1\r\n\r\n")
+}
+
+// writeSOCKS5Reply writes the SOCKS5 reply with an unspecified bound address
+func writeSOCKS5Reply(w io.Writer, replyCode byte) error {
+	_, err := util.WriteWithValidation(w, []byte{socks5Version, replyCode, 0, /* reserved */
+		socks5IP4, 0, 0, 0, 0 /* address */, 0, 0 /* port */})
+	return err
+}
+
+// sendSOCKS5TunnelMessage is the SOCKS5 version of sendTunnelMessage
+func sendSOCKS5TunnelMessage(c net.Conn, fail error) (int, error) {
+	if fail != nil {
+		if err := writeSOCKS5Reply(c, socks5ReplyCodeFromError(fail)); err != nil {
+			return 0, util.ErrWrapper(fail, "fail to write error message to client with error %s", err)
+		}
+		return 0, fail
+	}
+	if err := writeSOCKS5Reply(c, socks5ReplySucceeded); err != nil {
+		return 0, err
+	}
+	return 10, nil
+}
+
+func socks5ReplyCodeFromStatus(statusCode int) byte {
+	switch statusCode {
+	case http.StatusForbidden, http.StatusProxyAuthRequired, http.StatusBadGateway:
+		return socks5ReplyNotAllowed
+	}
+	return socks5ReplyGeneralFailure
+}
+
+// socks5ReplyCodeFromError the reply code of the tunnel failure, which is told by
+// the errno of the dialing failure, then by the transport.ErrorKind
+func socks5ReplyCodeFromError(err error) byte {
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		switch errno {
+		case syscall.ECONNREFUSED:
+			return socks5ReplyConnectionRefused
+		case syscall.ENETUNREACH:
+			return socks5ReplyNetworkUnreachable
+		case syscall.EHOSTUNREACH:
+			return socks5ReplyHostUnreachable
+		}
+	}
+	switch transport.KindOf(err) {
+	case transport.ErrorKindDNS, transport.ErrorKindTimeout:
+		return socks5ReplyHostUnreachable
+	}
+	return socks5ReplyGeneralFailure
+}
+
+// bufferedConn is a net.Conn which reads from the buffered reader of the conn
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+var zeroTime time.Time
@@ -0,0 +1,173 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/haxii/fastproxy/auth"
+)
+
+// startSOCKS5Conn serves a SOCKS5 client connection over a pipe, returns the
+// client side of the pipe
+func startSOCKS5Conn(proxy *Proxy) net.Conn {
+	proxy.init()
+	c, s := net.Pipe()
+	go func() {
+		defer s.Close()
+		proxy.serveSOCKS5(s)
+	}()
+	return c
+}
+
+// socks5Exchange writes the message to c then reads the expected length of reply
+func socks5Exchange(t *testing.T, c net.Conn, message []byte, replyLen int) []byte {
+	if _, err := c.Write(message); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	reply := make([]byte, replyLen)
+	if _, err := io.ReadFull(c, reply); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	return reply
+}
+
+// socks5ConnectIP4 makes a CONNECT request to the IPv4 address addr
+func socks5ConnectIP4(addr string) []byte {
+	host, portStr, _ := net.SplitHostPort(addr)
+	port, _ := strconv.Atoi(portStr)
+	req := []byte{socks5Version, socks5Connect, 0, socks5IP4}
+	req = append(req, net.ParseIP(host).To4()...)
+	return append(req, byte(port>>8), byte(port))
+}
+
+func TestSOCKS5Greeting(t *testing.T) {
+	c := startSOCKS5Conn(&Proxy{})
+	defer c.Close()
+	reply := socks5Exchange(t, c, []byte{socks5Version, 2, socks5AuthPassword, socks5AuthNone}, 2)
+	if !bytes.Equal(reply, []byte{socks5Version, socks5AuthNone}) {
+		t.Fatalf("unexpected greeting reply %v", reply)
+	}
+
+	// password is required by the authenticator
+	c = startSOCKS5Conn(&Proxy{Authenticator: auth.NewBasic("", auth.NewMemoryStore(nil))})
+	defer c.Close()
+	reply = socks5Exchange(t, c, []byte{socks5Version, 1, socks5AuthNone}, 2)
+	if !bytes.Equal(reply, []byte{socks5Version, socks5AuthNoAcceptable}) {
+		t.Fatalf("unexpected greeting reply %v", reply)
+	}
+}
+
+func TestSOCKS5PasswordAuth(t *testing.T) {
+	proxy := &Proxy{Authenticator: auth.NewBasic("",
+		auth.NewMemoryStore(map[string]string{"user": "pass"}))}
+	testPasswordAuth := func(username, password string, expStatus byte) net.Conn {
+		c := startSOCKS5Conn(proxy)
+		reply := socks5Exchange(t, c, []byte{socks5Version, 1, socks5AuthPassword}, 2)
+		if !bytes.Equal(reply, []byte{socks5Version, socks5AuthPassword}) {
+			t.Fatalf("unexpected greeting reply %v", reply)
+		}
+		req := []byte{socks5PasswordVersion, byte(len(username))}
+		req = append(req, username...)
+		req = append(req, byte(len(password)))
+		req = append(req, password...)
+		reply = socks5Exchange(t, c, req, 2)
+		if !bytes.Equal(reply, []byte{socks5PasswordVersion, expStatus}) {
+			t.Fatalf("unexpected authentication reply %v", reply)
+		}
+		return c
+	}
+	testPasswordAuth("user", "wrong", socks5PasswordFailure).Close()
+	c := testPasswordAuth("user", "pass", socks5PasswordSuccess)
+	defer c.Close()
+
+	// the authenticated client goes on with its request
+	reply := socks5Exchange(t, c, []byte{socks5Version, 2 /* BIND */, 0, socks5IP4, 127, 0, 0, 1, 0, 80}, 10)
+	if reply[1] != socks5ReplyCommandNotSupported {
+		t.Fatalf("unexpected reply code %d", reply[1])
+	}
+}
+
+func TestSOCKS5Connect(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	closed.Close()
+
+	proxy := &Proxy{ServerReadTimeout: 3 * time.Second, ServerWriteTimeout: 3 * time.Second}
+	connect := func(req []byte, expReplyCode byte) net.Conn {
+		c := startSOCKS5Conn(proxy)
+		socks5Exchange(t, c, []byte{socks5Version, 1, socks5AuthNone}, 2)
+		reply := socks5Exchange(t, c, req, 10)
+		if reply[0] != socks5Version || reply[1] != expReplyCode {
+			t.Fatalf("unexpected reply %v, expecting reply code %d", reply, expReplyCode)
+		}
+		return c
+	}
+
+	// data is relayed once the tunnel made, which outlives the handshake deadlines
+	c := connect(socks5ConnectIP4(ln.Addr().String()), socks5ReplySucceeded)
+	defer c.Close()
+	time.Sleep(3 * time.Second)
+	if echo := socks5Exchange(t, c, []byte("hello"), 5); string(echo) != "hello" {
+		t.Fatalf("unexpected data relayed %q", echo)
+	}
+
+	connect(socks5ConnectIP4(closed.Addr().String()), socks5ReplyConnectionRefused).Close()
+	connect([]byte{socks5Version, 3 /* UDP ASSOCIATE */, 0, socks5IP4, 127, 0, 0, 1, 0, 80},
+		socks5ReplyCommandNotSupported).Close()
+	connect([]byte{socks5Version, socks5Connect, 0, 2 /* unknown */}, socks5ReplyAddrNotSupported).Close()
+	// the domains are put into the CONNECT request, which must not be malformed
+	for _, domain := range []string{"", "example.com HTTP/1.1\r\nHost:", "example.com\x00"} {
+		req := []byte{socks5Version, socks5Connect, 0, socks5Domain, byte(len(domain))}
+		req = append(req, domain...)
+		connect(append(req, 0, 80), socks5ReplyAddrNotSupported).Close()
+	}
+}
+
+func TestSOCKS5ReplyCodeFromError(t *testing.T) {
+	dialError := func(errno syscall.Errno) error {
+		return &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", errno)}
+	}
+	for _, test := range []struct {
+		err          error
+		expReplyCode byte
+	}{
+		{dialError(syscall.ECONNREFUSED), socks5ReplyConnectionRefused},
+		{dialError(syscall.ENETUNREACH), socks5ReplyNetworkUnreachable},
+		{dialError(syscall.EHOSTUNREACH), socks5ReplyHostUnreachable},
+		{fmt.Errorf("fail to dial: %w", dialError(syscall.ECONNREFUSED)), socks5ReplyConnectionRefused},
+		{&net.DNSError{Err: "no such host"}, socks5ReplyHostUnreachable},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: os.ErrDeadlineExceeded}, socks5ReplyHostUnreachable},
+		{errors.New("connection refused"), socks5ReplyGeneralFailure},
+	} {
+		if code := socks5ReplyCodeFromError(test.err); code != test.expReplyCode {
+			t.Fatalf("unexpected reply code %d of error %s, expecting %d", code, test.err, test.expReplyCode)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"net"
+
+	"github.com/haxii/fastproxy/superproxy"
+	"github.com/haxii/fastproxy/transport"
+)
+
+// setSuperProxy sets the super proxy of the request made by c, the hijacker's is
+// preferred, then SuperProxy, then the one picked from SuperProxyPool by the client IP
+func (p *Proxy) setSuperProxy(c net.Conn, req *Request) error {
+	if req.upstream != nil {
+		// reverse proxy requests are made to the upstreams directly
+		return req.makeDNSLookUpAndSetSuperProxy(nil)
+	}
+	if err := req.makeDNSLookUpAndSetSuperProxy(p.SuperProxy); err != nil {
+		return err
+	}
+	if req.proxy != nil || p.SuperProxyPool == nil {
+		return nil
+	}
+	sp := p.SuperProxyPool.Pick(addrIP(c.RemoteAddr()))
+	if sp == nil {
+		return superproxy.ErrNoSuperProxyAvail
+	}
+	req.SetProxy(sp)
+	return nil
+}
+
+// isSuperProxyFailure if the failure is made by the super proxy rather than the target,
+// the failures after the request is canceled are excluded
+func (r *Request) isSuperProxyFailure(err error) bool {
+	if err == nil || r.Context().Err() != nil {
+		return false
+	}
+	switch transport.KindOf(err) {
+	case transport.ErrorKindDial, transport.ErrorKindDNS, transport.ErrorKindTLSHandshake,
+		transport.ErrorKindTimeout, transport.ErrorKindSuperProxyAuth:
+		return true
+	}
+	return false
+}
+
+// markSuperProxy records the result of the request for the pool
+// the super proxy picked from, the super proxy fails if it made err
+func (r *Request) markSuperProxy(err error) {
+	if r.proxy == nil {
+		return
+	}
+	pool := r.proxy.Pool()
+	if pool == nil {
+		return
+	}
+	if r.isSuperProxyFailure(err) {
+		pool.MarkFailed(r.proxy)
+		return
+	}
+	if err == nil {
+		pool.MarkSucceeded(r.proxy)
+	}
+}
+
+// retrySuperProxy switches the request to another member of the pool after
+// the super proxy failed with fail, tried are the super proxies failed before,
+// returns false if there is nothing to retry with
+func (r *Request) retrySuperProxy(c net.Conn, fail error, tried []*superproxy.SuperProxy) bool {
+	if r.proxy == nil || !r.isSuperProxyFailure(fail) {
+		return false
+	}
+	pool := r.proxy.Pool()
+	if pool == nil || len(tried) > pool.RetryLimit() {
+		return false
+	}
+	next := pool.PickExcept(addrIP(c.RemoteAddr()), tried)
+	if next == nil {
+		return false
+	}
+	if err := next.AcquireToken(r.Context()); err != nil {
+		return false
+	}
+	r.proxy.PushBackToken()
+	r.SetProxy(next)
+	return true
+}
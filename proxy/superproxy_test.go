@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net"
+	nethttp "net/http"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/haxii/fastproxy/superproxy"
+	"github.com/haxii/fastproxy/transport"
+)
+
+func TestSuperProxyPoolWithHijacker(t *testing.T) {
+	// the super proxy answers the requests itself
+	superProxyURL, s := startTarget(t, func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		w.Write([]byte("super proxy " + r.URL.String()))
+	})
+	defer s.Close()
+	u, _ := url.Parse(superProxyURL)
+	port, _ := strconv.Atoi(u.Port())
+	sp, err := superproxy.NewSuperProxy(u.Hostname(), uint16(port), superproxy.ProxyTypeHTTP, "", "", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	pool := superproxy.NewPool(superproxy.StrategyRoundRobin, sp)
+	pool.FailTimeout = time.Hour
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	proxy := &Proxy{
+		SuperProxyPool: pool,
+		HijackerPool: hijackerPoolFunc(func(host, port string) Hijacker {
+			return &simpleHijacker{nopHijacker{host: host, port: port}}
+		}),
+	}
+	go proxy.serve(ln, "TestProxy", proxy.serveConn, nil, nil)
+	defer proxy.Close()
+	proxyURL, _ := url.Parse("http://" + ln.Addr().String())
+	c := &nethttp.Client{
+		Transport: &nethttp.Transport{Proxy: nethttp.ProxyURL(proxyURL)},
+		Timeout:   10 * time.Second,
+	}
+
+	// the pool is used when the hijacker returns no super proxy
+	resp, err := c.Get("http://example.com/pool")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(body) != "super proxy http://example.com/pool" {
+		t.Fatalf("request should be made with the super proxy of the pool, got %q", body)
+	}
+
+	// service unavailable if none of the members available
+	for i := 0; i < superproxy.DefaultPoolMaxFails; i++ {
+		pool.MarkFailed(sp)
+	}
+	resp, err = c.Get("http://example.com/pool")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != nethttp.StatusServiceUnavailable {
+		t.Fatalf("unexpected status code %d, expecting 503", resp.StatusCode)
+	}
+	if kind := resp.Header.Get(ErrorHeader); kind != transport.ErrorKindUnavailable.String() {
+		t.Fatalf("unexpected error kind %q", kind)
+	}
+}
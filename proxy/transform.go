@@ -0,0 +1,483 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+
+	"github.com/haxii/fastproxy/bytebufferpool"
+	"github.com/haxii/fastproxy/http"
+	"github.com/haxii/fastproxy/util"
+)
+
+// transformBufferSize the transformed body is buffered up to this size,
+// the body ends within it is sent with the `Content-Length` recomputed
+const transformBufferSize = 32 * 1024
+
+var crlf = []byte("\r\n")
+
+// transformFrom reads the rest of the response whose header of headerLen is
+// peeked in reader, then writes it to client with rawHeader and the body
+// transformed by transform.
+// The body is decoded according to the `Content-Encoding` before transforming
+// and encoded again after if decodeBody is set, the body of unsupported
+// encodings is not transformed.
+func (r *Response) transformFrom(reader *bufio.Reader, headerLen int, rawHeader []byte,
+	transform func(io.Reader) io.Reader, decodeBody bool) (int, error) {
+	var hijackerBodyWriter io.WriteCloser
+	if r.hijacker != nil {
+		hijackerBodyWriter = r.hijacker.OnResponse(r.respLine, r.header, rawHeader)
+	}
+	defer func() {
+		if hijackerBodyWriter != nil {
+			hijackerBodyWriter.Close()
+		}
+	}()
+	// the header is copied out of reader's buffer before reading the body,
+	// the framing fields are dropped since the body is re-framed
+	header := bytebufferpool.Get()
+	defer bytebufferpool.Put(header)
+	header.B = appendHeaderWithout(header.B, rawHeader, http.IsBodyFramingHeader)
+	if _, err := reader.Discard(headerLen); err != nil {
+		return 0, util.ErrWrapper(err, "fail to read raw headers")
+	}
+
+	r.bodyReader.Reset(reader, r.bodyType(), r.header.ContentLength())
+	var body io.Reader = &r.bodyReader
+	if hijackerBodyWriter != nil {
+		body = io.TeeReader(body, sniffWriter{hijackerBodyWriter})
+	}
+
+	buffer := bytebufferpool.Get()
+	defer bytebufferpool.Put(buffer)
+	f := &transformFramer{resp: r, header: header.B, buffer: buffer}
+	body, dst, err := decodeTransformBody(body, f, r.header.ContentEncoding(), decodeBody)
+	if err != nil {
+		return f.n, util.ErrWrapper(err, "fail to decode response body")
+	}
+	if body != nil {
+		body = transform(body)
+	} else {
+		// unsupported encoding, forward the body as is
+		body, dst = &r.bodyReader, f
+		if hijackerBodyWriter != nil {
+			body = io.TeeReader(body, sniffWriter{hijackerBodyWriter})
+		}
+	}
+	if _, err := io.Copy(dst, body); err != nil {
+		return f.n, util.ErrWrapper(err, "fail to transform response body")
+	}
+	if dst != f {
+		// flush the encoder
+		if err := dst.Close(); err != nil {
+			return f.n, util.ErrWrapper(err, "fail to encode response body")
+		}
+	}
+	if err := f.Close(); err != nil {
+		return f.n, util.ErrWrapper(err, "fail to write response body")
+	}
+	// the transformation may leave the body unread, which is discarded
+	// to make the target connection reusable
+	if _, err := io.Copy(ioutil.Discard, &r.bodyReader); err != nil {
+		return f.n, util.ErrWrapper(err, "fail to read response body")
+	}
+	r.onTrailers(r.bodyReader.Trailers())
+	return f.n, nil
+}
+
+// rewrite rewrites the status and the header if the hijacker asks,
+// returns the raw header to be sent to client
+func (r *Response) rewrite(rawHeader []byte) ([]byte, error) {
+	if _, err := r.fields.Parse(rawHeader); err != nil {
+		return rawHeader, util.ErrWrapper(err, "fail to parse response http header fields")
+	}
+	newStatusCode := r.hijacker.RewriteResponse(r.respLine, r.header, &r.fields)
+	statusCode := r.respLine.GetStatusCode()
+	if newStatusCode > 0 && newStatusCode != statusCode &&
+		!http.IsStatusInterim(newStatusCode) && newStatusCode != http.StatusSwitchingProtocols &&
+		statusCode != http.StatusSwitchingProtocols &&
+		statusHasBody(newStatusCode) == statusHasBody(statusCode) {
+		r.respLine.ChangeStatusCode(newStatusCode)
+	}
+	header := r.fields.AppendBytes(r.rewrittenHeader[:0])
+	r.rewrittenHeader = header
+	if bytes.Equal(header, rawHeader) {
+		return rawHeader, nil
+	}
+	// the framing and the connection fields of the target are kept,
+	// which tells how the body and the target connection are read
+	r.fields.Del("Content-Length")
+	r.fields.Del("Transfer-Encoding")
+	r.fields.Del("Connection")
+	header = r.fields.AppendBytes(header[:0])
+	header = appendHeaderWithout(header[:len(header)-len(crlf)], rawHeader, func(h []byte) bool {
+		return !http.IsBodyFramingHeader(h) && !http.IsConnectionHeader(h)
+	})
+	header = append(header, crlf...)
+	r.rewrittenHeader = header
+	if _, err := r.header.Parse(header); err != nil {
+		return rawHeader, util.ErrWrapper(err, "fail to parse rewritten response http headers")
+	}
+	return header, nil
+}
+
+// decodeTransformBody makes the decoded body reader and the encoder writing to
+// dst according to encoding, a nil body is returned if encoding is unsupported
+func decodeTransformBody(body io.Reader, dst io.WriteCloser,
+	encoding []byte, decodeBody bool) (io.Reader, io.WriteCloser, error) {
+	if !decodeBody {
+		return body, dst, nil
+	}
+	switch string(encoding) {
+	case "", "identity":
+		return body, dst, nil
+	case "gzip", "x-gzip":
+		gr, err := gzip.NewReader(body)
+		if err == io.EOF {
+			// empty body
+			return bytes.NewReader(nil), dst, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		return gr, gzip.NewWriter(dst), nil
+	case "deflate":
+		zr, err := zlib.NewReader(body)
+		if err == io.EOF {
+			return bytes.NewReader(nil), dst, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		return zr, zlib.NewWriter(dst), nil
+	}
+	return nil, nil, nil
+}
+
+// appendHeaderWithout appends the raw header without the fields matching skip
+// and the empty line ending it to dst
+func appendHeaderWithout(dst, rawHeader []byte, skip func(header []byte) bool) []byte {
+	for len(rawHeader) > 0 {
+		m := bytes.IndexByte(rawHeader, '\n')
+		if m < 0 {
+			m = len(rawHeader) - 1
+		}
+		line := rawHeader[:m+1]
+		rawHeader = rawHeader[m+1:]
+		if len(bytes.TrimSpace(line)) == 0 {
+			break
+		}
+		if !skip(line) {
+			dst = append(dst, line...)
+		}
+	}
+	return dst
+}
+
+// sniffWriter writes to the hijacker's body writer ignoring the errors
+type sniffWriter struct {
+	w io.Writer
+}
+
+func (s sniffWriter) Write(p []byte) (int, error) {
+	// the failure of the hijacker never breaks the response
+	_, _ = util.WriteWithValidation(s.w, p)
+	return len(p), nil
+}
+
+// transformFramer frames the transformed body, which is buffered until the
+// buffer is full. The header is written with the `Content-Length` of the whole
+// body if it ends before that, otherwise the body is sent chunked, or delimited
+// by closing the connection for HTTP/1.0 clients.
+type transformFramer struct {
+	resp   *Response
+	header []byte
+	buffer *bytebufferpool.ByteBuffer
+
+	isHeaderWritten bool
+	isChunked       bool
+	chunked         http.ChunkedWriter
+	// n bytes written to client
+	n int
+}
+
+func (f *transformFramer) Write(p []byte) (int, error) {
+	if !f.isHeaderWritten {
+		if f.buffer.Len()+len(p) <= transformBufferSize {
+			return f.buffer.Write(p)
+		}
+		if err := f.writeHeader(false); err != nil {
+			return 0, err
+		}
+		if _, err := f.writeBody(f.buffer.B); err != nil {
+			return 0, err
+		}
+		f.buffer.Reset()
+	}
+	return f.writeBody(p)
+}
+
+// Close writes the buffered body with the header, or ends the chunked body
+func (f *transformFramer) Close() error {
+	if !f.isHeaderWritten {
+		if err := f.writeHeader(true); err != nil {
+			return err
+		}
+		_, err := f.writeBody(f.buffer.B)
+		return err
+	}
+	if f.isChunked {
+		return f.chunked.Close()
+	}
+	return nil
+}
+
+func (f *transformFramer) writeHeader(isBodyEnded bool) error {
+	r := f.resp
+	switch {
+	case isBodyEnded:
+		f.header = append(f.header, "Content-Length: "...)
+		f.header = strconv.AppendInt(f.header, int64(f.buffer.Len()), 10)
+		f.header = append(f.header, "\r\n"...)
+	case !r.isClientHTTP10:
+		f.header = append(f.header, "Transfer-Encoding: chunked\r\n"...)
+		f.isChunked = true
+		f.chunked.Reset(countWriter{f})
+	default:
+		r.isClientBodyDelimitedByClose = true
+	}
+	f.header = append(f.header, "\r\n"...)
+	f.isHeaderWritten = true
+	n, err := parallelWriteHeader(r.writer, func([]byte) {}, f.header, r.isConnectionClose())
+	f.n += n
+	return err
+}
+
+func (f *transformFramer) writeBody(p []byte) (int, error) {
+	if f.isChunked {
+		return f.chunked.Write(p)
+	}
+	return countWriter{f}.Write(p)
+}
+
+// countWriter writes to the response writer with the bytes counted
+type countWriter struct {
+	f *transformFramer
+}
+
+func (w countWriter) Write(p []byte) (int, error) {
+	n, err := util.WriteWithValidation(w.f.resp.writer, p)
+	w.f.n += n
+	return n, err
+}
+
+// errRequestBodyTooLarge the buffered request body exceeds MaxRequestBodyBufferSize
+var errRequestBodyTooLarge = errors.New("request body too large to buffer")
+
+// transformBody transforms the request body if the hijacker asks, the header
+// is re-generated for the transformed body then. w writes to the client,
+// which is told to continue before buffering the body if it's expecting so
+func (r *Request) transformBody(w *bufio.Writer, bufferSize int, maxBufferSize int64, tempDir string) error {
+	if r.hijacker == nil || !r.header.HasBody() ||
+		http.IsMethodGet(r.Method()) || http.IsMethodHead(r.Method()) {
+		return nil
+	}
+	rewriteHeader, transform, bufferBody := r.hijacker.TransformRequest(r.header, &r.fields)
+	if rewriteHeader == nil && transform == nil {
+		return nil
+	}
+	isHTTP10 := bytes.Equal(r.Protocol(), protocolHTTP10)
+	if isHTTP10 {
+		// chunked body is not supported by HTTP/1.0
+		bufferBody = true
+	}
+	// the header fields are copied already, discard the raw header before
+	// reading the body which follows it
+	if err := r.discardRawHeader(); err != nil {
+		return util.ErrWrapper(err, "fail to read raw headers")
+	}
+	r.bodyReader.Reset(r.reader, r.header.BodyType(), r.header.ContentLength())
+	var body io.Reader = requestBodyCounter{r}
+	if transform != nil {
+		body = transform(body)
+	}
+
+	if !bufferBody {
+		if rewriteHeader != nil {
+			rewriteHeader(&r.fields, -1)
+		}
+		r.fields.Del("Content-Length")
+		r.fields.Set("Transfer-Encoding", "chunked")
+		r.transformedBody = body
+		return r.setTransformedHeader()
+	}
+
+	if r.ExpectContinue() && !isHTTP10 {
+		// answer the continue on behalf of the target
+		if _, err := util.WriteWithValidation(w, http.StatusLine(http.StatusContinue)); err != nil {
+			return err
+		}
+		if _, err := util.WriteWithValidation(w, crlf); err != nil {
+			return err
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+	r.bodyBuffer.init(bufferSize, maxBufferSize, tempDir)
+	if _, err := io.Copy(&r.bodyBuffer, body); err != nil {
+		if err == errRequestBodyTooLarge {
+			return err
+		}
+		return util.ErrWrapper(err, "fail to buffer transformed request body")
+	}
+	// the transformation may leave the body unread, which is discarded
+	// to make the client connection reusable
+	if _, err := io.Copy(ioutil.Discard, requestBodyCounter{r}); err != nil {
+		return util.ErrWrapper(err, "fail to read request body")
+	}
+	if rewriteHeader != nil {
+		rewriteHeader(&r.fields, r.bodyBuffer.size)
+	}
+	// the target is never asked for the continue since the body is buffered
+	r.fields.Del("Expect")
+	r.fields.Del("Transfer-Encoding")
+	var contentLength [20]byte
+	r.fields.SetBytes("Content-Length", strconv.AppendInt(contentLength[:0], r.bodyBuffer.size, 10))
+	var err error
+	if r.transformedBody, err = r.bodyBuffer.reader(); err != nil {
+		return util.ErrWrapper(err, "fail to read buffered request body")
+	}
+	return r.setTransformedHeader()
+}
+
+// setTransformedHeader set the header made of fields to be sent,
+// the parsed header is updated
+func (r *Request) setTransformedHeader() error {
+	r.transformedHeader = r.fields.AppendBytes(r.transformedHeader[:0])
+	if _, err := r.header.Parse(r.transformedHeader); err != nil {
+		return util.ErrWrapper(err, "fail to parse transformed request http headers")
+	}
+	r.rawHeader = r.transformedHeader
+	return nil
+}
+
+// writeTransformedBodyTo writes the transformed body to w,
+// which is chunked if not buffered
+func (r *Request) writeTransformedBodyTo(w io.Writer) (int, error) {
+	var dst io.Writer = w
+	if r.header.BodyType() == http.BodyTypeChunked {
+		r.chunkedWriter.Reset(w)
+		dst = &r.chunkedWriter
+	}
+	if r.hijackerBodyWriter != nil {
+		dst = io.MultiWriter(dst, sniffWriter{r.hijackerBodyWriter})
+	}
+	n, err := io.Copy(dst, r.transformedBody)
+	if err != nil {
+		return int(n), util.ErrWrapper(err, "fail to write transformed request body")
+	}
+	if r.header.BodyType() == http.BodyTypeChunked {
+		if err = r.chunkedWriter.Close(); err != nil {
+			return int(n), util.ErrWrapper(err, "fail to write transformed request body")
+		}
+		// the transformation may leave the body unread
+		if _, err = io.Copy(ioutil.Discard, requestBodyCounter{r}); err != nil {
+			return int(n), util.ErrWrapper(err, "fail to read request body")
+		}
+	}
+	r.onTrailers(r.bodyReader.Trailers())
+	return int(n), nil
+}
+
+// requestBodyCounter reads the request body with the bytes read counted
+type requestBodyCounter struct {
+	r *Request
+}
+
+func (c requestBodyCounter) Read(p []byte) (int, error) {
+	n, err := c.r.bodyReader.Read(p)
+	c.r.readBytes += int64(n)
+	return n, err
+}
+
+// requestBodyBuffer buffers the transformed request body in memory,
+// the body exceeding the memory size is spilled to a temporary file
+type requestBodyBuffer struct {
+	buffer *bytebufferpool.ByteBuffer
+	file   *os.File
+	// size bytes buffered
+	size int64
+
+	memSize int
+	maxSize int64
+	tempDir string
+}
+
+func (b *requestBodyBuffer) init(memSize int, maxSize int64, tempDir string) {
+	b.reset()
+	b.memSize = memSize
+	b.maxSize = maxSize
+	b.tempDir = tempDir
+}
+
+func (b *requestBodyBuffer) Write(p []byte) (int, error) {
+	if b.maxSize > 0 && b.size+int64(len(p)) > b.maxSize {
+		return 0, errRequestBodyTooLarge
+	}
+	if b.file == nil {
+		if b.buffer == nil {
+			b.buffer = bytebufferpool.Get()
+		}
+		if b.buffer.Len()+len(p) <= b.memSize {
+			b.size += int64(len(p))
+			return b.buffer.Write(p)
+		}
+		f, err := ioutil.TempFile(b.tempDir, "fastproxy-body-")
+		if err != nil {
+			return 0, err
+		}
+		b.file = f
+		if _, err = util.WriteWithValidation(f, b.buffer.B); err != nil {
+			return 0, err
+		}
+		b.buffer.Reset()
+	}
+	n, err := b.file.Write(p)
+	b.size += int64(n)
+	return n, err
+}
+
+// reader the reader of the body buffered
+func (b *requestBodyBuffer) reader() (io.Reader, error) {
+	if b.file == nil {
+		if b.buffer == nil {
+			return bytes.NewReader(nil), nil
+		}
+		return bytes.NewReader(b.buffer.B), nil
+	}
+	if _, err := b.file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return b.file, nil
+}
+
+// reset releases the memory buffer and removes the temporary file
+func (b *requestBodyBuffer) reset() {
+	if b.buffer != nil {
+		bytebufferpool.Put(b.buffer)
+		b.buffer = nil
+	}
+	if b.file != nil {
+		b.file.Close()
+		os.Remove(b.file.Name())
+		b.file = nil
+	}
+	b.size = 0
+}
@@ -0,0 +1,193 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/haxii/fastproxy/mitm"
+	"github.com/haxii/fastproxy/servertime"
+	"github.com/haxii/fastproxy/util"
+)
+
+var errNoTransparentTarget = errors.New("no target found for transparent connection")
+
+// ServeTransparent serve transparently redirected connections on the provided
+// ip address, e.g. redirected by iptables `REDIRECT` or `TPROXY`.
+//
+// The target is the original destination of the connection, which is read from
+// `SO_ORIGINAL_DST` on linux, or the local address of the connection for `TPROXY`.
+// The TLS server name or http `Host` header is used as the target host name,
+// the port is always the original one. Connections whose original destination
+// is unknown are declined, otherwise the proxy is open to any target.
+//
+// TLS connections go through the same hijacker chain as the HTTPS tunnels,
+// http requests go through the same chain as the proxy requests, other
+// connections are tunneled to the original destination directly.
+// Protocols in which the server sends the first message are not supported.
+func (p *Proxy) ServeTransparent(network, addr string) error {
+	ln, lnErr := net.Listen(network, addr)
+	if lnErr != nil {
+		return lnErr
+	}
+	lnAddr := ln.Addr()
+	return p.serve(ln, "ProxyTransparent", func(c net.Conn) error {
+		return p.serveTransparent(c, lnAddr)
+	}, nil, nil)
+}
+
+func (p *Proxy) serveTransparent(c net.Conn, lnAddr net.Addr) error {
+	cc := p.trackConn(c)
+	defer p.untrackConn(cc)
+	reader := p.bufioPool.AcquireReader(c)
+	defer p.bufioPool.ReleaseReader(reader)
+	if p.ServerReadTimeout > 0 {
+		if _, err := p.updateReadDeadline(c, servertime.CoarseTimeNow(), zeroTime); err != nil {
+			return err
+		}
+	}
+	dst := transparentDst(c, lnAddr)
+
+	isTLS, err := mitm.IsTLSHandshake(reader)
+	if err != nil {
+		if err == io.EOF {
+			return nil
+		}
+		return util.ErrWrapper(err, "fail to sniff the protocol")
+	}
+	if isTLS {
+		// fallback to the original destination if no server name found
+		serverName, _ := mitm.PeekClientHelloServerName(reader)
+		return p.serveTransparentTunnel(cc, reader, serverName, dst, false)
+	}
+	if isHTTPRequest(reader) {
+		return p.serveHTTPConn(cc, reader, true, dst)
+	}
+	return p.serveTransparentTunnel(cc, reader, "", dst, true)
+}
+
+// serveTransparentTunnel makes a tunnel to the original destination dst,
+// host is used as the domain of the target if provided
+func (p *Proxy) serveTransparentTunnel(cc *clientConn, reader *bufio.Reader,
+	host string, dst *net.TCPAddr, isRawTunnel bool) error {
+	c := cc.conn
+	if dst == nil {
+		return errNoTransparentTarget
+	}
+	if len(host) == 0 {
+		host = dst.IP.String()
+	}
+	hostWithPort := net.JoinHostPort(host, strconv.Itoa(dst.Port))
+
+	// make a CONNECT request for the transparent connection
+	connectReader := p.bufioPool.AcquireReader(bytes.NewReader(makeConnectRequest(hostWithPort)))
+	defer p.bufioPool.ReleaseReader(connectReader)
+	req := p.reqPool.Acquire()
+	defer p.reqPool.Release(req)
+	if _, err := req.parseStartLine(connectReader); err != nil {
+		return err
+	}
+	req.reqLine.HostInfo().SetIP(dst.IP)
+	req.isTransparent = true
+	req.isRawTunnel = isRawTunnel
+	req.clientConn = cc
+	req.setContext(p.requestContext(cc.ctx, true))
+
+	// the sniffed data is buffered by the reader
+	err := p.do(&bufferedConn{Conn: c, reader: reader}, req)
+	if err != nil && err != io.EOF {
+		return util.ErrWrapper(err, "proxy error with transparent target "+hostWithPort)
+	}
+	return nil
+}
+
+// setTransparentHTTPTarget set the target of an origin-form request to the
+// original destination, using the host name of the `Host` header if provided
+func setTransparentHTTPTarget(req *Request, dst *net.TCPAddr) error {
+	if dst == nil {
+		return errNoTransparentTarget
+	}
+	if err := req.peekRawHeader(); err != nil {
+		return err
+	}
+	host := string(req.header.Host())
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		// the port of the header is never trusted
+		host = h
+	} else {
+		host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	}
+	if len(host) == 0 {
+		host = dst.IP.String()
+	}
+	req.reqLine.ChangeHost(net.JoinHostPort(host, strconv.Itoa(dst.Port)))
+	if len(req.reqLine.HostInfo().HostWithPort()) == 0 {
+		return errNoTransparentTarget
+	}
+	req.reqLine.HostInfo().SetIP(dst.IP)
+	return nil
+}
+
+// transparentDst the original destination of the transparent connection, nil if unknown
+func transparentDst(c net.Conn, lnAddr net.Addr) *net.TCPAddr {
+	if dst, err := originalDst(c); err == nil {
+		return dst
+	}
+	// the local address is the original destination for TPROXY,
+	// but it is the listener itself for connections made directly
+	dst, ok := c.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return nil
+	}
+	if ln, ok := lnAddr.(*net.TCPAddr); ok && ln.Port == dst.Port &&
+		(ln.IP.IsUnspecified() || ln.IP.Equal(dst.IP)) {
+		return nil
+	}
+	return dst
+}
+
+// unwrapConn returns the underlying connection of the wrapped one
+func unwrapConn(c net.Conn) net.Conn {
+	for {
+		wrapped, ok := c.(interface{ NetConn() net.Conn })
+		if !ok {
+			return c
+		}
+		c = wrapped.NetConn()
+	}
+}
+
+var httpMethods = [][]byte{
+	[]byte("GET"), []byte("HEAD"), []byte("POST"), []byte("PUT"), []byte("DELETE"),
+	[]byte("CONNECT"), []byte("OPTIONS"), []byte("TRACE"), []byte("PATCH"),
+}
+
+const maxHTTPMethodLen = 7
+
+// isHTTPRequest if the reader starts with a http method token, stops
+// peeking as soon as the peeked bytes can't be a method
+func isHTTPRequest(reader *bufio.Reader) bool {
+	for n := 1; n <= maxHTTPMethodLen+1; n++ {
+		b, err := reader.Peek(n)
+		if err != nil {
+			return false
+		}
+		isPrefix := false
+		for _, method := range httpMethods {
+			if b[n-1] == ' ' && bytes.Equal(b[:n-1], method) {
+				return true
+			}
+			if bytes.HasPrefix(method, b) {
+				isPrefix = true
+			}
+		}
+		if !isPrefix {
+			return false
+		}
+	}
+	return false
+}
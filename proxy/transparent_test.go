@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	nethttp "net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// startTransparentProxy serves the connections as transparently redirected
+// ones whose original destination is dst, nil for the unknown
+func startTransparentProxy(t *testing.T, dst *net.TCPAddr) (string, *Proxy) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	proxy := &Proxy{}
+	go proxy.serve(ln, "TestTransparentProxy", func(c net.Conn) error {
+		if dst == nil {
+			// the original destination of connections made directly is unknown
+			return proxy.serveTransparent(c, ln.Addr())
+		}
+		cc := proxy.trackConn(c)
+		defer proxy.untrackConn(cc)
+		reader := proxy.bufioPool.AcquireReader(c)
+		defer proxy.bufioPool.ReleaseReader(reader)
+		return proxy.serveHTTPConn(cc, reader, true, dst)
+	}, nil, nil)
+	return ln.Addr().String(), proxy
+}
+
+func TestTransparentHTTPTarget(t *testing.T) {
+	target, s := startTarget(t, func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		w.Write([]byte("target " + r.Host))
+	})
+	defer s.Close()
+	u, _ := url.Parse(target)
+	dst, _ := net.ResolveTCPAddr("tcp", u.Host)
+	addr, proxy := startTransparentProxy(t, dst)
+	defer proxy.Close()
+
+	testTarget := func(host string) {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		defer c.Close()
+		fmt.Fprintf(c, "GET / HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n\r\n", host)
+		resp, err := nethttp.ReadResponse(bufio.NewReader(c), nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if resp.StatusCode != nethttp.StatusOK || string(body) != "target "+host {
+			t.Fatalf("request of host %s should be sent to the original destination, got %d %q",
+				host, resp.StatusCode, body)
+		}
+	}
+	testTarget("example.com")
+	// the port of the host header is ignored
+	testTarget("example.com:1")
+	testTarget("[::1]:1")
+}
+
+func TestTransparentUnknownTarget(t *testing.T) {
+	target, s := startTarget(t, func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		w.Write([]byte("target"))
+	})
+	defer s.Close()
+	u, _ := url.Parse(target)
+	addr, proxy := startTransparentProxy(t, nil)
+	defer proxy.Close()
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer c.Close()
+	fmt.Fprintf(c, "GET / HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n\r\n", u.Host)
+	resp, err := nethttp.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != nethttp.StatusBadRequest {
+		t.Fatalf("unexpected status code %d, expecting 400", resp.StatusCode)
+	}
+
+	// the tunnels are declined as well
+	c, err = net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer c.Close()
+	c.Write([]byte("\x00\x01raw data"))
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	if n, err := c.Read(make([]byte, 1)); n != 0 || err == nil {
+		t.Fatalf("tunnel without target should be closed, got %d bytes with error %v", n, err)
+	}
+}
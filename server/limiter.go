@@ -0,0 +1,219 @@
+package server
+
+import (
+	"github.com/haxii/fastproxy/metrics"
+	"github.com/haxii/fastproxy/servertime"
+	"github.com/haxii/log/v2"
+
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultSubnetPrefixIPv4 default prefix length of the IPv4 subnets limited by MaxConnsPerSubnet
+	DefaultSubnetPrefixIPv4 = 24
+	// DefaultSubnetPrefixIPv6 default prefix length of the IPv6 subnets limited by MaxConnsPerSubnet
+	DefaultSubnetPrefixIPv6 = 64
+)
+
+// connCounter counts the concurrent connections by key, the key is removed
+// once its connections are all closed, so the counter only holds the active ones
+type connCounter struct {
+	lock   sync.Mutex
+	counts map[[net.IPv6len]byte]int
+}
+
+// acquire counts a connection of key, false returned if the key has max
+// connections already, which is not counted then
+func (c *connCounter) acquire(key [net.IPv6len]byte, max int) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.counts == nil {
+		c.counts = make(map[[net.IPv6len]byte]int)
+	}
+	n := c.counts[key]
+	if n >= max {
+		return false
+	}
+	c.counts[key] = n + 1
+	return true
+}
+
+// release uncounts a connection of key
+func (c *connCounter) release(key [net.IPv6len]byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if n := c.counts[key]; n > 1 {
+		c.counts[key] = n - 1
+	} else {
+		delete(c.counts, key)
+	}
+}
+
+// len number of the keys with active connections
+func (c *connCounter) len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.counts)
+}
+
+// tokenBucket limits the accept rate, tokens are refilled at rate per second
+// up to burst, it's only used by the accepting goroutine thus not locked
+type tokenBucket struct {
+	rate     float64
+	burst    float64
+	tokens   float64
+	lastTime time.Time
+}
+
+func (b *tokenBucket) init(rate float64, burst int) {
+	b.rate = rate
+	b.burst = float64(burst)
+	if b.burst < 1 {
+		b.burst = rate
+		if b.burst < 1 {
+			b.burst = 1
+		}
+	}
+	b.tokens = b.burst
+	b.lastTime = time.Now()
+}
+
+// take takes a token if any
+func (b *tokenBucket) take(now time.Time) bool {
+	if elapsed := now.Sub(b.lastTime); elapsed > 0 {
+		b.tokens += elapsed.Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.lastTime = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// connIP the IP of the connection in 16-byte form, false returned
+// if the connection is not made over IP, e.g. unix socket
+func connIP(c net.Conn) ([net.IPv6len]byte, bool) {
+	var key [net.IPv6len]byte
+	var ip net.IP
+	switch addr := c.RemoteAddr().(type) {
+	case *net.TCPAddr:
+		ip = addr.IP
+	case *net.UDPAddr:
+		ip = addr.IP
+	case *net.IPAddr:
+		ip = addr.IP
+	}
+	if ip16 := ip.To16(); ip16 != nil {
+		copy(key[:], ip16)
+		return key, true
+	}
+	return key, false
+}
+
+// subnetKey masks ip with the IPv4 or IPv6 prefix length
+func subnetKey(ip [net.IPv6len]byte, prefixIPv4, prefixIPv6 int) [net.IPv6len]byte {
+	var mask net.IPMask
+	if net.IP(ip[:]).To4() != nil {
+		mask = net.CIDRMask(96+prefixIPv4, 8*net.IPv6len)
+	} else {
+		mask = net.CIDRMask(prefixIPv6, 8*net.IPv6len)
+	}
+	if mask == nil {
+		return ip
+	}
+	for i := range ip {
+		ip[i] &= mask[i]
+	}
+	return ip
+}
+
+// connLimit the limit rejecting a connection
+type connLimit int
+
+const (
+	connLimitNone connLimit = iota
+	connLimitAcceptRate
+	connLimitPerIP
+	connLimitPerSubnet
+)
+
+// acquireConn counts the accepted connection in the limiters,
+// the limit exceeded is returned, and the connection is not counted then
+func (s *Server) acquireConn(c net.Conn) connLimit {
+	if s.AcceptRate > 0 && !s.acceptBucket.take(time.Now()) {
+		return connLimitAcceptRate
+	}
+	if s.MaxConnsPerIP <= 0 && s.MaxConnsPerSubnet <= 0 {
+		return connLimitNone
+	}
+	ip, ok := connIP(c)
+	if !ok {
+		return connLimitNone
+	}
+	if s.MaxConnsPerIP > 0 && !s.perIPConns.acquire(ip, s.MaxConnsPerIP) {
+		return connLimitPerIP
+	}
+	if s.MaxConnsPerSubnet > 0 {
+		subnet := subnetKey(ip, s.SubnetPrefixIPv4, s.SubnetPrefixIPv6)
+		if !s.perSubnetConns.acquire(subnet, s.MaxConnsPerSubnet) {
+			if s.MaxConnsPerIP > 0 {
+				s.perIPConns.release(ip)
+			}
+			return connLimitPerSubnet
+		}
+	}
+	return connLimitNone
+}
+
+// releaseConn uncounts the connection counted by acquireConn
+func (s *Server) releaseConn(c net.Conn) {
+	if s.MaxConnsPerIP <= 0 && s.MaxConnsPerSubnet <= 0 {
+		return
+	}
+	ip, ok := connIP(c)
+	if !ok {
+		return
+	}
+	if s.MaxConnsPerIP > 0 {
+		s.perIPConns.release(ip)
+	}
+	if s.MaxConnsPerSubnet > 0 {
+		s.perSubnetConns.release(subnetKey(ip, s.SubnetPrefixIPv4, s.SubnetPrefixIPv6))
+	}
+}
+
+// rejectConn closes the connection rejected by limit
+func (s *Server) rejectConn(c net.Conn, limit connLimit, lastErrorTime *time.Time) {
+	var onExceeded func(net.Conn)
+	var counter *metrics.Counter
+	var reason string
+	switch limit {
+	case connLimitAcceptRate:
+		onExceeded, counter = s.OnAcceptRateExceeded, acceptRateRejectionsCounter
+		reason = fmt.Sprintf("more than %g connections are accepted per second", s.AcceptRate)
+	case connLimitPerIP:
+		onExceeded, counter = s.OnPerIPLimitExceeded, perIPRejectionsCounter
+		reason = fmt.Sprintf("%d concurrent connections are served for the client IP", s.MaxConnsPerIP)
+	case connLimitPerSubnet:
+		onExceeded, counter = s.OnPerSubnetLimitExceeded, perSubnetRejectionsCounter
+		reason = fmt.Sprintf("%d concurrent connections are served for the client subnet", s.MaxConnsPerSubnet)
+	}
+	counter.Inc()
+	if onExceeded != nil {
+		onExceeded(c)
+	}
+	if time.Since(*lastErrorTime) > time.Minute {
+		log.Errorf(errors.New("connection limit exceeded"), "The incoming connection from %s cannot be served, "+
+			"because %s", c.RemoteAddr(), reason)
+		*lastErrorTime = servertime.CoarseTimeNow()
+	}
+	c.Close()
+}
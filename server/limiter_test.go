@@ -0,0 +1,181 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+type addrConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c *addrConn) RemoteAddr() net.Addr { return c.addr }
+func (c *addrConn) Close() error         { return nil }
+
+func tcpConn(ip string) net.Conn {
+	return &addrConn{addr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 1234}}
+}
+
+func TestServerLimitPerIP(t *testing.T) {
+	s := &Server{MaxConnsPerIP: 2}
+	a1, a2, a3 := tcpConn("10.0.0.1"), tcpConn("10.0.0.1"), tcpConn("10.0.0.1")
+	if l := s.acquireConn(a1); l != connLimitNone {
+		t.Fatalf("unexpected limit %d", l)
+	}
+	if l := s.acquireConn(a2); l != connLimitNone {
+		t.Fatalf("unexpected limit %d", l)
+	}
+	if l := s.acquireConn(a3); l != connLimitPerIP {
+		t.Fatalf("expected per ip limit, got %d", l)
+	}
+	if l := s.acquireConn(tcpConn("10.0.0.2")); l != connLimitNone {
+		t.Fatalf("unexpected limit %d for another ip", l)
+	}
+	s.releaseConn(a1)
+	if l := s.acquireConn(a3); l != connLimitNone {
+		t.Fatalf("unexpected limit %d after release", l)
+	}
+	s.releaseConn(a2)
+	s.releaseConn(a3)
+	s.releaseConn(tcpConn("10.0.0.2"))
+	if n := s.perIPConns.len(); n != 0 {
+		t.Fatalf("expected counters cleaned up, %d left", n)
+	}
+
+	// the connection without IP is never limited
+	unix := &addrConn{addr: &net.UnixAddr{Name: "/tmp/sock", Net: "unix"}}
+	for i := 0; i < 3; i++ {
+		if l := s.acquireConn(unix); l != connLimitNone {
+			t.Fatalf("unexpected limit %d for unix conn", l)
+		}
+	}
+}
+
+func TestServerLimitPerSubnet(t *testing.T) {
+	s := &Server{MaxConnsPerIP: 2, MaxConnsPerSubnet: 2,
+		SubnetPrefixIPv4: DefaultSubnetPrefixIPv4, SubnetPrefixIPv6: DefaultSubnetPrefixIPv6}
+	if l := s.acquireConn(tcpConn("10.0.0.1")); l != connLimitNone {
+		t.Fatalf("unexpected limit %d", l)
+	}
+	if l := s.acquireConn(tcpConn("10.0.0.2")); l != connLimitNone {
+		t.Fatalf("unexpected limit %d", l)
+	}
+	if l := s.acquireConn(tcpConn("10.0.0.3")); l != connLimitPerSubnet {
+		t.Fatalf("expected per subnet limit, got %d", l)
+	}
+	// the ip rejected by subnet limit is not counted
+	if n := s.perIPConns.len(); n != 2 {
+		t.Fatalf("expected 2 ips counted, got %d", n)
+	}
+	if l := s.acquireConn(tcpConn("10.0.1.1")); l != connLimitNone {
+		t.Fatalf("unexpected limit %d for another subnet", l)
+	}
+
+	if l := s.acquireConn(tcpConn("2001:db8::1")); l != connLimitNone {
+		t.Fatalf("unexpected limit %d", l)
+	}
+	if l := s.acquireConn(tcpConn("2001:db8::ffff:1")); l != connLimitNone {
+		t.Fatalf("unexpected limit %d", l)
+	}
+	if l := s.acquireConn(tcpConn("2001:db8::2")); l != connLimitPerSubnet {
+		t.Fatalf("expected per subnet limit, got %d", l)
+	}
+	if l := s.acquireConn(tcpConn("2001:db8:0:1::1")); l != connLimitNone {
+		t.Fatalf("unexpected limit %d for another subnet", l)
+	}
+
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2", "10.0.1.1",
+		"2001:db8::1", "2001:db8::ffff:1", "2001:db8:0:1::1"} {
+		s.releaseConn(tcpConn(ip))
+	}
+	if n := s.perIPConns.len() + s.perSubnetConns.len(); n != 0 {
+		t.Fatalf("expected counters cleaned up, %d left", n)
+	}
+}
+
+func TestServerLimitAcceptRate(t *testing.T) {
+	var b tokenBucket
+	b.init(10, 2)
+	now := b.lastTime
+	if !b.take(now) || !b.take(now) {
+		t.Fatalf("expected burst of 2 taken")
+	}
+	if b.take(now) {
+		t.Fatalf("expected bucket exhausted")
+	}
+	if b.take(now.Add(50 * time.Millisecond)) {
+		t.Fatalf("expected half a token refilled only")
+	}
+	if !b.take(now.Add(100 * time.Millisecond)) {
+		t.Fatalf("expected a token refilled")
+	}
+	if !b.take(now.Add(time.Second)) || !b.take(now.Add(time.Second)) || b.take(now.Add(time.Second)) {
+		t.Fatalf("expected tokens refilled up to burst")
+	}
+
+	rejected := 0
+	s := &Server{AcceptRate: 1, OnAcceptRateExceeded: func(net.Conn) { rejected++ }}
+	s.acceptBucket.init(s.AcceptRate, s.AcceptBurst)
+	if l := s.acquireConn(tcpConn("10.0.0.1")); l != connLimitNone {
+		t.Fatalf("unexpected limit %d", l)
+	}
+	c := tcpConn("10.0.0.1")
+	if l := s.acquireConn(c); l != connLimitAcceptRate {
+		t.Fatalf("expected accept rate limit, got %d", l)
+	}
+	var lastErrorTime time.Time
+	s.rejectConn(c, connLimitAcceptRate, &lastErrorTime)
+	if rejected != 1 {
+		t.Fatalf("expected rejection callback called once, got %d", rejected)
+	}
+}
+
+func TestServerLimitConcurrencyReleased(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	s := &Server{
+		Listener:      ln,
+		Concurrency:   1,
+		MaxConnsPerIP: 2,
+		ConnHandler: func(c net.Conn) error {
+			// blocks until the connection closed
+			_, err := c.Read(make([]byte, 1))
+			return err
+		},
+	}
+	go s.ListenAndServe()
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer conn.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	// the connection over the concurrency is rejected and closed
+	rejected, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer rejected.Close()
+	rejected.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err = rejected.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("the connection over the concurrency should be closed")
+	}
+
+	conn.Close()
+	for i := 0; s.activeConnCount() > 0; i++ {
+		if i > 30 {
+			t.Fatalf("the connection served is not closed")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if n := s.perIPConns.len(); n != 0 {
+		t.Fatalf("expected counters cleaned up, %d left", n)
+	}
+}
@@ -110,3 +110,8 @@ func (c *gracefulConn) Close() error {
 
 	return nil
 }
+
+// NetConn returns the underlying connection, e.g. for reading socket options
+func (c *gracefulConn) NetConn() net.Conn {
+	return c.Conn
+}
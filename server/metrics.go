@@ -0,0 +1,18 @@
+package server
+
+import "github.com/haxii/fastproxy/metrics"
+
+var (
+	workersGauge = metrics.DefaultRegistry.Gauge("fastproxy_server_workers",
+		"Number of the workers serving the connections.")
+	connsGauge = metrics.DefaultRegistry.Gauge("fastproxy_server_connections",
+		"Number of the client connections being served.")
+	rejectionsCounter = metrics.DefaultRegistry.Counter("fastproxy_server_concurrency_limit_rejections_total",
+		"Number of the client connections rejected since the concurrency limit exceeded.")
+	acceptRateRejectionsCounter = metrics.DefaultRegistry.Counter("fastproxy_server_limit_rejections_total",
+		"Number of the client connections rejected since the connection limit exceeded.", "limit", "accept_rate")
+	perIPRejectionsCounter = metrics.DefaultRegistry.Counter("fastproxy_server_limit_rejections_total",
+		"Number of the client connections rejected since the connection limit exceeded.", "limit", "per_ip")
+	perSubnetRejectionsCounter = metrics.DefaultRegistry.Counter("fastproxy_server_limit_rejections_total",
+		"Number of the client connections rejected since the connection limit exceeded.", "limit", "per_subnet")
+)
@@ -4,6 +4,7 @@ import (
 	"github.com/haxii/fastproxy/servertime"
 	"github.com/haxii/log/v2"
 
+	"context"
 	"errors"
 	"io"
 	"net"
@@ -20,6 +21,35 @@ type Server struct {
 	// limit exceeds, before the conn is force closed
 	OnConcurrencyLimitExceeded func(net.Conn)
 
+	// MaxConnsPerIP maximum number of concurrent connections
+	// from a client IP, no limit if 0
+	MaxConnsPerIP int
+	// OnPerIPLimitExceeded called when MaxConnsPerIP
+	// exceeds, before the conn is force closed
+	OnPerIPLimitExceeded func(net.Conn)
+
+	// MaxConnsPerSubnet maximum number of concurrent connections
+	// from a client subnet, no limit if 0
+	MaxConnsPerSubnet int
+	// SubnetPrefixIPv4 prefix length of the IPv4 subnet,
+	// DefaultSubnetPrefixIPv4 used if 0
+	SubnetPrefixIPv4 int
+	// SubnetPrefixIPv6 prefix length of the IPv6 subnet,
+	// DefaultSubnetPrefixIPv6 used if 0
+	SubnetPrefixIPv6 int
+	// OnPerSubnetLimitExceeded called when MaxConnsPerSubnet
+	// exceeds, before the conn is force closed
+	OnPerSubnetLimitExceeded func(net.Conn)
+
+	// AcceptRate maximum number of connections accepted per second, no limit if 0
+	AcceptRate float64
+	// AcceptBurst maximum number of connections accepted at once
+	// within AcceptRate, AcceptRate is used if 0
+	AcceptBurst int
+	// OnAcceptRateExceeded called when AcceptRate
+	// exceeds, before the conn is force closed
+	OnAcceptRateExceeded func(net.Conn)
+
 	// Listener server's listener
 	Listener net.Listener
 	// connections handler
@@ -31,6 +61,11 @@ type Server struct {
 	// active connections
 	activeConn map[net.Conn]struct{}
 	mu         sync.Mutex
+
+	// connection limiters
+	perIPConns     connCounter
+	perSubnetConns connCounter
+	acceptBucket   tokenBucket
 }
 
 // DefaultConcurrency is the maximum number of concurrent connections
@@ -53,6 +88,15 @@ func (s *Server) ListenAndServe() error {
 	if len(s.ServiceName) == 0 {
 		s.ServiceName = "fastproxy.server"
 	}
+	if s.SubnetPrefixIPv4 <= 0 {
+		s.SubnetPrefixIPv4 = DefaultSubnetPrefixIPv4
+	}
+	if s.SubnetPrefixIPv6 <= 0 {
+		s.SubnetPrefixIPv6 = DefaultSubnetPrefixIPv6
+	}
+	if s.AcceptRate > 0 {
+		s.acceptBucket.init(s.AcceptRate, s.AcceptBurst)
+	}
 
 	var lastOverflowErrorTime time.Time
 	var lastPerIPErrorTime time.Time
@@ -75,9 +119,11 @@ func (s *Server) ListenAndServe() error {
 			return err
 		}
 		if !wp.Serve(c) {
+			rejectionsCounter.Inc()
 			if s.OnConcurrencyLimitExceeded != nil {
 				s.OnConcurrencyLimitExceeded(c)
 			}
+			s.releaseConn(c)
 			c.Close()
 			if time.Since(lastOverflowErrorTime) > time.Minute {
 				log.Errorf(errors.New("concurrency exceeded"), "The incoming connection cannot be served, "+
@@ -112,22 +158,80 @@ func (s *Server) acceptConn(ln net.Listener, lastPerIPErrorTime *time.Time) (net
 		if c == nil {
 			panic("BUG: net.Listener returned (nil, nil)")
 		}
+		if limit := s.acquireConn(c); limit != connLimitNone {
+			s.rejectConn(c, limit, lastPerIPErrorTime)
+			continue
+		}
 		return c, nil
 	}
 }
 
-// Close close the server and close all the active connections
+// Close close the server and close all the active connections,
+// use Shutdown to wait for the active connections
 func (s *Server) Close() {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	s.stopAccepting()
+	s.closeConns()
+}
+
+// shutdownPollInterval how often the active connections are checked during shutdown
+const shutdownPollInterval = 100 * time.Millisecond
+
+// Shutdown gracefully shuts down the server, it stops accepting new connections
+// then waits for the active connections to be closed by their handlers.
+//
+// If ctx is done before that, the active connections are closed and ctx.Err()
+// is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.stopAccepting()
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if s.activeConnCount() == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			s.closeConns()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// stopAccepting closes the listener without waiting for the open connections
+func (s *Server) stopAccepting() {
+	if ln, ok := s.Listener.(*GracefulNetListener); ok {
+		ln.ln.Close()
+		return
+	}
 	s.Listener.Close()
+}
+
+// closeConns closes all the active connections, the lock is not held
+// while closing since the workers need it to untrack the connections
+func (s *Server) closeConns() {
+	s.mu.Lock()
+	conns := make([]net.Conn, 0, len(s.activeConn))
 	for c := range s.activeConn {
-		c.Close()
+		conns = append(conns, c)
 		delete(s.activeConn, c)
 	}
+	s.mu.Unlock()
+	for _, c := range conns {
+		c.Close()
+	}
+}
+
+func (s *Server) activeConnCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.activeConn)
 }
 
 func (s *Server) trackConn(c net.Conn, add bool) {
+	if !add {
+		s.releaseConn(c)
+	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	if s.activeConn == nil {
@@ -135,7 +239,9 @@ func (s *Server) trackConn(c net.Conn, add bool) {
 	}
 	if add {
 		s.activeConn[c] = struct{}{}
+		connsGauge.Inc()
 	} else {
 		delete(s.activeConn, c)
+		connsGauge.Dec()
 	}
 }
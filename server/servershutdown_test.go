@@ -2,6 +2,8 @@ package server
 
 import (
 	"bytes"
+	"context"
+	"io"
 	"net"
 	"strings"
 	"testing"
@@ -87,3 +89,86 @@ func TestServerShutDownWrong(t *testing.T) {
 		t.Fatalf("unexpected error: %s", err)
 	}
 }
+
+func TestServerShutdown(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	served := make(chan struct{})
+	s := &Server{
+		Listener: NewGracefulListener(ln, 3*time.Second),
+		ConnHandler: func(c net.Conn) error {
+			b := make([]byte, 1)
+			if _, err := c.Read(b); err != nil {
+				return err
+			}
+			time.Sleep(500 * time.Millisecond)
+			_, err := c.Write(b)
+			close(served)
+			return err
+		},
+	}
+	go s.ListenAndServe()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte("a")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if err = s.Shutdown(ctx); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	select {
+	case <-served:
+	default:
+		t.Fatalf("server shut down before the connection served")
+	}
+	b := make([]byte, 1)
+	if _, err = conn.Read(b); err != nil || b[0] != 'a' {
+		t.Fatalf("unexpected response %q with error: %v", b, err)
+	}
+	if _, err = net.Dial("tcp", ln.Addr().String()); err == nil {
+		t.Fatalf("expected error: connection refused")
+	}
+}
+
+func TestServerShutdownTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	s := &Server{
+		Listener: NewGracefulListener(ln, 3*time.Second),
+		ConnHandler: func(c net.Conn) error {
+			// blocks until the connection closed
+			_, err := c.Read(make([]byte, 1))
+			return err
+		},
+	}
+	go s.ListenAndServe()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer conn.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	if err = s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("unexpected error: %v, expected: %s", err, context.DeadlineExceeded)
+	}
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err = conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("unexpected error: %v, expected: %s", err, io.EOF)
+	}
+}
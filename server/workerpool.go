@@ -172,6 +172,7 @@ func (wp *WorkerPool) getCh() *workerChan {
 		if wp.workersCount < wp.MaxWorkersCount {
 			createWorker = true
 			wp.workersCount++
+			workersGauge.Inc()
 		}
 	} else {
 		ch = ready[n]
@@ -242,4 +243,5 @@ func (wp *WorkerPool) workerFunc(ch *workerChan) {
 	wp.lock.Lock()
 	wp.workersCount--
 	wp.lock.Unlock()
+	workersGauge.Dec()
 }
@@ -10,6 +10,7 @@ import (
 	"github.com/haxii/fastproxy/bufiopool"
 	"github.com/haxii/fastproxy/bytebufferpool"
 	"github.com/haxii/fastproxy/cert"
+	"github.com/haxii/fastproxy/transport"
 	"github.com/haxii/fastproxy/util"
 )
 
@@ -109,7 +110,11 @@ func (p *SuperProxy) readHTTPProxyResp(c net.Conn, pool *bufiopool.Pool) error {
 			if isStartLine {
 				isStartLine = false
 				if !bytes.Contains(b[:lineLen], []byte(" 200 ")) {
-					return fmt.Errorf("connected to proxy failed with start line %s", b[:lineLen])
+					err := fmt.Errorf("connected to proxy failed with start line %s", b[:lineLen])
+					if bytes.Contains(b[:lineLen], []byte(" 407 ")) {
+						return &transport.Error{Kind: transport.ErrorKindSuperProxyAuth, Err: err}
+					}
+					return err
 				}
 			} else {
 				if (lineLen == 2 && b[0] == '\r') || lineLen == 1 {
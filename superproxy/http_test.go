@@ -71,6 +71,7 @@ L/ib
 }
 
 func TestWriteHTTPProxyReqAndReadHTTPProxyResp(t *testing.T) {
+	skipIfNoLocalProxy(t, "localhost:3128")
 	go func() {
 		http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 			w.Write([]byte("Hello world!"))
@@ -0,0 +1,9 @@
+package superproxy
+
+import "github.com/haxii/fastproxy/metrics"
+
+var tokensInUseGauge = metrics.DefaultRegistry.Gauge("fastproxy_superproxy_tokens_in_use",
+	"Number of the concurrency tokens of the super proxies in use.")
+
+var ejectionsCounter = metrics.DefaultRegistry.Counter("fastproxy_superproxy_ejections_total",
+	"Total number of the super proxies ejected from the pools.")
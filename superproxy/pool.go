@@ -0,0 +1,453 @@
+package superproxy
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/haxii/fastproxy/bufiopool"
+	"github.com/haxii/fastproxy/servertime"
+	"github.com/haxii/fastproxy/transport"
+)
+
+// Strategy selection strategy of the super proxy pool
+type Strategy int
+
+const (
+	// StrategyRoundRobin picks the super proxies in turn
+	StrategyRoundRobin Strategy = iota
+	// StrategyWeighted picks the super proxies in turn in proportion to their weights
+	StrategyWeighted
+	// StrategyLeastInUse picks the super proxy with the least concurrency tokens in use
+	StrategyLeastInUse
+	// StrategyRandom picks a super proxy randomly
+	StrategyRandom
+	// StrategySticky picks the super proxy by the hash of the key, e.g. the client IP
+	// or a session key, so the same key goes through the same super proxy
+	StrategySticky
+)
+
+// DefaultPoolMaxFails used when pool's MaxFails not set
+const DefaultPoolMaxFails = 3
+
+// DefaultPoolRetries used when pool's Retries not set
+const DefaultPoolRetries = 2
+
+var (
+	// DefaultPoolFailTimeout used when pool's FailTimeout not set
+	DefaultPoolFailTimeout = 30 * time.Second
+	// DefaultPoolMaxFailTimeout used when pool's MaxFailTimeout not set
+	DefaultPoolMaxFailTimeout = 10 * time.Minute
+	// DefaultHealthCheckInterval used when pool's HealthCheckInterval not set
+	DefaultHealthCheckInterval = 10 * time.Second
+	// DefaultHealthCheckTimeout used when pool's HealthCheckTimeout not set
+	DefaultHealthCheckTimeout = 5 * time.Second
+)
+
+// ErrNoSuperProxyAvail all the members of the pool are ejected
+var ErrNoSuperProxyAvail = &transport.Error{Kind: transport.ErrorKindUnavailable,
+	Err: errors.New("no super proxy available")}
+
+// Member a super proxy of the pool
+type Member struct {
+	// Proxy the super proxy, which should belong to one pool only
+	Proxy *SuperProxy
+	// Weight used by the weighted strategy, 1 is used if not set
+	Weight int
+
+	pool *Pool
+
+	// consecutive failures and ejections since the last success,
+	// and the time ejected until in unix nano
+	fails        uint32
+	ejections    uint32
+	ejectedUntil int64
+
+	// current weight of the smooth weighted round-robin, guarded by pool's mu
+	currentWeight int
+}
+
+// NewMember makes a member with the super proxy and its weight
+func NewMember(proxy *SuperProxy, weight int) *Member {
+	return &Member{Proxy: proxy, Weight: weight}
+}
+
+// IsEjected if the member is ejected by the failures
+func (m *Member) IsEjected() bool {
+	until := atomic.LoadInt64(&m.ejectedUntil)
+	return until > 0 && servertime.CoarseTimeNow().UnixNano() < until
+}
+
+func (m *Member) weight() int {
+	if m.Weight <= 0 {
+		return 1
+	}
+	return m.Weight
+}
+
+// Pool a group of super proxies picked by the strategy, a picked super proxy
+// can be used anywhere a single one is accepted, and tells its pool by Pool
+//
+// A member is ejected after MaxFails consecutive failures, the ejecting duration
+// starts from FailTimeout and doubles on every ejection till MaxFailTimeout,
+// a member ejected before is ejected again on its first failure, until it succeeds.
+//
+// The pool probes the members in background by making tunnels to HealthCheckTarget
+// when set, Close stops the probing.
+//
+// The members should NOT be changed after the pool is used.
+type Pool struct {
+	// Members super proxies of the pool
+	Members []*Member
+
+	// Strategy selection strategy, round-robin is used by default
+	Strategy Strategy
+
+	// MaxFails consecutive failures to eject the member, DefaultPoolMaxFails is used if not set
+	MaxFails int
+	// FailTimeout the first ejecting duration, DefaultPoolFailTimeout is used if not set
+	FailTimeout time.Duration
+	// MaxFailTimeout the max ejecting duration, DefaultPoolMaxFailTimeout is used if not set
+	MaxFailTimeout time.Duration
+
+	// Retries max tunnels retried on the other members after one failed,
+	// DefaultPoolRetries is used if not set, negative disables retrying
+	Retries int
+
+	// HealthCheckTarget host with port the health probes make tunnels to,
+	// the members are not probed if not set
+	HealthCheckTarget string
+	// HealthCheckInterval interval of the probes, DefaultHealthCheckInterval is used if not set
+	HealthCheckInterval time.Duration
+	// HealthCheckTimeout max duration of a probe, DefaultHealthCheckTimeout is used if not set
+	HealthCheckTimeout time.Duration
+
+	counter uint64
+	mu      sync.Mutex
+
+	initOnce  sync.Once
+	closeOnce sync.Once
+	stopCh    chan struct{}
+	bufioPool *bufiopool.Pool
+}
+
+// NewPool makes a pool with the given super proxies of the same weight
+func NewPool(strategy Strategy, proxies ...*SuperProxy) *Pool {
+	p := &Pool{Strategy: strategy}
+	for _, proxy := range proxies {
+		p.Members = append(p.Members, NewMember(proxy, 1))
+	}
+	return p
+}
+
+// Pool the pool the super proxy picked from, nil if it is not picked from a pool
+func (p *SuperProxy) Pool() *Pool {
+	if p.member == nil {
+		return nil
+	}
+	return p.member.pool
+}
+
+// TokensInUse the concurrency tokens of the super proxy in use
+func (p *SuperProxy) TokensInUse() int {
+	return cap(p.concurrencyChan) - len(p.concurrencyChan)
+}
+
+func (p *Pool) init() {
+	p.initOnce.Do(func() {
+		for _, m := range p.Members {
+			m.pool = p
+			m.Proxy.member = m
+		}
+		p.stopCh = make(chan struct{})
+		if len(p.HealthCheckTarget) > 0 {
+			p.bufioPool = bufiopool.New(bufiopool.MinReadBufferSize, bufiopool.MinWriteBufferSize)
+			go p.healthCheck()
+		}
+	})
+}
+
+// Close stops the health probes of the pool
+func (p *Pool) Close() {
+	p.init()
+	p.closeOnce.Do(func() {
+		close(p.stopCh)
+	})
+}
+
+// Pick picks an available super proxy, nil returned if all the members are ejected.
+// key is used by the sticky strategy.
+func (p *Pool) Pick(key string) *SuperProxy {
+	return p.PickExcept(key, nil)
+}
+
+// PickExcept picks an available super proxy other than the excluded ones,
+// which is used to retry on another member after the excluded ones failed
+func (p *Pool) PickExcept(key string, excluded []*SuperProxy) *SuperProxy {
+	if len(p.Members) == 0 {
+		return nil
+	}
+	p.init()
+	var m *Member
+	switch p.Strategy {
+	case StrategyWeighted:
+		m = p.pickWeighted(excluded)
+	case StrategyLeastInUse:
+		m = p.pickLeastInUse(excluded)
+	case StrategyRandom:
+		m = p.pickRandom(excluded)
+	case StrategySticky:
+		m = p.pickSticky(key, excluded)
+	default:
+		m = p.pickRoundRobin(excluded)
+	}
+	if m == nil {
+		return nil
+	}
+	return m.Proxy
+}
+
+// available if the member can be picked
+func available(m *Member, excluded []*SuperProxy) bool {
+	if m.IsEjected() {
+		return false
+	}
+	for _, e := range excluded {
+		if e == m.Proxy {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *Pool) pickRoundRobin(excluded []*SuperProxy) *Member {
+	n := len(p.Members)
+	start := int(atomic.AddUint64(&p.counter, 1) % uint64(n))
+	for i := 0; i < n; i++ {
+		if m := p.Members[(start+i)%n]; available(m, excluded) {
+			return m
+		}
+	}
+	return nil
+}
+
+// pickWeighted picks with the smooth weighted round-robin, which spreads
+// the picks of the heavy members rather than picking them in a row
+func (p *Pool) pickWeighted(excluded []*SuperProxy) *Member {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var picked *Member
+	total := 0
+	for _, m := range p.Members {
+		if !available(m, excluded) {
+			continue
+		}
+		w := m.weight()
+		m.currentWeight += w
+		total += w
+		if picked == nil || m.currentWeight > picked.currentWeight {
+			picked = m
+		}
+	}
+	if picked != nil {
+		picked.currentWeight -= total
+	}
+	return picked
+}
+
+func (p *Pool) pickLeastInUse(excluded []*SuperProxy) *Member {
+	n := len(p.Members)
+	// start from a rotating index so ties are balanced
+	start := int(atomic.AddUint64(&p.counter, 1) % uint64(n))
+	var picked *Member
+	least := 0
+	for i := 0; i < n; i++ {
+		m := p.Members[(start+i)%n]
+		if !available(m, excluded) {
+			continue
+		}
+		if c := m.Proxy.TokensInUse(); picked == nil || c < least {
+			picked, least = m, c
+		}
+	}
+	return picked
+}
+
+func (p *Pool) pickRandom(excluded []*SuperProxy) *Member {
+	// reservoir sampling over the available members
+	var picked *Member
+	n := 0
+	for _, m := range p.Members {
+		if !available(m, excluded) {
+			continue
+		}
+		n++
+		if rand.Intn(n) == 0 {
+			picked = m
+		}
+	}
+	return picked
+}
+
+// pickSticky picks by the rendezvous hash of the key, so only the keys
+// of the unavailable members are moved to the others
+func (p *Pool) pickSticky(key string, excluded []*SuperProxy) *Member {
+	var picked *Member
+	var highest uint32
+	for _, m := range p.Members {
+		if !available(m, excluded) {
+			continue
+		}
+		if h := hashKey(key, m.Proxy.hostWithPort); picked == nil || h > highest {
+			picked, highest = m, h
+		}
+	}
+	return picked
+}
+
+func hashKey(key, node string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	h.Write([]byte{'#'})
+	h.Write([]byte(node))
+	// fnv is poorly distributed for similar keys, finalize it
+	// using the avalanche step of murmur3
+	x := h.Sum32()
+	x ^= x >> 16
+	x *= 0x85ebca6b
+	x ^= x >> 13
+	x *= 0xc2b2ae35
+	x ^= x >> 16
+	return x
+}
+
+// MarkFailed records a failure of the super proxy picked from the pool,
+// ejects it when the consecutive failures reach MaxFails
+func (p *Pool) MarkFailed(proxy *SuperProxy) {
+	p.init()
+	if m := proxy.member; m != nil && m.pool == p {
+		p.markFailed(m)
+	}
+}
+
+// MarkSucceeded records a success of the super proxy picked from the pool,
+// which resets its failures and ejecting duration
+func (p *Pool) MarkSucceeded(proxy *SuperProxy) {
+	p.init()
+	if m := proxy.member; m != nil && m.pool == p {
+		p.markSucceeded(m)
+	}
+}
+
+func (p *Pool) markFailed(m *Member) {
+	if m.IsEjected() {
+		// failures of the requests made before ejected
+		return
+	}
+	maxFails := p.MaxFails
+	if maxFails <= 0 {
+		maxFails = DefaultPoolMaxFails
+	}
+	ejections := atomic.LoadUint32(&m.ejections)
+	if atomic.AddUint32(&m.fails, 1) < uint32(maxFails) && ejections == 0 {
+		return
+	}
+	failTimeout := p.FailTimeout
+	if failTimeout <= 0 {
+		failTimeout = DefaultPoolFailTimeout
+	}
+	maxFailTimeout := p.MaxFailTimeout
+	if maxFailTimeout <= 0 {
+		maxFailTimeout = DefaultPoolMaxFailTimeout
+	}
+	for i := uint32(0); i < ejections && failTimeout < maxFailTimeout; i++ {
+		failTimeout *= 2
+	}
+	if failTimeout > maxFailTimeout {
+		failTimeout = maxFailTimeout
+	}
+	atomic.StoreUint32(&m.fails, 0)
+	atomic.AddUint32(&m.ejections, 1)
+	atomic.StoreInt64(&m.ejectedUntil, servertime.CoarseTimeNow().Add(failTimeout).UnixNano())
+	ejectionsCounter.Inc()
+}
+
+func (p *Pool) markSucceeded(m *Member) {
+	if atomic.LoadUint32(&m.fails) > 0 {
+		atomic.StoreUint32(&m.fails, 0)
+	}
+	if atomic.LoadUint32(&m.ejections) > 0 && !m.IsEjected() {
+		atomic.StoreUint32(&m.ejections, 0)
+	}
+}
+
+// RetryLimit max tunnels retried on the other members after one failed
+func (p *Pool) RetryLimit() int {
+	if p.Retries == 0 {
+		return DefaultPoolRetries
+	}
+	if p.Retries < 0 {
+		return 0
+	}
+	return p.Retries
+}
+
+// healthCheck probes the members every interval until the pool closed
+func (p *Pool) healthCheck() {
+	interval := p.HealthCheckInterval
+	if interval <= 0 {
+		interval = DefaultHealthCheckInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stopCh:
+			return
+		case <-ticker.C:
+		}
+		var wg sync.WaitGroup
+		for _, m := range p.Members {
+			if m.IsEjected() {
+				continue
+			}
+			wg.Add(1)
+			go func(m *Member) {
+				defer wg.Done()
+				p.probe(m)
+			}(m)
+		}
+		wg.Wait()
+	}
+}
+
+// probe makes a tunnel to HealthCheckTarget through the member
+func (p *Pool) probe(m *Member) {
+	timeout := p.HealthCheckTimeout
+	if timeout <= 0 {
+		timeout = DefaultHealthCheckTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	go func() {
+		// give up the probe when the pool closed
+		select {
+		case <-p.stopCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	c, err := m.Proxy.MakeTunnel(ctx, nil, nil, p.bufioPool, p.HealthCheckTarget)
+	if err != nil {
+		if ctx.Err() != context.Canceled {
+			p.markFailed(m)
+		}
+		return
+	}
+	c.Close()
+	p.markSucceeded(m)
+}
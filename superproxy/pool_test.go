@@ -0,0 +1,262 @@
+package superproxy
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/haxii/fastproxy/servertime"
+)
+
+func newTestPool(t *testing.T, strategy Strategy, n int) *Pool {
+	var proxies []*SuperProxy
+	for i := 0; i < n; i++ {
+		sp, err := NewSuperProxy("10.0.0."+strconv.Itoa(i+1), 3128, ProxyTypeHTTP, "", "", "")
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		proxies = append(proxies, sp)
+	}
+	return NewPool(strategy, proxies...)
+}
+
+func ejectMember(p *Pool, m *Member) {
+	for i := 0; i < DefaultPoolMaxFails; i++ {
+		p.MarkFailed(m.Proxy)
+	}
+}
+
+func TestPoolPickRoundRobin(t *testing.T) {
+	p := newTestPool(t, StrategyRoundRobin, 3)
+	counts := make(map[*SuperProxy]int)
+	for i := 0; i < 30; i++ {
+		counts[p.Pick("")]++
+	}
+	for _, m := range p.Members {
+		if counts[m.Proxy] != 10 {
+			t.Fatalf("super proxy %s picked %d times, expecting 10", m.Proxy.HostWithPort(), counts[m.Proxy])
+		}
+		if m.Proxy.Pool() != p {
+			t.Fatalf("picked super proxy should tell its pool")
+		}
+	}
+}
+
+func TestPoolPickWeighted(t *testing.T) {
+	p := newTestPool(t, StrategyWeighted, 2)
+	p.Members[0].Weight = 3
+	a, b := p.Members[0].Proxy, p.Members[1].Proxy
+	var picks []*SuperProxy
+	for i := 0; i < 8; i++ {
+		picks = append(picks, p.Pick(""))
+	}
+	counts := make(map[*SuperProxy]int)
+	for i, sp := range picks {
+		counts[sp]++
+		if i > 0 && sp == b && picks[i-1] == b {
+			t.Fatalf("the light member should not be picked in a row")
+		}
+	}
+	if counts[a] != 6 || counts[b] != 2 {
+		t.Fatalf("unexpected picks %d:%d, expecting 6:2", counts[a], counts[b])
+	}
+}
+
+func TestPoolPickLeastInUse(t *testing.T) {
+	p := newTestPool(t, StrategyLeastInUse, 3)
+	p.Members[0].Proxy.AcquireToken(context.Background())
+	p.Members[0].Proxy.AcquireToken(context.Background())
+	p.Members[2].Proxy.AcquireToken(context.Background())
+	for i := 0; i < 10; i++ {
+		if sp := p.Pick(""); sp != p.Members[1].Proxy {
+			t.Fatalf("unexpected super proxy %s, expecting the least in use", sp.HostWithPort())
+		}
+	}
+}
+
+func TestPoolPickRandom(t *testing.T) {
+	p := newTestPool(t, StrategyRandom, 3)
+	ejectMember(p, p.Members[0])
+	hit := make(map[*SuperProxy]bool)
+	for i := 0; i < 100; i++ {
+		hit[p.Pick("")] = true
+	}
+	if hit[p.Members[0].Proxy] {
+		t.Fatalf("ejected super proxy should not be picked")
+	}
+	if len(hit) != 2 {
+		t.Fatalf("available super proxies should all be picked, got %d", len(hit))
+	}
+}
+
+func TestPoolPickSticky(t *testing.T) {
+	p := newTestPool(t, StrategySticky, 3)
+	picked := make(map[string]*SuperProxy)
+	hit := make(map[*SuperProxy]bool)
+	for i := 0; i < 100; i++ {
+		key := "session-" + strconv.Itoa(i)
+		sp := p.Pick(key)
+		picked[key] = sp
+		hit[sp] = true
+		if again := p.Pick(key); again != sp {
+			t.Fatalf("key %s picked different super proxies", key)
+		}
+	}
+	if len(hit) != 3 {
+		t.Fatalf("keys should be distributed to all super proxies, got %d", len(hit))
+	}
+
+	// only the keys of the ejected member are moved
+	ejected := p.Members[0]
+	ejectMember(p, ejected)
+	for key, sp := range picked {
+		now := p.Pick(key)
+		if now == ejected.Proxy {
+			t.Fatalf("ejected super proxy should not be picked")
+		}
+		if sp != ejected.Proxy && now != sp {
+			t.Fatalf("key %s moved from %s to %s", key, sp.HostWithPort(), now.HostWithPort())
+		}
+	}
+}
+
+func TestPoolPickExcept(t *testing.T) {
+	p := newTestPool(t, StrategySticky, 3)
+	first := p.Pick("key")
+	second := p.PickExcept("key", []*SuperProxy{first})
+	if second == nil || second == first {
+		t.Fatalf("another super proxy should be picked")
+	}
+	if p.PickExcept("key", []*SuperProxy{first, second, p.PickExcept("key", []*SuperProxy{first, second})}) != nil {
+		t.Fatalf("nothing should be picked when all excluded")
+	}
+}
+
+func TestPoolEjectionBackoff(t *testing.T) {
+	p := newTestPool(t, StrategyRoundRobin, 2)
+	p.MaxFails = 2
+	p.FailTimeout = time.Minute
+	p.MaxFailTimeout = 3 * time.Minute
+	p.Pick("")
+	m := p.Members[0]
+	ejectedFor := func() time.Duration {
+		return time.Duration(atomic.LoadInt64(&m.ejectedUntil) - servertime.CoarseTimeNow().UnixNano())
+	}
+	expire := func() {
+		atomic.StoreInt64(&m.ejectedUntil, servertime.CoarseTimeNow().Add(-time.Second).UnixNano())
+	}
+
+	// failures are reset by success
+	p.MarkFailed(m.Proxy)
+	p.MarkSucceeded(m.Proxy)
+	p.MarkFailed(m.Proxy)
+	if m.IsEjected() {
+		t.Fatalf("super proxy should not be ejected before max fails reached")
+	}
+	p.MarkFailed(m.Proxy)
+	if !m.IsEjected() {
+		t.Fatalf("super proxy should be ejected after max fails reached")
+	}
+	if d := ejectedFor(); d <= 0 || d > time.Minute {
+		t.Fatalf("unexpected ejecting duration %s", d)
+	}
+
+	// ejected again on the first failure with the doubled duration
+	expire()
+	p.MarkFailed(m.Proxy)
+	if d := ejectedFor(); d <= time.Minute || d > 2*time.Minute {
+		t.Fatalf("unexpected ejecting duration %s", d)
+	}
+	expire()
+	p.MarkFailed(m.Proxy)
+	if d := ejectedFor(); d <= 2*time.Minute || d > 3*time.Minute {
+		t.Fatalf("ejecting duration %s should be limited by max fail timeout", d)
+	}
+
+	// success resets the ejecting duration
+	expire()
+	p.MarkSucceeded(m.Proxy)
+	p.MarkFailed(m.Proxy)
+	if m.IsEjected() {
+		t.Fatalf("super proxy should not be ejected before max fails reached after success")
+	}
+}
+
+func TestPoolHealthCheck(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer ln.Close()
+	var healthy int32 = 1
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				if _, err := http.ReadRequest(bufio.NewReader(c)); err != nil {
+					return
+				}
+				if atomic.LoadInt32(&healthy) == 1 {
+					c.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+				} else {
+					c.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
+				}
+			}(c)
+		}
+	}()
+
+	healthyProxy, _ := NewSuperProxy("127.0.0.1", uint16(ln.Addr().(*net.TCPAddr).Port), ProxyTypeHTTP, "", "", "")
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	closed.Close()
+	deadProxy, _ := NewSuperProxy("127.0.0.1", uint16(closed.Addr().(*net.TCPAddr).Port), ProxyTypeHTTP, "", "", "")
+
+	p := NewPool(StrategyRoundRobin, healthyProxy, deadProxy)
+	p.MaxFails = 1
+	p.FailTimeout = time.Hour
+	p.HealthCheckTarget = "example.com:443"
+	p.HealthCheckInterval = 10 * time.Millisecond
+	defer p.Close()
+	p.Pick("")
+
+	waitEjected := func(m *Member) bool {
+		for i := 0; i < 100; i++ {
+			if m.IsEjected() {
+				return true
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return false
+	}
+	if !waitEjected(p.Members[1]) {
+		t.Fatalf("unreachable super proxy should be ejected by the probes")
+	}
+	if p.Members[0].IsEjected() {
+		t.Fatalf("healthy super proxy should not be ejected")
+	}
+	for i := 0; i < 10; i++ {
+		if sp := p.Pick(""); sp != healthyProxy {
+			t.Fatalf("only the healthy super proxy should be picked")
+		}
+	}
+
+	// the super proxy failed to make tunnels is ejected as well
+	atomic.StoreInt32(&healthy, 0)
+	if !waitEjected(p.Members[0]) {
+		t.Fatalf("super proxy failed to make tunnels should be ejected by the probes")
+	}
+	if p.Pick("") != nil {
+		t.Fatalf("nothing should be picked when all ejected")
+	}
+}
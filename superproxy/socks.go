@@ -7,6 +7,7 @@ import (
 	"strconv"
 
 	"github.com/haxii/fastproxy/bytebufferpool"
+	"github.com/haxii/fastproxy/transport"
 )
 
 const socks5Version = 5
@@ -77,8 +78,8 @@ func (p *SuperProxy) connectSOCKS5Proxy(conn net.Conn, targetHost string, target
 			p.hostWithPort + " has unexpected version " + strconv.Itoa(int(buf.B[0])))
 	}
 	if buf.B[1] == 0xff {
-		return errors.New("proxy: SOCKS5 proxy at " +
-			p.hostWithPort + " requires authentication")
+		return &transport.Error{Kind: transport.ErrorKindSuperProxyAuth, Err: errors.New("proxy: SOCKS5 proxy at " +
+			p.hostWithPort + " requires authentication")}
 	}
 
 	// See RFC 1929
@@ -94,8 +95,8 @@ func (p *SuperProxy) connectSOCKS5Proxy(conn net.Conn, targetHost string, target
 		}
 
 		if buf.B[1] != 0 {
-			return errors.New("proxy: SOCKS5 proxy at " +
-				p.hostWithPort + " rejected username/password")
+			return &transport.Error{Kind: transport.ErrorKindSuperProxyAuth, Err: errors.New("proxy: SOCKS5 proxy at " +
+				p.hostWithPort + " rejected username/password")}
 		}
 	}
 
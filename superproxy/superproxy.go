@@ -1,12 +1,12 @@
 package superproxy
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
 	"net"
 	"strconv"
-	"time"
 
 	"github.com/haxii/fastproxy/bufiopool"
 	"github.com/haxii/fastproxy/transport"
@@ -25,6 +25,9 @@ const (
 
 	// DefaultMaxConcurrency a max concurrency setting for super proxy by default
 	DefaultMaxConcurrency = 128
+
+	// DefaultMaxConns max connections pooled to a super proxy by default
+	DefaultMaxConns = 1024
 )
 
 //SuperProxy chaining proxy
@@ -37,7 +40,8 @@ type SuperProxy struct {
 
 	// proxyType, HTTP/HTTPS/SOCKS5
 	proxyType ProxyType
-	// proxy net connections pool/manager
+	// proxy net connections pool/manager, which pools the keep-alive
+	// connections of the absolute-form requests to HTTP/HTTPS proxies
 	connManager transport.ConnManager
 
 	// whether the super proxy supports SSL encryption?
@@ -53,6 +57,9 @@ type SuperProxy struct {
 
 	//concurrency chan
 	concurrencyChan chan struct{}
+
+	// member of the pool the super proxy belongs to
+	member *Member
 }
 
 // NewSuperProxy new a super proxy
@@ -70,8 +77,8 @@ func NewSuperProxy(proxyHost string, proxyPort uint16, proxyType ProxyType,
 	s := &SuperProxy{
 		proxyType: proxyType,
 		connManager: transport.ConnManager{
-			MaxConns:            1024,
-			MaxIdleConnDuration: 10 * time.Second,
+			MaxConns:            DefaultMaxConns,
+			MaxIdleConnDuration: transport.DefaultMaxIdleConnDuration,
 		},
 	}
 	s.hostWithPort = fmt.Sprintf("%s:%d", proxyHost, proxyPort)
@@ -123,64 +130,76 @@ func (p *SuperProxy) HTTPProxyAuthHeaderWithCRLF() []byte {
 	return p.authHeaderWithCRLF
 }
 
-// MakeTunnel makes a TCP tunnel by making a connect request to proxy
-func (p *SuperProxy) MakeTunnel(dial func(addr string) (net.Conn, error),
+// MakeTunnel makes a TCP tunnel by making a connect request to proxy,
+// the tunnel making is given up when ctx is done
+func (p *SuperProxy) MakeTunnel(ctx context.Context, dial func(addr string) (net.Conn, error),
 	dialTLS func(addr string, tlsConfig *tls.Config) (net.Conn, error),
 	pool *bufiopool.Pool, targetHostWithPort string) (net.Conn, error) {
-	var (
-		c   net.Conn
-		err error
-	)
-	switch p.proxyType {
-	case ProxyTypeHTTP:
-		fallthrough
-	case ProxyTypeSOCKS5:
-		if dial != nil {
-			c, err = dial(p.hostWithPort)
-		} else {
-			c, err = transport.Dial(p.hostWithPort)
-		}
-	case ProxyTypeHTTPS:
-		if dialTLS != nil {
-			c, err = dialTLS(p.hostWithPort, p.tlsConfig)
-		} else {
-			c, err = transport.DialTLS(p.hostWithPort, p.tlsConfig)
-		}
+	c, err := p.Dial(ctx, dial, dialTLS)
+	if err != nil {
+		return nil, err
 	}
 
+	// interrupt the handshaking with proxy when ctx is done
+	stopWatching := transport.WatchContext(ctx, c)
+	err = p.handshake(c, pool, targetHostWithPort)
+	stopWatching()
+	if err == nil {
+		err = ctx.Err()
+	}
 	if err != nil {
+		c.Close()
 		return nil, err
 	}
+	return c, nil
+}
+
+// Dial makes a connection to the proxy, which is a TLS one for HTTPS proxies,
+// the dialing is given up when ctx is done if the default dialers are used
+func (p *SuperProxy) Dial(ctx context.Context, dial func(addr string) (net.Conn, error),
+	dialTLS func(addr string, tlsConfig *tls.Config) (net.Conn, error)) (net.Conn, error) {
+	if p.proxyType == ProxyTypeHTTPS {
+		if dialTLS != nil {
+			return dialTLS(p.hostWithPort, p.tlsConfig)
+		}
+		return transport.DialTLSContext(ctx, p.hostWithPort, p.tlsConfig)
+	}
+	if dial != nil {
+		return dial(p.hostWithPort)
+	}
+	return transport.DialContext(ctx, p.hostWithPort)
+}
 
+// ConnManager the manager pooling the keep-alive connections to the HTTP/HTTPS
+// proxy for the absolute-form requests, the pool belongs to the super proxy
+// with its credentials, which holds at most DefaultMaxConns connections
+func (p *SuperProxy) ConnManager() *transport.ConnManager {
+	return &p.connManager
+}
+
+// handshake asks the proxy to make a tunnel to target
+func (p *SuperProxy) handshake(c net.Conn, pool *bufiopool.Pool, targetHostWithPort string) error {
 	if p.proxyType != ProxyTypeSOCKS5 {
 		// HTTP/HTTPS tunnel establishing
-		_, err := p.writeHTTPProxyReq(c, []byte(targetHostWithPort))
-		if err != nil {
-			c.Close()
-			return nil, err
-		}
-		if err = p.readHTTPProxyResp(c, pool); err != nil {
-			c.Close()
-			return nil, err
-		}
-	} else {
-		// SOCKS5 tunnel establishing
-		targetHost, targetPortStr, err := net.SplitHostPort(targetHostWithPort)
-		if err != nil {
-			return nil, err
-		}
-		targetPort, err := strconv.Atoi(targetPortStr)
-		if err != nil {
-			return nil, errors.New("proxy: failed to parse target port number: " + targetPortStr)
-		}
-		if targetPort < 1 || targetPort > 0xffff {
-			return nil, errors.New("proxy: target port number out of range: " + targetPortStr)
-		}
-		if err = p.connectSOCKS5Proxy(c, targetHost, targetPort); err != nil {
-			return nil, err
+		if _, err := p.writeHTTPProxyReq(c, []byte(targetHostWithPort)); err != nil {
+			return err
 		}
+		return p.readHTTPProxyResp(c, pool)
 	}
-	return c, nil
+
+	// SOCKS5 tunnel establishing
+	targetHost, targetPortStr, err := net.SplitHostPort(targetHostWithPort)
+	if err != nil {
+		return err
+	}
+	targetPort, err := strconv.Atoi(targetPortStr)
+	if err != nil {
+		return errors.New("proxy: failed to parse target port number: " + targetPortStr)
+	}
+	if targetPort < 1 || targetPort > 0xffff {
+		return errors.New("proxy: target port number out of range: " + targetPortStr)
+	}
+	return p.connectSOCKS5Proxy(c, targetHost, targetPort)
 }
 
 // SetMaxConcurrency sets max concurrency,
@@ -197,12 +216,20 @@ func (p *SuperProxy) SetMaxConcurrency(n int) {
 }
 
 // AcquireToken acquire a token from concurrencyChan,
-// block here if concurrencyChan is empty
-func (p *SuperProxy) AcquireToken() {
-	<-p.concurrencyChan
+// block here if concurrencyChan is empty until ctx is done,
+// ctx.Err() is returned then and no token should be pushed back
+func (p *SuperProxy) AcquireToken(ctx context.Context) error {
+	select {
+	case <-p.concurrencyChan:
+		tokensInUseGauge.Inc()
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 // PushBackToken push a token back to concurrencyChan
 func (p *SuperProxy) PushBackToken() {
+	tokensInUseGauge.Dec()
 	p.concurrencyChan <- struct{}{}
 }
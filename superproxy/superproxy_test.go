@@ -2,6 +2,7 @@ package superproxy
 
 import (
 	"bytes"
+	"context"
 	"io"
 	"net"
 	"net/http"
@@ -13,9 +14,22 @@ import (
 	"github.com/haxii/fastproxy/bufiopool"
 )
 
+// skipIfNoLocalProxy skips the test depending on the local super proxies
+// listening on addrs, which are not available in every environment
+func skipIfNoLocalProxy(t *testing.T, addrs ...string) {
+	for _, addr := range addrs {
+		c, err := net.DialTimeout("tcp", addr, time.Second)
+		if err != nil {
+			t.Skipf("super proxy %s not available: %s", addr, err)
+		}
+		c.Close()
+	}
+}
+
 // TestNewSuperProxy test new super proxy with http, https and socks5 types
 // and test if those superproxy can make tunnel with a simple server
 func TestNewSuperProxy(t *testing.T) {
+	skipIfNoLocalProxy(t, "localhost:3128", "localhost:3129", "localhost:9099")
 	var j = 0
 	go func() {
 		http.HandleFunc("/test", func(w http.ResponseWriter, r *http.Request) {
@@ -57,7 +71,7 @@ func testNewSuperProxyWithHTTPType(t *testing.T) {
 		t.Fatalf("unexpected host with port bytes")
 	}
 	pool := bufiopool.New(1, 1)
-	conn, err := superProxy.MakeTunnel(pool, "localhost:9999")
+	conn, err := superProxy.MakeTunnel(context.Background(), nil, nil, pool, "localhost:9999")
 	if err != nil {
 		t.Fatalf("unexpected error: %s", err.Error())
 	}
@@ -90,7 +104,7 @@ func testNewSuperProxyWithSocks5Type(t *testing.T) {
 	}
 
 	pool := bufiopool.New(1, 1)
-	conn, err := superProxy.MakeTunnel(pool, "localhost:9999")
+	conn, err := superProxy.MakeTunnel(context.Background(), nil, nil, pool, "localhost:9999")
 	if err != nil {
 		t.Fatalf("unexpected error: %s", err.Error())
 	}
@@ -150,7 +164,7 @@ h0cEia4cq5miAgYT3lkfyFJsLFcvZ2Jj/c/eulT155LNqqjaKT06IhvnaLrdgpVX
 	}
 	superProxy.tlsConfig.InsecureSkipVerify = true
 	pool := bufiopool.New(1, 1)
-	conn, err := superProxy.MakeTunnel(pool, "localhost:9999")
+	conn, err := superProxy.MakeTunnel(context.Background(), nil, nil, pool, "localhost:9999")
 	if err != nil {
 		t.Fatalf("unexpected error: %s", err.Error())
 	}
@@ -191,26 +205,32 @@ func testSuperProxyConcurrency(t *testing.T) {
 		go func() {
 			conn, err := net.Dial("tcp4", "localhost:9999")
 			if err != nil {
-				t.Fatalf("unexpected error: %s", err)
+				t.Errorf("unexpected error: %s", err)
+				return
 			}
 			if _, err = conn.Write([]byte("GET /test HTTP/1.1\r\nHost: localhost:9999\r\n\r\n")); err != nil {
-				t.Fatalf("unexpected error: %s", err.Error())
+				t.Errorf("unexpected error: %s", err.Error())
+				return
 			}
 			result := make([]byte, 1000)
 			if i < 2 {
 				if _, err = conn.Read(result); err != nil {
-					t.Fatalf("unexpected error: %s", err.Error())
+					t.Errorf("unexpected error: %s", err.Error())
+					return
 				}
 				if !strings.Contains(string(result), "HTTP/1.1 200 OK") {
-					t.Fatalf("unexpected result")
+					t.Errorf("unexpected result")
+					return
 				}
 			}
 			if i > 1 {
 				if _, err = conn.Read(result); err == nil {
-					t.Fatal("expected error: EOF")
+					t.Error("expected error: EOF")
+					return
 				}
 				if err != io.EOF {
-					t.Fatalf("expected error: EOF, but get unexpected error: %s", err)
+					t.Errorf("expected error: EOF, but get unexpected error: %s", err)
+					return
 				}
 			}
 			conn.Close()
@@ -226,24 +246,43 @@ func testSuperProxyConcurrency(t *testing.T) {
 	superProxy.SetMaxConcurrency(2)
 	time.Sleep(5 * time.Second)
 	for i := 0; i < 6; i++ {
-		superProxy.AcquireToken()
+		superProxy.AcquireToken(context.Background())
 		go func() {
-			conn, err := superProxy.MakeTunnel(pool, "localhost:9999")
+			defer superProxy.PushBackToken()
+			conn, err := superProxy.MakeTunnel(context.Background(), nil, nil, pool, "localhost:9999")
 			if err != nil {
-				t.Fatalf("unexpected error: %s", err.Error())
+				t.Errorf("unexpected error: %s", err.Error())
+				return
 			}
 			if _, err = conn.Write([]byte("GET /test HTTP/1.1\r\nHost: localhost:9999\r\n\r\n")); err != nil {
-				t.Fatalf("unexpected error: %s", err.Error())
+				t.Errorf("unexpected error: %s", err.Error())
+				return
 			}
 			result := make([]byte, 1000)
 			if _, err = conn.Read(result); err != nil {
-				t.Fatalf("unexpected error: %s", err.Error())
+				t.Errorf("unexpected error: %s", err.Error())
+				return
 			}
 			if !strings.Contains(string(result), "HTTP/1.1 200 OK") {
-				t.Fatalf("unexpected result: %s", result)
+				t.Errorf("unexpected result: %s", result)
+				return
 			}
-			superProxy.PushBackToken()
 		}()
 		time.Sleep(1 * time.Second)
 	}
 }
+
+// test the pool cap is kept by the concurrency setting
+func TestSuperProxyMaxConns(t *testing.T) {
+	superProxy, err := NewSuperProxy("localhost", uint16(3128), ProxyTypeHTTP, "", "", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if superProxy.ConnManager().MaxConns != DefaultMaxConns {
+		t.Fatalf("unexpected max conns %d", superProxy.ConnManager().MaxConns)
+	}
+	superProxy.SetMaxConcurrency(2)
+	if superProxy.ConnManager().MaxConns != DefaultMaxConns {
+		t.Fatalf("max conns %d should not be changed by the concurrency", superProxy.ConnManager().MaxConns)
+	}
+}
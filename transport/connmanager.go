@@ -2,7 +2,6 @@ package transport
 
 import (
 	"errors"
-	"io"
 	"net"
 	"sync"
 	"time"
@@ -62,39 +61,58 @@ var (
 // Dialer returns a connection
 type NewConn func() (net.Conn, error)
 
-// AcquireConn acquire a connection
+// AcquireConn acquire a connection, an idle one is reused if available,
+// otherwise a new one is made by dialer
 func (c *ConnManager) AcquireConn(dialer NewConn) (*Conn, error) {
-	var cc *Conn
-	createConn := false
-	startCleaner := false
-
-	var n int
-	c.connsLock.Lock()
-	n = len(c.conns)
-	if n == 0 {
-		maxConns := c.MaxConns
-		if maxConns <= 0 {
-			maxConns = DefaultMaxConnsPerHost
+	for {
+		cc := c.acquireIdleConn()
+		if cc == nil {
+			return c.AcquireNewConn(dialer)
 		}
-		if c.connsCount < maxConns {
-			c.connsCount++
-			createConn = true
-			if !c.connsCleanerRun {
-				startCleaner = true
-				c.connsCleanerRun = true
-			}
+		// the idle connection may be closed by remote after released
+		if !c.isConnClosedByRemote(cc) {
+			return cc, nil
 		}
-	} else {
+		c.CloseConn(cc)
+	}
+}
+
+// acquireIdleConn acquire the most recently used idle connection, nil if none
+func (c *ConnManager) acquireIdleConn() *Conn {
+	var cc *Conn
+	c.connsLock.Lock()
+	if n := len(c.conns); n > 0 {
 		n--
 		cc = c.conns[n]
 		c.conns[n] = nil
 		c.conns = c.conns[:n]
 	}
 	c.connsLock.Unlock()
+	return cc
+}
+
+// AcquireNewConn acquire a new connection made by dialer without reusing the
+// idle ones, which is used for the connections never released, e.g. tunnels
+func (c *ConnManager) AcquireNewConn(dialer NewConn) (*Conn, error) {
+	createConn := false
+	startCleaner := false
 
-	if cc != nil {
-		return cc, nil
+	c.connsLock.Lock()
+	maxConns := c.MaxConns
+	if maxConns <= 0 {
+		maxConns = DefaultMaxConnsPerHost
+	}
+	if c.connsCount < maxConns {
+		c.connsCount++
+		connsGauge.Inc()
+		createConn = true
+		if !c.connsCleanerRun {
+			startCleaner = true
+			c.connsCleanerRun = true
+		}
 	}
+	c.connsLock.Unlock()
+
 	if !createConn {
 		return nil, ErrNoFreeConns
 	}
@@ -108,20 +126,17 @@ func (c *ConnManager) AcquireConn(dialer NewConn) (*Conn, error) {
 		c.decConnsCount()
 		return nil, err
 	}
-	cc = acquireClientConn(conn)
-
-	return cc, nil
+	return acquireClientConn(conn), nil
 }
 
 func (c *ConnManager) connsCleaner() {
-	if c.MaxIdleConnDuration <= 0 {
-		c.MaxIdleConnDuration = DefaultMaxIdleConnDuration
-	}
-
 	var (
 		scratch             []*Conn
 		maxIdleConnDuration = c.MaxIdleConnDuration
 	)
+	if maxIdleConnDuration <= 0 {
+		maxIdleConnDuration = DefaultMaxIdleConnDuration
+	}
 	for {
 		currentTime := time.Now()
 
@@ -175,30 +190,42 @@ func (c *ConnManager) decConnsCount() {
 	c.connsLock.Lock()
 	c.connsCount--
 	c.connsLock.Unlock()
+	connsGauge.Dec()
 }
 
-// ReleaseConn release the connection back into host connection pool
+// ReleaseConn release the connection back into host connection pool,
+// it's closed after MaxIdleConnDuration if not reused
 func (c *ConnManager) ReleaseConn(cc *Conn) {
-	go func() { // release the connection in new go routine cause of the delay
-		if c.isConnClosedByRemote(cc.c, 10*time.Microsecond) {
-			c.CloseConn(cc)
-			return
-		}
-		cc.lastUseTime = servertime.CoarseTimeNow()
-		c.connsLock.Lock()
-		c.conns = append(c.conns, cc)
-		c.connsLock.Unlock()
-	}()
+	cc.lastUseTime = servertime.CoarseTimeNow()
+	c.connsLock.Lock()
+	c.conns = append(c.conns, cc)
+	c.connsLock.Unlock()
 }
 
-func (c *ConnManager) isConnClosedByRemote(conn net.Conn, delay time.Duration) bool {
-	one := []byte{'1'}
-	conn.SetReadDeadline(time.Now().Add(delay))
-	if _, err := conn.Read(one); err == io.EOF {
+// closedByRemoteCheckDelay duration waiting for the idle connection's EOF
+const closedByRemoteCheckDelay = 10 * time.Microsecond
+
+// isConnClosedByRemote checks if the idle connection is closed by remote,
+// any data received on an idle connection is unexpected, so it's closed too
+func (c *ConnManager) isConnClosedByRemote(cc *Conn) bool {
+	var one [1]byte
+	conn := cc.c
+	if err := conn.SetReadDeadline(time.Now().Add(closedByRemoteCheckDelay)); err != nil {
+		return true
+	}
+	n, err := conn.Read(one[:])
+	if n > 0 {
+		return true
+	}
+	if e, ok := err.(net.Error); !ok || !e.Timeout() {
 		return true
 	}
 	var zero time.Time
-	conn.SetReadDeadline(zero)
+	if conn.SetReadDeadline(zero) != nil {
+		return true
+	}
+	// the read deadline is updated again on next use
+	cc.LastReadDeadlineTime = zero
 	return false
 }
 
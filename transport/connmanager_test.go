@@ -0,0 +1,87 @@
+package transport
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestConnManagerReuse(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer ln.Close()
+	serverConns := make(chan net.Conn, 4)
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			serverConns <- c
+		}
+	}()
+
+	dials := 0
+	dialer := func() (net.Conn, error) {
+		dials++
+		return net.Dial("tcp", ln.Addr().String())
+	}
+	m := &ConnManager{}
+
+	cc, err := m.AcquireConn(dialer)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	s1 := <-serverConns
+	m.ReleaseConn(cc)
+	cc, err = m.AcquireConn(dialer)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if dials != 1 {
+		t.Fatalf("idle connection should be reused, but %d dials made", dials)
+	}
+
+	// the idle connection closed by remote should not be reused
+	m.ReleaseConn(cc)
+	cc, err = m.AcquireNewConn(dialer)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if dials != 2 {
+		t.Fatalf("new connection should be made, but %d dials made", dials)
+	}
+	m.CloseConn(cc)
+	s1.Close()
+	(<-serverConns).Close()
+	time.Sleep(10 * time.Millisecond)
+	cc, err = m.AcquireConn(dialer)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if dials != 3 {
+		t.Fatalf("connection closed by remote should not be reused, %d dials made", dials)
+	}
+	m.CloseConn(cc)
+}
+
+func TestConnManagerUnexpectedData(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	m := &ConnManager{}
+	cc, err := m.AcquireNewConn(func() (net.Conn, error) { return client, nil })
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if m.isConnClosedByRemote(cc) {
+		t.Fatalf("idle connection should be alive")
+	}
+	go server.Write([]byte("unexpected"))
+	time.Sleep(10 * time.Millisecond)
+	if !m.isConnClosedByRemote(cc) {
+		t.Fatalf("connection with unexpected data should not be reused")
+	}
+	m.CloseConn(cc)
+}
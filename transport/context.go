@@ -0,0 +1,43 @@
+package transport
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// aLongTimeAgo a non-zero time in the past, used to interrupt the blocking I/O
+var aLongTimeAgo = time.Unix(1, 0)
+
+// WatchContext interrupts the blocking reads and writes of conn when ctx is done,
+// by setting the deadline of conn to a time in the past.
+//
+// The returned stop func must be called after the I/O with conn finished,
+// it waits the watching go routine to make sure the deadline is no longer
+// touched. The deadline of conn should be considered broken if ctx.Err() is
+// not nil after stopping.
+func WatchContext(ctx context.Context, conn net.Conn) (stop func()) {
+	if ctx.Done() == nil {
+		// never be done, e.g. context.Background()
+		return func() {}
+	}
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(aLongTimeAgo)
+		case <-done:
+		}
+		close(stopped)
+	}()
+	isStopped := false
+	return func() {
+		if isStopped {
+			return
+		}
+		isStopped = true
+		close(done)
+		<-stopped
+	}
+}
@@ -0,0 +1,113 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"time"
+)
+
+// ErrorKind the kind of failure when connecting or talking to the upstream
+type ErrorKind int
+
+const (
+	// ErrorKindUnknown failures not classified
+	ErrorKindUnknown ErrorKind = iota
+	// ErrorKindDial failed to connect to the upstream
+	ErrorKindDial
+	// ErrorKindDNS failed to resolve the upstream host
+	ErrorKindDNS
+	// ErrorKindTLSHandshake failed to handshake TLS with the upstream
+	ErrorKindTLSHandshake
+	// ErrorKindTimeout the upstream timed out
+	ErrorKindTimeout
+	// ErrorKindSuperProxyAuth the super proxy rejected the credentials
+	ErrorKindSuperProxyAuth
+	// ErrorKindUnavailable no connection available to the upstream
+	ErrorKindUnavailable
+)
+
+// String the kind in snake case, e.g. `dns_failure`
+func (k ErrorKind) String() string {
+	switch k {
+	case ErrorKindDial:
+		return "dial_failure"
+	case ErrorKindDNS:
+		return "dns_failure"
+	case ErrorKindTLSHandshake:
+		return "tls_handshake_failure"
+	case ErrorKindTimeout:
+		return "upstream_timeout"
+	case ErrorKindSuperProxyAuth:
+		return "super_proxy_auth_failure"
+	case ErrorKindUnavailable:
+		return "upstream_unavailable"
+	}
+	return "upstream_failure"
+}
+
+// Error the failure of kind, which can't be told from the error itself
+type Error struct {
+	Kind ErrorKind
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// KindOf classifies the error returned by the dialers and clients
+func KindOf(err error) ErrorKind {
+	var e *Error
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	var opErr *net.OpError
+	switch {
+	case err == nil:
+		return ErrorKindUnknown
+	case errors.As(err, &e):
+		return e.Kind
+	case err == ErrDialTimeout || err == ErrTimeout || errors.Is(err, context.DeadlineExceeded):
+		return ErrorKindTimeout
+	case err == ErrNoFreeConns:
+		return ErrorKindUnavailable
+	case err == errNoDNSEntries || errors.As(err, &dnsErr):
+		return ErrorKindDNS
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return ErrorKindTimeout
+	case errors.As(err, &opErr) && opErr.Op == "dial":
+		return ErrorKindDial
+	}
+	return ErrorKindUnknown
+}
+
+// HandshakeTLS handshakes the TLS connection if not yet, the handshaking
+// is given up when ctx is done or timeout exceeds, DefaultTLSHandshakeTimeout
+// is used if timeout not set. The failure is an Error of ErrorKindTLSHandshake.
+func HandshakeTLS(ctx context.Context, conn net.Conn, timeout time.Duration) error {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok || tlsConn.ConnectionState().HandshakeComplete {
+		return nil
+	}
+	if timeout <= 0 {
+		timeout = DefaultTLSHandshakeTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		switch ctx.Err() {
+		case context.Canceled:
+			return context.Canceled
+		case context.DeadlineExceeded:
+			return &Error{Kind: ErrorKindTimeout, Err: err}
+		}
+		return &Error{Kind: ErrorKindTLSHandshake, Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestKindOf(t *testing.T) {
+	testKindOf(t, ErrDialTimeout, ErrorKindTimeout)
+	testKindOf(t, ErrNoFreeConns, ErrorKindUnavailable)
+	testKindOf(t, context.DeadlineExceeded, ErrorKindTimeout)
+	testKindOf(t, &net.DNSError{Err: "no such host", Name: "foo.bar"}, ErrorKindDNS)
+	testKindOf(t, &net.OpError{Op: "dial", Err: errors.New("connection refused")}, ErrorKindDial)
+	testKindOf(t, &Error{Kind: ErrorKindSuperProxyAuth, Err: errors.New("rejected")}, ErrorKindSuperProxyAuth)
+	testKindOf(t, errors.New("unknown"), ErrorKindUnknown)
+
+	d := &Dialer{LookupIP: func(host string) ([]net.IP, error) {
+		return nil, errors.New("lookup failed")
+	}}
+	_, err := d.Dial(context.Background(), "foo.bar:80", time.Second, false, nil)
+	testKindOf(t, err, ErrorKindDNS)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	_, err = Dial(addr)
+	testKindOf(t, err, ErrorKindDial)
+}
+
+func testKindOf(t *testing.T, err error, expKind ErrorKind) {
+	if kind := KindOf(err); kind != expKind {
+		t.Fatalf("error %v: expected kind %s, got %s", err, expKind, kind)
+	}
+}
+
+func TestHandshakeTLS(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			// a plain text server
+			c.Write([]byte("HTTP/1.1 400 Bad Request\r\nConnection: close\r\n\r\n"))
+			c.Close()
+		}
+	}()
+	_, err = DialTLS(ln.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	testKindOf(t, err, ErrorKindTLSHandshake)
+
+	// handshake once only
+	conn, err := Dial(ln.Addr().String())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer conn.Close()
+	if err = HandshakeTLS(context.Background(), conn, 0); err != nil {
+		t.Fatalf("non-TLS connection should be skipped, got %s", err)
+	}
+}
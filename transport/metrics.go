@@ -0,0 +1,12 @@
+package transport
+
+import "github.com/haxii/fastproxy/metrics"
+
+var (
+	dialsCounter = metrics.DefaultRegistry.Counter("fastproxy_transport_dials_total",
+		"Number of the dials made by the default dialer.")
+	dialErrorsCounter = metrics.DefaultRegistry.Counter("fastproxy_transport_dial_errors_total",
+		"Number of the failed dials made by the default dialer, the abandoned ones are excluded.")
+	connsGauge = metrics.DefaultRegistry.Gauge("fastproxy_transport_connections",
+		"Number of the connections managed by the connection managers.")
+)
@@ -1,6 +1,7 @@
 package transport
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
 	"net"
@@ -26,6 +27,10 @@ type DialFunc func(addr string) (net.Conn, error)
 // DefaultDialTimeout is timeout used by Dial for establishing TCP connections.
 const DefaultDialTimeout = 5 * time.Second
 
+// DefaultTLSHandshakeTimeout is timeout used for handshaking TLS with the
+// established connections.
+const DefaultTLSHandshakeTimeout = 10 * time.Second
+
 // DefaultMaxDialConcurrency max dial concurrency
 const DefaultMaxDialConcurrency = 1000
 
@@ -36,7 +41,7 @@ type Dialer struct {
 	LookupIP func(host string) ([]net.IP, error)
 
 	dialer      *tcpDialer
-	dialMap     map[int]DialFunc
+	dialMap     map[int]dialContextFunc
 	dialMapLock sync.Mutex
 
 	once sync.Once
@@ -65,17 +70,24 @@ type Dialer struct {
 //     * foobar.baz:443
 //     * foo.bar:80
 //     * aaa.com:8080
-func (d *Dialer) Dial(addr string, timeout time.Duration, isTLS bool, tlsConfig *tls.Config) (net.Conn, error) {
+//
+// The dialing is given up when ctx is done, ctx.Err() is returned then.
+func (d *Dialer) Dial(ctx context.Context, addr string, timeout time.Duration,
+	isTLS bool, tlsConfig *tls.Config) (net.Conn, error) {
 	d.once.Do(func() {
 		d.dialer = &tcpDialer{
 			maxDialConcurrency: d.MaxDialConcurrency,
 			dialTCP:            d.DialTCP,
 			lookupIP:           d.LookupIP,
 		}
-		d.dialMap = make(map[int]DialFunc)
+		d.dialMap = make(map[int]dialContextFunc)
 	})
-	conn, err := d.getDialer(timeout)(addr)
+	dialsCounter.Inc()
+	conn, err := d.getDialer(timeout)(ctx, addr)
 	if err != nil {
+		if ctx.Err() == nil {
+			dialErrorsCounter.Inc()
+		}
 		return nil, err
 	}
 	if conn == nil {
@@ -83,11 +95,18 @@ func (d *Dialer) Dial(addr string, timeout time.Duration, isTLS bool, tlsConfig
 	}
 	if isTLS {
 		conn = tls.Client(conn, tlsConfig)
+		if err = HandshakeTLS(ctx, conn, timeout); err != nil {
+			conn.Close()
+			return nil, err
+		}
 	}
 	return conn, nil
 }
 
-func (d *Dialer) getDialer(timeout time.Duration) DialFunc {
+// dialContextFunc a DialFunc which gives up when ctx is done
+type dialContextFunc func(ctx context.Context, addr string) (net.Conn, error)
+
+func (d *Dialer) getDialer(timeout time.Duration) dialContextFunc {
 	if timeout <= 0 {
 		timeout = DefaultDialTimeout
 	}
@@ -121,7 +140,7 @@ type tcpDialer struct {
 // ErrDialTimeout is returned when TCP dialing is timed out.
 var ErrDialTimeout = errors.New("dialing to the given TCP address timed out")
 
-func (d *tcpDialer) newDial(timeout time.Duration) DialFunc {
+func (d *tcpDialer) newDial(timeout time.Duration) dialContextFunc {
 	d.once.Do(func() {
 		if d.dialTCP == nil {
 			d.dialTCP = func(addr *net.TCPAddr) (net.Conn, error) {
@@ -139,7 +158,7 @@ func (d *tcpDialer) newDial(timeout time.Duration) DialFunc {
 		go d.tcpAddrsClean()
 	})
 
-	return func(addr string) (net.Conn, error) {
+	return func(ctx context.Context, addr string) (net.Conn, error) {
 		addrs, idx, err := d.getTCPAddrs(addr)
 		if err != nil {
 			return nil, err
@@ -149,11 +168,11 @@ func (d *tcpDialer) newDial(timeout time.Duration) DialFunc {
 		n := uint32(len(addrs))
 		deadline := time.Now().Add(timeout)
 		for n > 0 {
-			conn, err = d.tryDial(&addrs[idx%n], deadline, d.concurrencyCh)
+			conn, err = d.tryDial(ctx, &addrs[idx%n], deadline, d.concurrencyCh)
 			if err == nil {
 				return conn, nil
 			}
-			if err == ErrDialTimeout {
+			if err == ErrDialTimeout || err == ctx.Err() {
 				return nil, err
 			}
 			idx++
@@ -163,25 +182,31 @@ func (d *tcpDialer) newDial(timeout time.Duration) DialFunc {
 	}
 }
 
-func (d *tcpDialer) tryDial(addr *net.TCPAddr, deadline time.Time, concurrencyCh chan struct{}) (net.Conn, error) {
+func (d *tcpDialer) tryDial(ctx context.Context, addr *net.TCPAddr,
+	deadline time.Time, concurrencyCh chan struct{}) (net.Conn, error) {
 	timeout := -time.Since(deadline)
 	if timeout <= 0 {
 		return nil, ErrDialTimeout
 	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 
 	select {
 	case concurrencyCh <- struct{}{}:
 	default:
 		tc := servertime.AcquireTimer(timeout)
-		isTimeout := false
+		var err error
 		select {
 		case concurrencyCh <- struct{}{}:
 		case <-tc.C:
-			isTimeout = true
+			err = ErrDialTimeout
+		case <-ctx.Done():
+			err = ctx.Err()
 		}
 		servertime.ReleaseTimer(tc)
-		if isTimeout {
-			return nil, ErrDialTimeout
+		if err != nil {
+			return nil, err
 		}
 	}
 
@@ -198,7 +223,9 @@ func (d *tcpDialer) tryDial(addr *net.TCPAddr, deadline time.Time, concurrencyCh
 	ch := chv.(chan dialResult)
 	go func() {
 		var dr dialResult
-		dr.conn, dr.err = d.dialTCP(addr)
+		if dr.conn, dr.err = d.dialTCP(addr); dr.err != nil {
+			dr.err = &Error{Kind: ErrorKindDial, Err: dr.err}
+		}
 		ch <- dr
 		<-concurrencyCh
 	}()
@@ -216,12 +243,23 @@ func (d *tcpDialer) tryDial(addr *net.TCPAddr, deadline time.Time, concurrencyCh
 		dialResultChanPool.Put(ch)
 	case <-tc.C:
 		err = ErrDialTimeout
+		// the dialing is given up, close the connection if made later
+		go closeDialResult(ch)
+	case <-ctx.Done():
+		err = ctx.Err()
+		go closeDialResult(ch)
 	}
 	servertime.ReleaseTimer(tc)
 
 	return conn, err
 }
 
+func closeDialResult(ch chan dialResult) {
+	if dr := <-ch; dr.conn != nil {
+		dr.conn.Close()
+	}
+}
+
 var dialResultChanPool sync.Pool
 
 type dialResult struct {
@@ -304,7 +342,7 @@ func (d *tcpDialer) resolveTCPAddrs(addr string) ([]net.TCPAddr, error) {
 
 	ips, err := d.lookupIP(host)
 	if err != nil {
-		return nil, err
+		return nil, &Error{Kind: ErrorKindDNS, Err: err}
 	}
 
 	n := len(ips)
@@ -317,7 +355,7 @@ func (d *tcpDialer) resolveTCPAddrs(addr string) ([]net.TCPAddr, error) {
 		})
 	}
 	if len(addrs) == 0 {
-		return nil, errNoDNSEntries
+		return nil, &Error{Kind: ErrorKindDNS, Err: errNoDNSEntries}
 	}
 	return addrs, nil
 }
@@ -1,6 +1,7 @@
 package transport
 
 import (
+	"context"
 	"crypto/tls"
 	"io"
 	"net"
@@ -14,12 +15,29 @@ var defaultDialer Dialer
 
 //DialTLS dial tls without pool
 func DialTLS(addr string, tlsConfig *tls.Config) (net.Conn, error) {
-	return defaultDialer.Dial(addr, -1, true, tlsConfig)
+	return DialTLSContext(context.Background(), addr, tlsConfig)
 }
 
 //Dial dial without pool
 func Dial(addr string) (net.Conn, error) {
-	return defaultDialer.Dial(addr, -1, false, nil)
+	return DialContext(context.Background(), addr)
+}
+
+// DialTLSContext dial tls without pool, gives up when ctx is done
+func DialTLSContext(ctx context.Context, addr string, tlsConfig *tls.Config) (net.Conn, error) {
+	return defaultDialer.Dial(ctx, addr, -1, true, tlsConfig)
+}
+
+// DialContext dial without pool, gives up when ctx is done
+func DialContext(ctx context.Context, addr string) (net.Conn, error) {
+	return defaultDialer.Dial(ctx, addr, -1, false, nil)
+}
+
+// DialTimeoutContext dial without pool, gives up when ctx is done or the
+// connection cannot be established within timeout, DefaultDialTimeout is
+// used if timeout not set
+func DialTimeoutContext(ctx context.Context, addr string, timeout time.Duration) (net.Conn, error) {
+	return defaultDialer.Dial(ctx, addr, timeout, false, nil)
 }
 
 // Forward forward remote and local connection
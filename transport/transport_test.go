@@ -1,7 +1,9 @@
 package transport
 
 import (
+	"context"
 	"fmt"
+	"net"
 	"net/http"
 	"strings"
 	"testing"
@@ -73,3 +75,37 @@ func TestTransportDialTLS(t *testing.T) {
 		t.Fatalf("expected result is %s, but get unexpected result: %s", "HTTP/1.1 400", string(result))
 	}
 }
+
+func TestDialContextCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := DialContext(ctx, "127.0.0.1:9997"); err != context.Canceled {
+		t.Fatalf("expected error %s, but get %v", context.Canceled, err)
+	}
+}
+
+func TestWatchContext(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	// stopped before done, the deadline is not touched
+	ctx, cancel := context.WithCancel(context.Background())
+	stop := WatchContext(ctx, c1)
+	stop()
+	cancel()
+	go c2.Write([]byte("a"))
+	if _, err := c1.Read(make([]byte, 1)); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	// the blocking read is interrupted when done
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	stop = WatchContext(ctx, c1)
+	_, err := c1.Read(make([]byte, 1))
+	stop()
+	if e, ok := err.(net.Error); !ok || !e.Timeout() {
+		t.Fatalf("expected a timeout error, but get %v", err)
+	}
+}
@@ -0,0 +1,73 @@
+package upstream
+
+import (
+	"bytes"
+	"strings"
+)
+
+// Route routes the requests to the pool by host and path prefix
+type Route struct {
+	// Host the request's host without port, matched case-insensitively.
+	// `*.example.com` matches all the sub domains of example.com,
+	// empty host matches all the hosts
+	Host string
+
+	// PathPrefix prefix of the request path, empty prefix matches all the paths
+	PathPrefix string
+
+	// Pool the upstream pool of the matched requests
+	Pool *Pool
+}
+
+// Router matches the requests with the routes
+//
+// The routes with exact hosts are preferred over the wildcard ones, then
+// the route with the longest path prefix wins.
+type Router struct {
+	Routes []*Route
+}
+
+// Match returns the route matches the host and path, nil if not found,
+// host is the `Host` header value, the port is ignored
+func (r *Router) Match(host, path []byte) *Route {
+	host = stripPort(host)
+	var matched *Route
+	matchedHostRank := 0
+	for _, route := range r.Routes {
+		hostRank := matchHost(route.Host, host)
+		if hostRank == 0 || !bytes.HasPrefix(path, []byte(route.PathPrefix)) {
+			continue
+		}
+		if matched == nil || hostRank > matchedHostRank ||
+			(hostRank == matchedHostRank && len(route.PathPrefix) > len(matched.PathPrefix)) {
+			matched, matchedHostRank = route, hostRank
+		}
+	}
+	return matched
+}
+
+// matchHost returns 0 if not matched, otherwise the higher rank the more specific
+func matchHost(pattern string, host []byte) int {
+	switch {
+	case len(pattern) == 0:
+		return 1
+	case strings.HasPrefix(pattern, "*."):
+		suffix := pattern[1:]
+		if len(host) > len(suffix) && strings.EqualFold(string(host[len(host)-len(suffix):]), suffix) {
+			return 2
+		}
+	case strings.EqualFold(pattern, string(host)):
+		return 3
+	}
+	return 0
+}
+
+func stripPort(host []byte) []byte {
+	if i := bytes.LastIndexByte(host, ':'); i > bytes.LastIndexByte(host, ']') {
+		host = host[:i]
+	}
+	if len(host) > 1 && host[0] == '[' && host[len(host)-1] == ']' {
+		host = host[1 : len(host)-1]
+	}
+	return host
+}
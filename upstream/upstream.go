@@ -0,0 +1,218 @@
+package upstream
+
+import (
+	"hash/fnv"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/haxii/fastproxy/servertime"
+)
+
+// Balance load balancing strategy of the upstream pool
+type Balance int
+
+const (
+	// BalanceRoundRobin picks the upstreams in turn
+	BalanceRoundRobin Balance = iota
+	// BalanceLeastPending picks the upstream with the least pending requests
+	BalanceLeastPending
+	// BalanceConsistentHash picks the upstream by the consistent hash of the key,
+	// e.g. the client IP, so the same key goes to the same upstream
+	BalanceConsistentHash
+)
+
+// DefaultMaxFails used when pool's MaxFails not set
+const DefaultMaxFails = 3
+
+// DefaultFailTimeout used when pool's FailTimeout not set
+var DefaultFailTimeout = 30 * time.Second
+
+// virtual nodes of each upstream in the consistent hash ring
+const ringReplicas = 160
+
+// Upstream a backend server of the pool
+type Upstream struct {
+	// Addr host with port of the server
+	Addr string
+
+	// consecutive failures and the time ejected until in unix nano
+	fails        uint32
+	ejectedUntil int64
+}
+
+// NewUpstream makes an upstream with given host with port
+func NewUpstream(addr string) *Upstream {
+	return &Upstream{Addr: addr}
+}
+
+// IsEjected if the upstream is ejected by passive health checking
+func (u *Upstream) IsEjected() bool {
+	until := atomic.LoadInt64(&u.ejectedUntil)
+	return until > 0 && servertime.CoarseTimeNow().UnixNano() < until
+}
+
+// Pool a group of upstream servers balanced by the strategy
+//
+// An upstream is ejected for FailTimeout after MaxFails consecutive failures,
+// then it is picked again for a retry after the time out.
+//
+// The upstreams should NOT be changed after the pool is used.
+type Pool struct {
+	// Upstreams servers of the pool
+	Upstreams []*Upstream
+
+	// Balance balancing strategy, round-robin is used by default
+	Balance Balance
+
+	// TLS connects the upstreams with TLS
+	TLS bool
+	// TLSServerName server name for TLS handshaking, the domain of upstream's Addr is used if not set
+	TLSServerName string
+
+	// MaxFails consecutive failures to eject the upstream, DefaultMaxFails is used if not set
+	MaxFails int
+	// FailTimeout the ejecting duration, DefaultFailTimeout is used if not set
+	FailTimeout time.Duration
+
+	counter  uint64
+	ring     []ringNode
+	ringOnce sync.Once
+}
+
+type ringNode struct {
+	hash     uint32
+	upstream *Upstream
+}
+
+// NewPool makes a pool with the given upstream addresses
+func NewPool(balance Balance, addrs ...string) *Pool {
+	p := &Pool{Balance: balance}
+	for _, addr := range addrs {
+		p.Upstreams = append(p.Upstreams, NewUpstream(addr))
+	}
+	return p
+}
+
+// ServerName the TLS server name used for the upstream
+func (p *Pool) ServerName(u *Upstream) string {
+	if len(p.TLSServerName) > 0 {
+		return p.TLSServerName
+	}
+	host, _, err := net.SplitHostPort(u.Addr)
+	if err != nil {
+		return u.Addr
+	}
+	return host
+}
+
+// Pick picks an available upstream, nil returned if all the upstreams are ejected.
+// key is used by the consistent hash strategy, pending returns the pending
+// requests of the upstream, which is used by the least pending strategy.
+func (p *Pool) Pick(key string, pending func(u *Upstream) int) *Upstream {
+	if len(p.Upstreams) == 0 {
+		return nil
+	}
+	switch p.Balance {
+	case BalanceLeastPending:
+		if pending != nil {
+			return p.pickLeastPending(pending)
+		}
+	case BalanceConsistentHash:
+		return p.pickConsistentHash(key)
+	}
+	return p.pickRoundRobin()
+}
+
+func (p *Pool) pickRoundRobin() *Upstream {
+	n := len(p.Upstreams)
+	start := int(atomic.AddUint64(&p.counter, 1) % uint64(n))
+	for i := 0; i < n; i++ {
+		if u := p.Upstreams[(start+i)%n]; !u.IsEjected() {
+			return u
+		}
+	}
+	return nil
+}
+
+func (p *Pool) pickLeastPending(pending func(u *Upstream) int) *Upstream {
+	n := len(p.Upstreams)
+	// start from a rotating index so ties are balanced
+	start := int(atomic.AddUint64(&p.counter, 1) % uint64(n))
+	var picked *Upstream
+	least := 0
+	for i := 0; i < n; i++ {
+		u := p.Upstreams[(start+i)%n]
+		if u.IsEjected() {
+			continue
+		}
+		if c := pending(u); picked == nil || c < least {
+			picked, least = u, c
+		}
+	}
+	return picked
+}
+
+func (p *Pool) pickConsistentHash(key string) *Upstream {
+	p.ringOnce.Do(p.buildRing)
+	h := hashKey(key)
+	start := sort.Search(len(p.ring), func(i int) bool { return p.ring[i].hash >= h })
+	for i := 0; i < len(p.ring); i++ {
+		if u := p.ring[(start+i)%len(p.ring)].upstream; !u.IsEjected() {
+			return u
+		}
+	}
+	return nil
+}
+
+func (p *Pool) buildRing() {
+	p.ring = make([]ringNode, 0, len(p.Upstreams)*ringReplicas)
+	for _, u := range p.Upstreams {
+		for i := 0; i < ringReplicas; i++ {
+			p.ring = append(p.ring, ringNode{hash: hashKey(u.Addr + "#" + strconv.Itoa(i)), upstream: u})
+		}
+	}
+	sort.Slice(p.ring, func(i, j int) bool { return p.ring[i].hash < p.ring[j].hash })
+}
+
+func hashKey(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	// fnv is poorly distributed for similar keys, finalize it
+	// using the avalanche step of murmur3
+	x := h.Sum32()
+	x ^= x >> 16
+	x *= 0x85ebca6b
+	x ^= x >> 13
+	x *= 0xc2b2ae35
+	x ^= x >> 16
+	return x
+}
+
+// MarkFailed records a failure of the upstream, ejects it when
+// the consecutive failures reach MaxFails
+func (p *Pool) MarkFailed(u *Upstream) {
+	maxFails := p.MaxFails
+	if maxFails <= 0 {
+		maxFails = DefaultMaxFails
+	}
+	if atomic.AddUint32(&u.fails, 1) < uint32(maxFails) {
+		return
+	}
+	failTimeout := p.FailTimeout
+	if failTimeout <= 0 {
+		failTimeout = DefaultFailTimeout
+	}
+	atomic.StoreUint32(&u.fails, 0)
+	atomic.StoreInt64(&u.ejectedUntil, servertime.CoarseTimeNow().Add(failTimeout).UnixNano())
+}
+
+// MarkSucceeded records a success of the upstream, which resets the failures
+func (p *Pool) MarkSucceeded(u *Upstream) {
+	if atomic.LoadUint32(&u.fails) > 0 {
+		atomic.StoreUint32(&u.fails, 0)
+	}
+}
@@ -0,0 +1,128 @@
+package upstream
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPickRoundRobin(t *testing.T) {
+	p := NewPool(BalanceRoundRobin, "a:80", "b:80", "c:80")
+	counts := make(map[string]int)
+	for i := 0; i < 30; i++ {
+		counts[p.Pick("", nil).Addr]++
+	}
+	for _, u := range p.Upstreams {
+		if counts[u.Addr] != 10 {
+			t.Fatalf("upstream %s picked %d times, expecting 10", u.Addr, counts[u.Addr])
+		}
+	}
+}
+
+func TestPickLeastPending(t *testing.T) {
+	p := NewPool(BalanceLeastPending, "a:80", "b:80", "c:80")
+	pending := map[string]int{"a:80": 3, "b:80": 1, "c:80": 2}
+	for i := 0; i < 10; i++ {
+		if u := p.Pick("", func(u *Upstream) int { return pending[u.Addr] }); u.Addr != "b:80" {
+			t.Fatalf("unexpected upstream %s, expecting b:80", u.Addr)
+		}
+	}
+}
+
+func TestPickConsistentHash(t *testing.T) {
+	p := NewPool(BalanceConsistentHash, "a:80", "b:80", "c:80")
+	picked := make(map[string]string)
+	hit := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		key := "10.0.0." + string(rune('0'+i%10)) + string(rune('0'+i/10))
+		u := p.Pick(key, nil)
+		picked[key] = u.Addr
+		hit[u.Addr] = true
+		if again := p.Pick(key, nil); again != u {
+			t.Fatalf("key %s picked different upstreams", key)
+		}
+	}
+	if len(hit) != 3 {
+		t.Fatalf("keys should be distributed to all upstreams, got %v", hit)
+	}
+
+	// only the keys of the ejected upstream are moved
+	ejected := p.Upstreams[0]
+	for i := 0; i < DefaultMaxFails; i++ {
+		p.MarkFailed(ejected)
+	}
+	for key, addr := range picked {
+		u := p.Pick(key, nil)
+		if u == ejected {
+			t.Fatalf("ejected upstream should not be picked")
+		}
+		if addr != ejected.Addr && u.Addr != addr {
+			t.Fatalf("key %s moved from %s to %s", key, addr, u.Addr)
+		}
+	}
+}
+
+func TestPassiveEjection(t *testing.T) {
+	p := NewPool(BalanceRoundRobin, "a:80", "b:80")
+	p.MaxFails = 2
+	p.FailTimeout = time.Hour
+	a := p.Upstreams[0]
+
+	// failures are reset by success
+	p.MarkFailed(a)
+	p.MarkSucceeded(a)
+	p.MarkFailed(a)
+	if a.IsEjected() {
+		t.Fatalf("upstream should not be ejected before max fails reached")
+	}
+	p.MarkFailed(a)
+	if !a.IsEjected() {
+		t.Fatalf("upstream should be ejected after max fails reached")
+	}
+	for i := 0; i < 10; i++ {
+		if u := p.Pick("", nil); u == a {
+			t.Fatalf("ejected upstream should not be picked")
+		}
+	}
+
+	p.MarkFailed(p.Upstreams[1])
+	p.MarkFailed(p.Upstreams[1])
+	if u := p.Pick("", nil); u != nil {
+		t.Fatalf("no upstream should be picked when all ejected, got %s", u.Addr)
+	}
+
+	// ejection timed out
+	a.ejectedUntil = time.Now().Add(-time.Second).UnixNano()
+	if u := p.Pick("", nil); u != a {
+		t.Fatalf("upstream should be picked after ejection timed out")
+	}
+}
+
+func TestRouterMatch(t *testing.T) {
+	api := &Pool{}
+	static := &Pool{}
+	wildcard := &Pool{}
+	fallback := &Pool{}
+	r := &Router{Routes: []*Route{
+		{Host: "", Pool: fallback},
+		{Host: "*.example.com", Pool: wildcard},
+		{Host: "www.example.com", Pool: static},
+		{Host: "www.example.com", PathPrefix: "/api/", Pool: api},
+	}}
+	testRouterMatch(t, r, "www.example.com", "/api/users", api)
+	testRouterMatch(t, r, "WWW.Example.com:8080", "/index.html", static)
+	testRouterMatch(t, r, "img.example.com", "/api/users", wildcard)
+	testRouterMatch(t, r, "example.com", "/", fallback)
+	testRouterMatch(t, r, "[::1]:80", "/", fallback)
+
+	r = &Router{Routes: []*Route{{Host: "a.com", Pool: api}}}
+	if route := r.Match([]byte("b.com"), []byte("/")); route != nil {
+		t.Fatalf("unexpected route matched")
+	}
+}
+
+func testRouterMatch(t *testing.T, r *Router, host, path string, expPool *Pool) {
+	route := r.Match([]byte(host), []byte(path))
+	if route == nil || route.Pool != expPool {
+		t.Fatalf("unexpected route for %s%s", host, path)
+	}
+}